@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 
 	"device-agent/app/controller"
+	"device-agent/internal/logging"
 
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 	"gopkg.in/yaml.v3"
@@ -28,7 +29,16 @@ func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
 
 	config := a.loadConfig()
-	a.controller = controller.NewController(config)
+
+	loggers, err := logging.New(config.Log, os.Stdout)
+	if err != nil {
+		slog.Error("Invalid log config, using defaults", "error", err)
+		loggers, _ = logging.New(logging.Config{}, os.Stdout)
+	}
+	// Anything still logging through the log package ends up here too.
+	slog.SetDefault(loggers.Logger("app"))
+
+	a.controller = controller.NewController(config, loggers)
 
 	// Set callbacks
 	a.controller.SetOpenURLCallback(func(url string) {
@@ -41,7 +51,7 @@ func (a *App) startup(ctx context.Context) {
 
 	// Start the controller
 	if err := a.controller.Start(ctx); err != nil {
-		log.Printf("Failed to start controller: %v", err)
+		slog.Error("Failed to start controller", "error", err)
 	}
 }
 
@@ -60,11 +70,12 @@ func (a *App) loadConfig() *controller.Config {
 	config.Proxy.Enable = false
 	config.Reconnect.MinMS = 500
 	config.Reconnect.MaxMS = 15000
+	config.CredentialFile = "data/credential.json"
 
 	// Try to load from file
 	if data, err := os.ReadFile("configs/agent.yaml"); err == nil {
 		if err := yaml.Unmarshal(data, config); err != nil {
-			log.Printf("Failed to parse config file: %v", err)
+			slog.Error("Failed to parse config file", "error", err)
 		}
 	}
 
@@ -3,10 +3,11 @@ package controller
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"device-agent/app/netclient"
 	"device-agent/app/websvc"
+	"device-agent/internal/logging"
 	"device-agent/internal/tcpserver"
 )
 
@@ -19,12 +20,27 @@ type Config struct {
 	Serve      websvc.Config     `yaml:"serve"`
 	Proxy      websvc.ProxyConfig `yaml:"proxy"`
 	Reconnect  netclient.ReconnectConfig `yaml:"reconnect"`
+	TLS        netclient.TLSConfig       `yaml:"tls"`
+
+	MaxProtocolVersion uint8    `yaml:"max_protocol_version"`
+	Codec              string   `yaml:"codec"`
+	Compression        bool     `yaml:"compression"`
+	CompressThreshold  int      `yaml:"compress_threshold"`
+	FileDir            string   `yaml:"file_dir"`
+	UploadPaths        []string `yaml:"upload_paths"`
+	KeyID              string   `yaml:"key_id"`
+	EnrollmentToken    string   `yaml:"enrollment_token"`
+	CredentialFile     string   `yaml:"credential_file"`
+
+	Log logging.Config `yaml:"log"`
 }
 
 type Controller struct {
 	config    *Config
 	client    *netclient.Client
 	webServer *websvc.Server
+	loggers   *logging.Loggers
+	logger    *slog.Logger
 
 	onOpenURL    func(string)
 	onStatusChange func(Status)
@@ -35,9 +51,12 @@ type Status struct {
 	LastErr   string `json:"last_err,omitempty"`
 }
 
-func NewController(config *Config) *Controller {
+// NewController creates a controller whose components log through loggers.
+func NewController(config *Config, loggers *logging.Loggers) *Controller {
 	return &Controller{
-		config: config,
+		config:  config,
+		loggers: loggers,
+		logger:  loggers.Logger("controller"),
 	}
 }
 
@@ -52,9 +71,10 @@ func (c *Controller) SetStatusCallback(callback func(Status)) {
 func (c *Controller) Start(ctx context.Context) error {
 	// Setup web server
 	webConfig := &websvc.Config{
-		Addr:  c.config.Serve.Addr,
-		Root:  c.config.Serve.Root,
-		Proxy: c.config.Proxy,
+		Addr:   c.config.Serve.Addr,
+		Root:   c.config.Serve.Root,
+		Proxy:  c.config.Proxy,
+		Logger: c.loggers.Logger("websvc"),
 	}
 
 	if c.config.Serve.Enable {
@@ -71,6 +91,18 @@ func (c *Controller) Start(ctx context.Context) error {
 		SN:         c.config.SN,
 		Key:        c.config.Key,
 		Reconnect:  c.config.Reconnect,
+		TLS:        c.config.TLS,
+
+		MaxProtocolVersion: c.config.MaxProtocolVersion,
+		Codec:              c.config.Codec,
+		Compression:        c.config.Compression,
+		CompressThreshold:  c.config.CompressThreshold,
+		FileDir:            c.config.FileDir,
+		UploadPaths:        c.config.UploadPaths,
+		KeyID:              c.config.KeyID,
+		EnrollmentToken:    c.config.EnrollmentToken,
+		CredentialFile:     c.config.CredentialFile,
+		Logger:             c.loggers.Logger("netclient"),
 	}
 
 	c.client = netclient.NewClient(clientConfig, c.handleCommand)
@@ -85,7 +117,7 @@ func (c *Controller) Start(ctx context.Context) error {
 		c.OpenURL(c.config.OpenURL)
 	}
 
-	log.Printf("Controller started for device %s", c.config.SN)
+	c.logger.Info("Controller started", logging.KeySN, c.client.SN())
 	return nil
 }
 
@@ -98,7 +130,7 @@ func (c *Controller) Stop() error {
 		c.webServer.Stop()
 	}
 
-	log.Println("Controller stopped")
+	c.logger.Info("Controller stopped")
 	return nil
 }
 
@@ -128,12 +160,12 @@ func (c *Controller) GetStatus() Status {
 func (c *Controller) handleCommand(cmd *tcpserver.CommandMessage) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Command handler panic: %v", r)
+			c.logger.Error("Command handler panic", logging.KeyCmdID, cmd.CmdID, "cmd", cmd.Cmd, "panic", r)
 			c.client.SendACK(cmd.CmdID, "error", fmt.Sprintf("panic: %v", r))
 		}
 	}()
 
-	log.Printf("Received command: %s (ID: %s)", cmd.Cmd, cmd.CmdID)
+	c.logger.Info("Received command", logging.KeyCmdID, cmd.CmdID, "cmd", cmd.Cmd)
 
 	switch cmd.Cmd {
 	case "OPEN_WEB":
@@ -195,8 +227,8 @@ func (c *Controller) handleConnectionStatus(connected bool) {
 	}
 
 	if connected {
-		log.Printf("Device %s connected to server", c.config.SN)
+		c.logger.Info("Connected to server", logging.KeySN, c.client.SN())
 	} else {
-		log.Printf("Device %s disconnected from server", c.config.SN)
+		c.logger.Warn("Disconnected from server", logging.KeySN, c.client.SN(), "error", status.LastErr)
 	}
 }
\ No newline at end of file
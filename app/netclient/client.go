@@ -3,13 +3,16 @@ package netclient
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
+	"device-agent/internal/logging"
 	"device-agent/internal/security"
 	"device-agent/internal/tcpserver"
 )
@@ -20,6 +23,33 @@ type Config struct {
 	SN         string
 	Key        string
 	Reconnect  ReconnectConfig
+	TLS        TLSConfig
+
+	// MaxProtocolVersion caps the versions offered during auth; zero offers
+	// everything this build supports.
+	MaxProtocolVersion uint8
+	// Codec is the preferred payload codec; JSON is always offered as a
+	// fallback and is the default.
+	Codec string
+	// Compression offers gzip for large frames; CompressThreshold is the
+	// payload size above which this side compresses, zero for the default.
+	Compression       bool
+	CompressThreshold int
+	// FileDir receives files pushed by the gateway; empty rejects them.
+	FileDir string
+	// UploadPaths lists the files and directories the gateway may request
+	// uploads from; empty rejects every upload request.
+	UploadPaths []string
+	// KeyID names the app key Key belongs to; empty lets the gateway try
+	// every key currently valid for AppID.
+	KeyID string
+	// EnrollmentToken is used to obtain a key when Key is empty. The
+	// enrolled AppID, SN and key are kept in CredentialFile and used from
+	// then on.
+	EnrollmentToken string
+	CredentialFile  string
+	// Logger receives the client's logs; nil uses slog.Default().
+	Logger *slog.Logger
 }
 
 type ReconnectConfig struct {
@@ -27,6 +57,14 @@ type ReconnectConfig struct {
 	MaxMS int
 }
 
+type TLSConfig struct {
+	Enable     bool   `yaml:"enable"`
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+}
+
 type Client struct {
 	config     *Config
 	conn       net.Conn
@@ -35,6 +73,7 @@ type Client struct {
 	connected   bool
 	connMu      sync.RWMutex
 	writeMu     sync.Mutex
+	wire        *tcpserver.WireParams
 
 	ctx         context.Context
 	cancel      context.CancelFunc
@@ -42,8 +81,12 @@ type Client struct {
 
 	onCommand   func(*tcpserver.CommandMessage)
 	onConnected func(bool)
+	files       *fileReceiver
+	uploads     *uploadAllowlist
+	identity    identity // guarded by connMu
 
 	lastError   error
+	logger      *slog.Logger
 }
 
 func NewClient(config *Config, onCommand func(*tcpserver.CommandMessage)) *Client {
@@ -52,13 +95,24 @@ func NewClient(config *Config, onCommand func(*tcpserver.CommandMessage)) *Clien
 	keys := map[string]string{config.AppID: config.Key}
 	auth := security.NewAuthenticator(keys, 300, security.NewMemoryNonceStore())
 
-	return &Client{
+	logger := logging.Or(config.Logger)
+	client := &Client{
 		config:    config,
+		logger:    logger,
 		auth:      auth,
+		identity:  loadIdentity(config, logger),
+		wire:      tcpserver.HandshakeParams(),
 		ctx:       ctx,
 		cancel:    cancel,
 		onCommand: onCommand,
 	}
+	if config.FileDir != "" {
+		client.files = newFileReceiver(config.FileDir)
+	}
+	if len(config.UploadPaths) > 0 {
+		client.uploads = newUploadAllowlist(config.UploadPaths, logger)
+	}
+	return client
 }
 
 func (c *Client) SetConnectedCallback(callback func(bool)) {
@@ -90,6 +144,12 @@ func (c *Client) GetLastError() error {
 	return c.lastError
 }
 
+// log returns the client's logger with the identity it logs in as.
+func (c *Client) log() *slog.Logger {
+	id := c.getIdentity()
+	return c.logger.With(logging.KeyAppID, id.AppID, logging.KeySN, id.SN)
+}
+
 func (c *Client) SendACK(cmdID, status, detail string) error {
 	ack := &tcpserver.ACKMessage{
 		CmdID:  cmdID,
@@ -97,12 +157,30 @@ func (c *Client) SendACK(cmdID, status, detail string) error {
 		Detail: detail,
 	}
 
-	msg, err := tcpserver.NewMessage(tcpserver.TypeACK, ack)
-	if err != nil {
-		return err
+	return c.sendPayload(tcpserver.TypeACK, ack)
+}
+
+// SendProgress reports intermediate progress for a long-running command.
+// The command must still be finished with SendACK.
+func (c *Client) SendProgress(cmdID string, percent int, stage, detail string) error {
+	progress := &tcpserver.ProgressMessage{
+		CmdID:   cmdID,
+		Percent: percent,
+		Stage:   stage,
+		Detail:  detail,
+	}
+
+	return c.sendPayload(tcpserver.TypeProgress, progress)
+}
+
+func (c *Client) SendReport(kind string, data map[string]interface{}) error {
+	report := &tcpserver.ReportMessage{
+		Kind:      kind,
+		Data:      data,
+		Timestamp: time.Now().Unix(),
 	}
 
-	return c.sendMessage(msg)
+	return c.sendPayload(tcpserver.TypeReport, report)
 }
 
 func (c *Client) reconnectLoop() {
@@ -120,7 +198,11 @@ func (c *Client) reconnectLoop() {
 
 		if err := c.connect(); err != nil {
 			c.setError(err)
-			log.Printf("Connection failed: %v, retrying in %v", err, backoff)
+			if errors.Is(err, errEnrollmentRejected) {
+				c.log().Error("Enrollment failed, not retrying", "error", err)
+				return
+			}
+			c.log().Warn("Connection failed", "error", err, "retry_in", backoff)
 
 			select {
 			case <-c.ctx.Done():
@@ -146,7 +228,13 @@ func (c *Client) reconnectLoop() {
 }
 
 func (c *Client) connect() error {
-	conn, err := net.DialTimeout("tcp", c.config.ServerAddr, 10*time.Second)
+	if c.needsEnrollment() {
+		if err := c.enroll(); err != nil {
+			return err
+		}
+	}
+
+	conn, err := c.dial()
 	if err != nil {
 		return fmt.Errorf("dial failed: %w", err)
 	}
@@ -155,9 +243,58 @@ func (c *Client) connect() error {
 	c.conn = conn
 	c.connMu.Unlock()
 
+	c.setWire(tcpserver.HandshakeParams())
 	return c.authenticate()
 }
 
+func (c *Client) dial() (net.Conn, error) {
+	if !c.config.TLS.Enable {
+		return net.DialTimeout("tcp", c.config.ServerAddr, 10*time.Second)
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return tls.DialWithDialer(dialer, "tcp", c.config.ServerAddr, tlsConfig)
+}
+
+func (c *Client) tlsConfig() (*tls.Config, error) {
+	serverName := c.config.TLS.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(c.config.ServerAddr)
+		if err != nil {
+			return nil, fmt.Errorf("parse server address: %w", err)
+		}
+		serverName = host
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.config.TLS.CAFile != "" {
+		pool, err := tcpserver.LoadCertPool(c.config.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.config.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.config.TLS.CertFile, c.config.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
 func (c *Client) authenticate() error {
 	nonce := make([]byte, 16)
 	if _, err := rand.Read(nonce); err != nil {
@@ -166,26 +303,28 @@ func (c *Client) authenticate() error {
 
 	ts := time.Now().Unix()
 	nonceStr := hex.EncodeToString(nonce)
-	signature := c.auth.GenerateSignature(c.config.AppID, c.config.SN, ts, nonceStr, c.config.Key)
+	id := c.getIdentity()
+	signature := c.auth.GenerateSignature(id.AppID, id.SN, ts, nonceStr, id.Key)
 
 	auth := &tcpserver.AuthMessage{
-		AppID: c.config.AppID,
-		SN:    c.config.SN,
+		AppID: id.AppID,
+		SN:    id.SN,
 		TS:    ts,
 		Nonce: nonceStr,
 		Sign:  signature,
+		KeyID: c.config.KeyID,
 		Meta: map[string]string{
 			"version": "1.0.0",
 			"os":      "client",
 		},
+		Versions: tcpserver.SupportedVersions(c.config.MaxProtocolVersion),
+		Codecs:   c.offeredCodecs(),
 	}
-
-	msg, err := tcpserver.NewMessage(tcpserver.TypeAuth, auth)
-	if err != nil {
-		return fmt.Errorf("create auth message: %w", err)
+	if c.config.Compression {
+		auth.Compression = []string{tcpserver.CompressionGzip}
 	}
 
-	if err := c.sendMessage(msg); err != nil {
+	if err := c.sendPayload(tcpserver.TypeAuth, auth); err != nil {
 		return fmt.Errorf("send auth: %w", err)
 	}
 
@@ -200,7 +339,7 @@ func (c *Client) authenticate() error {
 	}
 
 	var authOK tcpserver.AuthOKMessage
-	if err := tcpserver.UnmarshalPayload(response.Payload, &authOK); err != nil {
+	if err := c.decodePayload(response.Payload, &authOK); err != nil {
 		return fmt.Errorf("parse auth response: %w", err)
 	}
 
@@ -208,14 +347,42 @@ func (c *Client) authenticate() error {
 		return fmt.Errorf("auth failed: %s", authOK.Message)
 	}
 
-	log.Printf("Device %s authenticated successfully", c.config.SN)
+	// Gateways that predate negotiation leave version and codec unset.
+	wire := tcpserver.HandshakeParams()
+	if authOK.Version != 0 {
+		wire.Version = authOK.Version
+	}
+	if authOK.Codec != "" {
+		codec, exists := tcpserver.LookupCodec(authOK.Codec)
+		if !exists {
+			return fmt.Errorf("gateway selected unknown codec %q", authOK.Codec)
+		}
+		wire.Codec = codec
+	}
+	if authOK.Compression != "" {
+		if authOK.Compression != tcpserver.CompressionGzip || wire.Version < tcpserver.ProtocolVersionV2 {
+			return fmt.Errorf("gateway selected unsupported compression %q", authOK.Compression)
+		}
+		wire.Compression = authOK.Compression
+		wire.CompressThreshold = c.config.CompressThreshold
+	}
+	c.setWire(wire)
+
+	c.log().Info("Authenticated", "protocol_version", wire.Version, "codec", wire.Codec.Name(), "compression", wire.Compression)
 	return nil
 }
 
+func (c *Client) offeredCodecs() []string {
+	if c.config.Codec == "" || c.config.Codec == tcpserver.CodecJSON {
+		return []string{tcpserver.CodecJSON}
+	}
+	return []string{c.config.Codec, tcpserver.CodecJSON}
+}
+
 func (c *Client) handleConnection() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Connection handler panic: %v", r)
+			c.log().Error("Connection handler panic", "panic", r)
 		}
 	}()
 
@@ -228,21 +395,26 @@ func (c *Client) handleConnection() {
 			return
 		case <-heartbeatTicker.C:
 			if err := c.sendPing(); err != nil {
-				log.Printf("Send ping failed: %v", err)
+				c.log().Warn("Send ping failed", "error", err)
 				return
 			}
 		default:
 		}
 
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		msg, err := tcpserver.ReadMessage(c.conn)
+		msg, err := tcpserver.ReadFrame(c.conn, c.getWire())
 		if err != nil {
 			c.setError(err)
 			return
 		}
 
+		if version := c.getWire().Version; msg.Version != version {
+			c.setError(fmt.Errorf("protocol version mismatch: got %d, expected %d", msg.Version, version))
+			return
+		}
+
 		if err := c.handleMessage(msg); err != nil {
-			log.Printf("Handle message error: %v", err)
+			c.log().Warn("Failed to handle message", "type", msg.Type.String(), "error", err)
 		}
 	}
 }
@@ -253,27 +425,32 @@ func (c *Client) handleMessage(msg *tcpserver.Message) error {
 		return c.handlePing(msg)
 	case tcpserver.TypeCMD:
 		return c.handleCommand(msg)
+	case tcpserver.TypeFileBegin:
+		return c.handleFileBegin(msg)
+	case tcpserver.TypeFileChunk:
+		return c.handleFileChunk(msg)
+	case tcpserver.TypeFileComplete:
+		return c.handleFileComplete(msg)
+	case tcpserver.TypeUploadRequest:
+		return c.handleUploadRequest(msg)
 	default:
-		log.Printf("Unhandled message type: %d", msg.Type)
+		c.log().Warn("Unhandled message type", "type", int(msg.Type))
 	}
 	return nil
 }
 
 func (c *Client) handlePing(msg *tcpserver.Message) error {
 	pong := &tcpserver.PongMessage{Timestamp: time.Now().Unix()}
-	pongMsg, err := tcpserver.NewMessage(tcpserver.TypePong, pong)
-	if err != nil {
-		return err
-	}
-	return c.sendMessage(pongMsg)
+	return c.sendPayload(tcpserver.TypePong, pong)
 }
 
 func (c *Client) handleCommand(msg *tcpserver.Message) error {
 	var cmd tcpserver.CommandMessage
-	if err := tcpserver.UnmarshalPayload(msg.Payload, &cmd); err != nil {
+	if err := c.decodePayload(msg.Payload, &cmd); err != nil {
 		return fmt.Errorf("parse command: %w", err)
 	}
 
+	c.log().Debug("Command received", logging.KeyCmdID, cmd.CmdID, "cmd", cmd.Cmd)
 	if c.onCommand != nil {
 		go c.onCommand(&cmd)
 	}
@@ -281,19 +458,96 @@ func (c *Client) handleCommand(msg *tcpserver.Message) error {
 	return nil
 }
 
-func (c *Client) sendPing() error {
-	ping := &tcpserver.PingMessage{Timestamp: time.Now().Unix()}
-	msg, err := tcpserver.NewMessage(tcpserver.TypePing, ping)
+func (c *Client) handleFileBegin(msg *tcpserver.Message) error {
+	var begin tcpserver.FileBeginMessage
+	if err := c.decodePayload(msg.Payload, &begin); err != nil {
+		return fmt.Errorf("parse file begin: %w", err)
+	}
+
+	if c.files == nil {
+		return c.sendFileStatus(begin.TransferID, tcpserver.FileStatusError, 0, "file transfer is disabled")
+	}
+
+	offset, err := c.files.begin(&begin)
 	if err != nil {
-		return err
+		return c.sendFileStatus(begin.TransferID, tcpserver.FileStatusError, 0, err.Error())
+	}
+	return c.sendFileStatus(begin.TransferID, tcpserver.FileStatusReady, offset, "")
+}
+
+func (c *Client) handleFileChunk(msg *tcpserver.Message) error {
+	var chunk tcpserver.FileChunkMessage
+	if err := c.decodePayload(msg.Payload, &chunk); err != nil {
+		return fmt.Errorf("parse file chunk: %w", err)
+	}
+
+	if c.files == nil {
+		return nil
+	}
+
+	if err := c.files.chunk(&chunk); err != nil {
+		var mismatch *offsetMismatchError
+		if errors.As(err, &mismatch) {
+			if !c.files.resync(chunk.TransferID, mismatch.held) {
+				return nil
+			}
+			c.log().Info("Resyncing file transfer", "transfer_id", chunk.TransferID, "offset", mismatch.held)
+			return c.sendFileStatus(chunk.TransferID, tcpserver.FileStatusReady, mismatch.held, "")
+		}
+		c.files.abort(chunk.TransferID)
+		return c.sendFileStatus(chunk.TransferID, tcpserver.FileStatusError, 0, err.Error())
+	}
+	return nil
+}
+
+func (c *Client) handleFileComplete(msg *tcpserver.Message) error {
+	var complete tcpserver.FileCompleteMessage
+	if err := c.decodePayload(msg.Payload, &complete); err != nil {
+		return fmt.Errorf("parse file complete: %w", err)
 	}
-	return c.sendMessage(msg)
+
+	if c.files == nil {
+		return nil
+	}
+
+	dest, err := c.files.complete(&complete)
+	if err != nil {
+		c.files.abort(complete.TransferID)
+		return c.sendFileStatus(complete.TransferID, tcpserver.FileStatusError, 0, err.Error())
+	}
+
+	c.log().Info("Received file", "path", dest, "transfer_id", complete.TransferID)
+	return c.sendFileStatus(complete.TransferID, tcpserver.FileStatusDone, 0, "")
 }
 
-func (c *Client) sendMessage(msg *tcpserver.Message) error {
+func (c *Client) sendFileStatus(transferID, status string, offset int64, detail string) error {
+	return c.sendPayload(tcpserver.TypeFileStatus, &tcpserver.FileStatusMessage{
+		TransferID: transferID,
+		Status:     status,
+		Offset:     offset,
+		Detail:     detail,
+	})
+}
+
+func (c *Client) sendPing() error {
+	ping := &tcpserver.PingMessage{Timestamp: time.Now().Unix()}
+	return c.sendPayload(tcpserver.TypePing, ping)
+}
+
+// sendPayload encodes payload and sends it under the write lock, so the
+// codec cannot change between encoding and framing.
+func (c *Client) sendPayload(msgType tcpserver.MessageType, payload interface{}) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
+	msg, err := tcpserver.NewMessageWithCodec(c.wire.Codec, msgType, payload)
+	if err != nil {
+		return err
+	}
+	return c.writeLocked(msg)
+}
+
+func (c *Client) writeLocked(msg *tcpserver.Message) error {
 	c.connMu.RLock()
 	conn := c.conn
 	c.connMu.RUnlock()
@@ -302,7 +556,23 @@ func (c *Client) sendMessage(msg *tcpserver.Message) error {
 		return fmt.Errorf("not connected")
 	}
 
-	return tcpserver.WriteMessage(conn, msg)
+	return tcpserver.WriteFrame(conn, msg, c.wire)
+}
+
+func (c *Client) decodePayload(data []byte, v interface{}) error {
+	return c.getWire().Codec.Unmarshal(data, v)
+}
+
+func (c *Client) setWire(wire *tcpserver.WireParams) {
+	c.writeMu.Lock()
+	c.wire = wire
+	c.writeMu.Unlock()
+}
+
+func (c *Client) getWire() *tcpserver.WireParams {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.wire
 }
 
 func (c *Client) closeConnection() {
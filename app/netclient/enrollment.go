@@ -0,0 +1,179 @@
+package netclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/google/uuid"
+)
+
+// identity is what the client logs in as. Enrollment fills it in and keeps
+// it in Config.CredentialFile.
+type identity struct {
+	AppID        string `json:"appid"`
+	SN           string `json:"sn"`
+	Key          string `json:"key,omitempty"`
+	EnrollmentID string `json:"enrollment_id,omitempty"`
+	Claim        string `json:"claim,omitempty"`
+}
+
+// errEnrollmentRejected means asking again cannot help; the device needs a
+// new token.
+var errEnrollmentRejected = errors.New("enrollment rejected")
+
+// loadIdentity uses the configured key if there is one, then the credential
+// file, and otherwise leaves the key empty for enrollment to fill in.
+func loadIdentity(config *Config, logger *slog.Logger) identity {
+	id := identity{AppID: config.AppID, SN: config.SN, Key: config.Key}
+	if id.Key != "" || config.CredentialFile == "" {
+		return id
+	}
+
+	data, err := os.ReadFile(config.CredentialFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Failed to read credential file", "path", config.CredentialFile, "error", err)
+		}
+		return id
+	}
+
+	var stored identity
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.Error("Failed to parse credential file", "path", config.CredentialFile, "error", err)
+		return id
+	}
+	return stored
+}
+
+func saveIdentity(path string, id identity) error {
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("create directory: %w", err)
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// SN returns the serial number the client logs in with, which enrollment
+// may have assigned.
+func (c *Client) SN() string {
+	return c.getIdentity().SN
+}
+
+func (c *Client) getIdentity() identity {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.identity
+}
+
+func (c *Client) setIdentity(id identity) {
+	c.connMu.Lock()
+	c.identity = id
+	c.connMu.Unlock()
+
+	if c.config.CredentialFile == "" {
+		return
+	}
+	if err := saveIdentity(c.config.CredentialFile, id); err != nil {
+		c.log().Error("Failed to save credential file", "path", c.config.CredentialFile, "error", err)
+	}
+}
+
+func (c *Client) needsEnrollment() bool {
+	return c.getIdentity().Key == "" && c.config.EnrollmentToken != ""
+}
+
+// enroll asks the gateway for a key on a connection of its own, which the
+// gateway closes after answering. It returns nil once the key is stored;
+// a pending enrollment is an error so the reconnect loop asks again later.
+// A rejection returns errEnrollmentRejected.
+func (c *Client) enroll() error {
+	// Keep the enrollment ID and claim before the first request, so a lost
+	// answer can be asked for again with the same, now used, token.
+	id := c.getIdentity()
+	if id.EnrollmentID == "" {
+		claim := make([]byte, 32)
+		if _, err := rand.Read(claim); err != nil {
+			return fmt.Errorf("generate enrollment claim: %w", err)
+		}
+		id.EnrollmentID = uuid.New().String()
+		id.Claim = hex.EncodeToString(claim)
+		c.setIdentity(id)
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return fmt.Errorf("dial failed: %w", err)
+	}
+
+	c.connMu.Lock()
+	c.conn = conn
+	c.connMu.Unlock()
+	defer c.closeConnection()
+
+	c.setWire(tcpserver.HandshakeParams())
+
+	req := &tcpserver.EnrollMessage{
+		Token:        c.config.EnrollmentToken,
+		SN:           id.SN,
+		EnrollmentID: id.EnrollmentID,
+		Claim:        id.Claim,
+		Meta: map[string]string{
+			"version": "1.0.0",
+			"os":      "client",
+		},
+	}
+	if err := c.sendPayload(tcpserver.TypeEnroll, req); err != nil {
+		return fmt.Errorf("send enroll: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	response, err := tcpserver.ReadMessage(conn)
+	if err != nil {
+		return fmt.Errorf("read enroll response: %w", err)
+	}
+	if response.Type != tcpserver.TypeEnrollResult {
+		return fmt.Errorf("unexpected enroll response type: %d", response.Type)
+	}
+
+	var result tcpserver.EnrollResultMessage
+	if err := c.decodePayload(response.Payload, &result); err != nil {
+		return fmt.Errorf("parse enroll response: %w", err)
+	}
+
+	switch result.Status {
+	case tcpserver.EnrollmentApproved:
+		if result.Key == "" {
+			return fmt.Errorf("gateway approved enrollment without a key")
+		}
+		c.setIdentity(identity{AppID: result.AppID, SN: result.SN, Key: result.Key})
+		c.log().Info("Enrolled")
+		return nil
+	case tcpserver.EnrollmentPending:
+		c.setIdentity(identity{AppID: result.AppID, SN: result.SN, EnrollmentID: result.EnrollmentID, Claim: id.Claim})
+		return fmt.Errorf("enrollment %s is pending approval", result.EnrollmentID)
+	default:
+		// Start afresh with the next token.
+		c.setIdentity(identity{AppID: id.AppID, SN: id.SN})
+		return fmt.Errorf("%w: %s", errEnrollmentRejected, result.Message)
+	}
+}
@@ -0,0 +1,180 @@
+package netclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"device-agent/internal/tcpserver"
+)
+
+// partialDir holds incomplete transfers inside the file directory, so the
+// final rename never crosses a filesystem.
+const partialDir = ".transfers"
+
+// fileReceiver writes files pushed by the gateway into dir. Partial data is
+// kept across reconnects so a transfer resumes where it stopped. It is only
+// used from the connection's read loop.
+type fileReceiver struct {
+	dir    string
+	active map[string]*tcpserver.FileBeginMessage
+	// resyncs holds the offset last asked for per transfer, so a burst of
+	// stale chunks asks the gateway to restart only once.
+	resyncs map[string]int64
+}
+
+func newFileReceiver(dir string) *fileReceiver {
+	return &fileReceiver{
+		dir:     dir,
+		active:  make(map[string]*tcpserver.FileBeginMessage),
+		resyncs: make(map[string]int64),
+	}
+}
+
+func (r *fileReceiver) partialPath(transferID string) (string, error) {
+	if transferID == "" || transferID == "." || transferID == ".." || strings.ContainsAny(transferID, `/\`) {
+		return "", fmt.Errorf("invalid transfer id %q", transferID)
+	}
+	return filepath.Join(r.dir, partialDir, transferID+".part"), nil
+}
+
+// begin prepares to receive a file and returns the offset already held.
+func (r *fileReceiver) begin(msg *tcpserver.FileBeginMessage) (int64, error) {
+	if _, err := tcpserver.CleanTransferName(msg.Name); err != nil {
+		return 0, err
+	}
+	partial, err := r.partialPath(msg.TransferID)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(partial), 0o755); err != nil {
+		return 0, fmt.Errorf("create partial directory: %w", err)
+	}
+
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("open partial file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat partial file: %w", err)
+	}
+	offset := info.Size()
+	if offset > msg.Size {
+		if err := f.Truncate(0); err != nil {
+			return 0, fmt.Errorf("reset partial file: %w", err)
+		}
+		offset = 0
+	}
+
+	r.active[msg.TransferID] = msg
+	delete(r.resyncs, msg.TransferID)
+	return offset, nil
+}
+
+// offsetMismatchError reports a chunk that does not continue the partial
+// file, e.g. one sent before the gateway restarted the stream. The transfer
+// resumes from held rather than failing.
+type offsetMismatchError struct {
+	offset int64
+	held   int64
+}
+
+func (e *offsetMismatchError) Error() string {
+	return fmt.Sprintf("chunk offset %d does not match received size %d", e.offset, e.held)
+}
+
+func (r *fileReceiver) chunk(msg *tcpserver.FileChunkMessage) error {
+	begin, exists := r.active[msg.TransferID]
+	if !exists {
+		return fmt.Errorf("unknown transfer %s", msg.TransferID)
+	}
+	if msg.Offset+int64(len(msg.Data)) > begin.Size {
+		return fmt.Errorf("chunk at %d overruns file size %d", msg.Offset, begin.Size)
+	}
+
+	partial, _ := r.partialPath(msg.TransferID)
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open partial file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat partial file: %w", err)
+	}
+	if info.Size() != msg.Offset {
+		return &offsetMismatchError{offset: msg.Offset, held: info.Size()}
+	}
+
+	if _, err := f.WriteAt(msg.Data, msg.Offset); err != nil {
+		return fmt.Errorf("write partial file: %w", err)
+	}
+	delete(r.resyncs, msg.TransferID)
+	return nil
+}
+
+// resync reports whether the gateway should be asked to restart the
+// transfer from held. It is false while such a request is outstanding.
+func (r *fileReceiver) resync(transferID string, held int64) bool {
+	if last, asked := r.resyncs[transferID]; asked && last == held {
+		return false
+	}
+	r.resyncs[transferID] = held
+	return true
+}
+
+// complete verifies the received file and moves it into place.
+func (r *fileReceiver) complete(msg *tcpserver.FileCompleteMessage) (string, error) {
+	begin, exists := r.active[msg.TransferID]
+	if !exists {
+		return "", fmt.Errorf("unknown transfer %s", msg.TransferID)
+	}
+	delete(r.active, msg.TransferID)
+	delete(r.resyncs, msg.TransferID)
+
+	partial, _ := r.partialPath(msg.TransferID)
+	f, err := os.Open(partial)
+	if err != nil {
+		return "", fmt.Errorf("open partial file: %w", err)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return "", fmt.Errorf("read partial file: %w", err)
+	}
+
+	if size != begin.Size {
+		return "", fmt.Errorf("size mismatch: got %d, expected %d", size, begin.Size)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != begin.SHA256 {
+		return "", fmt.Errorf("sha256 mismatch: got %s, expected %s", sum, begin.SHA256)
+	}
+
+	name, _ := tcpserver.CleanTransferName(begin.Name)
+	dest := filepath.Join(r.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", fmt.Errorf("create destination directory: %w", err)
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		return "", fmt.Errorf("move file into place: %w", err)
+	}
+	return dest, nil
+}
+
+// abort drops a transfer and its partial data.
+func (r *fileReceiver) abort(transferID string) {
+	delete(r.active, transferID)
+	delete(r.resyncs, transferID)
+	if partial, err := r.partialPath(transferID); err == nil {
+		os.Remove(partial)
+	}
+}
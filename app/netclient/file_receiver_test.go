@@ -0,0 +1,135 @@
+package netclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"device-agent/internal/tcpserver"
+)
+
+func beginMessage(id, name, content string) *tcpserver.FileBeginMessage {
+	sum := sha256.Sum256([]byte(content))
+	return &tcpserver.FileBeginMessage{
+		TransferID: id,
+		Name:       name,
+		Size:       int64(len(content)),
+		SHA256:     hex.EncodeToString(sum[:]),
+	}
+}
+
+// TestFileReceiverResumes receives part of a file, starts the transfer
+// again as after a reconnect and checks it continues from the data held.
+func TestFileReceiverResumes(t *testing.T) {
+	dir := t.TempDir()
+	receiver := newFileReceiver(dir)
+	begin := beginMessage("t1", "media/notes.txt", "0123456789")
+
+	if offset, err := receiver.begin(begin); err != nil || offset != 0 {
+		t.Fatalf("begin: %d, %v", offset, err)
+	}
+	if err := receiver.chunk(&tcpserver.FileChunkMessage{TransferID: "t1", Offset: 0, Data: []byte("0123")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new receiver, as after the agent restarted.
+	receiver = newFileReceiver(dir)
+	offset, err := receiver.begin(begin)
+	if err != nil || offset != 4 {
+		t.Fatalf("begin after restarting: %d, %v", offset, err)
+	}
+
+	// A stale chunk asks for the held offset once.
+	var mismatch *offsetMismatchError
+	err = receiver.chunk(&tcpserver.FileChunkMessage{TransferID: "t1", Offset: 0, Data: []byte("0123")})
+	if !errors.As(err, &mismatch) || mismatch.held != 4 {
+		t.Fatalf("stale chunk: %v", err)
+	}
+	if !receiver.resync("t1", 4) || receiver.resync("t1", 4) {
+		t.Error("resync not asked exactly once")
+	}
+
+	if err := receiver.chunk(&tcpserver.FileChunkMessage{TransferID: "t1", Offset: 4, Data: []byte("456789")}); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := receiver.complete(&tcpserver.FileCompleteMessage{TransferID: "t1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != filepath.Join(dir, "media", "notes.txt") {
+		t.Errorf("stored at %s", dest)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "0123456789" {
+		t.Errorf("stored %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, partialDir, "t1.part")); !os.IsNotExist(err) {
+		t.Errorf("partial file left: %v", err)
+	}
+}
+
+func TestFileReceiverRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		begin  *tcpserver.FileBeginMessage
+		chunks []string
+		err    string
+	}{
+		{
+			name:  "name outside the directory",
+			begin: beginMessage("t1", "../escape.txt", "data"),
+			err:   "invalid file name",
+		},
+		{
+			name:  "transfer id with a separator",
+			begin: beginMessage("../t1", "notes.txt", "data"),
+			err:   "invalid transfer id",
+		},
+		{
+			name:   "chunk past the size",
+			begin:  beginMessage("t1", "notes.txt", "data"),
+			chunks: []string{"data!"},
+			err:    "overruns file size",
+		},
+		{
+			name:   "short file",
+			begin:  beginMessage("t1", "notes.txt", "data"),
+			chunks: []string{"dat"},
+			err:    "size mismatch",
+		},
+		{
+			name:   "wrong checksum",
+			begin:  beginMessage("t1", "notes.txt", "data"),
+			chunks: []string{"date"},
+			err:    "sha256 mismatch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			receiver := newFileReceiver(dir)
+
+			_, err := receiver.begin(tt.begin)
+			var offset int64
+			for _, chunk := range tt.chunks {
+				if err != nil {
+					break
+				}
+				err = receiver.chunk(&tcpserver.FileChunkMessage{TransferID: tt.begin.TransferID, Offset: offset, Data: []byte(chunk)})
+				offset += int64(len(chunk))
+			}
+			if err == nil {
+				_, err = receiver.complete(&tcpserver.FileCompleteMessage{TransferID: tt.begin.TransferID})
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			if _, statErr := os.Stat(filepath.Join(dir, "notes.txt")); !os.IsNotExist(statErr) {
+				t.Errorf("rejected file stored: %v", statErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package netclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"device-agent/internal/tcpserver"
+)
+
+// uploadAllowlist limits which files the gateway may request. Each entry is
+// a file or a directory whose whole tree is allowed. Symlinks are resolved
+// before matching so a link cannot point outside an allowed tree.
+type uploadAllowlist struct {
+	roots []string
+}
+
+func newUploadAllowlist(paths []string, logger *slog.Logger) *uploadAllowlist {
+	allowlist := &uploadAllowlist{}
+	for _, p := range paths {
+		root, err := filepath.Abs(p)
+		if err != nil {
+			logger.Warn("Ignoring upload path", "path", p, "error", err)
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
+		allowlist.roots = append(allowlist.roots, root)
+	}
+	return allowlist
+}
+
+// resolve returns the real path of p if it lies under an allowed root.
+func (a *uploadAllowlist) resolve(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", fmt.Errorf("path %s is not allowed", p)
+	}
+
+	for _, root := range a.roots {
+		if rel, err := filepath.Rel(root, real); err == nil && filepath.IsLocal(rel) {
+			return real, nil
+		}
+	}
+	return "", fmt.Errorf("path %s is not allowed", p)
+}
+
+func (c *Client) handleUploadRequest(msg *tcpserver.Message) error {
+	var req tcpserver.UploadRequestMessage
+	if err := c.decodePayload(msg.Payload, &req); err != nil {
+		return fmt.Errorf("parse upload request: %w", err)
+	}
+
+	// Stream outside the read loop so pings keep being answered.
+	go func() {
+		if err := c.uploadFile(&req); err != nil {
+			c.log().Warn("Upload failed", "upload_id", req.UploadID, "path", req.Path, "error", err)
+			c.sendFileStatus(req.UploadID, tcpserver.FileStatusError, 0, err.Error())
+		}
+	}()
+	return nil
+}
+
+// uploadFile sends the file in chunks and hashes it on the way, so a file
+// that is still being written is sent as it was when the upload started.
+func (c *Client) uploadFile(req *tcpserver.UploadRequestMessage) error {
+	if c.uploads == nil {
+		return fmt.Errorf("file upload is disabled")
+	}
+
+	path, err := c.uploads.resolve(req.Path)
+	if err != nil {
+		return err
+	}
+
+	// Check the type before opening: opening a FIFO blocks until a writer
+	// shows up.
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", req.Path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	opened, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+	if !os.SameFile(info, opened) {
+		return fmt.Errorf("%s changed while opening", req.Path)
+	}
+
+	size := info.Size()
+	begin := &tcpserver.FileBeginMessage{
+		TransferID: req.UploadID,
+		Name:       filepath.Base(path),
+		Size:       size,
+	}
+	if err := c.sendPayload(tcpserver.TypeFileBegin, begin); err != nil {
+		return fmt.Errorf("send upload begin: %w", err)
+	}
+
+	hash := sha256.New()
+	reader := io.TeeReader(io.LimitReader(f, size), hash)
+	buf := make([]byte, tcpserver.DefaultTransferChunkSize)
+
+	var offset int64
+	for offset < size {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			chunk := &tcpserver.FileChunkMessage{TransferID: req.UploadID, Offset: offset, Data: buf[:n]}
+			if sendErr := c.sendPayload(tcpserver.TypeFileChunk, chunk); sendErr != nil {
+				return fmt.Errorf("send upload chunk: %w", sendErr)
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read file: %w", err)
+		}
+	}
+	if offset != size {
+		return fmt.Errorf("file shrank while uploading: read %d of %d bytes", offset, size)
+	}
+
+	complete := &tcpserver.FileCompleteMessage{
+		TransferID: req.UploadID,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+	}
+	if err := c.sendPayload(tcpserver.TypeFileComplete, complete); err != nil {
+		return fmt.Errorf("send upload complete: %w", err)
+	}
+
+	c.log().Info("Uploaded file", "upload_id", req.UploadID, "path", path, "bytes", size)
+	return nil
+}
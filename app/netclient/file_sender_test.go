@@ -0,0 +1,56 @@
+package netclient
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadAllowlist(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"logs/old", "private"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"logs/agent.log", "logs/old/agent.log", "private/key.pem", "config.yaml"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "private", "key.pem"), filepath.Join(root, "logs", "key.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist := newUploadAllowlist([]string{
+		filepath.Join(root, "logs"),
+		filepath.Join(root, "config.yaml"),
+	}, slog.Default())
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"logs/agent.log", true},
+		{"logs/old/agent.log", true},
+		{"config.yaml", true},
+		{"logs/../private/key.pem", false},
+		{"logs/../../etc/passwd", false},
+		{"private/key.pem", false},
+		{"logs/key.log", false},
+		{"logs/missing.log", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resolved, err := allowlist.resolve(filepath.Join(root, tt.path))
+			if (err == nil) != tt.allowed {
+				t.Fatalf("resolve: %q, %v", resolved, err)
+			}
+		})
+	}
+
+	if _, err := newUploadAllowlist(nil, slog.Default()).resolve(filepath.Join(root, "config.yaml")); err == nil {
+		t.Error("an empty allow-list allowed a file")
+	}
+}
@@ -3,12 +3,15 @@ package websvc
 import (
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"path/filepath"
 	"strings"
 
+	"device-agent/internal/logging"
+
 	"github.com/gin-gonic/gin"
 )
 
@@ -17,6 +20,8 @@ type Config struct {
 	Addr   string
 	Root   string
 	Proxy  ProxyConfig
+	// Logger receives the server's logs; nil uses slog.Default().
+	Logger *slog.Logger `yaml:"-"`
 }
 
 type ProxyConfig struct {
@@ -29,11 +34,13 @@ type Server struct {
 	config     *Config
 	httpServer *http.Server
 	proxy      *httputil.ReverseProxy
+	logger     *slog.Logger
 }
 
 func NewServer(config *Config) *Server {
 	s := &Server{
 		config: config,
+		logger: logging.Or(config.Logger),
 	}
 
 	if config.Proxy.Enable && config.Proxy.Target != "" {
@@ -76,11 +83,11 @@ func (s *Server) Start() error {
 
 	go func() {
 		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Printf("Web server error: %v\n", err)
+			s.logger.Error("Web server error", "error", err)
 		}
 	}()
 
-	fmt.Printf("Web server started on %s\n", s.config.Addr)
+	s.logger.Info("Web server started", "addr", s.config.Addr)
 	return nil
 }
 
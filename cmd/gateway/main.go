@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,52 +12,273 @@ import (
 	"time"
 
 	"device-agent/internal/api"
+	"device-agent/internal/logging"
+	"device-agent/internal/security"
 	"device-agent/internal/tcpserver"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
+	Log logging.Config `yaml:"log"`
 	TCP struct {
-		Addr              string        `yaml:"addr"`
-		HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
-		SessionTimeout    time.Duration `yaml:"session_timeout"`
-		TimeWindowSec     int64         `yaml:"time_window_sec"`
+		Addr               string        `yaml:"addr"`
+		HeartbeatInterval  time.Duration `yaml:"heartbeat_interval"`
+		SessionTimeout     time.Duration `yaml:"session_timeout"`
+		TimeWindowSec      int64         `yaml:"time_window_sec"`
+		MaxProtocolVersion uint8         `yaml:"max_protocol_version"`
+		Codecs             []string      `yaml:"codecs"`
+		Compression        struct {
+			Enable    bool `yaml:"enable"`
+			Threshold int  `yaml:"threshold"`
+		} `yaml:"compression"`
+		TLS struct {
+			Enable            bool   `yaml:"enable"`
+			CertFile          string `yaml:"cert_file"`
+			KeyFile           string `yaml:"key_file"`
+			CAFile            string `yaml:"ca_file"`
+			RequireClientCert bool   `yaml:"require_client_cert"`
+		} `yaml:"tls"`
 	} `yaml:"tcp"`
 	HTTP struct {
-		Addr string `yaml:"addr"`
+		Addr          string         `yaml:"addr"`
+		CORSOrigins   []string       `yaml:"cors_origins"`
+		PublicMetrics bool           `yaml:"public_metrics"`
+		Auth          api.AuthConfig `yaml:"auth"`
 	} `yaml:"http"`
 	Auth struct {
-		Keys map[string]string `yaml:"keys"`
+		Keys     map[string]string  `yaml:"keys"`
+		KeyRing  []*security.AppKey `yaml:"key_ring"`
+		KeyModes map[string]string  `yaml:"key_modes"`
 	} `yaml:"auth"`
+	Reports struct {
+		BufferSize int `yaml:"buffer_size"`
+	} `yaml:"reports"`
+	Devices struct {
+		Store         string        `yaml:"store"`
+		Path          string        `yaml:"path"`
+		FlushInterval time.Duration `yaml:"flush_interval"`
+	} `yaml:"devices"`
+	Queue struct {
+		Store      string        `yaml:"store"`
+		Path       string        `yaml:"path"`
+		DefaultTTL time.Duration `yaml:"default_ttl"`
+	} `yaml:"queue"`
+	Commands struct {
+		HistorySize int `yaml:"history_size"`
+	} `yaml:"commands"`
+	Transfers struct {
+		Dir       string `yaml:"dir"`
+		ChunkSize int    `yaml:"chunk_size"`
+		MaxSize   int64  `yaml:"max_size"`
+	} `yaml:"transfers"`
+	Nonces struct {
+		Store string `yaml:"store"`
+		Path  string `yaml:"path"`
+	} `yaml:"nonces"`
+	Uploads struct {
+		Dir     string `yaml:"dir"`
+		MaxSize int64  `yaml:"max_size"`
+	} `yaml:"uploads"`
+	Credentials struct {
+		Store string `yaml:"store"`
+		Path  string `yaml:"path"`
+	} `yaml:"credentials"`
+	AppKeys struct {
+		Store string `yaml:"store"`
+		Path  string `yaml:"path"`
+	} `yaml:"app_keys"`
+	Enrollments struct {
+		Store string `yaml:"store"`
+		Path  string `yaml:"path"`
+	} `yaml:"enrollments"`
+	Blocklist struct {
+		Store string `yaml:"store"`
+		Path  string `yaml:"path"`
+	} `yaml:"blocklist"`
+	Audit struct {
+		Store     string `yaml:"store"`
+		Path      string `yaml:"path"`
+		MaxSizeMB int    `yaml:"max_size_mb"`
+		MaxFiles  int    `yaml:"max_files"`
+	} `yaml:"audit"`
+	Webhooks struct {
+		Store                   string `yaml:"store"`
+		Path                    string `yaml:"path"`
+		DeadLetterPath          string `yaml:"dead_letter_path"`
+		tcpserver.WebhookConfig `yaml:",inline"`
+	} `yaml:"webhooks"`
+	Cluster struct {
+		Enable        bool          `yaml:"enable"`
+		NodeID        string        `yaml:"node_id"`
+		RPCAddr       string        `yaml:"rpc_addr"`
+		AdvertiseAddr string        `yaml:"advertise_addr"`
+		Secret        string        `yaml:"secret"`
+		NodeTTL       time.Duration `yaml:"node_ttl"`
+		Registry      string        `yaml:"registry"`
+		Path          string        `yaml:"path"`
+		TLS           struct {
+			Enable            bool   `yaml:"enable"`
+			CertFile          string `yaml:"cert_file"`
+			KeyFile           string `yaml:"key_file"`
+			CAFile            string `yaml:"ca_file"`
+			RequireClientCert bool   `yaml:"require_client_cert"`
+		} `yaml:"tls"`
+	} `yaml:"cluster"`
+	Tenants struct {
+		Defaults tcpserver.TenantConfig            `yaml:"defaults"`
+		Apps     map[string]tcpserver.TenantConfig `yaml:"apps"`
+	} `yaml:"tenants"`
 }
 
 func main() {
 	config := loadConfig()
 
+	loggers, err := logging.New(config.Log, os.Stdout)
+	if err != nil {
+		fatal("Invalid log config", err)
+	}
+	// Anything still logging through the log package ends up here too.
+	slog.SetDefault(loggers.Logger("gateway"))
+
+	deviceStore, err := newDeviceStore(config)
+	if err != nil {
+		fatal("Failed to open device store", err)
+	}
+
+	commandQueue, err := newCommandQueue(config)
+	if err != nil {
+		fatal("Failed to open command queue", err)
+	}
+
+	nonceStore, err := newNonceStore(config)
+	if err != nil {
+		fatal("Failed to open nonce store", err)
+	}
+
+	credentialStore, err := newCredentialStore(config)
+	if err != nil {
+		fatal("Failed to open credential store", err)
+	}
+
+	keyStore, err := newKeyStore(config)
+	if err != nil {
+		fatal("Failed to open key store", err)
+	}
+
+	enrollmentStore, err := newEnrollmentStore(config)
+	if err != nil {
+		fatal("Failed to open enrollment store", err)
+	}
+
+	blockStore, err := newBlockStore(config)
+	if err != nil {
+		fatal("Failed to open blocklist", err)
+	}
+
+	auditLog, err := newAuditLog(config)
+	if err != nil {
+		fatal("Failed to open audit log", err)
+	}
+
+	webhookStore, err := newWebhookStore(config)
+	if err != nil {
+		fatal("Failed to open webhook store", err)
+	}
+
 	tcpConfig := &tcpserver.Config{
-		Addr:              config.TCP.Addr,
-		HeartbeatInterval: config.TCP.HeartbeatInterval,
-		SessionTimeout:    config.TCP.SessionTimeout,
-		Keys:              config.Auth.Keys,
-		TimeWindowSec:     config.TCP.TimeWindowSec,
+		Addr:               config.TCP.Addr,
+		HeartbeatInterval:  config.TCP.HeartbeatInterval,
+		SessionTimeout:     config.TCP.SessionTimeout,
+		Keys:               config.Auth.Keys,
+		TimeWindowSec:      config.TCP.TimeWindowSec,
+		ReportBufferSize:   config.Reports.BufferSize,
+		DeviceStore:        deviceStore,
+		CommandQueue:       commandQueue,
+		CommandHistorySize: config.Commands.HistorySize,
+		TransferDir:        config.Transfers.Dir,
+		TransferChunkSize:  config.Transfers.ChunkSize,
+		MaxTransferSize:    config.Transfers.MaxSize,
+		UploadDir:          config.Uploads.Dir,
+		MaxUploadSize:      config.Uploads.MaxSize,
+		NonceStore:         nonceStore,
+		CredentialStore:    credentialStore,
+		KeyModes:           config.Auth.KeyModes,
+		KeyRing:            config.Auth.KeyRing,
+		KeyStore:           keyStore,
+		EnrollmentStore:    enrollmentStore,
+		BlockStore:         blockStore,
+		TenantDefaults:     config.Tenants.Defaults,
+		Tenants:            config.Tenants.Apps,
+		AuditLog:           auditLog,
+		WebhookStore:       webhookStore,
+		Webhooks:           config.Webhooks.WebhookConfig,
+		TLS: &tcpserver.TLSConfig{
+			Enable:            config.TCP.TLS.Enable,
+			CertFile:          config.TCP.TLS.CertFile,
+			KeyFile:           config.TCP.TLS.KeyFile,
+			CAFile:            config.TCP.TLS.CAFile,
+			RequireClientCert: config.TCP.TLS.RequireClientCert,
+		},
+		MaxProtocolVersion: config.TCP.MaxProtocolVersion,
+		Codecs:             config.TCP.Codecs,
+		Compression:        config.TCP.Compression.Enable,
+		CompressThreshold:  config.TCP.Compression.Threshold,
+		Logger:             loggers.Logger("tcpserver"),
+	}
+
+	if config.Cluster.Enable {
+		registry, err := newClusterRegistry(config)
+		if err != nil {
+			fatal("Failed to open cluster registry", err)
+		}
+		tcpConfig.Cluster = &tcpserver.ClusterConfig{
+			NodeID:        config.Cluster.NodeID,
+			RPCAddr:       config.Cluster.RPCAddr,
+			AdvertiseAddr: config.Cluster.AdvertiseAddr,
+			Secret:        config.Cluster.Secret,
+			NodeTTL:       config.Cluster.NodeTTL,
+			TLS: &tcpserver.TLSConfig{
+				Enable:            config.Cluster.TLS.Enable,
+				CertFile:          config.Cluster.TLS.CertFile,
+				KeyFile:           config.Cluster.TLS.KeyFile,
+				CAFile:            config.Cluster.TLS.CAFile,
+				RequireClientCert: config.Cluster.TLS.RequireClientCert,
+			},
+		}
+		tcpConfig.ClusterRegistry = registry
 	}
 
 	tcpServer := tcpserver.NewServer(tcpConfig)
 	if err := tcpServer.Start(); err != nil {
-		log.Fatalf("Failed to start TCP server: %v", err)
+		fatal("Failed to start TCP server", err)
+	}
+
+	var apiAuth *api.APIAuth
+	if config.HTTP.Auth.Enabled {
+		apiAuth, err = api.NewAPIAuth(config.HTTP.Auth)
+		if err != nil {
+			fatal("Failed to set up API auth", err)
+		}
+	} else {
+		slog.Warn("HTTP API auth is disabled; anyone who can reach the API can manage devices", "addr", config.HTTP.Addr)
 	}
 
-	router := api.SetupSimpleRouter(tcpServer.GetSessionManager(), tcpServer.GetACKWaiter())
+	router := api.SetupSimpleRouter(tcpServer, api.RouterConfig{
+		Auth:          apiAuth,
+		CORSOrigins:   config.HTTP.CORSOrigins,
+		PublicMetrics: config.HTTP.PublicMetrics,
+		Logger:        loggers.Logger("api"),
+	})
 	httpServer := &http.Server{
 		Addr:    config.HTTP.Addr,
 		Handler: router,
 	}
 
 	go func() {
-		log.Printf("HTTP server listening on %s", config.HTTP.Addr)
+		slog.Info("HTTP server listening", "addr", config.HTTP.Addr)
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start HTTP server: %v", err)
+			fatal("Failed to start HTTP server", err)
 		}
 	}()
 
@@ -63,20 +286,32 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
-	log.Println("Shutting down servers...")
+	slog.Info("Shutting down servers")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Printf("HTTP server forced to shutdown: %v", err)
+		slog.Warn("HTTP server forced to shutdown", "error", err)
 	}
 
 	if err := tcpServer.Stop(); err != nil {
-		log.Printf("TCP server forced to shutdown: %v", err)
+		slog.Warn("TCP server forced to shutdown", "error", err)
+	}
+
+	if closer, ok := deviceStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("Failed to close device store", "error", err)
+		}
+	}
+
+	if closer, ok := nonceStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("Failed to close nonce store", "error", err)
+		}
 	}
 
-	log.Println("Servers stopped")
+	slog.Info("Servers stopped")
 }
 
 func loadConfig() *Config {
@@ -88,6 +323,40 @@ func loadConfig() *Config {
 	config.TCP.SessionTimeout = 90 * time.Second
 	config.TCP.TimeWindowSec = 300 // 5 minutes
 	config.HTTP.Addr = ":8080"
+	config.Reports.BufferSize = tcpserver.DefaultReportBufferSize
+	config.Devices.Store = "file"
+	config.Devices.Path = "data/devices.json"
+	config.Devices.FlushInterval = tcpserver.DefaultDeviceFlushInterval
+	config.Queue.Store = "file"
+	config.Queue.Path = "data/queue.json"
+	config.Queue.DefaultTTL = tcpserver.DefaultQueueTTL
+	config.Commands.HistorySize = tcpserver.DefaultCommandHistorySize
+	config.Transfers.Dir = "data/transfers"
+	config.Transfers.ChunkSize = tcpserver.DefaultTransferChunkSize
+	config.Transfers.MaxSize = tcpserver.DefaultMaxTransferSize
+	config.Nonces.Store = "file"
+	config.Nonces.Path = "data/nonces.db"
+	config.Uploads.Dir = "data/uploads"
+	config.Uploads.MaxSize = tcpserver.DefaultMaxUploadSize
+	config.Credentials.Store = "file"
+	config.Credentials.Path = "data/credentials.json"
+	config.AppKeys.Store = "file"
+	config.AppKeys.Path = "data/app_keys.json"
+	config.Enrollments.Store = "file"
+	config.Enrollments.Path = "data/enrollments.json"
+	config.Blocklist.Store = "file"
+	config.Blocklist.Path = "data/blocklist.json"
+	config.Audit.Store = "file"
+	config.Audit.Path = "data/audit.jsonl"
+	config.Audit.MaxSizeMB = tcpserver.DefaultAuditMaxSize >> 20
+	config.Audit.MaxFiles = tcpserver.DefaultAuditMaxFiles
+	config.Webhooks.Store = "file"
+	config.Webhooks.Path = "data/webhooks.json"
+	config.Webhooks.DeadLetterPath = "data/webhook-dead-letters.json"
+	config.Cluster.RPCAddr = "127.0.0.1:9101"
+	config.Cluster.NodeTTL = tcpserver.DefaultClusterNodeTTL
+	config.Cluster.Registry = "file"
+	config.Cluster.Path = "data/cluster.json"
 	config.Auth.Keys = map[string]string{
 		"A1": "K_SECRET_ABC",
 	}
@@ -95,9 +364,124 @@ func loadConfig() *Config {
 	// Try to load from file
 	if data, err := os.ReadFile("configs/gateway.yaml"); err == nil {
 		if err := yaml.Unmarshal(data, config); err != nil {
-			log.Printf("Failed to parse config file: %v", err)
+			slog.Error("Failed to parse config file", "error", err)
 		}
 	}
 
 	return config
-}
\ No newline at end of file
+}
+
+func newDeviceStore(config *Config) (tcpserver.DeviceStore, error) {
+	switch config.Devices.Store {
+	case "memory":
+		return tcpserver.NewMemoryDeviceStore(), nil
+	case "file", "":
+		return tcpserver.NewFileDeviceStore(config.Devices.Path, config.Devices.FlushInterval)
+	default:
+		return nil, fmt.Errorf("unknown device store %q", config.Devices.Store)
+	}
+}
+
+func newCommandQueue(config *Config) (*tcpserver.CommandQueue, error) {
+	switch config.Queue.Store {
+	case "memory":
+		return tcpserver.NewMemoryCommandQueue(config.Queue.DefaultTTL), nil
+	case "file", "":
+		return tcpserver.NewFileCommandQueue(config.Queue.Path, config.Queue.DefaultTTL)
+	default:
+		return nil, fmt.Errorf("unknown command queue store %q", config.Queue.Store)
+	}
+}
+
+func newNonceStore(config *Config) (security.NonceStore, error) {
+	switch config.Nonces.Store {
+	case "memory":
+		return security.NewMemoryNonceStore(), nil
+	case "file", "":
+		return security.NewFileNonceStore(config.Nonces.Path)
+	default:
+		return nil, fmt.Errorf("unknown nonce store %q", config.Nonces.Store)
+	}
+}
+
+func newCredentialStore(config *Config) (security.CredentialStore, error) {
+	switch config.Credentials.Store {
+	case "memory":
+		return security.NewMemoryCredentialStore(), nil
+	case "file", "":
+		return security.NewFileCredentialStore(config.Credentials.Path)
+	default:
+		return nil, fmt.Errorf("unknown credential store %q", config.Credentials.Store)
+	}
+}
+
+func newKeyStore(config *Config) (security.KeyStore, error) {
+	switch config.AppKeys.Store {
+	case "memory":
+		return security.NewMemoryKeyStore(), nil
+	case "file", "":
+		return security.NewFileKeyStore(config.AppKeys.Path)
+	default:
+		return nil, fmt.Errorf("unknown key store %q", config.AppKeys.Store)
+	}
+}
+
+func newEnrollmentStore(config *Config) (tcpserver.EnrollmentStore, error) {
+	switch config.Enrollments.Store {
+	case "memory":
+		return tcpserver.NewMemoryEnrollmentStore(), nil
+	case "file", "":
+		return tcpserver.NewFileEnrollmentStore(config.Enrollments.Path)
+	default:
+		return nil, fmt.Errorf("unknown enrollment store %q", config.Enrollments.Store)
+	}
+}
+
+func newBlockStore(config *Config) (tcpserver.BlockStore, error) {
+	switch config.Blocklist.Store {
+	case "memory":
+		return tcpserver.NewMemoryBlockStore(), nil
+	case "file", "":
+		return tcpserver.NewFileBlockStore(config.Blocklist.Path)
+	default:
+		return nil, fmt.Errorf("unknown blocklist store %q", config.Blocklist.Store)
+	}
+}
+
+func newAuditLog(config *Config) (tcpserver.AuditLog, error) {
+	switch config.Audit.Store {
+	case "memory":
+		return tcpserver.NewMemoryAuditLog(tcpserver.DefaultAuditBufferSize), nil
+	case "file", "":
+		return tcpserver.NewFileAuditLog(config.Audit.Path, int64(config.Audit.MaxSizeMB)<<20, config.Audit.MaxFiles)
+	default:
+		return nil, fmt.Errorf("unknown audit store %q", config.Audit.Store)
+	}
+}
+
+func newWebhookStore(config *Config) (tcpserver.WebhookStore, error) {
+	switch config.Webhooks.Store {
+	case "memory":
+		return tcpserver.NewMemoryWebhookStore(), nil
+	case "file", "":
+		return tcpserver.NewFileWebhookStore(config.Webhooks.Path, config.Webhooks.DeadLetterPath)
+	default:
+		return nil, fmt.Errorf("unknown webhook store %q", config.Webhooks.Store)
+	}
+}
+
+func newClusterRegistry(config *Config) (tcpserver.ClusterRegistry, error) {
+	switch config.Cluster.Registry {
+	case "memory":
+		return tcpserver.NewMemoryClusterRegistry(config.Cluster.NodeTTL), nil
+	case "file", "":
+		return tcpserver.NewFileClusterRegistry(config.Cluster.Path, config.Cluster.NodeTTL)
+	default:
+		return nil, fmt.Errorf("unknown cluster registry %q", config.Cluster.Registry)
+	}
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
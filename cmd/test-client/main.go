@@ -2,14 +2,19 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"os"
 	"time"
 
 	"device-agent/app/netclient"
+	"device-agent/internal/logging"
 	"device-agent/internal/tcpserver"
 )
 
 func main() {
+	loggers, _ := logging.New(logging.Config{Level: "debug"}, os.Stdout)
+	logger = loggers.Logger("test-client")
+
 	config := &netclient.Config{
 		ServerAddr: "localhost:9001",
 		AppID:      "A1",
@@ -19,24 +24,23 @@ func main() {
 			MinMS: 500,
 			MaxMS: 15000,
 		},
+		Logger: loggers.Logger("netclient"),
 	}
 
 	client := netclient.NewClient(config, handleCommand)
 	globalClient = client
 	client.SetConnectedCallback(func(connected bool) {
 		if connected {
-			log.Printf("✅ Device %s connected to server", config.SN)
+			logger.Info("Connected to server", logging.KeySN, config.SN)
 		} else {
-			log.Printf("❌ Device %s disconnected from server", config.SN)
-			if err := client.GetLastError(); err != nil {
-				log.Printf("Last error: %v", err)
-			}
+			logger.Warn("Disconnected from server", logging.KeySN, config.SN, "error", client.GetLastError())
 		}
 	})
 
-	log.Printf("Starting test client for device %s", config.SN)
+	logger.Info("Starting test client", logging.KeySN, config.SN)
 	if err := client.Start(); err != nil {
-		log.Fatalf("Failed to start client: %v", err)
+		logger.Error("Failed to start client", "error", err)
+		os.Exit(1)
 	}
 
 	// Keep running
@@ -44,40 +48,43 @@ func main() {
 	<-ctx.Done()
 }
 
-var globalClient *netclient.Client
+var (
+	globalClient *netclient.Client
+	logger       *slog.Logger
+)
 
 func handleCommand(cmd *tcpserver.CommandMessage) {
-	log.Printf("📨 Received command: %s (ID: %s)", cmd.Cmd, cmd.CmdID)
-	log.Printf("Arguments: %+v", cmd.Args)
+	log := logger.With(logging.KeyCmdID, cmd.CmdID, "cmd", cmd.Cmd)
+	log.Info("Received command", "args", cmd.Args)
 
 	// Simulate command processing
 	switch cmd.Cmd {
 	case "OPEN_WEB":
 		url, ok := cmd.Args["url"].(string)
 		if !ok {
-			log.Printf("❌ Invalid URL in command")
+			log.Warn("Invalid url parameter")
 			globalClient.SendACK(cmd.CmdID, "error", "invalid url parameter")
 			return
 		}
-		log.Printf("🌐 Would open URL: %s", url)
+		log.Info("Would open URL", "url", url)
 		time.Sleep(500 * time.Millisecond) // Simulate work
-		log.Printf("✅ Command %s completed successfully", cmd.CmdID)
+		log.Info("Command completed")
 		globalClient.SendACK(cmd.CmdID, "ok", "url opened: "+url)
 
 	case "SERVE_PATH":
 		path, ok := cmd.Args["path"].(string)
 		if !ok {
-			log.Printf("❌ Invalid path in command")
+			log.Warn("Invalid path parameter")
 			globalClient.SendACK(cmd.CmdID, "error", "invalid path parameter")
 			return
 		}
-		log.Printf("📁 Would serve path: %s", path)
+		log.Info("Would serve path", "path", path)
 		time.Sleep(500 * time.Millisecond) // Simulate work
-		log.Printf("✅ Command %s completed successfully", cmd.CmdID)
+		log.Info("Command completed")
 		globalClient.SendACK(cmd.CmdID, "ok", "serving path: "+path)
 
 	default:
-		log.Printf("❓ Unknown command: %s", cmd.Cmd)
+		log.Warn("Unknown command")
 		globalClient.SendACK(cmd.CmdID, "error", "unknown command")
 	}
 }
\ No newline at end of file
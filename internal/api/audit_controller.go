@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"device-agent/internal/logging"
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditCmdIDKey = "audit_cmd_id"
+	auditCmdKey   = "audit_cmd"
+)
+
+// auditCommand names the command a request sends, for its audit entry.
+func auditCommand(c *gin.Context, cmdID, cmd string) {
+	c.Set(auditCmdIDKey, cmdID)
+	c.Set(auditCmdKey, cmd)
+}
+
+// Audit records every API call that may change state once it has been
+// handled, including calls refused by the handler. It runs after
+// Authenticate, so unauthenticated callers cannot fill the log.
+func Audit(auditLog tcpserver.AuditLog, logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		appID := c.GetString(deviceAppKey)
+		if appID == "" {
+			appID = c.Param("appid")
+		}
+		cmdID := c.GetString(auditCmdIDKey)
+		if cmdID == "" {
+			cmdID = c.Param("cmd_id")
+		}
+
+		event := &tcpserver.AuditEvent{
+			Time:       time.Now(),
+			Kind:       tcpserver.AuditAPI,
+			Action:     c.Request.Method + " " + route,
+			RequestID:  requestID(c),
+			AppID:      appID,
+			SN:         c.Param("sn"),
+			CmdID:      cmdID,
+			Cmd:        c.GetString(auditCmdKey),
+			RemoteAddr: c.ClientIP(),
+			Path:       c.Request.URL.Path,
+			Status:     c.Writer.Status(),
+			Result:     tcpserver.AuditSuccess,
+		}
+		if principal := principalFrom(c); principal != nil {
+			event.Actor = principal.Name
+			event.Role = principal.Role
+		}
+		if event.Status >= http.StatusBadRequest {
+			event.Result = tcpserver.AuditFailure
+		}
+
+		if err := auditLog.Append(event); err != nil {
+			logger.Error("Failed to write audit log", logging.KeyRequestID, event.RequestID, "error", err)
+		}
+	}
+}
+
+type AuditController struct {
+	auditLog tcpserver.AuditLog
+}
+
+func NewAuditController(auditLog tcpserver.AuditLog) *AuditController {
+	return &AuditController{
+		auditLog: auditLog,
+	}
+}
+
+// List returns audit events, newest first, filtered by ?since= and ?until=
+// (RFC 3339 or unix seconds), ?sn=, ?appid= and ?kind=.
+func (ac *AuditController) List(c *gin.Context) {
+	filter, err := auditFilter(c)
+	if err == nil {
+		filter.Limit, err = positiveQueryInt(c, "limit", 100)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	events, err := ac.auditLog.Query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    events,
+		"count":   len(events),
+	})
+}
+
+// Export downloads the audit events matching the same filters as List as
+// JSON Lines, oldest first. Without a limit the events are streamed as they
+// are read.
+func (ac *AuditController) Export(c *gin.Context) {
+	filter, err := auditFilter(c)
+	if err == nil && c.Query("limit") != "" {
+		filter.Limit, err = positiveQueryInt(c, "limit", 0)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	var events []tcpserver.AuditEvent
+	if filter.Limit > 0 {
+		if events, err = ac.auditLog.Query(filter); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	if filter.Limit > 0 {
+		for i := len(events) - 1; i >= 0; i-- {
+			if err := encoder.Encode(&events[i]); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	// The status is sent by now, so a read error can only cut the export
+	// short.
+	ac.auditLog.Scan(filter, func(event *tcpserver.AuditEvent) error {
+		return encoder.Encode(event)
+	})
+}
+
+// auditFilter reads the query filters shared by List and Export. Callers
+// limited to some apps only see those apps' events.
+func auditFilter(c *gin.Context) (tcpserver.AuditFilter, error) {
+	filter := tcpserver.AuditFilter{
+		Kind:  c.Query("kind"),
+		AppID: c.Query("appid"),
+		SN:    c.Query("sn"),
+	}
+	if principal := principalFrom(c); principal != nil && !principal.AllApps() {
+		filter.AppIDs = principal.AppIDs
+	}
+
+	var err error
+	if filter.Since, err = timeQuery(c, "since"); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = timeQuery(c, "until"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func timeQuery(c *gin.Context, name string) (time.Time, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time or unix seconds", name)
+	}
+	return t, nil
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// roleRank orders roles so that each one includes the ones below it.
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+const principalKey = "principal"
+
+// Principal is the authenticated caller of the management API. A principal
+// with no AppIDs may act on every app.
+type Principal struct {
+	Name   string   `json:"name"`
+	Role   string   `json:"role"`
+	AppIDs []string `json:"appids,omitempty"`
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return roleRank[p.Role] >= roleRank[role]
+}
+
+func (p *Principal) AllApps() bool {
+	return len(p.AppIDs) == 0
+}
+
+func (p *Principal) CanAccessApp(appID string) bool {
+	if p.AllApps() {
+		return true
+	}
+	for _, id := range p.AppIDs {
+		if id == appID {
+			return true
+		}
+	}
+	return false
+}
+
+// APIToken is a static bearer token and the principal it stands for.
+type APIToken struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Role   string   `yaml:"role"`
+	AppIDs []string `yaml:"appids"`
+}
+
+// JWTConfig verifies HS256 tokens signed by an external issuer. The token
+// carries the principal in its sub, role and appids claims and must expire.
+type JWTConfig struct {
+	Secret   string `yaml:"secret"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+}
+
+type AuthConfig struct {
+	Enabled bool       `yaml:"enabled"`
+	Tokens  []APIToken `yaml:"tokens"`
+	JWT     JWTConfig  `yaml:"jwt"`
+}
+
+var errInvalidAPIToken = errors.New("invalid token")
+
+const (
+	minAPITokenLength  = 24
+	minJWTSecretLength = 32
+	// placeholderPrefix marks the example secrets in configs/gateway.yaml.
+	placeholderPrefix = "change-me"
+)
+
+// APIAuth resolves bearer tokens to principals.
+type APIAuth struct {
+	tokens map[[sha256.Size]byte]*Principal
+	jwt    JWTConfig
+}
+
+func NewAPIAuth(config AuthConfig) (*APIAuth, error) {
+	auth := &APIAuth{
+		tokens: make(map[[sha256.Size]byte]*Principal),
+		jwt:    config.JWT,
+	}
+
+	for _, token := range config.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("api token %q has no token", token.Name)
+		}
+		if len(token.Token) < minAPITokenLength || strings.HasPrefix(token.Token, placeholderPrefix) {
+			return nil, fmt.Errorf("api token %q must be a random string of at least %d characters", token.Name, minAPITokenLength)
+		}
+		if _, ok := roleRank[token.Role]; !ok {
+			return nil, fmt.Errorf("api token %q has unknown role %q", token.Name, token.Role)
+		}
+		auth.tokens[sha256.Sum256([]byte(token.Token))] = &Principal{
+			Name:   token.Name,
+			Role:   token.Role,
+			AppIDs: token.AppIDs,
+		}
+	}
+	if secret := auth.jwt.Secret; secret != "" && (len(secret) < minJWTSecretLength || strings.HasPrefix(secret, placeholderPrefix)) {
+		return nil, fmt.Errorf("jwt secret must be a random string of at least %d characters", minJWTSecretLength)
+	}
+	if len(auth.tokens) == 0 && auth.jwt.Secret == "" {
+		return nil, fmt.Errorf("api auth is enabled but no tokens or jwt secret are configured")
+	}
+	return auth, nil
+}
+
+// Verify returns the principal for a raw bearer token.
+func (a *APIAuth) Verify(raw string) (*Principal, error) {
+	// Tokens are looked up by hash so the comparison does not depend on how
+	// much of a guessed token is right.
+	sum := sha256.Sum256([]byte(raw))
+	for hash, principal := range a.tokens {
+		if subtle.ConstantTimeCompare(hash[:], sum[:]) == 1 {
+			return principal, nil
+		}
+	}
+
+	if a.jwt.Secret == "" || strings.Count(raw, ".") != 2 {
+		return nil, errInvalidAPIToken
+	}
+	return a.verifyJWT(raw)
+}
+
+func (a *APIAuth) verifyJWT(raw string) (*Principal, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.jwt.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.jwt.Issuer))
+	}
+	if a.jwt.Audience != "" {
+		options = append(options, jwt.WithAudience(a.jwt.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(options...).ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(a.jwt.Secret), nil
+	})
+	if err != nil {
+		return nil, errInvalidAPIToken
+	}
+
+	principal := &Principal{}
+	principal.Name, _ = claims["sub"].(string)
+	principal.Role, _ = claims["role"].(string)
+	if _, ok := roleRank[principal.Role]; !ok || principal.Name == "" {
+		return nil, errInvalidAPIToken
+	}
+	if appIDs, ok := claims["appids"].([]interface{}); ok {
+		for _, id := range appIDs {
+			if s, ok := id.(string); ok && s != "" {
+				principal.AppIDs = append(principal.AppIDs, s)
+			}
+		}
+		// A token scoped to apps that named none of them gets no apps,
+		// not all of them.
+		if len(principal.AppIDs) == 0 {
+			return nil, errInvalidAPIToken
+		}
+	}
+	return principal, nil
+}
+
+// Authenticate requires a valid bearer token on every request and stores
+// its principal in the context. The token may also be passed as
+// ?access_token= for clients such as EventSource that cannot set headers.
+// A nil auth lets every request through without a principal.
+func Authenticate(auth *APIAuth) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if auth == nil {
+			c.Next()
+			return
+		}
+
+		raw := c.Query("access_token")
+		if header := c.GetHeader("Authorization"); header != "" {
+			scheme, token, _ := strings.Cut(header, " ")
+			if strings.EqualFold(scheme, "Bearer") {
+				raw = strings.TrimSpace(token)
+			}
+		}
+		if raw == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="device-agent"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   "missing bearer token",
+			})
+			return
+		}
+
+		principal, err := auth.Verify(raw)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="device-agent", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// RequireRole rejects callers below role.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if principal := principalFrom(c); principal != nil && !principal.HasRole(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"success": false,
+				"error":   role + " role required",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireApp rejects callers that may not act on the app that resolve finds
+// for the request. Resources of other apps are reported as not found, so a
+// tenant cannot probe for them.
+func RequireApp(what string, resolve func(c *gin.Context) (string, bool)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := principalFrom(c)
+		if principal == nil || principal.AllApps() {
+			c.Next()
+			return
+		}
+
+		appID, found := resolve(c)
+		if !found || !principal.CanAccessApp(appID) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   what + " not found",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// principalFrom returns the caller, or nil when API auth is disabled.
+func principalFrom(c *gin.Context) *Principal {
+	if value, exists := c.Get(principalKey); exists {
+		return value.(*Principal)
+	}
+	return nil
+}
+
+// canAccessApp reports whether the caller may see resources of appID.
+func canAccessApp(c *gin.Context, appID string) bool {
+	principal := principalFrom(c)
+	return principal == nil || principal.CanAccessApp(appID)
+}
+
+// Whoami returns the caller's principal.
+func Whoami(c *gin.Context) {
+	principal := principalFrom(c)
+	if principal == nil {
+		principal = &Principal{Name: "anonymous", Role: RoleAdmin}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    principal,
+	})
+}
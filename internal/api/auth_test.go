@@ -0,0 +1,211 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testJWTSecret = "jwt-secret-0123456789abcdef0123456789"
+
+func signJWT(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestNewAPIAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AuthConfig
+		ok     bool
+	}{
+		{"token", AuthConfig{Tokens: []APIToken{{Name: "a", Token: testAdminToken, Role: RoleAdmin}}}, true},
+		{"jwt", AuthConfig{JWT: JWTConfig{Secret: testJWTSecret}}, true},
+		{"nothing configured", AuthConfig{}, false},
+		{"empty token", AuthConfig{Tokens: []APIToken{{Name: "a", Role: RoleAdmin}}}, false},
+		{"short token", AuthConfig{Tokens: []APIToken{{Name: "a", Token: "short", Role: RoleAdmin}}}, false},
+		{"placeholder token", AuthConfig{Tokens: []APIToken{{Name: "a", Token: "change-me-0123456789abcdef", Role: RoleAdmin}}}, false},
+		{"unknown role", AuthConfig{Tokens: []APIToken{{Name: "a", Token: testAdminToken, Role: "root"}}}, false},
+		{"short jwt secret", AuthConfig{JWT: JWTConfig{Secret: "secret"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAPIAuth(tt.config); (err == nil) != tt.ok {
+				t.Errorf("NewAPIAuth: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := newTestAuth(t, JWTConfig{Secret: testJWTSecret, Issuer: "idp", Audience: "gateway"})
+	router := gin.New()
+	router.GET("/whoami", Authenticate(auth), Whoami)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		base := jwt.MapClaims{"sub": "alice", "role": RoleOperator, "iss": "idp", "aud": "gateway", "exp": exp}
+		for k, v := range extra {
+			if v == nil {
+				delete(base, k)
+			} else {
+				base[k] = v
+			}
+		}
+		return base
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		status int
+		want   Principal
+	}{
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "unknown token", header: "Bearer unknown-token-0123456789abcdef", status: http.StatusUnauthorized},
+		{name: "basic auth", header: "Basic " + testAdminToken, status: http.StatusUnauthorized},
+		{name: "static token", header: "Bearer " + testAdminToken, status: http.StatusOK, want: Principal{Name: "admin", Role: RoleAdmin}},
+		{name: "lower case scheme", header: "bearer " + testViewerToken, status: http.StatusOK, want: Principal{Name: "viewer", Role: RoleViewer}},
+		{name: "query token", query: "?access_token=" + testTenantToken, status: http.StatusOK, want: Principal{Name: "tenant", Role: RoleOperator, AppIDs: []string{testAppID}}},
+		{name: "jwt", header: "Bearer " + signJWT(t, testJWTSecret, claims(nil)), status: http.StatusOK, want: Principal{Name: "alice", Role: RoleOperator}},
+		{name: "jwt with apps", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"appids": []string{"A2"}})), status: http.StatusOK, want: Principal{Name: "alice", Role: RoleOperator, AppIDs: []string{"A2"}}},
+		{name: "jwt with no apps", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"appids": []string{}})), status: http.StatusUnauthorized},
+		{name: "jwt without expiry", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"exp": nil})), status: http.StatusUnauthorized},
+		{name: "expired jwt", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), status: http.StatusUnauthorized},
+		{name: "jwt with another secret", header: "Bearer " + signJWT(t, testJWTSecret+"x", claims(nil)), status: http.StatusUnauthorized},
+		{name: "jwt from another issuer", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"iss": "other"})), status: http.StatusUnauthorized},
+		{name: "jwt for another audience", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"aud": "other"})), status: http.StatusUnauthorized},
+		{name: "jwt with unknown role", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"role": "root"})), status: http.StatusUnauthorized},
+		{name: "jwt without subject", header: "Bearer " + signJWT(t, testJWTSecret, claims(jwt.MapClaims{"sub": nil})), status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/whoami"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			var resp struct {
+				Data Principal `json:"data"`
+			}
+			if tt.status != http.StatusOK {
+				decodeResponse(t, rec, tt.status, nil)
+				if rec.Header().Get("WWW-Authenticate") == "" {
+					t.Error("no WWW-Authenticate header")
+				}
+				return
+			}
+			decodeResponse(t, rec, tt.status, &resp)
+			if resp.Data.Name != tt.want.Name || resp.Data.Role != tt.want.Role || len(resp.Data.AppIDs) != len(tt.want.AppIDs) {
+				t.Fatalf("principal %+v, want %+v", resp.Data, tt.want)
+			}
+			for i := range tt.want.AppIDs {
+				if resp.Data.AppIDs[i] != tt.want.AppIDs[i] {
+					t.Errorf("principal %+v, want %+v", resp.Data, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	auth := newTestAuth(t, JWTConfig{})
+	router := gin.New()
+	router.Use(Authenticate(auth))
+	router.GET("/viewer", RequireRole(RoleViewer), Whoami)
+	router.GET("/operator", RequireRole(RoleOperator), Whoami)
+	router.GET("/admin", RequireRole(RoleAdmin), Whoami)
+
+	tokens := map[string]string{
+		RoleViewer:   testViewerToken,
+		RoleOperator: testOperatorToken,
+		RoleAdmin:    testAdminToken,
+	}
+	tests := []struct {
+		role     string
+		required string
+		want     int
+	}{
+		{RoleViewer, RoleViewer, http.StatusOK},
+		{RoleViewer, RoleOperator, http.StatusForbidden},
+		{RoleViewer, RoleAdmin, http.StatusForbidden},
+		{RoleOperator, RoleViewer, http.StatusOK},
+		{RoleOperator, RoleOperator, http.StatusOK},
+		{RoleOperator, RoleAdmin, http.StatusForbidden},
+		{RoleAdmin, RoleViewer, http.StatusOK},
+		{RoleAdmin, RoleOperator, http.StatusOK},
+		{RoleAdmin, RoleAdmin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" on "+tt.required, func(t *testing.T) {
+			decodeResponse(t, apiRequest(router, http.MethodGet, "/"+tt.required, tokens[tt.role], nil), tt.want, nil)
+		})
+	}
+
+	// Without API auth there is no principal and every role passes.
+	open := gin.New()
+	open.GET("/admin", Authenticate(nil), RequireRole(RoleAdmin), Whoami)
+	decodeResponse(t, apiRequest(open, http.MethodGet, "/admin", "", nil), http.StatusOK, nil)
+}
+
+// TestTenantScope checks a principal limited to testAppID cannot reach
+// devices or commands of A2, whichever route names them.
+func TestTenantScope(t *testing.T) {
+	server := newTestServer(t, false, nil)
+	router := newTestRouter(t, server, nil)
+
+	devices := server.GetDeviceStore()
+	now := time.Now()
+	for _, record := range []*tcpserver.DeviceRecord{
+		{AppID: testAppID, SN: "shared", FirstSeen: now, LastSeen: now},
+		{AppID: "A2", SN: "shared", FirstSeen: now, LastSeen: now},
+		{AppID: "A2", SN: "other", FirstSeen: now, LastSeen: now},
+	} {
+		devices.Put(record)
+	}
+	server.GetCommandLedger().RecordSent("A2", "other", &tcpserver.CommandMessage{CmdID: "c2", Cmd: "OPEN_WEB"}, "")
+
+	tests := []struct {
+		name  string
+		token string
+		path  string
+		want  int
+	}{
+		{"own app by path", testTenantToken, "/api/apps/A1/devices/shared", http.StatusOK},
+		{"other app by path", testTenantToken, "/api/apps/A2/devices/shared", http.StatusNotFound},
+		{"shared sn resolves to own app", testTenantToken, "/api/devices/shared", http.StatusOK},
+		{"sn only in other app", testTenantToken, "/api/devices/other", http.StatusNotFound},
+		{"command of other app", testTenantToken, "/api/commands/c2", http.StatusNotFound},
+		{"shared sn is ambiguous for all apps", testViewerToken, "/api/devices/shared", http.StatusConflict},
+		{"command for all apps", testViewerToken, "/api/commands/c2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decodeResponse(t, apiRequest(router, http.MethodGet, tt.path, tt.token, nil), tt.want, nil)
+		})
+	}
+
+	var detail struct {
+		Data struct {
+			AppID string `json:"appid"`
+		} `json:"data"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/shared", testTenantToken, nil), http.StatusOK, &detail)
+	if detail.Data.AppID != testAppID {
+		t.Errorf("resolved to app %q", detail.Data.AppID)
+	}
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BlocklistController struct {
+	sessionManager *tcpserver.SessionManager
+	blocklist      *tcpserver.Blocklist
+}
+
+func NewBlocklistController(sessionManager *tcpserver.SessionManager, blocklist *tcpserver.Blocklist) *BlocklistController {
+	return &BlocklistController{
+		sessionManager: sessionManager,
+		blocklist:      blocklist,
+	}
+}
+
+type AddBlockRuleRequest struct {
+	Type        string `json:"type" binding:"required"`
+	Value       string `json:"value" binding:"required"`
+	AppID       string `json:"appid"`
+	Reason      string `json:"reason"`
+	DurationSec int    `json:"duration_sec"`
+}
+
+func (bc *BlocklistController) List(c *gin.Context) {
+	rules, err := bc.blocklist.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	principal := principalFrom(c)
+	visible := []*tcpserver.BlockRule{}
+	for _, rule := range rules {
+		if bc.ruleInScope(principal, rule) {
+			visible = append(visible, rule)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    visible,
+		"count":   len(visible),
+	})
+}
+
+// Add blocks devices by sn, appid or cidr, for duration_sec or until the
+// rule is removed, and disconnects the online devices it matches. An sn rule
+// without an appid blocks that SN in every app.
+func (bc *BlocklistController) Add(c *gin.Context) {
+	var req AddBlockRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	rule := &tcpserver.BlockRule{
+		Type:   req.Type,
+		Value:  req.Value,
+		AppID:  req.AppID,
+		Reason: req.Reason,
+	}
+	if req.DurationSec > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.DurationSec) * time.Second)
+		rule.ExpiresAt = &expiresAt
+	}
+
+	principal := principalFrom(c)
+	if rule.Type == tcpserver.BlockBySN && rule.AppID == "" && principal != nil && len(principal.AppIDs) == 1 {
+		rule.AppID = principal.AppIDs[0]
+	}
+	if !bc.ruleInScope(principal, rule) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "not permitted to block " + req.Type + " " + req.Value,
+		})
+		return
+	}
+
+	rule, err := bc.blocklist.Add(rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	reason := "device blocked"
+	if rule.Reason != "" {
+		reason += ": " + rule.Reason
+	}
+	var disconnected []tcpserver.DeviceRef
+	for _, info := range bc.sessionManager.GetSessionInfo() {
+		if info.SN == "" || (principal != nil && !principal.CanAccessApp(info.AppID)) {
+			continue
+		}
+		if rule.Matches(info.AppID, info.SN, info.RemoteAddr) {
+			if bc.sessionManager.Disconnect(info.AppID, info.SN, reason) {
+				disconnected = append(disconnected, tcpserver.DeviceRef{AppID: info.AppID, SN: info.SN})
+			}
+		}
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data": gin.H{
+			"rule":         rule,
+			"disconnected": disconnected,
+		},
+	})
+}
+
+func (bc *BlocklistController) Remove(c *gin.Context) {
+	id := c.Param("rule_id")
+
+	err := bc.checkRuleScope(principalFrom(c), id)
+	if err == nil {
+		err = bc.blocklist.Remove(id)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, tcpserver.ErrBlockRuleNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+	})
+}
+
+// checkRuleScope reports rules principal may not manage as not found.
+func (bc *BlocklistController) checkRuleScope(principal *Principal, id string) error {
+	if principal == nil || principal.AllApps() {
+		return nil
+	}
+
+	rules, err := bc.blocklist.List()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.ID == id && bc.ruleInScope(principal, rule) {
+			return nil
+		}
+	}
+	return tcpserver.ErrBlockRuleNotFound
+}
+
+// ruleInScope reports whether principal may see and manage rule. CIDR rules
+// and SN rules without an app can refuse devices of any app, so only
+// principals with every app may.
+func (bc *BlocklistController) ruleInScope(principal *Principal, rule *tcpserver.BlockRule) bool {
+	if principal == nil || principal.AllApps() {
+		return true
+	}
+
+	switch rule.Type {
+	case tcpserver.BlockByAppID:
+		return principal.CanAccessApp(rule.Value)
+	case tcpserver.BlockBySN:
+		return rule.AppID != "" && principal.CanAccessApp(rule.AppID)
+	default:
+		return false
+	}
+}
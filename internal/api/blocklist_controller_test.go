@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"device-agent/internal/tcpserver"
+)
+
+// TestBlocklist blocks a connected device through the API, checks it is
+// disconnected and kept out, and unblocks it again.
+func TestBlocklist(t *testing.T) {
+	server := newTestServer(t, true, nil)
+	router := newTestRouter(t, server, nil)
+	sessions := server.GetSessionManager()
+	connectTestDevice(t, server, testAppID, "s1", nil)
+	connectTestDevice(t, server, "A2", "s1", nil)
+
+	rule := AddBlockRuleRequest{Type: tcpserver.BlockBySN, Value: "s1", AppID: testAppID, Reason: "stolen"}
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/blocklist", testOperatorToken, rule), http.StatusForbidden, nil)
+
+	var added struct {
+		Data struct {
+			Rule         tcpserver.BlockRule   `json:"rule"`
+			Disconnected []tcpserver.DeviceRef `json:"disconnected"`
+		} `json:"data"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/blocklist", testAdminToken, rule), http.StatusCreated, &added)
+	if len(added.Data.Disconnected) != 1 || added.Data.Disconnected[0] != (tcpserver.DeviceRef{AppID: testAppID, SN: "s1"}) {
+		t.Errorf("disconnected %+v", added.Data.Disconnected)
+	}
+	if _, online := sessions.GetByDevice(testAppID, "s1"); online {
+		t.Error("blocked device still online")
+	}
+	if _, online := sessions.GetByDevice("A2", "s1"); !online {
+		t.Error("same SN of another app disconnected")
+	}
+
+	var list struct {
+		Count int `json:"count"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/blocklist", testAdminToken, nil), http.StatusOK, &list)
+	if list.Count != 1 {
+		t.Errorf("%d rules listed, want 1", list.Count)
+	}
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/blocklist", testAdminToken, AddBlockRuleRequest{Type: "mac", Value: "x"}), http.StatusBadRequest, nil)
+
+	decodeResponse(t, apiRequest(router, http.MethodDelete, "/api/blocklist/"+added.Data.Rule.ID, testAdminToken, nil), http.StatusOK, nil)
+	decodeResponse(t, apiRequest(router, http.MethodDelete, "/api/blocklist/"+added.Data.Rule.ID, testAdminToken, nil), http.StatusNotFound, nil)
+
+	// The agent keeps retrying, and gets in once its penalty is over.
+	waitFor(t, "unblocked device to reconnect", func() bool {
+		_, online := sessions.GetByDevice(testAppID, "s1")
+		return online
+	})
+}
+
+func TestDisconnectDevice(t *testing.T) {
+	server := newTestServer(t, true, nil)
+	router := newTestRouter(t, server, nil)
+	connectTestDevice(t, server, testAppID, "s1", nil)
+
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/devices/s1/disconnect", testViewerToken, nil), http.StatusForbidden, nil)
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/apps/A2/devices/s1/disconnect", testOperatorToken, nil), http.StatusNotFound, nil)
+
+	events, cancel := server.GetEventBus().Subscribe(tcpserver.EventFilter{Types: []string{tcpserver.EventDeviceDisconnected}})
+	defer cancel()
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/devices/s1/disconnect", testOperatorToken, DisconnectRequest{Reason: "maintenance"}), http.StatusOK, nil)
+	select {
+	case event := <-events:
+		if event.SN != "s1" || event.Reason != "maintenance" {
+			t.Errorf("event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no device.disconnected event")
+	}
+
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/apps/A1/devices/s9/disconnect", testOperatorToken, nil), http.StatusNotFound, nil)
+}
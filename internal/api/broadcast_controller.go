@@ -0,0 +1,329 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultBroadcastConcurrency = 16
+	maxBroadcastConcurrency     = 128
+)
+
+type BroadcastController struct {
+	sessionManager *tcpserver.SessionManager
+	ackWaiter      *tcpserver.ACKWaiter
+	commandLedger  *tcpserver.CommandLedger
+	tenants        *tcpserver.Tenants
+	cluster        *tcpserver.Cluster
+	devices        deviceApps
+}
+
+func NewBroadcastController(sessionManager *tcpserver.SessionManager, deviceStore tcpserver.DeviceStore, ackWaiter *tcpserver.ACKWaiter, commandLedger *tcpserver.CommandLedger, tenants *tcpserver.Tenants, cluster *tcpserver.Cluster) *BroadcastController {
+	return &BroadcastController{
+		sessionManager: sessionManager,
+		ackWaiter:      ackWaiter,
+		commandLedger:  commandLedger,
+		tenants:        tenants,
+		cluster:        cluster,
+		devices:        deviceApps{sessionManager: sessionManager, deviceStore: deviceStore, cluster: cluster},
+	}
+}
+
+type BroadcastRequest struct {
+	SNs         []string        `json:"sns"`
+	AppID       string          `json:"appid"`
+	Selector    string          `json:"selector"`
+	MsgType     string          `json:"msg_type" binding:"required"`
+	Payload     json.RawMessage `json:"payload" binding:"required"`
+	TimeoutMS   int             `json:"timeout_ms"`
+	Concurrency int             `json:"concurrency"`
+}
+
+type BroadcastResult struct {
+	AppID  string                `json:"appid,omitempty"`
+	SN     string                `json:"sn"`
+	CmdID  string                `json:"cmd_id,omitempty"`
+	Status string                `json:"status"`
+	ACK    *tcpserver.ACKMessage `json:"ack,omitempty"`
+	Error  string                `json:"error,omitempty"`
+	// Node is the cluster node the command was forwarded to, if the device
+	// is connected to another one.
+	Node string `json:"node,omitempty"`
+}
+
+const (
+	BroadcastStatusOK          = "ok"
+	BroadcastStatusError       = "error"
+	BroadcastStatusTimeout     = "timeout"
+	BroadcastStatusOffline     = "offline"
+	BroadcastStatusRateLimited = "rate_limited"
+)
+
+func (bc *BroadcastController) Broadcast(c *gin.Context) {
+	var req BroadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	if len(req.SNs) == 0 && req.AppID == "" && req.Selector == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "one of sns, appid or selector is required",
+		})
+		return
+	}
+
+	selector, err := parseSelector(req.Selector)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid selector: " + err.Error(),
+		})
+		return
+	}
+
+	var args map[string]interface{}
+	if err := json.Unmarshal(req.Payload, &args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid payload: " + err.Error(),
+		})
+		return
+	}
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultBroadcastConcurrency
+	}
+	if concurrency > maxBroadcastConcurrency {
+		concurrency = maxBroadcastConcurrency
+	}
+
+	timeout := time.Duration(req.TimeoutMS) * time.Millisecond
+	if timeout <= 0 {
+		timeout = tcpserver.DefaultCommandTimeout
+	}
+
+	if appID := c.Param("appid"); appID != "" {
+		req.AppID = appID
+	}
+	auditCommand(c, "", req.MsgType)
+
+	targets, err := bc.resolveTargets(principalFrom(c), &req, selector)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "failed to resolve targets: " + err.Error(),
+		})
+		return
+	}
+	results := make([]BroadcastResult, len(targets))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, device := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, device tcpserver.DeviceRef) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = bc.sendOne(device, req.MsgType, args, req.TimeoutMS, timeout, requestID(c))
+		}(i, device)
+	}
+	wg.Wait()
+
+	summary := map[string]int{
+		BroadcastStatusOK:          0,
+		BroadcastStatusError:       0,
+		BroadcastStatusTimeout:     0,
+		BroadcastStatusOffline:     0,
+		BroadcastStatusRateLimited: 0,
+	}
+	for _, result := range results {
+		summary[result.Status]++
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    results,
+		"count":   len(results),
+		"summary": summary,
+	})
+}
+
+// resolveTargets returns the devices to command. Explicit SNs are kept even
+// when offline so the caller sees them in the results; otherwise every
+// session on this node is a candidate. AppID and selector narrow either set,
+// and devices of apps the principal may not access are dropped. Without an
+// AppID, an explicit SN names that SN in every app, on any node. The labels
+// of devices on other nodes are not known here, so a selector drops them.
+func (bc *BroadcastController) resolveTargets(principal *Principal, req *BroadcastRequest, selector map[string]string) ([]tcpserver.DeviceRef, error) {
+	var candidates []tcpserver.DeviceRef
+	for _, sn := range req.SNs {
+		if sn == "" {
+			continue
+		}
+		if req.AppID != "" {
+			candidates = append(candidates, tcpserver.DeviceRef{AppID: req.AppID, SN: sn})
+			continue
+		}
+		appIDs, err := bc.devices.AppIDs(sn)
+		if err != nil {
+			return nil, err
+		}
+		if len(appIDs) == 0 {
+			candidates = append(candidates, tcpserver.DeviceRef{SN: sn})
+		}
+		for _, appID := range appIDs {
+			candidates = append(candidates, tcpserver.DeviceRef{AppID: appID, SN: sn})
+		}
+	}
+	if len(req.SNs) == 0 {
+		candidates = bc.sessionManager.GetOnlineDevices()
+	}
+
+	seen := make(map[tcpserver.DeviceRef]bool)
+	var targets []tcpserver.DeviceRef
+	for _, device := range candidates {
+		if seen[device] {
+			continue
+		}
+		seen[device] = true
+
+		if principal != nil && !principal.CanAccessApp(device.AppID) {
+			continue
+		}
+
+		session, online := bc.sessionManager.GetByDevice(device.AppID, device.SN)
+		if online && !matchesSession(session, req.AppID, selector) {
+			continue
+		}
+		if !online && len(req.SNs) == 0 {
+			continue
+		}
+		if !online && len(selector) > 0 {
+			if _, err := bc.cluster.Owner(device.AppID, device.SN); err == nil {
+				continue
+			}
+		}
+		targets = append(targets, device)
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].AppID != targets[j].AppID {
+			return targets[i].AppID < targets[j].AppID
+		}
+		return targets[i].SN < targets[j].SN
+	})
+	return targets, nil
+}
+
+// sendOne commands one device and waits for its ACK. A device connected to
+// another cluster node gets the command forwarded there, and its ACK comes
+// back here.
+func (bc *BroadcastController) sendOne(device tcpserver.DeviceRef, msgType string, args map[string]interface{}, timeoutMS int, timeout time.Duration, requestID string) BroadcastResult {
+	session, local := bc.sessionManager.GetByDevice(device.AppID, device.SN)
+	var owner *tcpserver.ClusterNode
+	if !local {
+		var err error
+		if owner, err = bc.cluster.Owner(device.AppID, device.SN); err != nil {
+			return BroadcastResult{AppID: device.AppID, SN: device.SN, Status: BroadcastStatusOffline}
+		}
+	}
+	if err := bc.tenants.AllowCommand(device.AppID); err != nil {
+		return BroadcastResult{AppID: device.AppID, SN: device.SN, Status: BroadcastStatusRateLimited, Error: err.Error()}
+	}
+
+	cmd := &tcpserver.CommandMessage{
+		CmdID:     uuid.New().String(),
+		Cmd:       msgType,
+		Args:      args,
+		TimeoutMS: timeoutMS,
+	}
+	result := BroadcastResult{AppID: device.AppID, SN: device.SN, CmdID: cmd.CmdID}
+
+	// Wait for the ACK before sending, so a device that answers at once
+	// frees its slot at once.
+	pending := bc.ackWaiter.Expect(cmd.CmdID)
+	var err error
+	if local {
+		err = bc.commandLedger.SendTracked(session, cmd, requestID)
+	} else {
+		result.Node = owner.ID
+		err = bc.cluster.Forward(owner, device.AppID, device.SN, cmd, requestID)
+	}
+	if errors.Is(err, tcpserver.ErrDeviceOffline) {
+		pending.Release()
+		result.Status = BroadcastStatusOffline
+		return result
+	}
+	if err != nil {
+		pending.Release()
+		result.Status = BroadcastStatusError
+		result.Error = "failed to send command: " + err.Error()
+		return result
+	}
+
+	ack, err := pending.Wait(timeout)
+	if err != nil {
+		bc.commandLedger.RecordTimeout(cmd.CmdID)
+		result.Status = BroadcastStatusTimeout
+		result.Error = err.Error()
+		return result
+	}
+
+	result.ACK = ack
+	if ack.Status == "ok" {
+		result.Status = BroadcastStatusOK
+	} else {
+		result.Status = BroadcastStatusError
+		result.Error = ack.Detail
+	}
+	return result
+}
+
+func matchesSession(session *tcpserver.Session, appID string, selector map[string]string) bool {
+	if appID != "" && session.AppID != appID {
+		return false
+	}
+	for key, value := range selector {
+		if session.Meta[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSelector parses a label selector of the form "k1=v1,k2=v2".
+func parseSelector(raw string) (map[string]string, error) {
+	selector := make(map[string]string)
+	if strings.TrimSpace(raw) == "" {
+		return selector, nil
+	}
+
+	for _, part := range strings.Split(raw, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", part)
+		}
+		selector[key] = strings.TrimSpace(value)
+	}
+	return selector, nil
+}
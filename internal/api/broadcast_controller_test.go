@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"device-agent/internal/tcpserver"
+)
+
+const testClusterSecret = "0123456789abcdef0123456789abcdef"
+
+// newTestClusterNode starts a server that joins the cluster sharing
+// registry as nodeID.
+func newTestClusterNode(t *testing.T, registry tcpserver.ClusterRegistry, nodeID string) *tcpserver.Server {
+	t.Helper()
+
+	return newTestServer(t, true, func(config *tcpserver.Config) {
+		config.Cluster = &tcpserver.ClusterConfig{
+			NodeID:  nodeID,
+			RPCAddr: "127.0.0.1:0",
+			Secret:  testClusterSecret,
+			NodeTTL: time.Minute,
+		}
+		config.ClusterRegistry = registry
+	})
+}
+
+// TestBroadcastAcrossNodes broadcasts from node a to a device on a, one on
+// node b and one on neither, and checks each gets the right outcome.
+func TestBroadcastAcrossNodes(t *testing.T) {
+	registry := tcpserver.NewMemoryClusterRegistry(time.Minute)
+	a := newTestClusterNode(t, registry, "a")
+	b := newTestClusterNode(t, registry, "b")
+	router := newTestRouter(t, a, nil)
+
+	connectTestDevice(t, a, testAppID, "s1", ackCommands)
+	connectTestDevice(t, b, testAppID, "s2", ackCommands)
+	waitFor(t, "a to see s2 on b", func() bool {
+		_, err := a.GetCluster().Owner(testAppID, "s2")
+		return err == nil
+	})
+
+	var resp struct {
+		Data    []BroadcastResult `json:"data"`
+		Summary map[string]int    `json:"summary"`
+	}
+	req := BroadcastRequest{SNs: []string{"s1", "s2", "s3"}, AppID: testAppID, MsgType: "OPEN_WEB", Payload: []byte(`{}`), TimeoutMS: 5000}
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/commands/broadcast", testOperatorToken, req), http.StatusOK, &resp)
+	if len(resp.Data) != 3 {
+		t.Fatalf("results %+v", resp.Data)
+	}
+	want := []struct{ sn, status, node string }{
+		{"s1", BroadcastStatusOK, ""},
+		{"s2", BroadcastStatusOK, "b"},
+		{"s3", BroadcastStatusOffline, ""},
+	}
+	for i, w := range want {
+		got := resp.Data[i]
+		if got.SN != w.sn || got.Status != w.status || got.Node != w.node {
+			t.Errorf("result %d: %+v, want %s %s on %q", i, got, w.sn, w.status, w.node)
+		}
+	}
+	if record, _ := a.GetCommandLedger().Get(resp.Data[1].CmdID); record == nil || record.State != tcpserver.CommandStateAcked {
+		t.Errorf("forwarded command on a: %+v", record)
+	}
+
+	// b's labels are not known on a, so a selector leaves its device out.
+	req = BroadcastRequest{SNs: []string{"s2"}, AppID: testAppID, Selector: "site=x", MsgType: "OPEN_WEB", Payload: []byte(`{}`)}
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/commands/broadcast", testOperatorToken, req), http.StatusOK, &resp)
+	if len(resp.Data) != 0 {
+		t.Errorf("results with a selector: %+v", resp.Data)
+	}
+}
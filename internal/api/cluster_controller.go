@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ClusterController struct {
+	cluster *tcpserver.Cluster
+}
+
+func NewClusterController(cluster *tcpserver.Cluster) *ClusterController {
+	return &ClusterController{
+		cluster: cluster,
+	}
+}
+
+// ListNodes returns the live nodes of the cluster and which one answered.
+func (cc *ClusterController) ListNodes(c *gin.Context) {
+	if cc.cluster == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "cluster mode is not enabled",
+		})
+		return
+	}
+
+	nodes, err := cc.cluster.Registry().Nodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"node_id": cc.cluster.NodeID(),
+		"data":    nodes,
+		"count":   len(nodes),
+	})
+}
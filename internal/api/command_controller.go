@@ -0,0 +1,150 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	eventStreamKeepalive  = 15 * time.Second
+	eventStreamMaxRuntime = 30 * time.Minute
+)
+
+type CommandController struct {
+	commandLedger *tcpserver.CommandLedger
+	progressHub   *tcpserver.ProgressHub
+}
+
+func NewCommandController(commandLedger *tcpserver.CommandLedger, progressHub *tcpserver.ProgressHub) *CommandController {
+	return &CommandController{
+		commandLedger: commandLedger,
+		progressHub:   progressHub,
+	}
+}
+
+func (cc *CommandController) Get(c *gin.Context) {
+	cmdID := c.Param("cmd_id")
+	if cmdID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "cmd_id parameter is required",
+		})
+		return
+	}
+
+	record, exists := cc.commandLedger.Get(cmdID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "command not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    record,
+	})
+}
+
+func (cc *CommandController) ListByDevice(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	if sn == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "sn parameter is required",
+		})
+		return
+	}
+
+	limit, err := positiveQueryInt(c, "limit", 50)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	records := cc.commandLedger.ListByDevice(appID, sn, limit)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    records,
+		"count":   len(records),
+	})
+}
+
+// StreamEvents streams progress updates and the final ACK for a command as
+// Server-Sent Events. The stream ends after the ACK is sent.
+func (cc *CommandController) StreamEvents(c *gin.Context) {
+	cmdID := c.Param("cmd_id")
+	if cmdID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "cmd_id parameter is required",
+		})
+		return
+	}
+
+	// Subscribe before reading the ledger so no event falls in between.
+	events, cancel := cc.progressHub.Subscribe(cmdID)
+	defer cancel()
+
+	record, exists := cc.commandLedger.Get(cmdID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "command not found",
+		})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	if record.State == tcpserver.CommandStateAcked {
+		c.SSEvent(tcpserver.CommandEventACK, &tcpserver.ACKMessage{
+			CmdID:  record.CmdID,
+			Status: record.ACKStatus,
+			Detail: record.ACKDetail,
+		})
+		return
+	}
+	if record.Progress != nil {
+		c.SSEvent(tcpserver.CommandEventProgress, record.Progress)
+	}
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	deadline := time.NewTimer(eventStreamMaxRuntime)
+	defer deadline.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event := <-events:
+			if event.Type == tcpserver.CommandEventACK {
+				c.SSEvent(event.Type, event.ACK)
+				return false
+			}
+			c.SSEvent(event.Type, event.Progress)
+			return true
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			return true
+		case <-deadline.C:
+			c.SSEvent("timeout", gin.H{"cmd_id": cmdID})
+			return false
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"device-agent/app/netclient"
+	"device-agent/internal/tcpserver"
+)
+
+// TestStreamCommandEvents follows a long-running command over SSE while the
+// agent reports progress and then ACKs it.
+func TestStreamCommandEvents(t *testing.T) {
+	gateway := newTestServer(t, true, nil)
+	server := httptest.NewServer(newTestRouter(t, gateway, nil))
+	t.Cleanup(server.Close)
+
+	received := make(chan *tcpserver.CommandMessage, 1)
+	client := connectTestDevice(t, gateway, testAppID, "s1", func(_ *netclient.Client, cmd *tcpserver.CommandMessage) {
+		received <- cmd
+	})
+
+	var sent SendMessageResponse
+	body := map[string]interface{}{"msg_type": "DOWNLOAD", "payload": map[string]string{"url": "https://example.com/pack.zip"}}
+	decodeResponse(t, apiRequest(server.Config.Handler, http.MethodPost, "/api/devices/s1/send-async", testOperatorToken, body), http.StatusOK, &sent)
+	cmd := <-received
+
+	events := openStream(t, server, "/api/commands/"+sent.CmdID+"/events", testViewerToken)
+	client.SendProgress(cmd.CmdID, 40, "download", "4/10 MB")
+	client.SendProgress(cmd.CmdID, 100, "unpack", "")
+	client.SendACK(cmd.CmdID, "ok", "installed")
+
+	for _, want := range []struct {
+		name    string
+		percent int
+	}{{"progress", 40}, {"progress", 100}} {
+		event := nextSSE(t, events)
+		var progress tcpserver.ProgressMessage
+		json.Unmarshal([]byte(event.Data), &progress)
+		if event.Name != want.name || progress.Percent != want.percent {
+			t.Errorf("event %s %+v, want %s at %d%%", event.Name, progress, want.name, want.percent)
+		}
+	}
+	event := nextSSE(t, events)
+	var ack tcpserver.ACKMessage
+	json.Unmarshal([]byte(event.Data), &ack)
+	if event.Name != tcpserver.CommandEventACK || ack.Detail != "installed" {
+		t.Errorf("event %s %+v, want the ACK", event.Name, ack)
+	}
+	if _, open := <-events; open {
+		t.Error("stream still open after the ACK")
+	}
+
+	// A command that is already answered streams its ACK at once.
+	events = openStream(t, server, "/api/commands/"+sent.CmdID+"/events", testViewerToken)
+	if event := nextSSE(t, events); event.Name != tcpserver.CommandEventACK {
+		t.Errorf("event %s, want the ACK", event.Name)
+	}
+
+	decodeResponse(t, apiRequest(server.Config.Handler, http.MethodGet, "/api/commands/unknown/events", testViewerToken, nil), http.StatusNotFound, nil)
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"device-agent/internal/security"
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CredentialController struct {
+	sessionManager *tcpserver.SessionManager
+	authenticator  *security.Authenticator
+	credentials    security.CredentialStore
+}
+
+func NewCredentialController(sessionManager *tcpserver.SessionManager, authenticator *security.Authenticator, credentials security.CredentialStore) *CredentialController {
+	return &CredentialController{
+		sessionManager: sessionManager,
+		authenticator:  authenticator,
+		credentials:    credentials,
+	}
+}
+
+// CredentialInfo is a credential as listed by the API, without its key.
+type CredentialInfo struct {
+	AppID         string     `json:"appid"`
+	SN            string     `json:"sn"`
+	HasKey        bool       `json:"has_key"`
+	Revoked       bool       `json:"revoked"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func newCredentialInfo(cred *security.DeviceCredential) CredentialInfo {
+	return CredentialInfo{
+		AppID:         cred.AppID,
+		SN:            cred.SN,
+		HasKey:        cred.Key != "",
+		Revoked:       cred.Revoked,
+		RevokedAt:     cred.RevokedAt,
+		RevokedReason: cred.RevokedReason,
+		CreatedAt:     cred.CreatedAt,
+		UpdatedAt:     cred.UpdatedAt,
+	}
+}
+
+type IssueCredentialRequest struct {
+	Key string `json:"key"`
+}
+
+type RevokeCredentialRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (cc *CredentialController) List(c *gin.Context) {
+	creds, err := cc.credentials.List(c.Query("appid"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	infos := make([]CredentialInfo, 0, len(creds))
+	for _, cred := range creds {
+		if canAccessApp(c, cred.AppID) {
+			infos = append(infos, newCredentialInfo(cred))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    infos,
+		"count":   len(infos),
+	})
+}
+
+// Issue sets the key a device signs with and returns it. A key in the body
+// is stored as given. Without one, apps in derived mode get the device's
+// derived key, from the app's active key named by kid, and other apps get a
+// freshly generated key, which is stored.
+// Issuing does not lift a revocation.
+func (cc *CredentialController) Issue(c *gin.Context) {
+	appID := c.Param("appid")
+	sn := c.Param("sn")
+	if !cc.authenticator.HasApp(appID) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "unknown appid",
+		})
+		return
+	}
+
+	var req IssueCredentialRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid request: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	cred, err := cc.load(appID, sn)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	key := req.Key
+	keyID := ""
+	source := "provided"
+	switch {
+	case key != "":
+		cred.Key = key
+	case cc.authenticator.KeyMode(appID) == security.KeyModeDerived:
+		cred.Key = ""
+		var appKey *security.AppKey
+		if appKey, err = cc.authenticator.ActiveKey(appID); err == nil {
+			keyID = appKey.ID
+			key = security.DeriveDeviceKey(appKey.Key, appID, sn)
+		}
+		source = "derived"
+	default:
+		key, err = security.GenerateDeviceKey()
+		cred.Key = key
+		source = "generated"
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	if err := cc.save(cred); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"credential": newCredentialInfo(cred),
+			"key":        key,
+			"kid":        keyID,
+			"source":     source,
+		},
+	})
+}
+
+// Revoke blocks a device from authenticating and disconnects it if online.
+// Other devices of the app are unaffected.
+func (cc *CredentialController) Revoke(c *gin.Context) {
+	appID := c.Param("appid")
+	sn := c.Param("sn")
+
+	var req RevokeCredentialRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid request: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	cred, err := cc.load(appID, sn)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	cred.Revoked = true
+	cred.RevokedAt = &now
+	cred.RevokedReason = req.Reason
+	if err := cc.save(cred); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	disconnected := cc.sessionManager.Disconnect(appID, sn, "credential revoked")
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"credential":   newCredentialInfo(cred),
+			"disconnected": disconnected,
+		},
+	})
+}
+
+// Reinstate lifts a revocation.
+func (cc *CredentialController) Reinstate(c *gin.Context) {
+	cred, err := cc.credentials.Get(c.Param("appid"), c.Param("sn"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, security.ErrCredentialNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	cred.Revoked = false
+	cred.RevokedAt = nil
+	cred.RevokedReason = ""
+	if err := cc.save(cred); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    newCredentialInfo(cred),
+	})
+}
+
+// Delete removes a device's credential, returning it to its app's key mode.
+func (cc *CredentialController) Delete(c *gin.Context) {
+	if err := cc.credentials.Delete(c.Param("appid"), c.Param("sn")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, security.ErrCredentialNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+	})
+}
+
+// load returns the stored credential, or a new one when there is none.
+func (cc *CredentialController) load(appID, sn string) (*security.DeviceCredential, error) {
+	cred, err := cc.credentials.Get(appID, sn)
+	if errors.Is(err, security.ErrCredentialNotFound) {
+		return &security.DeviceCredential{AppID: appID, SN: sn, CreatedAt: time.Now()}, nil
+	}
+	return cred, err
+}
+
+func (cc *CredentialController) save(cred *security.DeviceCredential) error {
+	cred.UpdatedAt = time.Now()
+	return cc.credentials.Put(cred)
+}
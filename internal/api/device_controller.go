@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 
 	"device-agent/internal/tcpserver"
@@ -10,39 +11,155 @@ import (
 
 type DeviceController struct {
 	sessionManager *tcpserver.SessionManager
+	deviceStore    tcpserver.DeviceStore
 }
 
-func NewDeviceController(sessionManager *tcpserver.SessionManager) *DeviceController {
+func NewDeviceController(sessionManager *tcpserver.SessionManager, deviceStore tcpserver.DeviceStore) *DeviceController {
 	return &DeviceController{
 		sessionManager: sessionManager,
+		deviceStore:    deviceStore,
 	}
 }
 
 type DeviceInfo struct {
-	SN         string            `json:"sn"`
-	AppID      string            `json:"appid"`
-	RemoteAddr string            `json:"remote_addr"`
-	LoginAt    string            `json:"login_at"`
-	LastPing   string            `json:"last_ping"`
-	Meta       map[string]string `json:"meta"`
-	Online     bool              `json:"online"`
+	SN               string            `json:"sn"`
+	AppID            string            `json:"appid"`
+	RemoteAddr       string            `json:"remote_addr"`
+	LoginAt          string            `json:"login_at,omitempty"`
+	LastPing         string            `json:"last_ping,omitempty"`
+	FirstSeen        string            `json:"first_seen,omitempty"`
+	LastSeen         string            `json:"last_seen,omitempty"`
+	DisconnectReason string            `json:"disconnect_reason,omitempty"`
+	ProtocolVersion  uint8             `json:"protocol_version,omitempty"`
+	Codec            string            `json:"codec,omitempty"`
+	Compression      string            `json:"compression,omitempty"`
+	Meta             map[string]string `json:"meta"`
+	Online           bool              `json:"online"`
+}
+
+const timeLayout = "2006-01-02 15:04:05"
+
+func sessionDeviceInfo(session *tcpserver.Session) DeviceInfo {
+	return DeviceInfo{
+		SN:              session.SN,
+		AppID:           session.AppID,
+		RemoteAddr:      session.RemoteAddr,
+		LoginAt:         session.LoginAt.Format(timeLayout),
+		LastPing:        session.LastPing.Format(timeLayout),
+		ProtocolVersion: session.ProtocolVersion(),
+		Codec:           session.Codec().Name(),
+		Compression:     session.Wire().Compression,
+		Meta:            session.Meta,
+		Online:          true,
+	}
+}
+
+func recordDeviceInfo(record *tcpserver.DeviceRecord) DeviceInfo {
+	return DeviceInfo{
+		SN:               record.SN,
+		AppID:            record.AppID,
+		RemoteAddr:       record.LastRemoteAddr,
+		FirstSeen:        record.FirstSeen.Format(timeLayout),
+		LastSeen:         record.LastSeen.Format(timeLayout),
+		DisconnectReason: record.DisconnectReason,
+		Meta:             record.Meta,
+		Online:           false,
+	}
+}
+
+// deviceInfo merges the stored record with the live session, if any.
+func (dc *DeviceController) deviceInfo(record *tcpserver.DeviceRecord) DeviceInfo {
+	session, online := dc.sessionManager.GetByDevice(record.AppID, record.SN)
+	if !online {
+		return recordDeviceInfo(record)
+	}
+
+	info := sessionDeviceInfo(session)
+	info.FirstSeen = record.FirstSeen.Format(timeLayout)
+	info.LastSeen = record.LastSeen.Format(timeLayout)
+	return info
+}
+
+func (dc *DeviceController) List(c *gin.Context) {
+	page, err := positiveQueryInt(c, "page", 1)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	pageSize, err := positiveQueryInt(c, "page_size", 20)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	if pageSize > 200 {
+		pageSize = 200
+	}
+
+	records, err := dc.deviceStore.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "failed to list devices: " + err.Error(),
+		})
+		return
+	}
+
+	appID := appFilter(c)
+	status := c.Query("status")
+
+	var filtered []DeviceInfo
+	for _, record := range records {
+		if (appID != "" && record.AppID != appID) || !canAccessApp(c, record.AppID) {
+			continue
+		}
+		info := dc.deviceInfo(record)
+		if (status == "online" && !info.Online) || (status == "offline" && info.Online) {
+			continue
+		}
+		filtered = append(filtered, info)
+	}
+
+	total := len(filtered)
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	result := filtered[start:end]
+	if result == nil {
+		result = []DeviceInfo{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      result,
+		"count":     len(result),
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
 }
 
 func (dc *DeviceController) ListOnline(c *gin.Context) {
-	devices := dc.sessionManager.GetOnlineDevices()
+	appID := appFilter(c)
 
 	var result []DeviceInfo
-	for _, sn := range devices {
-		if session, exists := dc.sessionManager.GetBySN(sn); exists {
-			result = append(result, DeviceInfo{
-				SN:         session.SN,
-				AppID:      session.AppID,
-				RemoteAddr: session.RemoteAddr,
-				LoginAt:    session.LoginAt.Format("2006-01-02 15:04:05"),
-				LastPing:   session.LastPing.Format("2006-01-02 15:04:05"),
-				Meta:       session.Meta,
-				Online:     true,
-			})
+	for _, device := range dc.sessionManager.GetOnlineDevices() {
+		if (appID != "" && device.AppID != appID) || !canAccessApp(c, device.AppID) {
+			continue
+		}
+		if session, exists := dc.sessionManager.GetByDevice(device.AppID, device.SN); exists {
+			result = append(result, sessionDeviceInfo(session))
 		}
 	}
 
@@ -54,17 +171,36 @@ func (dc *DeviceController) ListOnline(c *gin.Context) {
 }
 
 func (dc *DeviceController) ListOffline(c *gin.Context) {
-	// In a real implementation, this would query a database for offline devices
-	// For now, return empty list as we only track online sessions in memory
+	records, err := dc.deviceStore.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "failed to list devices: " + err.Error(),
+		})
+		return
+	}
+
+	appID := appFilter(c)
+	result := []DeviceInfo{}
+	for _, record := range records {
+		if (appID != "" && record.AppID != appID) || !canAccessApp(c, record.AppID) {
+			continue
+		}
+		if _, online := dc.sessionManager.GetByDevice(record.AppID, record.SN); online {
+			continue
+		}
+		result = append(result, recordDeviceInfo(record))
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"data":    []DeviceInfo{},
-		"count":   0,
+		"data":    result,
+		"count":   len(result),
 	})
 }
 
 func (dc *DeviceController) GetDetail(c *gin.Context) {
-	sn := c.Param("sn")
+	appID, sn := deviceParams(c)
 	if sn == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -73,27 +209,68 @@ func (dc *DeviceController) GetDetail(c *gin.Context) {
 		return
 	}
 
-	session, exists := dc.sessionManager.GetBySN(sn)
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
+	var device DeviceInfo
+	record, err := dc.deviceStore.Get(appID, sn)
+	switch {
+	case err == nil:
+		device = dc.deviceInfo(record)
+	case errors.Is(err, tcpserver.ErrDeviceNotFound):
+		session, exists := dc.sessionManager.GetByDevice(appID, sn)
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "device not found",
+			})
+			return
+		}
+		device = sessionDeviceInfo(session)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
-			"error":   "device not found",
+			"error":   "failed to load device: " + err.Error(),
 		})
 		return
 	}
 
-	device := DeviceInfo{
-		SN:         session.SN,
-		AppID:      session.AppID,
-		RemoteAddr: session.RemoteAddr,
-		LoginAt:    session.LoginAt.Format("2006-01-02 15:04:05"),
-		LastPing:   session.LastPing.Format("2006-01-02 15:04:05"),
-		Meta:       session.Meta,
-		Online:     true,
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    device,
+	})
+}
+
+type DisconnectRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Disconnect closes an online device's session. The device is free to
+// reconnect unless it is also blocklisted.
+func (dc *DeviceController) Disconnect(c *gin.Context) {
+	var req DisconnectRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid request: " + err.Error(),
+			})
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "disconnected by operator"
+	}
+
+	appID, sn := deviceParams(c)
+	session, exists := dc.sessionManager.GetByDevice(appID, sn)
+	if !exists || !dc.sessionManager.Disconnect(appID, sn, req.Reason) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "device offline",
+		})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
-		"data":    device,
+		"data":    sessionDeviceInfo(session),
 	})
-}
\ No newline at end of file
+}
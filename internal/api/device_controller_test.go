@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"device-agent/internal/tcpserver"
+)
+
+// TestListDevices lists one online and one stored, offline device.
+func TestListDevices(t *testing.T) {
+	server := newTestServer(t, true, nil)
+	router := newTestRouter(t, server, nil)
+
+	seen := time.Now()
+	server.GetDeviceStore().Put(&tcpserver.DeviceRecord{AppID: testAppID, SN: "s2", FirstSeen: seen, LastSeen: seen, DisconnectReason: "read error: EOF"})
+	connectTestDevice(t, server, testAppID, "s1", nil)
+
+	var resp struct {
+		Data  []DeviceInfo `json:"data"`
+		Total int          `json:"total"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices", testViewerToken, nil), http.StatusOK, &resp)
+	if resp.Total != 2 || resp.Data[0].SN != "s1" || !resp.Data[0].Online || resp.Data[1].Online {
+		t.Errorf("devices %+v", resp)
+	}
+
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/offline", testViewerToken, nil), http.StatusOK, &resp)
+	if len(resp.Data) != 1 || resp.Data[0].SN != "s2" || resp.Data[0].DisconnectReason != "read error: EOF" {
+		t.Errorf("offline devices %+v", resp.Data)
+	}
+
+	var detail struct {
+		Data DeviceInfo `json:"data"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/s2", testViewerToken, nil), http.StatusOK, &detail)
+	if detail.Data.SN != "s2" || detail.Data.Online {
+		t.Errorf("offline device %+v", detail.Data)
+	}
+
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices?page=2&page_size=1", testViewerToken, nil), http.StatusOK, &resp)
+	if len(resp.Data) != 1 || resp.Data[0].SN != "s2" {
+		t.Errorf("second page %+v", resp.Data)
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EnrollmentController struct {
+	enrollments *tcpserver.EnrollmentManager
+}
+
+func NewEnrollmentController(enrollments *tcpserver.EnrollmentManager) *EnrollmentController {
+	return &EnrollmentController{
+		enrollments: enrollments,
+	}
+}
+
+// EnrollmentTokenInfo is an enrollment token as listed by the API, without
+// its secret hash.
+type EnrollmentTokenInfo struct {
+	ID              string     `json:"token_id"`
+	AppID           string     `json:"appid"`
+	SN              string     `json:"sn,omitempty"`
+	RequireApproval bool       `json:"require_approval"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	UsedAt          *time.Time `json:"used_at,omitempty"`
+	EnrollmentID    string     `json:"enrollment_id,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+func newEnrollmentTokenInfo(token *tcpserver.EnrollmentToken) EnrollmentTokenInfo {
+	return EnrollmentTokenInfo{
+		ID:              token.ID,
+		AppID:           token.AppID,
+		SN:              token.SN,
+		RequireApproval: token.RequireApproval,
+		ExpiresAt:       token.ExpiresAt,
+		UsedAt:          token.UsedAt,
+		EnrollmentID:    token.EnrollmentID,
+		CreatedAt:       token.CreatedAt,
+	}
+}
+
+type CreateEnrollmentTokenRequest struct {
+	AppID           string `json:"appid" binding:"required"`
+	SN              string `json:"sn"`
+	RequireApproval bool   `json:"require_approval"`
+	TTLSec          int    `json:"ttl_sec"`
+}
+
+type RejectEnrollmentRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CreateToken issues a one-time enrollment token. The token is only shown
+// in this response.
+func (ec *EnrollmentController) CreateToken(c *gin.Context) {
+	var req CreateEnrollmentTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	if !canAccessApp(c, req.AppID) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "unknown appid " + req.AppID,
+		})
+		return
+	}
+
+	ttl := time.Duration(req.TTLSec) * time.Second
+	raw, token, err := ec.enrollments.CreateToken(req.AppID, req.SN, req.RequireApproval, ttl)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data": gin.H{
+			"token":      raw,
+			"token_info": newEnrollmentTokenInfo(token),
+		},
+	})
+}
+
+func (ec *EnrollmentController) ListTokens(c *gin.Context) {
+	tokens, err := ec.enrollments.ListTokens()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	infos := make([]EnrollmentTokenInfo, 0, len(tokens))
+	for _, token := range tokens {
+		if canAccessApp(c, token.AppID) {
+			infos = append(infos, newEnrollmentTokenInfo(token))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    infos,
+		"count":   len(infos),
+	})
+}
+
+func (ec *EnrollmentController) DeleteToken(c *gin.Context) {
+	if err := ec.enrollments.DeleteToken(c.Param("token_id")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, tcpserver.ErrEnrollmentTokenNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+	})
+}
+
+// List returns enrollments, filtered by ?state=pending|approved|rejected.
+func (ec *EnrollmentController) List(c *gin.Context) {
+	enrollments, err := ec.enrollments.List(c.Query("state"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	visible := []*tcpserver.Enrollment{}
+	for _, enrollment := range enrollments {
+		if canAccessApp(c, enrollment.AppID) {
+			visible = append(visible, enrollment)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    visible,
+		"count":   len(visible),
+	})
+}
+
+func (ec *EnrollmentController) Get(c *gin.Context) {
+	enrollment, err := ec.enrollments.Get(c.Param("enrollment_id"))
+	if err != nil {
+		respondEnrollmentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    enrollment,
+	})
+}
+
+func (ec *EnrollmentController) Approve(c *gin.Context) {
+	enrollment, err := ec.enrollments.Approve(c.Param("enrollment_id"))
+	if err != nil {
+		respondEnrollmentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    enrollment,
+	})
+}
+
+func (ec *EnrollmentController) Reject(c *gin.Context) {
+	var req RejectEnrollmentRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid request: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	enrollment, err := ec.enrollments.Reject(c.Param("enrollment_id"), req.Reason)
+	if err != nil {
+		respondEnrollmentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    enrollment,
+	})
+}
+
+func respondEnrollmentError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, tcpserver.ErrEnrollmentNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, tcpserver.ErrEnrollmentDecided):
+		status = http.StatusConflict
+	}
+	c.JSON(status, gin.H{
+		"success": false,
+		"error":   err.Error(),
+	})
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+var eventTypes = []string{
+	tcpserver.EventDeviceConnected,
+	tcpserver.EventDeviceAuthenticated,
+	tcpserver.EventDeviceDisconnected,
+	tcpserver.EventDeviceExpired,
+	tcpserver.EventDeviceAuthFailed,
+	tcpserver.EventCommandSent,
+	tcpserver.EventCommandAcked,
+	tcpserver.EventCommandTimeout,
+	tcpserver.EventReport,
+}
+
+type EventController struct {
+	eventBus *tcpserver.EventBus
+}
+
+func NewEventController(eventBus *tcpserver.EventBus) *EventController {
+	return &EventController{
+		eventBus: eventBus,
+	}
+}
+
+// Stream sends device, command and report events as Server-Sent Events
+// until the client goes away. ?appid= and ?sn= narrow the stream to an app
+// or device, and ?type= to a comma-separated list of event types.
+func (ec *EventController) Stream(c *gin.Context) {
+	filter := tcpserver.EventFilter{
+		AppID: appFilter(c),
+		SN:    c.Query("sn"),
+	}
+	if principal := principalFrom(c); principal != nil && !principal.AllApps() {
+		filter.AppIDs = principal.AppIDs
+	}
+	if raw := c.Query("type"); raw != "" {
+		for _, eventType := range strings.Split(raw, ",") {
+			eventType = strings.TrimSpace(eventType)
+			if !containsEventType(eventType) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"success": false,
+					"error":   "unknown event type: " + eventType,
+				})
+				return
+			}
+			filter.Types = append(filter.Types, eventType)
+		}
+	}
+
+	events, cancel := ec.eventBus.Subscribe(filter)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, &event)
+			return true
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			return true
+		}
+	})
+}
+
+func containsEventType(eventType string) bool {
+	for _, known := range eventTypes {
+		if eventType == known {
+			return true
+		}
+	}
+	return false
+}
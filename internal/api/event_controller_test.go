@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"device-agent/internal/tcpserver"
+)
+
+// nextEvent decodes the next device event streamed on events.
+func nextEvent(t *testing.T, events <-chan sseEvent) tcpserver.Event {
+	t.Helper()
+
+	var event tcpserver.Event
+	if err := json.Unmarshal([]byte(nextSSE(t, events).Data), &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// TestEventStream streams events with filters and checks a tenant only
+// sees its own apps.
+func TestEventStream(t *testing.T) {
+	gateway := newTestServer(t, false, nil)
+	// Closed after the streams, which the server waits for.
+	server := httptest.NewServer(newTestRouter(t, gateway, nil))
+	t.Cleanup(server.Close)
+
+	all := openStream(t, server, "/api/events", testViewerToken)
+	acks := openStream(t, server, "/api/events?type=command.acked&sn=s1", testViewerToken)
+	tenant := openStream(t, server, "/api/events", testTenantToken)
+
+	bus := gateway.GetEventBus()
+	bus.Publish(tcpserver.Event{Type: tcpserver.EventCommandSent, AppID: "A2", SN: "s1", CmdID: "c1"})
+	bus.Publish(tcpserver.Event{Type: tcpserver.EventCommandAcked, AppID: "A2", SN: "s2", CmdID: "c2"})
+	bus.Publish(tcpserver.Event{Type: tcpserver.EventCommandAcked, AppID: testAppID, SN: "s1", CmdID: "c3"})
+
+	for _, want := range []string{"c1", "c2", "c3"} {
+		if event := nextEvent(t, all); event.CmdID != want {
+			t.Errorf("unfiltered stream got %+v, want %s", event, want)
+		}
+	}
+	if event := nextEvent(t, acks); event.CmdID != "c3" {
+		t.Errorf("filtered stream got %+v, want c3", event)
+	}
+	if event := nextEvent(t, tenant); event.CmdID != "c3" || event.AppID != testAppID {
+		t.Errorf("tenant stream got %+v, want c3", event)
+	}
+}
+
+func TestEventStreamRejectsUnknownType(t *testing.T) {
+	router := newTestRouter(t, newTestServer(t, false, nil), nil)
+
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/events?type=device.exploded", testViewerToken, nil), http.StatusBadRequest, nil)
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/apps/A2/events", testTenantToken, nil), http.StatusNotFound, nil)
+}
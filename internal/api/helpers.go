@@ -0,0 +1,136 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+func positiveQueryInt(c *gin.Context, name string, def int) (int, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s must be a positive integer", name)
+	}
+	return n, nil
+}
+
+const deviceAppKey = "device_appid"
+
+// deviceParams returns the device named by the request path. ResolveDevice
+// must have run first.
+func deviceParams(c *gin.Context) (string, string) {
+	return c.GetString(deviceAppKey), c.Param("sn")
+}
+
+// appFilter returns the app a list is limited to: the one in the path for
+// /api/apps/:appid routes, or the ?appid= query.
+func appFilter(c *gin.Context) string {
+	if appID := c.Param("appid"); appID != "" {
+		return appID
+	}
+	return c.Query("appid")
+}
+
+// deviceApps finds the apps that have a device with a given SN, from live
+// sessions, stored records and, in a cluster, devices on other nodes.
+type deviceApps struct {
+	sessionManager *tcpserver.SessionManager
+	deviceStore    tcpserver.DeviceStore
+	cluster        *tcpserver.Cluster
+}
+
+func (d deviceApps) AppIDs(sn string) ([]string, error) {
+	seen := make(map[string]bool)
+	var appIDs []string
+	add := func(appID string) {
+		if !seen[appID] {
+			seen[appID] = true
+			appIDs = append(appIDs, appID)
+		}
+	}
+
+	for _, session := range d.sessionManager.FindBySN(sn) {
+		add(session.AppID)
+	}
+	if d.cluster != nil {
+		remote, err := d.cluster.Registry().FindBySN(sn)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range remote {
+			add(device.AppID)
+		}
+	}
+	records, err := d.deviceStore.FindBySN(sn)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		add(record.AppID)
+	}
+	sort.Strings(appIDs)
+	return appIDs, nil
+}
+
+// ResolveDevice works out which app's device :sn names. Under
+// /api/apps/:appid the path says so; on the older /api/devices/:sn routes
+// the SN must belong to exactly one app the caller can see.
+func ResolveDevice(devices deviceApps) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sn := c.Param("sn")
+		if appID := c.Param("appid"); appID != "" {
+			if !canAccessApp(c, appID) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+					"success": false,
+					"error":   "device not found",
+				})
+				return
+			}
+			c.Set(deviceAppKey, appID)
+			c.Next()
+			return
+		}
+
+		appIDs, err := devices.AppIDs(sn)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   "failed to look up device: " + err.Error(),
+			})
+			return
+		}
+
+		var visible []string
+		for _, appID := range appIDs {
+			if canAccessApp(c, appID) {
+				visible = append(visible, appID)
+			}
+		}
+
+		switch len(visible) {
+		case 0:
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   "device not found",
+			})
+		case 1:
+			c.Set(deviceAppKey, visible[0])
+			c.Next()
+		default:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   fmt.Sprintf("sn %s is used by apps %s; use /api/apps/:appid/devices/%s", sn, strings.Join(visible, ", "), sn),
+			})
+		}
+	}
+}
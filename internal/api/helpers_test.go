@@ -0,0 +1,227 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"device-agent/app/netclient"
+	"device-agent/internal/tcpserver"
+)
+
+const (
+	testAppID = "A1"
+	testKey   = "K_TEST"
+
+	testAdminToken    = "admin-token-0123456789abcdef"
+	testOperatorToken = "operator-token-0123456789abcdef"
+	testViewerToken   = "viewer-token-0123456789abcdef"
+	// testTenantToken is an operator limited to testAppID.
+	testTenantToken = "tenant-token-0123456789abcdef"
+)
+
+func newTestAuth(t *testing.T, jwt JWTConfig) *APIAuth {
+	t.Helper()
+
+	auth, err := NewAPIAuth(AuthConfig{
+		Enabled: true,
+		Tokens: []APIToken{
+			{Name: "admin", Token: testAdminToken, Role: RoleAdmin},
+			{Name: "operator", Token: testOperatorToken, Role: RoleOperator},
+			{Name: "viewer", Token: testViewerToken, Role: RoleViewer},
+			{Name: "tenant", Token: testTenantToken, Role: RoleOperator, AppIDs: []string{testAppID}},
+		},
+		JWT: jwt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+// newTestServer returns a gateway that knows apps testAppID and A2, both
+// with testKey. It is started, on a free local port, only when start is
+// set; configure may change the config first.
+func newTestServer(t *testing.T, start bool, configure func(config *tcpserver.Config)) *tcpserver.Server {
+	t.Helper()
+
+	config := &tcpserver.Config{
+		Addr:              "127.0.0.1:0",
+		HeartbeatInterval: time.Minute,
+		SessionTimeout:    time.Minute,
+		Keys:              map[string]string{testAppID: testKey, "A2": testKey},
+		TimeWindowSec:     300,
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	server := tcpserver.NewServer(config)
+	if !start {
+		return server
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("start server: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	return server
+}
+
+// newTestRouter serves the API of server to the test tokens.
+func newTestRouter(t *testing.T, server *tcpserver.Server, configure func(config *RouterConfig)) http.Handler {
+	t.Helper()
+
+	config := RouterConfig{Auth: newTestAuth(t, JWTConfig{})}
+	if configure != nil {
+		configure(&config)
+	}
+	return SetupSimpleRouter(server, config)
+}
+
+// apiRequest calls router with token as the bearer token, if any, and body
+// encoded as JSON, if any.
+func apiRequest(router http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// decodeResponse decodes a response body into v and fails the test unless
+// it has status.
+func decodeResponse(t *testing.T, recorder *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+
+	if recorder.Code != status {
+		t.Fatalf("status %d, want %d: %s", recorder.Code, status, recorder.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode response: %v: %s", err, recorder.Body.String())
+	}
+}
+
+// sseEvent is one Server-Sent Event.
+type sseEvent struct {
+	Name string
+	Data string
+}
+
+// openStream opens path on server as token and returns the events it
+// streams; the channel is closed when the stream ends. It returns once the
+// response headers have arrived.
+func openStream(t *testing.T, server *httptest.Server, path, token string) <-chan sseEvent {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "" && event.Data != "":
+				events <- event
+				event = sseEvent{}
+			case strings.HasPrefix(line, "event:"):
+				event.Name = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				event.Data = strings.TrimPrefix(line, "data:")
+			}
+		}
+	}()
+	return events
+}
+
+// nextSSE returns the next event streamed on events.
+func nextSSE(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event streamed")
+	}
+	return sseEvent{}
+}
+
+// connectTestDevice connects an agent as sn of appID to server and waits
+// until the gateway has its session. onCommand receives the commands sent
+// to it.
+func connectTestDevice(t *testing.T, server *tcpserver.Server, appID, sn string, onCommand func(client *netclient.Client, cmd *tcpserver.CommandMessage)) *netclient.Client {
+	t.Helper()
+
+	var client *netclient.Client
+	client = netclient.NewClient(&netclient.Config{
+		ServerAddr: server.Addr().String(),
+		AppID:      appID,
+		SN:         sn,
+		Key:        testKey,
+		Reconnect:  netclient.ReconnectConfig{MinMS: 50, MaxMS: 200},
+	}, func(cmd *tcpserver.CommandMessage) {
+		if onCommand != nil {
+			onCommand(client, cmd)
+		}
+	})
+	client.Start()
+	t.Cleanup(func() { client.Stop() })
+
+	waitFor(t, "device "+sn+" to connect", func() bool {
+		_, online := server.GetSessionManager().GetByDevice(appID, sn)
+		return online
+	})
+	return client
+}
+
+// ackCommands answers every command with an ok ACK.
+func ackCommands(client *netclient.Client, cmd *tcpserver.CommandMessage) {
+	client.SendACK(cmd.CmdID, "ok", "done")
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"device-agent/internal/security"
+
+	"github.com/gin-gonic/gin"
+)
+
+type KeyController struct {
+	authenticator *security.Authenticator
+}
+
+func NewKeyController(authenticator *security.Authenticator) *KeyController {
+	return &KeyController{
+		authenticator: authenticator,
+	}
+}
+
+// KeyInfo is an app key as listed by the API, without the secret.
+type KeyInfo struct {
+	AppID     string     `json:"appid"`
+	ID        string     `json:"kid"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Valid     bool       `json:"valid"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func newKeyInfo(key *security.AppKey, now time.Time) KeyInfo {
+	return KeyInfo{
+		AppID:     key.AppID,
+		ID:        key.ID,
+		NotBefore: key.NotBefore,
+		NotAfter:  key.NotAfter,
+		Valid:     key.ValidAt(now),
+		CreatedAt: key.CreatedAt,
+	}
+}
+
+type AddKeyRequest struct {
+	ID        string     `json:"kid"`
+	Key       string     `json:"key"`
+	NotBefore *time.Time `json:"not_before"`
+	NotAfter  *time.Time `json:"not_after"`
+}
+
+type RetireKeyRequest struct {
+	At *time.Time `json:"at"`
+}
+
+func (kc *KeyController) List(c *gin.Context) {
+	keys, err := kc.authenticator.AppKeys(c.Query("appid"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	now := time.Now()
+	infos := make([]KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		if canAccessApp(c, key.AppID) {
+			infos = append(infos, newKeyInfo(key, now))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    infos,
+		"count":   len(infos),
+	})
+}
+
+// Add adds a key to an existing app and returns it. The ID defaults to one
+// based on the current time and the key to a random one. Existing keys are
+// never overwritten; rotate by adding a new key and retiring the old one.
+func (kc *KeyController) Add(c *gin.Context) {
+	appID := c.Param("appid")
+	if !kc.authenticator.HasApp(appID) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "unknown appid",
+		})
+		return
+	}
+
+	var req AddKeyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid request: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	now := time.Now()
+	key := &security.AppKey{
+		AppID:     appID,
+		ID:        req.ID,
+		Key:       req.Key,
+		NotBefore: req.NotBefore,
+		NotAfter:  req.NotAfter,
+		CreatedAt: now,
+	}
+	if key.ID == "" {
+		key.ID = now.UTC().Format("20060102T150405Z")
+	}
+	if key.Key == "" {
+		generated, err := security.GenerateDeviceKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		key.Key = generated
+	}
+
+	existing, err := kc.authenticator.AppKeys(appID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+	for _, k := range existing {
+		if k.ID == key.ID {
+			c.JSON(http.StatusConflict, gin.H{
+				"success": false,
+				"error":   "key " + key.ID + " already exists",
+			})
+			return
+		}
+	}
+
+	if err := kc.authenticator.PutKey(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data": gin.H{
+			"app_key": newKeyInfo(key, now),
+			"key":     key.Key,
+		},
+	})
+}
+
+// Retire stops accepting a key, now or at the time given, so devices can
+// be moved to a newer key first.
+func (kc *KeyController) Retire(c *gin.Context) {
+	var req RetireKeyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid request: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	at := time.Now()
+	if req.At != nil {
+		at = *req.At
+	}
+
+	key, err := kc.authenticator.RetireKey(c.Param("appid"), c.Param("key_id"), at)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, security.ErrKeyNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    newKeyInfo(key, time.Now()),
+	})
+}
+
+// Delete removes a runtime key. Configured keys can only be retired.
+func (kc *KeyController) Delete(c *gin.Context) {
+	if err := kc.authenticator.DeleteKey(c.Param("appid"), c.Param("key_id")); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, security.ErrKeyNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, security.ErrKeyConfigured):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+	})
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
@@ -14,19 +15,29 @@ import (
 type MessageController struct {
 	sessionManager *tcpserver.SessionManager
 	ackWaiter      *tcpserver.ACKWaiter
+	commandQueue   *tcpserver.CommandQueue
+	commandLedger  *tcpserver.CommandLedger
+	tenants        *tcpserver.Tenants
+	cluster        *tcpserver.Cluster
 }
 
-func NewMessageController(sessionManager *tcpserver.SessionManager, ackWaiter *tcpserver.ACKWaiter) *MessageController {
+func NewMessageController(sessionManager *tcpserver.SessionManager, ackWaiter *tcpserver.ACKWaiter, commandQueue *tcpserver.CommandQueue, commandLedger *tcpserver.CommandLedger, tenants *tcpserver.Tenants, cluster *tcpserver.Cluster) *MessageController {
 	return &MessageController{
 		sessionManager: sessionManager,
 		ackWaiter:      ackWaiter,
+		commandQueue:   commandQueue,
+		commandLedger:  commandLedger,
+		tenants:        tenants,
+		cluster:        cluster,
 	}
 }
 
 type SendMessageRequest struct {
-	MsgType   string          `json:"msg_type" binding:"required"`
-	Payload   json.RawMessage `json:"payload" binding:"required"`
-	TimeoutMS int             `json:"timeout_ms"`
+	MsgType        string          `json:"msg_type" binding:"required"`
+	Payload        json.RawMessage `json:"payload" binding:"required"`
+	TimeoutMS      int             `json:"timeout_ms"`
+	QueueIfOffline bool            `json:"queue_if_offline"`
+	QueueTTLSec    int             `json:"queue_ttl_sec"`
 }
 
 type SendMessageResponse struct {
@@ -37,7 +48,7 @@ type SendMessageResponse struct {
 }
 
 func (mc *MessageController) SendToDevice(c *gin.Context) {
-	sn := c.Param("sn")
+	appID, sn := deviceParams(c)
 	if sn == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -55,15 +66,6 @@ func (mc *MessageController) SendToDevice(c *gin.Context) {
 		return
 	}
 
-	session, exists := mc.sessionManager.GetBySN(sn)
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"success": false,
-			"error":   "device offline",
-		})
-		return
-	}
-
 	cmdID := uuid.New().String()
 
 	var args map[string]interface{}
@@ -81,22 +83,40 @@ func (mc *MessageController) SendToDevice(c *gin.Context) {
 		Args:      args,
 		TimeoutMS: req.TimeoutMS,
 	}
+	auditCommand(c, cmdID, req.MsgType)
 
-	if err := session.SendCommand(cmd); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
+	if err := mc.tenants.AllowCommand(appID); err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{
 			"success": false,
-			"error":   "failed to send command: " + err.Error(),
+			"error":   err.Error(),
 		})
 		return
 	}
 
 	timeout := time.Duration(req.TimeoutMS) * time.Millisecond
 	if timeout <= 0 {
-		timeout = 5 * time.Second
+		timeout = tcpserver.DefaultCommandTimeout
+	}
+
+	session, exists := mc.sessionManager.GetByDevice(appID, sn)
+	if !exists {
+		mc.handleRemote(c, appID, sn, cmd, &req, timeout)
+		return
+	}
+
+	pending := mc.ackWaiter.Expect(cmdID)
+	if err := mc.commandLedger.SendTracked(session, cmd, requestID(c)); err != nil {
+		pending.Release()
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "failed to send command: " + err.Error(),
+		})
+		return
 	}
 
-	ack, err := mc.ackWaiter.Wait(cmdID, timeout)
+	ack, err := pending.Wait(timeout)
 	if err != nil {
+		mc.commandLedger.RecordTimeout(cmdID)
 		c.JSON(http.StatusGatewayTimeout, gin.H{
 			"success": false,
 			"error":   "ack timeout: " + err.Error(),
@@ -112,7 +132,7 @@ func (mc *MessageController) SendToDevice(c *gin.Context) {
 }
 
 func (mc *MessageController) SendAsync(c *gin.Context) {
-	sn := c.Param("sn")
+	appID, sn := deviceParams(c)
 	if sn == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -130,15 +150,6 @@ func (mc *MessageController) SendAsync(c *gin.Context) {
 		return
 	}
 
-	session, exists := mc.sessionManager.GetBySN(sn)
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{
-			"success": false,
-			"error":   "device offline",
-		})
-		return
-	}
-
 	cmdID := uuid.New().String()
 
 	var args map[string]interface{}
@@ -156,8 +167,23 @@ func (mc *MessageController) SendAsync(c *gin.Context) {
 		Args:      args,
 		TimeoutMS: req.TimeoutMS,
 	}
+	auditCommand(c, cmdID, req.MsgType)
 
-	if err := session.SendCommand(cmd); err != nil {
+	if err := mc.tenants.AllowCommand(appID); err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	session, exists := mc.sessionManager.GetByDevice(appID, sn)
+	if !exists {
+		mc.handleRemote(c, appID, sn, cmd, &req, 0)
+		return
+	}
+
+	if err := mc.commandLedger.SendTracked(session, cmd, requestID(c)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"success": false,
 			"error":   "failed to send command: " + err.Error(),
@@ -170,4 +196,93 @@ func (mc *MessageController) SendAsync(c *gin.Context) {
 		"cmd_id":  cmdID,
 		"message": "command sent",
 	})
-}
\ No newline at end of file
+}
+
+// handleRemote forwards a command for a device that is not connected here
+// to the cluster node it is connected to, waiting up to wait for its ACK.
+// That node sends the ACK back here, so the command can be followed on this
+// node like a local one. Devices no node has are offline.
+func (mc *MessageController) handleRemote(c *gin.Context, appID, sn string, cmd *tcpserver.CommandMessage, req *SendMessageRequest, wait time.Duration) {
+	owner, err := mc.cluster.Owner(appID, sn)
+	if err != nil {
+		mc.handleOffline(c, appID, sn, cmd, req)
+		return
+	}
+
+	var pending *tcpserver.PendingACK
+	if wait > 0 {
+		pending = mc.ackWaiter.Expect(cmd.CmdID)
+	}
+	err = mc.cluster.Forward(owner, appID, sn, cmd, requestID(c))
+	if err != nil && pending != nil {
+		pending.Release()
+	}
+	switch {
+	case errors.Is(err, tcpserver.ErrDeviceOffline):
+		mc.handleOffline(c, appID, sn, cmd, req)
+		return
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{
+			"success": false,
+			"error":   "failed to forward command: " + err.Error(),
+			"node":    owner.ID,
+		})
+		return
+	case pending == nil:
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"cmd_id":  cmd.CmdID,
+			"message": "command sent",
+			"node":    owner.ID,
+		})
+		return
+	}
+
+	ack, err := pending.Wait(wait)
+	if err != nil {
+		mc.commandLedger.RecordTimeout(cmd.CmdID)
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"success": false,
+			"error":   "ack timeout: " + err.Error(),
+			"node":    owner.ID,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"cmd_id":  cmd.CmdID,
+		"ack":     ack,
+		"node":    owner.ID,
+	})
+}
+
+func (mc *MessageController) handleOffline(c *gin.Context, appID, sn string, cmd *tcpserver.CommandMessage, req *SendMessageRequest) {
+	if !req.QueueIfOffline {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "device offline",
+		})
+		return
+	}
+
+	ttl := time.Duration(req.QueueTTLSec) * time.Second
+	queued, err := mc.commandQueue.Enqueue(appID, sn, cmd, requestID(c), ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "failed to queue command: " + err.Error(),
+		})
+		return
+	}
+	mc.cluster.MarkQueued(appID, sn)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success":    true,
+		"cmd_id":     cmd.CmdID,
+		"queued":     true,
+		"state":      queued.State,
+		"expires_at": queued.ExpiresAt,
+		"message":    "device offline, command queued",
+	})
+}
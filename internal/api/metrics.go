@@ -0,0 +1,45 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// HTTPMetrics counts API requests and their latency by route, registering
+// its metrics with registerer.
+func HTTPMetrics(registerer prometheus.Registerer) gin.HandlerFunc {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "http_requests_total",
+		Help:      "HTTP API requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gateway",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP API request latency by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	registerer.MustRegister(requests, duration)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Unmatched paths share one label so scanners cannot grow the series.
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		requests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		duration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Metrics serves the metrics in gatherer in the Prometheus text format.
+func Metrics(gatherer prometheus.Gatherer) gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
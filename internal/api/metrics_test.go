@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"device-agent/internal/tcpserver"
+)
+
+func newMetricsRouter(t *testing.T, public bool) (*tcpserver.Server, http.Handler) {
+	t.Helper()
+
+	server := newTestServer(t, false, nil)
+	return server, newTestRouter(t, server, func(config *RouterConfig) {
+		config.PublicMetrics = public
+	})
+}
+
+func scrape(router http.Handler, token string) *httptest.ResponseRecorder {
+	return apiRequest(router, http.MethodGet, "/metrics", token, nil)
+}
+
+func TestMetricsOutput(t *testing.T) {
+	server, router := newMetricsRouter(t, false)
+
+	ledger := server.GetCommandLedger()
+	ledger.RecordSent("A1", "s1", &tcpserver.CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB"}, "")
+	ledger.RecordSent("A1", "s1", &tcpserver.CommandMessage{CmdID: "c2", Cmd: "OPEN_WEB"}, "")
+	ledger.RecordACK(&tcpserver.ACKMessage{CmdID: "c1", Status: "ok"})
+	ledger.ExpireOverdue(time.Now().Add(tcpserver.DefaultCommandTimeout))
+
+	if code := scrape(router, "").Code; code != http.StatusUnauthorized {
+		t.Errorf("anonymous scrape: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := scrape(router, testViewerToken).Code; code != http.StatusForbidden {
+		t.Errorf("viewer scrape: status %d, want %d", code, http.StatusForbidden)
+	}
+
+	recorder := scrape(router, testAdminToken)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("admin scrape: status %d", recorder.Code)
+	}
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"gateway_commands_sent_total 2",
+		"gateway_ack_latency_seconds_count 1",
+		"gateway_ack_timeouts_total 1",
+		`gateway_http_requests_total{code="401",method="GET",route="/metrics"} 1`,
+		`gateway_http_requests_total{code="403",method="GET",route="/metrics"} 1`,
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+}
+
+func TestPublicMetrics(t *testing.T) {
+	_, router := newMetricsRouter(t, true)
+
+	recorder := scrape(router, "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("anonymous scrape: status %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if !strings.Contains(recorder.Body.String(), "gateway_commands_sent_total 0") {
+		t.Error("metrics lack gateway_commands_sent_total")
+	}
+}
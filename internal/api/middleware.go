@@ -1,13 +1,19 @@
 package api
 
 import (
-	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
 	"time"
 
+	"device-agent/internal/logging"
+
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
+const requestIDKey = "request_id"
+
 func RequestID() gin.HandlerFunc {
 	return gin.HandlerFunc(func(c *gin.Context) {
 		requestID := c.GetHeader("X-Request-ID")
@@ -15,30 +21,79 @@ func RequestID() gin.HandlerFunc {
 			requestID = uuid.New().String()
 		}
 		c.Header("X-Request-ID", requestID)
-		c.Set("request_id", requestID)
+		c.Set(requestIDKey, requestID)
 		c.Next()
 	})
 }
 
-func AccessLog() gin.HandlerFunc {
-	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
-			param.ClientIP,
-			param.TimeStamp.Format(time.RFC1123),
-			param.Method,
-			param.Path,
-			param.Request.Proto,
-			param.StatusCode,
-			param.Latency,
-			param.Request.UserAgent(),
-			param.ErrorMessage,
-		)
-	})
+// requestID returns the ID RequestID gave the request.
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// AccessLog logs every request once it has been handled, with its request
+// ID and, for requests that send a command, the command ID.
+func AccessLog(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		if c.Request.URL.RawQuery != "" {
+			path += "?" + c.Request.URL.RawQuery
+		}
+
+		c.Next()
+
+		attrs := []any{
+			logging.KeyRequestID, requestID(c),
+			"method", c.Request.Method,
+			"path", redactPath(path),
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+			"client_ip", c.ClientIP(),
+			"user_agent", c.Request.UserAgent(),
+		}
+		if cmdID := c.GetString(auditCmdIDKey); cmdID != "" {
+			attrs = append(attrs, logging.KeyCmdID, cmdID)
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "error", c.Errors.String())
+		}
+		logger.Info("HTTP request", attrs...)
+	}
 }
 
-func CORS() gin.HandlerFunc {
+// redactPath hides access tokens passed in the query string.
+func redactPath(path string) string {
+	base, rawQuery, found := strings.Cut(path, "?")
+	if !found || !strings.Contains(rawQuery, "access_token=") {
+		return path
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return base
+	}
+	query.Set("access_token", "REDACTED")
+	return base + "?" + query.Encode()
+}
+
+// CORS lets browsers on the given origins call the API. With no origins
+// every origin is allowed.
+func CORS(origins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
+		if len(allowed) == 0 {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Vary", "Origin")
+			if origin := c.GetHeader("Origin"); allowed[origin] {
+				c.Header("Access-Control-Allow-Origin", origin)
+			}
+		}
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
 
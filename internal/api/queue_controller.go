@@ -0,0 +1,76 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type QueueController struct {
+	commandQueue *tcpserver.CommandQueue
+}
+
+func NewQueueController(commandQueue *tcpserver.CommandQueue) *QueueController {
+	return &QueueController{
+		commandQueue: commandQueue,
+	}
+}
+
+func (qc *QueueController) List(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	if sn == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "sn parameter is required",
+		})
+		return
+	}
+
+	commands := qc.commandQueue.List(appID, sn, tcpserver.QueueState(c.Query("state")))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    commands,
+		"count":   len(commands),
+	})
+}
+
+func (qc *QueueController) Cancel(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	cmdID := c.Param("cmd_id")
+	if sn == "" || cmdID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "sn and cmd_id parameters are required",
+		})
+		return
+	}
+
+	queued, err := qc.commandQueue.Cancel(appID, sn, cmdID)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    queued,
+		})
+	case errors.Is(err, tcpserver.ErrQueuedCommandNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+	case errors.Is(err, tcpserver.ErrQueuedCommandFinished):
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   err.Error(),
+			"data":    queued,
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "failed to cancel command: " + err.Error(),
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReportController struct {
+	reportStore *tcpserver.ReportStore
+}
+
+func NewReportController(reportStore *tcpserver.ReportStore) *ReportController {
+	return &ReportController{
+		reportStore: reportStore,
+	}
+}
+
+func (rc *ReportController) ListRecent(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	if sn == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "sn parameter is required",
+		})
+		return
+	}
+
+	limit, err := positiveQueryInt(c, "limit", 50)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	reports := rc.reportStore.Recent(appID, sn, limit, c.Query("kind"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    reports,
+		"count":   len(reports),
+	})
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"device-agent/internal/tcpserver"
+)
+
+// TestListReports sends reports from an agent and reads them back through
+// the API.
+func TestListReports(t *testing.T) {
+	server := newTestServer(t, true, nil)
+	router := newTestRouter(t, server, nil)
+	client := connectTestDevice(t, server, testAppID, "s1", nil)
+
+	for _, kind := range []string{"status", "telemetry", "status"} {
+		if err := client.SendReport(kind, map[string]interface{}{"kind": kind}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "reports", func() bool {
+		return len(server.GetReportStore().Recent(testAppID, "s1", 0, "")) == 3
+	})
+
+	var resp struct {
+		Data  []tcpserver.Report `json:"data"`
+		Count int                `json:"count"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/s1/reports?kind=status&limit=1", testViewerToken, nil), http.StatusOK, &resp)
+	if resp.Count != 1 || resp.Data[0].Kind != "status" || resp.Data[0].SN != "s1" || resp.Data[0].AppID != testAppID {
+		t.Errorf("reports %+v", resp)
+	}
+
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/s1/reports", testViewerToken, nil), http.StatusOK, &resp)
+	if resp.Count != 3 {
+		t.Errorf("%d reports, want 3", resp.Count)
+	}
+
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/s1/reports?limit=-1", testViewerToken, nil), http.StatusBadRequest, nil)
+}
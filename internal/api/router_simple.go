@@ -1,32 +1,211 @@
 package api
 
 import (
+	"log/slog"
 	"time"
 
+	"device-agent/internal/logging"
 	"device-agent/internal/tcpserver"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupSimpleRouter(sessionManager *tcpserver.SessionManager, ackWaiter *tcpserver.ACKWaiter) *gin.Engine {
+// RouterConfig controls who may use the management API.
+type RouterConfig struct {
+	// Auth verifies callers; nil leaves the API open to anyone.
+	Auth *APIAuth
+	// CORSOrigins lists the origins browsers may call the API from. Empty
+	// allows any origin.
+	CORSOrigins []string
+	// PublicMetrics serves /metrics without authentication. Off by default,
+	// since the metrics name every AppID; scrapers then need an admin token.
+	PublicMetrics bool
+	// Logger receives the access log; nil uses slog.Default().
+	Logger *slog.Logger
+}
+
+func SetupSimpleRouter(server *tcpserver.Server, config RouterConfig) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 
 	r := gin.New()
-	r.Use(gin.Recovery(), RequestID(), AccessLog(), CORS())
+	logger := logging.Or(config.Logger)
+	registry := server.GetMetrics().Registry()
+	r.Use(gin.Recovery(), RequestID(), AccessLog(logger), HTTPMetrics(registry), CORS(config.CORSOrigins))
+
+	sessionManager := server.GetSessionManager()
+
+	deviceCtl := NewDeviceController(sessionManager, server.GetDeviceStore())
+	msgCtl := NewMessageController(sessionManager, server.GetACKWaiter(), server.GetCommandQueue(), server.GetCommandLedger(), server.GetTenants(), server.GetCluster())
+	reportCtl := NewReportController(server.GetReportStore())
+	queueCtl := NewQueueController(server.GetCommandQueue())
+	commandCtl := NewCommandController(server.GetCommandLedger(), server.GetProgressHub())
+	broadcastCtl := NewBroadcastController(sessionManager, server.GetDeviceStore(), server.GetACKWaiter(), server.GetCommandLedger(), server.GetTenants(), server.GetCluster())
+	transferCtl := NewTransferController(sessionManager, server.GetTransferManager())
+	uploadCtl := NewUploadController(sessionManager, server.GetUploadManager())
+	credentialCtl := NewCredentialController(sessionManager, server.GetAuthenticator(), server.GetCredentialStore())
+	keyCtl := NewKeyController(server.GetAuthenticator())
+	enrollmentCtl := NewEnrollmentController(server.GetEnrollmentManager())
+	blocklistCtl := NewBlocklistController(sessionManager, server.GetBlocklist())
+	tenantCtl := NewTenantController(sessionManager, server.GetAuthenticator(), server.GetTenants())
+	auditCtl := NewAuditController(server.GetAuditLog())
+	eventCtl := NewEventController(server.GetEventBus())
+	webhookCtl := NewWebhookController(server.GetWebhooks())
+	clusterCtl := NewClusterController(server.GetCluster())
+
+	operator := RequireRole(RoleOperator)
+	admin := RequireRole(RoleAdmin)
 
-	deviceCtl := NewDeviceController(sessionManager)
-	msgCtl := NewMessageController(sessionManager, ackWaiter)
+	// Resources named in the path are checked against the caller's apps.
+	resolveDevice := ResolveDevice(deviceApps{sessionManager: sessionManager, deviceStore: server.GetDeviceStore(), cluster: server.GetCluster()})
+	commandApp := RequireApp("command", func(c *gin.Context) (string, bool) {
+		record, ok := server.GetCommandLedger().Get(c.Param("cmd_id"))
+		if !ok {
+			return "", false
+		}
+		return record.AppID, true
+	})
+	transferApp := RequireApp("transfer", func(c *gin.Context) (string, bool) {
+		transfer, err := server.GetTransferManager().Get(c.Param("transfer_id"))
+		if err != nil {
+			return "", false
+		}
+		return transfer.AppID, true
+	})
+	pathApp := RequireApp("app", func(c *gin.Context) (string, bool) {
+		return c.Param("appid"), true
+	})
+	tokenApp := RequireApp("enrollment token", func(c *gin.Context) (string, bool) {
+		token, err := server.GetEnrollmentManager().GetToken(c.Param("token_id"))
+		if err != nil {
+			return "", false
+		}
+		return token.AppID, true
+	})
+	enrollmentApp := RequireApp("enrollment", func(c *gin.Context) (string, bool) {
+		enrollment, err := server.GetEnrollmentManager().Get(c.Param("enrollment_id"))
+		if err != nil {
+			return "", false
+		}
+		return enrollment.AppID, true
+	})
 
-	api := r.Group("/api")
+	// Device routes are served both per app, under /api/apps/:appid, and
+	// under /api/devices for SNs that only one app uses.
+	deviceRoutes := func(device *gin.RouterGroup) {
+		device.GET("", deviceCtl.GetDetail)
+		device.GET("/reports", reportCtl.ListRecent)
+		device.POST("/send", operator, msgCtl.SendToDevice)
+		device.POST("/send-async", operator, msgCtl.SendAsync)
+		device.GET("/queue", queueCtl.List)
+		device.DELETE("/queue/:cmd_id", operator, queueCtl.Cancel)
+		device.GET("/commands", commandCtl.ListByDevice)
+		device.POST("/files", operator, transferCtl.Upload)
+		device.GET("/files", transferCtl.ListByDevice)
+		device.POST("/uploads", operator, uploadCtl.Request)
+		device.GET("/uploads", uploadCtl.ListByDevice)
+		device.GET("/uploads/:upload_id", uploadCtl.Get)
+		device.POST("/disconnect", operator, deviceCtl.Disconnect)
+	}
+
+	api := r.Group("/api", Authenticate(config.Auth), Audit(server.GetAuditLog(), logger))
 	{
+		api.GET("/auth/whoami", Whoami)
+		api.GET("/events", eventCtl.Stream)
+
+		tenant := api.Group("/apps/:appid", pathApp)
+		{
+			tenant.GET("", tenantCtl.Get)
+			tenant.GET("/events", eventCtl.Stream)
+			tenant.GET("/devices", deviceCtl.List)
+			tenant.GET("/devices/online", deviceCtl.ListOnline)
+			tenant.GET("/devices/offline", deviceCtl.ListOffline)
+			tenant.POST("/commands/broadcast", operator, broadcastCtl.Broadcast)
+			deviceRoutes(tenant.Group("/devices/:sn", resolveDevice))
+		}
+
 		devices := api.Group("/devices")
 		{
+			devices.GET("", deviceCtl.List)
 			devices.GET("/online", deviceCtl.ListOnline)
 			devices.GET("/offline", deviceCtl.ListOffline)
-			devices.GET("/:sn", deviceCtl.GetDetail)
-			devices.POST("/:sn/send", msgCtl.SendToDevice)
-			devices.POST("/:sn/send-async", msgCtl.SendAsync)
+			deviceRoutes(devices.Group("/:sn", resolveDevice))
+		}
+
+		commands := api.Group("/commands")
+		{
+			commands.POST("/broadcast", operator, broadcastCtl.Broadcast)
+			commands.GET("/:cmd_id", commandApp, commandCtl.Get)
+			commands.GET("/:cmd_id/events", commandApp, commandCtl.StreamEvents)
+		}
+
+		transfers := api.Group("/transfers")
+		{
+			transfers.GET("/:transfer_id", transferApp, transferCtl.Get)
 		}
+
+		credentials := api.Group("/credentials", admin)
+		{
+			credentials.GET("", credentialCtl.List)
+			credentials.POST("/:appid/:sn", pathApp, credentialCtl.Issue)
+			credentials.DELETE("/:appid/:sn", pathApp, credentialCtl.Delete)
+			credentials.POST("/:appid/:sn/revoke", pathApp, credentialCtl.Revoke)
+			credentials.DELETE("/:appid/:sn/revoke", pathApp, credentialCtl.Reinstate)
+		}
+
+		keys := api.Group("/keys", admin)
+		{
+			keys.GET("", keyCtl.List)
+			keys.POST("/:appid", pathApp, keyCtl.Add)
+			keys.POST("/:appid/:key_id/retire", pathApp, keyCtl.Retire)
+			keys.DELETE("/:appid/:key_id", pathApp, keyCtl.Delete)
+		}
+
+		enrollmentTokens := api.Group("/enrollment-tokens", admin)
+		{
+			enrollmentTokens.POST("", enrollmentCtl.CreateToken)
+			enrollmentTokens.GET("", enrollmentCtl.ListTokens)
+			enrollmentTokens.DELETE("/:token_id", tokenApp, enrollmentCtl.DeleteToken)
+		}
+
+		enrollments := api.Group("/enrollments", admin)
+		{
+			enrollments.GET("", enrollmentCtl.List)
+			enrollments.GET("/:enrollment_id", enrollmentApp, enrollmentCtl.Get)
+			enrollments.POST("/:enrollment_id/approve", enrollmentApp, enrollmentCtl.Approve)
+			enrollments.POST("/:enrollment_id/reject", enrollmentApp, enrollmentCtl.Reject)
+		}
+
+		blocklist := api.Group("/blocklist", admin)
+		{
+			blocklist.GET("", blocklistCtl.List)
+			blocklist.POST("", blocklistCtl.Add)
+			blocklist.DELETE("/:rule_id", blocklistCtl.Remove)
+		}
+
+		webhooks := api.Group("/webhooks", admin)
+		{
+			webhooks.GET("", webhookCtl.List)
+			webhooks.POST("", webhookCtl.Add)
+			webhooks.GET("/dead-letters", webhookCtl.ListDeadLetters)
+			webhooks.POST("/dead-letters/:delivery_id/retry", webhookCtl.RetryDeadLetter)
+			webhooks.GET("/:webhook_id", webhookCtl.Get)
+			webhooks.DELETE("/:webhook_id", webhookCtl.Remove)
+			webhooks.POST("/:webhook_id/test", webhookCtl.Test)
+		}
+
+		api.GET("/cluster/nodes", admin, clusterCtl.ListNodes)
+
+		audit := api.Group("/audit", admin)
+		{
+			audit.GET("", auditCtl.List)
+			audit.GET("/export", auditCtl.Export)
+		}
+	}
+
+	if config.PublicMetrics {
+		r.GET("/metrics", Metrics(registry))
+	} else {
+		r.GET("/metrics", Authenticate(config.Auth), admin, Metrics(registry))
 	}
 
 	r.GET("/health", func(c *gin.Context) {
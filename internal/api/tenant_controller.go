@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+
+	"device-agent/internal/security"
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TenantController struct {
+	sessionManager *tcpserver.SessionManager
+	authenticator  *security.Authenticator
+	tenants        *tcpserver.Tenants
+}
+
+func NewTenantController(sessionManager *tcpserver.SessionManager, authenticator *security.Authenticator, tenants *tcpserver.Tenants) *TenantController {
+	return &TenantController{
+		sessionManager: sessionManager,
+		authenticator:  authenticator,
+		tenants:        tenants,
+	}
+}
+
+type TenantInfo struct {
+	AppID          string  `json:"appid"`
+	Online         int     `json:"online"`
+	MaxConnections int     `json:"max_connections"`
+	CommandRate    float64 `json:"command_rate"`
+	CommandBurst   int     `json:"command_burst"`
+}
+
+// Get returns an app's quotas and how many of its devices are online.
+func (tc *TenantController) Get(c *gin.Context) {
+	appID := c.Param("appid")
+	if !tc.authenticator.HasApp(appID) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "unknown appid",
+		})
+		return
+	}
+
+	config := tc.tenants.Config(appID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": TenantInfo{
+			AppID:          appID,
+			Online:         tc.sessionManager.CountByApp(appID),
+			MaxConnections: config.MaxConnections,
+			CommandRate:    config.CommandRate,
+			CommandBurst:   config.CommandBurst,
+		},
+	})
+}
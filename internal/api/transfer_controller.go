@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TransferController struct {
+	sessionManager *tcpserver.SessionManager
+	transfers      *tcpserver.TransferManager
+}
+
+func NewTransferController(sessionManager *tcpserver.SessionManager, transfers *tcpserver.TransferManager) *TransferController {
+	return &TransferController{
+		sessionManager: sessionManager,
+		transfers:      transfers,
+	}
+}
+
+// Upload streams a multipart "file" field to disk and pushes it to the
+// device. The destination name defaults to the uploaded file name and can
+// be overridden with ?name=. Offline devices receive the file when they
+// reconnect.
+func (tc *TransferController) Upload(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	if sn == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "sn parameter is required",
+		})
+		return
+	}
+
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "multipart form required: " + err.Error(),
+		})
+		return
+	}
+
+	var transfer *tcpserver.Transfer
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "invalid multipart body: " + err.Error(),
+			})
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		name := c.DefaultQuery("name", part.FileName())
+		transfer, err = tc.transfers.Create(appID, sn, name, part)
+		part.Close()
+		switch {
+		case errors.Is(err, tcpserver.ErrTransferTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		case err != nil:
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"error":   "failed to store file: " + err.Error(),
+			})
+			return
+		}
+		break
+	}
+
+	if transfer == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "file field is required",
+		})
+		return
+	}
+
+	// A failed begin leaves the transfer pending until the device reconnects.
+	if session, online := tc.sessionManager.GetByDevice(appID, sn); online {
+		tc.transfers.Begin(session, transfer.ID)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"data":    transfer,
+	})
+}
+
+func (tc *TransferController) ListByDevice(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	if sn == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "sn parameter is required",
+		})
+		return
+	}
+
+	transfers := tc.transfers.ListByDevice(appID, sn)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    transfers,
+		"count":   len(transfers),
+	})
+}
+
+func (tc *TransferController) Get(c *gin.Context) {
+	transfer, err := tc.transfers.Get(c.Param("transfer_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    transfer,
+	})
+}
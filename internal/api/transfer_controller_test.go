@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"device-agent/app/netclient"
+	"device-agent/internal/tcpserver"
+)
+
+// uploadFile posts content as the multipart file field to path.
+func uploadFile(router http.Handler, path, token, filename, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write([]byte(content))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestUploadFile pushes a file through the API to a connected agent and
+// checks it lands in the agent's file directory.
+func TestUploadFile(t *testing.T) {
+	server := newTestServer(t, true, func(config *tcpserver.Config) {
+		config.TransferDir = t.TempDir()
+		config.TransferChunkSize = 4
+	})
+	router := newTestRouter(t, server, nil)
+
+	fileDir := t.TempDir()
+	client := netclient.NewClient(&netclient.Config{
+		ServerAddr: server.Addr().String(),
+		AppID:      testAppID,
+		SN:         "s1",
+		Key:        testKey,
+		FileDir:    fileDir,
+	}, nil)
+	client.Start()
+	t.Cleanup(func() { client.Stop() })
+	waitFor(t, "device to connect", func() bool {
+		_, online := server.GetSessionManager().GetByDevice(testAppID, "s1")
+		return online
+	})
+
+	var created struct {
+		Data tcpserver.Transfer `json:"data"`
+	}
+	rec := uploadFile(router, "/api/devices/s1/files?name=docs/readme.txt", testOperatorToken, "upload.txt", "hello, device")
+	decodeResponse(t, rec, http.StatusAccepted, &created)
+	if created.Data.Name != "docs/readme.txt" || created.Data.Size != 13 {
+		t.Fatalf("created %+v", created.Data)
+	}
+
+	var got struct {
+		Data tcpserver.Transfer `json:"data"`
+	}
+	waitFor(t, "transfer to finish", func() bool {
+		decodeResponse(t, apiRequest(router, http.MethodGet, "/api/transfers/"+created.Data.ID, testViewerToken, nil), http.StatusOK, &got)
+		return got.Data.State == tcpserver.TransferStateDone
+	})
+	if data, err := os.ReadFile(filepath.Join(fileDir, "docs", "readme.txt")); err != nil || string(data) != "hello, device" {
+		t.Errorf("agent stored %q, %v", data, err)
+	}
+
+	var list struct {
+		Count int `json:"count"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/s1/files", testViewerToken, nil), http.StatusOK, &list)
+	if list.Count != 1 {
+		t.Errorf("%d transfers listed, want 1", list.Count)
+	}
+}
+
+func TestUploadFileRejected(t *testing.T) {
+	server := newTestServer(t, false, func(config *tcpserver.Config) {
+		config.TransferDir = t.TempDir()
+	})
+	router := newTestRouter(t, server, nil)
+
+	decodeResponse(t, uploadFile(router, "/api/apps/A1/devices/s1/files", testViewerToken, "a.txt", "data"), http.StatusForbidden, nil)
+	decodeResponse(t, uploadFile(router, "/api/apps/A1/devices/s1/files?name=../a.txt", testOperatorToken, "a.txt", "data"), http.StatusBadRequest, nil)
+
+	// Offline devices get the file when they connect; other tenants
+	// cannot see it.
+	var created struct {
+		Data tcpserver.Transfer `json:"data"`
+	}
+	decodeResponse(t, uploadFile(router, "/api/apps/A2/devices/s1/files", testOperatorToken, "a.txt", "data"), http.StatusAccepted, &created)
+	if created.Data.State != tcpserver.TransferStatePending {
+		t.Errorf("transfer to an offline device: %+v", created.Data)
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/transfers/"+created.Data.ID, testTenantToken, nil), http.StatusNotFound, nil)
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/transfers/"+created.Data.ID, testViewerToken, nil), http.StatusOK, nil)
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"net/http"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UploadController struct {
+	sessionManager *tcpserver.SessionManager
+	uploads        *tcpserver.UploadManager
+}
+
+func NewUploadController(sessionManager *tcpserver.SessionManager, uploads *tcpserver.UploadManager) *UploadController {
+	return &UploadController{
+		sessionManager: sessionManager,
+		uploads:        uploads,
+	}
+}
+
+type UploadRequest struct {
+	Path string `json:"path" binding:"required"`
+}
+
+// Request asks an online device to upload a file. The device only serves
+// paths on its own allow-list.
+func (uc *UploadController) Request(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	if sn == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "sn parameter is required",
+		})
+		return
+	}
+
+	var req UploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	session, exists := uc.sessionManager.GetByDevice(appID, sn)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   "device offline",
+		})
+		return
+	}
+
+	upload, err := uc.uploads.Request(session, req.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   "failed to send upload request: " + err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"data":    upload,
+	})
+}
+
+func (uc *UploadController) ListByDevice(c *gin.Context) {
+	uploads := uc.uploads.ListByDevice(deviceParams(c))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    uploads,
+		"count":   len(uploads),
+	})
+}
+
+// Get serves the uploaded file once it is complete. Until then it returns
+// the upload's state: 202 while in progress and 409 if it failed.
+func (uc *UploadController) Get(c *gin.Context) {
+	appID, sn := deviceParams(c)
+	id := c.Param("upload_id")
+
+	upload, err := uc.uploads.Get(appID, sn, id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	switch upload.State {
+	case tcpserver.UploadStateDone:
+		path, err := uc.uploads.ContentPath(appID, sn, id)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.FileAttachment(path, upload.Name)
+	case tcpserver.UploadStateFailed:
+		c.JSON(http.StatusConflict, gin.H{
+			"success": false,
+			"error":   upload.Error,
+			"data":    upload,
+		})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{
+			"success": true,
+			"data":    upload,
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"device-agent/app/netclient"
+	"device-agent/internal/tcpserver"
+)
+
+// TestRequestUpload pulls an allow-listed file from an agent through the
+// API and checks a path outside the allow-list is refused.
+func TestRequestUpload(t *testing.T) {
+	server := newTestServer(t, true, func(config *tcpserver.Config) {
+		config.UploadDir = t.TempDir()
+	})
+	router := newTestRouter(t, server, nil)
+
+	logDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(logDir, "agent.log"), []byte("started\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := netclient.NewClient(&netclient.Config{
+		ServerAddr:  server.Addr().String(),
+		AppID:       testAppID,
+		SN:          "s1",
+		Key:         testKey,
+		UploadPaths: []string{logDir},
+	}, nil)
+	client.Start()
+	t.Cleanup(func() { client.Stop() })
+	waitFor(t, "device to connect", func() bool {
+		_, online := server.GetSessionManager().GetByDevice(testAppID, "s1")
+		return online
+	})
+
+	var created struct {
+		Data tcpserver.Upload `json:"data"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/devices/s1/uploads", testOperatorToken, UploadRequest{Path: filepath.Join(logDir, "agent.log")}), http.StatusAccepted, &created)
+
+	path := "/api/devices/s1/uploads/" + created.Data.ID
+	waitFor(t, "upload to finish", func() bool {
+		return apiRequest(router, http.MethodGet, path, testViewerToken, nil).Code == http.StatusOK
+	})
+	rec := apiRequest(router, http.MethodGet, path, testViewerToken, nil)
+	if rec.Body.String() != "started\n" {
+		t.Errorf("downloaded %q", rec.Body.String())
+	}
+
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/devices/s1/uploads", testOperatorToken, UploadRequest{Path: "/etc/passwd"}), http.StatusAccepted, &created)
+	path = "/api/devices/s1/uploads/" + created.Data.ID
+	waitFor(t, "upload to be refused", func() bool {
+		return apiRequest(router, http.MethodGet, path, testViewerToken, nil).Code == http.StatusConflict
+	})
+
+	var list struct {
+		Count int `json:"count"`
+	}
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/devices/s1/uploads", testViewerToken, nil), http.StatusOK, &list)
+	if list.Count != 2 {
+		t.Errorf("%d uploads listed, want 2", list.Count)
+	}
+
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/devices/s1/uploads", testViewerToken, UploadRequest{Path: "/etc/passwd"}), http.StatusForbidden, nil)
+	decodeResponse(t, apiRequest(router, http.MethodPost, "/api/apps/A2/devices/s1/uploads", testOperatorToken, UploadRequest{Path: "/etc/passwd"}), http.StatusNotFound, nil)
+	decodeResponse(t, apiRequest(router, http.MethodGet, "/api/apps/A2/devices/s1/uploads/"+created.Data.ID, testViewerToken, nil), http.StatusNotFound, nil)
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"device-agent/internal/tcpserver"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookController struct {
+	webhooks *tcpserver.Webhooks
+}
+
+func NewWebhookController(webhooks *tcpserver.Webhooks) *WebhookController {
+	return &WebhookController{
+		webhooks: webhooks,
+	}
+}
+
+type AddWebhookRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+	AppIDs []string `json:"appids"`
+	Secret string   `json:"secret"`
+}
+
+// List returns the webhooks the caller may manage, without their secrets.
+func (wc *WebhookController) List(c *gin.Context) {
+	hooks, err := wc.webhooks.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	principal := principalFrom(c)
+	visible := []*tcpserver.Webhook{}
+	for _, hook := range hooks {
+		if webhookInScope(principal, hook) {
+			hook.Secret = ""
+			visible = append(visible, hook)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    visible,
+		"count":   len(visible),
+	})
+}
+
+// Add subscribes a URL to events, all webhook events by default, of the
+// apps in appids, or every app. The response is the only time the signing
+// secret is shown; one is generated when none is given.
+func (wc *WebhookController) Add(c *gin.Context) {
+	var req AddWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   "invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	hook := &tcpserver.Webhook{
+		URL:    req.URL,
+		Events: req.Events,
+		AppIDs: req.AppIDs,
+		Secret: req.Secret,
+	}
+
+	principal := principalFrom(c)
+	if len(hook.AppIDs) == 0 && principal != nil && !principal.AllApps() {
+		hook.AppIDs = principal.AppIDs
+	}
+	if !webhookInScope(principal, hook) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"success": false,
+			"error":   "not permitted to subscribe to these apps",
+		})
+		return
+	}
+
+	hook, err := wc.webhooks.Add(hook)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"success": true,
+		"data":    hook,
+	})
+}
+
+func (wc *WebhookController) Get(c *gin.Context) {
+	hook, err := wc.lookup(c)
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+
+	hook.Secret = ""
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    hook,
+	})
+}
+
+func (wc *WebhookController) Remove(c *gin.Context) {
+	hook, err := wc.lookup(c)
+	if err == nil {
+		err = wc.webhooks.Remove(hook.ID)
+	}
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+	})
+}
+
+// Test sends a webhook.test event to the webhook once and reports how the
+// receiver answered.
+func (wc *WebhookController) Test(c *gin.Context) {
+	hook, err := wc.lookup(c)
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+
+	delivery, err := wc.webhooks.Test(hook.ID)
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+	if delivery.Error != "" {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"success": false,
+			"error":   "webhook call failed: " + delivery.Error,
+			"data":    delivery,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    delivery,
+	})
+}
+
+// ListDeadLetters returns the calls that ran out of retries, newest first.
+func (wc *WebhookController) ListDeadLetters(c *gin.Context) {
+	visible := wc.visibleDeadLetters(c)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    visible,
+		"count":   len(visible),
+	})
+}
+
+// RetryDeadLetter starts a dead-lettered call over.
+func (wc *WebhookController) RetryDeadLetter(c *gin.Context) {
+	deliveryID := c.Param("delivery_id")
+
+	var err error = tcpserver.ErrDeadLetterNotFound
+	for _, delivery := range wc.visibleDeadLetters(c) {
+		if delivery.ID == deliveryID {
+			err = nil
+			break
+		}
+	}
+
+	var delivery *tcpserver.WebhookDelivery
+	if err == nil {
+		delivery, err = wc.webhooks.RetryDeadLetter(deliveryID)
+	}
+	if err != nil {
+		webhookError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success": true,
+		"data":    delivery,
+	})
+}
+
+// lookup returns the webhook named in the path, reporting webhooks the
+// caller may not manage as not found.
+func (wc *WebhookController) lookup(c *gin.Context) (*tcpserver.Webhook, error) {
+	hook, err := wc.webhooks.Get(c.Param("webhook_id"))
+	if err != nil {
+		return nil, err
+	}
+	if !webhookInScope(principalFrom(c), hook) {
+		return nil, tcpserver.ErrWebhookNotFound
+	}
+	return hook, nil
+}
+
+// visibleDeadLetters returns the dead letters of webhooks the caller may
+// manage. Those of deleted webhooks are only shown to callers with every
+// app.
+func (wc *WebhookController) visibleDeadLetters(c *gin.Context) []tcpserver.WebhookDelivery {
+	principal := principalFrom(c)
+	visible := []tcpserver.WebhookDelivery{}
+	for _, delivery := range wc.webhooks.DeadLetters() {
+		if principal != nil && !principal.AllApps() {
+			hook, err := wc.webhooks.Get(delivery.WebhookID)
+			if err != nil || !webhookInScope(principal, hook) {
+				continue
+			}
+		}
+		visible = append(visible, delivery)
+	}
+	return visible
+}
+
+// webhookInScope reports whether principal may see and manage hook. A
+// webhook without appids receives events of every app, so only principals
+// with every app may.
+func webhookInScope(principal *Principal, hook *tcpserver.Webhook) bool {
+	if principal == nil || principal.AllApps() {
+		return true
+	}
+	if len(hook.AppIDs) == 0 {
+		return false
+	}
+	for _, appID := range hook.AppIDs {
+		if !principal.CanAccessApp(appID) {
+			return false
+		}
+	}
+	return true
+}
+
+func webhookError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, tcpserver.ErrWebhookNotFound) || errors.Is(err, tcpserver.ErrDeadLetterNotFound) {
+		status = http.StatusNotFound
+	} else if errors.Is(err, tcpserver.ErrWebhookQueueFull) {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{
+		"success": false,
+		"error":   err.Error(),
+	})
+}
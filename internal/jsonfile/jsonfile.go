@@ -0,0 +1,36 @@
+// Package jsonfile writes the JSON files that back the gateway's file
+// stores.
+package jsonfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Write stores v as indented JSON at path with permissions perm, creating
+// the directory if needed. It writes a temporary file and renames it over
+// path, so readers never see a partial file.
+func Write(path string, v interface{}, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("create directory: %w", err)
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	// WriteFile keeps the mode of an existing temporary file.
+	if err := os.Chmod(tmp, perm); err != nil {
+		return fmt.Errorf("chmod %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,108 @@
+// Package logging builds the structured loggers used by the gateway and the
+// agent. Every component logs through its own *slog.Logger, tagged with a
+// component field, at a level that can be set per component.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Field keys shared by every component, so logs can be correlated across
+// the gateway and agents.
+const (
+	KeyComponent = "component"
+	KeySessionID = "session_id"
+	KeyAppID     = "appid"
+	KeySN        = "sn"
+	KeyCmdID     = "cmd_id"
+	KeyRequestID = "request_id"
+	KeyRemote    = "remote_addr"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Config selects the log format and levels. Level applies to components
+// not listed in Components.
+type Config struct {
+	Level      string            `yaml:"level"`
+	Format     string            `yaml:"format"`
+	Components map[string]string `yaml:"components"`
+}
+
+// Loggers hands out a logger per component, all writing to the same output.
+type Loggers struct {
+	out        io.Writer
+	format     string
+	level      slog.Level
+	components map[string]slog.Level
+}
+
+func New(config Config, out io.Writer) (*Loggers, error) {
+	loggers := &Loggers{
+		out:        out,
+		format:     config.Format,
+		components: make(map[string]slog.Level),
+	}
+
+	switch loggers.format {
+	case "":
+		loggers.format = FormatJSON
+	case FormatJSON, FormatText:
+	default:
+		return nil, fmt.Errorf("unknown log format %q", config.Format)
+	}
+
+	var err error
+	if loggers.level, err = parseLevel(config.Level); err != nil {
+		return nil, err
+	}
+	for component, level := range config.Components {
+		if loggers.components[component], err = parseLevel(level); err != nil {
+			return nil, fmt.Errorf("component %s: %w", component, err)
+		}
+	}
+	return loggers, nil
+}
+
+// Logger returns the logger for component.
+func (l *Loggers) Logger(component string) *slog.Logger {
+	level, exists := l.components[component]
+	if !exists {
+		level = l.level
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if l.format == FormatText {
+		handler = slog.NewTextHandler(l.out, options)
+	} else {
+		handler = slog.NewJSONHandler(l.out, options)
+	}
+	return slog.New(handler).With(KeyComponent, component)
+}
+
+// parseLevel accepts debug, info, warn or error; empty means info.
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(strings.ToLower(s))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// Or returns logger, or the default logger when it is nil.
+func Or(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
@@ -4,49 +4,335 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
 type Authenticator struct {
-	keys           map[string]string // appid -> key
-	timeWindowSec  int64
-	nonceStore     NonceStore
+	keys          map[string][]*AppKey // appid -> configured keys
+	keyStore      KeyStore             // keys managed at runtime, nil if none
+	keyModes      map[string]string    // appid -> KeyMode*, shared when unset
+	credentials   CredentialStore
+	timeWindowSec int64
+	nonceStore    NonceStore
+
+	// keyCache holds every key, merged and sorted, until the keys change.
+	keyCache []*AppKey
+	cacheMu  sync.RWMutex
 }
 
+// NonceStore remembers nonces until they expire. AddNonce must return
+// ErrNonceUsed for a nonce that is already stored and unexpired, so two
+// concurrent logins cannot both claim it.
 type NonceStore interface {
 	HasNonce(nonce string) bool
 	AddNonce(nonce string, ttl time.Duration) error
 }
 
+var ErrNonceUsed = errors.New("nonce already used")
+
+// NewAuthenticator takes one key per AppID, which gets DefaultKeyID.
+// Further keys can be added with AddKeys and SetKeyStore.
 func NewAuthenticator(keys map[string]string, timeWindowSec int64, nonceStore NonceStore) *Authenticator {
-	return &Authenticator{
-		keys:          keys,
+	a := &Authenticator{
+		keys:          make(map[string][]*AppKey),
 		timeWindowSec: timeWindowSec,
 		nonceStore:    nonceStore,
 	}
+	for appid, key := range keys {
+		a.keys[appid] = append(a.keys[appid], &AppKey{AppID: appid, ID: DefaultKeyID, Key: key})
+	}
+	return a
 }
 
-func (a *Authenticator) VerifySignature(appid, sn string, ts int64, nonce, signature string) error {
-	key, exists := a.keys[appid]
-	if !exists {
-		return fmt.Errorf("invalid appid")
+// AddKeys adds configured keys. It must be called before the authenticator
+// is in use.
+func (a *Authenticator) AddKeys(keys []*AppKey) {
+	for _, key := range keys {
+		copied := *key
+		a.keys[key.AppID] = append(a.keys[key.AppID], &copied)
 	}
+	a.invalidateKeys()
+}
 
-	if err := a.verifyTimestamp(ts); err != nil {
+// SetKeyStore enables adding, retiring and deleting keys at runtime. A
+// stored key takes precedence over a configured key with the same AppID
+// and ID. The store must only be changed through the authenticator, which
+// caches its keys.
+func (a *Authenticator) SetKeyStore(store KeyStore) {
+	a.keyStore = store
+	a.invalidateKeys()
+}
+
+// SetKeyModes sets how each app's key is used; apps without an entry use
+// KeyModeShared.
+func (a *Authenticator) SetKeyModes(modes map[string]string) {
+	a.keyModes = modes
+}
+
+// SetCredentialStore enables per-device keys and revocation.
+func (a *Authenticator) SetCredentialStore(store CredentialStore) {
+	a.credentials = store
+}
+
+// VerifySignature checks a login. keyID selects one of the app's keys; when
+// it is empty every key valid now is tried, which is what devices that
+// predate key IDs rely on.
+func (a *Authenticator) VerifySignature(appid, sn, keyID string, ts int64, nonce, signature string) error {
+	keys, err := a.deviceKeys(appid, sn, keyID, time.Now())
+	if err != nil {
 		return err
 	}
 
-	if err := a.verifyNonce(nonce); err != nil {
+	if err := a.verifyTimestamp(ts); err != nil {
 		return err
 	}
 
-	expectedSig := a.calculateSignature(appid, sn, ts, nonce, key)
-	if !hmac.Equal([]byte(signature), []byte(expectedSig)) {
+	// The nonce is stored only for a valid signature, so a forged login
+	// cannot burn nonces a device is about to use.
+	valid := false
+	for _, key := range keys {
+		expectedSig := a.calculateSignature(appid, sn, ts, nonce, key)
+		if hmac.Equal([]byte(signature), []byte(expectedSig)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
 		return fmt.Errorf("invalid signature")
 	}
 
-	return nil
+	return a.verifyNonce(nonce)
+}
+
+// deviceKeys returns the keys sn may sign with at now. A stored per-device
+// key wins; otherwise the app's key mode decides.
+func (a *Authenticator) deviceKeys(appid, sn, keyID string, now time.Time) ([]string, error) {
+	appKeys, err := a.sharedKeys(appid)
+	if err != nil {
+		return nil, err
+	}
+	if len(appKeys) == 0 {
+		return nil, fmt.Errorf("invalid appid")
+	}
+
+	if a.credentials != nil {
+		cred, err := a.credentials.Get(appid, sn)
+		switch {
+		case err == nil && cred.Revoked:
+			return nil, fmt.Errorf("device revoked")
+		case err == nil && cred.Key != "":
+			return []string{cred.Key}, nil
+		case err != nil && !errors.Is(err, ErrCredentialNotFound):
+			return nil, fmt.Errorf("load credential: %w", err)
+		}
+	}
+
+	mode := a.KeyMode(appid)
+	if mode == KeyModeProvisioned {
+		return nil, fmt.Errorf("no credential provisioned for device")
+	}
+
+	var keys []string
+	for _, appKey := range appKeys {
+		if (keyID != "" && appKey.ID != keyID) || !appKey.ValidAt(now) {
+			continue
+		}
+		switch mode {
+		case KeyModeShared:
+			keys = append(keys, appKey.Key)
+		case KeyModeDerived:
+			keys = append(keys, DeriveDeviceKey(appKey.Key, appid, sn))
+		default:
+			return nil, fmt.Errorf("unknown key mode %q", mode)
+		}
+	}
+	if len(keys) == 0 {
+		if keyID != "" {
+			return nil, fmt.Errorf("key %s is not valid", keyID)
+		}
+		return nil, fmt.Errorf("no valid key")
+	}
+	return keys, nil
+}
+
+// KeyMode returns how appid's key is used.
+func (a *Authenticator) KeyMode(appid string) string {
+	if mode := a.keyModes[appid]; mode != "" {
+		return mode
+	}
+	return KeyModeShared
+}
+
+// HasApp reports whether appid has any keys, valid or not.
+func (a *Authenticator) HasApp(appid string) bool {
+	keys, err := a.sharedKeys(appid)
+	return err == nil && len(keys) > 0
+}
+
+// AppKeys returns the keys of appid, or of every app when appid is empty,
+// whether valid or not, ordered by AppID and key ID.
+func (a *Authenticator) AppKeys(appid string) ([]*AppKey, error) {
+	shared, err := a.sharedKeys(appid)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*AppKey, 0, len(shared))
+	for _, key := range shared {
+		copied := *key
+		keys = append(keys, &copied)
+	}
+	return keys, nil
+}
+
+// sharedKeys is AppKeys without the copies, for lookups on every login.
+// The keys must not be modified.
+func (a *Authenticator) sharedKeys(appid string) ([]*AppKey, error) {
+	all, err := a.allKeys()
+	if err != nil {
+		return nil, err
+	}
+	if appid == "" {
+		return all, nil
+	}
+
+	// all is sorted by AppID, so the app's keys are one run.
+	first := sort.Search(len(all), func(i int) bool { return all[i].AppID >= appid })
+	last := first
+	for last < len(all) && all[last].AppID == appid {
+		last++
+	}
+	return all[first:last:last], nil
+}
+
+// allKeys returns every key, merging configured and stored keys only after
+// they changed.
+func (a *Authenticator) allKeys() ([]*AppKey, error) {
+	a.cacheMu.RLock()
+	cached := a.keyCache
+	a.cacheMu.RUnlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	if a.keyCache != nil {
+		return a.keyCache, nil
+	}
+
+	merged := make(map[string]*AppKey)
+	for _, keys := range a.keys {
+		for _, key := range keys {
+			merged[appKeyID(key.AppID, key.ID)] = key
+		}
+	}
+
+	if a.keyStore != nil {
+		stored, err := a.keyStore.List("")
+		if err != nil {
+			return nil, fmt.Errorf("load keys: %w", err)
+		}
+		for _, key := range stored {
+			merged[appKeyID(key.AppID, key.ID)] = key
+		}
+	}
+
+	keys := make([]*AppKey, 0, len(merged))
+	for _, key := range merged {
+		copied := *key
+		keys = append(keys, &copied)
+	}
+	sortAppKeys(keys)
+	a.keyCache = keys
+	return keys, nil
+}
+
+func (a *Authenticator) invalidateKeys() {
+	a.cacheMu.Lock()
+	a.keyCache = nil
+	a.cacheMu.Unlock()
+}
+
+// ActiveKey returns the valid key of appid that became valid last, which
+// is the one new devices should be given.
+func (a *Authenticator) ActiveKey(appid string) (*AppKey, error) {
+	keys, err := a.sharedKeys(appid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var active *AppKey
+	for _, key := range keys {
+		if !key.ValidAt(now) {
+			continue
+		}
+		if active == nil || keyStart(key).After(keyStart(active)) {
+			active = key
+		}
+	}
+	if active == nil {
+		return nil, ErrKeyNotFound
+	}
+	copied := *active
+	return &copied, nil
+}
+
+func keyStart(key *AppKey) time.Time {
+	if key.NotBefore != nil && key.NotBefore.After(key.CreatedAt) {
+		return *key.NotBefore
+	}
+	return key.CreatedAt
+}
+
+// PutKey adds or replaces a runtime key.
+func (a *Authenticator) PutKey(key *AppKey) error {
+	if a.keyStore == nil {
+		return fmt.Errorf("key store not configured")
+	}
+	defer a.invalidateKeys()
+	return a.keyStore.Put(key)
+}
+
+// DeleteKey removes a runtime key. Configured keys cannot be deleted, as
+// they would come back on restart; they are retired instead.
+func (a *Authenticator) DeleteKey(appid, keyID string) error {
+	if a.keyStore == nil {
+		return fmt.Errorf("key store not configured")
+	}
+	for _, key := range a.keys[appid] {
+		if key.ID == keyID {
+			return ErrKeyConfigured
+		}
+	}
+	defer a.invalidateKeys()
+	return a.keyStore.Delete(appid, keyID)
+}
+
+// RetireKey stops accepting a key from at on. Retiring a configured key
+// stores a copy of it with the new NotAfter.
+func (a *Authenticator) RetireKey(appid, keyID string, at time.Time) (*AppKey, error) {
+	keys, err := a.AppKeys(appid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if key.ID != keyID {
+			continue
+		}
+		key.NotAfter = &at
+		if err := a.PutKey(key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
 }
 
 func (a *Authenticator) calculateSignature(appid, sn string, ts int64, nonce, key string) string {
@@ -71,6 +357,9 @@ func (a *Authenticator) verifyNonce(nonce string) error {
 
 	ttl := time.Duration(a.timeWindowSec*2) * time.Second
 	if err := a.nonceStore.AddNonce(nonce, ttl); err != nil {
+		if errors.Is(err, ErrNonceUsed) {
+			return err
+		}
 		return fmt.Errorf("failed to store nonce: %w", err)
 	}
 
@@ -87,32 +376,3 @@ func abs(x int64) int64 {
 	}
 	return x
 }
-
-type MemoryNonceStore struct {
-	nonces map[string]time.Time
-}
-
-func NewMemoryNonceStore() *MemoryNonceStore {
-	return &MemoryNonceStore{
-		nonces: make(map[string]time.Time),
-	}
-}
-
-func (m *MemoryNonceStore) HasNonce(nonce string) bool {
-	_, exists := m.nonces[nonce]
-	return exists
-}
-
-func (m *MemoryNonceStore) AddNonce(nonce string, ttl time.Duration) error {
-	m.nonces[nonce] = time.Now().Add(ttl)
-	return nil
-}
-
-func (m *MemoryNonceStore) Cleanup() {
-	now := time.Now()
-	for nonce, expiry := range m.nonces {
-		if now.After(expiry) {
-			delete(m.nonces, nonce)
-		}
-	}
-}
\ No newline at end of file
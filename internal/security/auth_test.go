@@ -0,0 +1,93 @@
+package security
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySignature(t *testing.T) {
+	auth := NewAuthenticator(map[string]string{
+		"shared":      "K_SHARED",
+		"derived":     "K_MASTER",
+		"provisioned": "K_UNUSED",
+	}, 300, NewMemoryNonceStore())
+	auth.SetKeyModes(map[string]string{
+		"derived":     KeyModeDerived,
+		"provisioned": KeyModeProvisioned,
+	})
+
+	credentials := NewMemoryCredentialStore()
+	for _, cred := range []*DeviceCredential{
+		{AppID: "provisioned", SN: "p1", Key: "K_P1"},
+		{AppID: "shared", SN: "own-key", Key: "K_OWN"},
+		{AppID: "shared", SN: "revoked", Revoked: true},
+		{AppID: "derived", SN: "revoked", Revoked: true},
+	} {
+		if err := credentials.Put(cred); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auth.SetCredentialStore(credentials)
+
+	tests := []struct {
+		name    string
+		appid   string
+		sn      string
+		keyID   string
+		signKey string
+		skew    time.Duration
+		err     string
+	}{
+		{name: "shared key", appid: "shared", sn: "s1", signKey: "K_SHARED"},
+		{name: "shared key by id", appid: "shared", sn: "s1", keyID: DefaultKeyID, signKey: "K_SHARED"},
+		{name: "wrong key", appid: "shared", sn: "s1", signKey: "K_OTHER", err: "invalid signature"},
+		{name: "derived key", appid: "derived", sn: "d1", signKey: DeriveDeviceKey("K_MASTER", "derived", "d1")},
+		{name: "master key in derived mode", appid: "derived", sn: "d1", signKey: "K_MASTER", err: "invalid signature"},
+		{name: "key derived for another device", appid: "derived", sn: "d1", signKey: DeriveDeviceKey("K_MASTER", "derived", "d2"), err: "invalid signature"},
+		{name: "provisioned key", appid: "provisioned", sn: "p1", signKey: "K_P1"},
+		{name: "app key in provisioned mode", appid: "provisioned", sn: "p1", signKey: "K_UNUSED", err: "invalid signature"},
+		{name: "device without a provisioned key", appid: "provisioned", sn: "p2", signKey: "K_UNUSED", err: "no credential provisioned"},
+		{name: "device key overrides the shared key", appid: "shared", sn: "own-key", signKey: "K_SHARED", err: "invalid signature"},
+		{name: "device key", appid: "shared", sn: "own-key", signKey: "K_OWN"},
+		{name: "revoked device", appid: "shared", sn: "revoked", signKey: "K_SHARED", err: "device revoked"},
+		{name: "revoked derived device", appid: "derived", sn: "revoked", signKey: DeriveDeviceKey("K_MASTER", "derived", "revoked"), err: "device revoked"},
+		{name: "unknown app", appid: "unknown", sn: "s1", signKey: "K_SHARED", err: "invalid appid"},
+		{name: "unknown key id", appid: "shared", sn: "s1", keyID: "k2", signKey: "K_SHARED", err: "key k2 is not valid"},
+		{name: "stale timestamp", appid: "shared", sn: "s1", signKey: "K_SHARED", skew: -10 * time.Minute, err: "timestamp out of window"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := time.Now().Add(tt.skew).Unix()
+			nonce := "nonce-" + tt.name
+			sign := auth.GenerateSignature(tt.appid, tt.sn, ts, nonce, tt.signKey)
+
+			err := auth.VerifySignature(tt.appid, tt.sn, tt.keyID, ts, nonce, sign)
+			if tt.err == "" && err != nil {
+				t.Fatalf("refused: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestVerifySignatureNonce checks a nonce is only used up by a valid login.
+func TestVerifySignatureNonce(t *testing.T) {
+	auth := NewAuthenticator(map[string]string{"A1": "K1"}, 300, NewMemoryNonceStore())
+	ts := time.Now().Unix()
+
+	forged := auth.GenerateSignature("A1", "s1", ts, "n1", "K_FORGED")
+	if err := auth.VerifySignature("A1", "s1", "", ts, "n1", forged); err == nil {
+		t.Fatal("forged signature accepted")
+	}
+
+	sign := auth.GenerateSignature("A1", "s1", ts, "n1", "K1")
+	if err := auth.VerifySignature("A1", "s1", "", ts, "n1", sign); err != nil {
+		t.Fatalf("login after a forged attempt: %v", err)
+	}
+	if err := auth.VerifySignature("A1", "s1", "", ts, "n1", sign); err == nil || !strings.Contains(err.Error(), "nonce already used") {
+		t.Fatalf("replayed login: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"device-agent/internal/jsonfile"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key modes decide how the key configured for an AppID is used.
+const (
+	// KeyModeShared signs every device of the app with the app key itself.
+	KeyModeShared = "shared"
+	// KeyModeDerived treats the app key as a master key; each device signs
+	// with DeriveDeviceKey(master, appid, sn).
+	KeyModeDerived = "derived"
+	// KeyModeProvisioned only accepts keys stored per device.
+	KeyModeProvisioned = "provisioned"
+)
+
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// DeviceCredential is the per-device record consulted before the app key.
+// Key, when set, overrides the app's key mode for this device. A revoked
+// device is refused whatever its key.
+type DeviceCredential struct {
+	AppID         string     `json:"appid"`
+	SN            string     `json:"sn"`
+	Key           string     `json:"key,omitempty"`
+	Revoked       bool       `json:"revoked"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type CredentialStore interface {
+	Get(appID, sn string) (*DeviceCredential, error)
+	Put(cred *DeviceCredential) error
+	Delete(appID, sn string) error
+	List(appID string) ([]*DeviceCredential, error)
+}
+
+// DeriveDeviceKey derives a device's key from its app's master key with
+// HKDF-SHA256, so the gateway needs no per-device storage and a leaked
+// device key reveals nothing about other devices.
+func DeriveDeviceKey(masterKey, appID, sn string) string {
+	reader := hkdf.New(sha256.New, []byte(masterKey), []byte(appID), []byte("device-agent device key|"+sn))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(reader, key); err != nil {
+		panic(fmt.Sprintf("hkdf: %v", err))
+	}
+	return hex.EncodeToString(key)
+}
+
+// GenerateDeviceKey returns a random key for provisioning a device.
+func GenerateDeviceKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func credentialID(appID, sn string) string {
+	return appID + "/" + sn
+}
+
+type MemoryCredentialStore struct {
+	credentials map[string]*DeviceCredential
+	mu          sync.RWMutex
+}
+
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{
+		credentials: make(map[string]*DeviceCredential),
+	}
+}
+
+func (m *MemoryCredentialStore) Get(appID, sn string) (*DeviceCredential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cred, exists := m.credentials[credentialID(appID, sn)]
+	if !exists {
+		return nil, ErrCredentialNotFound
+	}
+	copied := *cred
+	return &copied, nil
+}
+
+func (m *MemoryCredentialStore) Put(cred *DeviceCredential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *cred
+	m.credentials[credentialID(cred.AppID, cred.SN)] = &copied
+	return nil
+}
+
+func (m *MemoryCredentialStore) Delete(appID, sn string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := credentialID(appID, sn)
+	if _, exists := m.credentials[id]; !exists {
+		return ErrCredentialNotFound
+	}
+	delete(m.credentials, id)
+	return nil
+}
+
+// List returns the credentials of appID, or of every app when appID is
+// empty, ordered by AppID and SN.
+func (m *MemoryCredentialStore) List(appID string) ([]*DeviceCredential, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var creds []*DeviceCredential
+	for _, cred := range m.credentials {
+		if appID == "" || cred.AppID == appID {
+			copied := *cred
+			creds = append(creds, &copied)
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		if creds[i].AppID != creds[j].AppID {
+			return creds[i].AppID < creds[j].AppID
+		}
+		return creds[i].SN < creds[j].SN
+	})
+	return creds, nil
+}
+
+// FileCredentialStore is a MemoryCredentialStore persisted to a JSON file
+// after every change. The file holds device secrets and is written 0600.
+type FileCredentialStore struct {
+	*MemoryCredentialStore
+	path    string
+	writeMu sync.Mutex
+}
+
+func NewFileCredentialStore(path string) (*FileCredentialStore, error) {
+	store := &FileCredentialStore{
+		MemoryCredentialStore: NewMemoryCredentialStore(),
+		path:                  path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("read credential store: %w", err)
+	}
+
+	var creds []*DeviceCredential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("parse credential store: %w", err)
+	}
+	for _, cred := range creds {
+		store.MemoryCredentialStore.Put(cred)
+	}
+	return store, nil
+}
+
+func (f *FileCredentialStore) Put(cred *DeviceCredential) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryCredentialStore.Put(cred); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileCredentialStore) Delete(appID, sn string) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryCredentialStore.Delete(appID, sn); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileCredentialStore) save() error {
+	creds, _ := f.MemoryCredentialStore.List("")
+	return jsonfile.Write(f.path, creds, 0o600)
+}
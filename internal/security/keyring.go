@@ -0,0 +1,184 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"device-agent/internal/jsonfile"
+)
+
+// DefaultKeyID is the ID of the key given for an AppID in the plain
+// appid -> key map passed to NewAuthenticator.
+const DefaultKeyID = "default"
+
+var (
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrKeyConfigured = errors.New("key is configured, retire it instead")
+)
+
+// AppKey is one of possibly several keys of an AppID. Keys overlap in time
+// during a rotation: devices move to the new key while the old one is still
+// accepted, then the old one is retired by setting NotAfter.
+type AppKey struct {
+	AppID     string     `json:"appid" yaml:"appid"`
+	ID        string     `json:"kid" yaml:"kid"`
+	Key       string     `json:"key" yaml:"key"`
+	NotBefore *time.Time `json:"not_before,omitempty" yaml:"not_before"`
+	NotAfter  *time.Time `json:"not_after,omitempty" yaml:"not_after"`
+	CreatedAt time.Time  `json:"created_at" yaml:"-"`
+}
+
+// ValidAt reports whether the key is accepted at t.
+func (k *AppKey) ValidAt(t time.Time) bool {
+	if k.NotBefore != nil && t.Before(*k.NotBefore) {
+		return false
+	}
+	if k.NotAfter != nil && !t.Before(*k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// KeyStore holds the app keys managed at runtime.
+type KeyStore interface {
+	Get(appID, id string) (*AppKey, error)
+	Put(key *AppKey) error
+	Delete(appID, id string) error
+	List(appID string) ([]*AppKey, error)
+}
+
+func appKeyID(appID, id string) string {
+	return appID + "/" + id
+}
+
+type MemoryKeyStore struct {
+	keys map[string]*AppKey
+	mu   sync.RWMutex
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys: make(map[string]*AppKey),
+	}
+}
+
+func (m *MemoryKeyStore) Get(appID, id string) (*AppKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, exists := m.keys[appKeyID(appID, id)]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (m *MemoryKeyStore) Put(key *AppKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *key
+	m.keys[appKeyID(key.AppID, key.ID)] = &copied
+	return nil
+}
+
+func (m *MemoryKeyStore) Delete(appID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kid := appKeyID(appID, id)
+	if _, exists := m.keys[kid]; !exists {
+		return ErrKeyNotFound
+	}
+	delete(m.keys, kid)
+	return nil
+}
+
+// List returns the keys of appID, or of every app when appID is empty,
+// ordered by AppID and key ID.
+func (m *MemoryKeyStore) List(appID string) ([]*AppKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []*AppKey
+	for _, key := range m.keys {
+		if appID == "" || key.AppID == appID {
+			copied := *key
+			keys = append(keys, &copied)
+		}
+	}
+	sortAppKeys(keys)
+	return keys, nil
+}
+
+// FileKeyStore is a MemoryKeyStore persisted to a JSON file after every
+// change. The file holds secrets and is written 0600.
+type FileKeyStore struct {
+	*MemoryKeyStore
+	path    string
+	writeMu sync.Mutex
+}
+
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	store := &FileKeyStore{
+		MemoryKeyStore: NewMemoryKeyStore(),
+		path:           path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("read key store: %w", err)
+	}
+
+	var keys []*AppKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse key store: %w", err)
+	}
+	for _, key := range keys {
+		store.MemoryKeyStore.Put(key)
+	}
+	return store, nil
+}
+
+func (f *FileKeyStore) Put(key *AppKey) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryKeyStore.Put(key); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileKeyStore) Delete(appID, id string) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryKeyStore.Delete(appID, id); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileKeyStore) save() error {
+	keys, _ := f.MemoryKeyStore.List("")
+	return jsonfile.Write(f.path, keys, 0o600)
+}
+
+func sortAppKeys(keys []*AppKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].AppID != keys[j].AppID {
+			return keys[i].AppID < keys[j].AppID
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
@@ -0,0 +1,167 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppKeyValidAt(t *testing.T) {
+	now := time.Now()
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+
+	tests := []struct {
+		name string
+		key  AppKey
+		at   time.Time
+		want bool
+	}{
+		{"no window", AppKey{}, now, true},
+		{"before NotBefore", AppKey{NotBefore: &now}, before, false},
+		{"at NotBefore", AppKey{NotBefore: &now}, now, true},
+		{"before NotAfter", AppKey{NotAfter: &now}, before, true},
+		{"at NotAfter", AppKey{NotAfter: &now}, now, false},
+		{"inside the window", AppKey{NotBefore: &before, NotAfter: &after}, now, true},
+		{"after the window", AppKey{NotBefore: &before, NotAfter: &now}, after, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.ValidAt(tt.at); got != tt.want {
+				t.Errorf("ValidAt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// login signs and verifies a login as s1 of A1 with key, under keyID if set.
+func login(auth *Authenticator, keyID, key string) error {
+	ts := time.Now().Unix()
+	nonce := fmt.Sprintf("nonce-%d", time.Now().UnixNano())
+	return auth.VerifySignature("A1", "s1", keyID, ts, nonce, auth.GenerateSignature("A1", "s1", ts, nonce, key))
+}
+
+// TestKeyRotation rotates A1 from its configured key to a stored one and
+// checks which keys are accepted at each step.
+func TestKeyRotation(t *testing.T) {
+	auth := NewAuthenticator(map[string]string{"A1": "K_OLD"}, 300, NewMemoryNonceStore())
+	auth.SetKeyStore(NewMemoryKeyStore())
+
+	// Logging in fills the key cache, which every change must invalidate.
+	if err := login(auth, "", "K_OLD"); err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	if err := auth.PutKey(&AppKey{AppID: "A1", ID: "k2", Key: "K_NEW", NotBefore: &future}); err != nil {
+		t.Fatal(err)
+	}
+	if err := login(auth, "", "K_NEW"); err == nil {
+		t.Error("key accepted before NotBefore")
+	}
+	if err := login(auth, "k2", "K_NEW"); err == nil {
+		t.Error("key accepted by id before NotBefore")
+	}
+
+	// During the overlap both keys work, and new devices get the new one.
+	created := time.Now()
+	if err := auth.PutKey(&AppKey{AppID: "A1", ID: "k2", Key: "K_NEW", CreatedAt: created}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"K_OLD", "K_NEW"} {
+		if err := login(auth, "", key); err != nil {
+			t.Errorf("%s during the overlap: %v", key, err)
+		}
+	}
+	if active, err := auth.ActiveKey("A1"); err != nil || active.ID != "k2" {
+		t.Errorf("active key %+v, %v", active, err)
+	}
+	if err := login(auth, DefaultKeyID, "K_NEW"); err == nil {
+		t.Error("new key accepted under the old key's id")
+	}
+
+	// Retiring the configured key stores a copy that ends it.
+	retired, err := auth.RetireKey("A1", DefaultKeyID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retired.NotAfter == nil || retired.Key != "K_OLD" {
+		t.Errorf("retired %+v", retired)
+	}
+	if err := login(auth, "", "K_OLD"); err == nil {
+		t.Error("retired key accepted")
+	}
+	if err := login(auth, "", "K_NEW"); err != nil {
+		t.Errorf("new key after retiring the old one: %v", err)
+	}
+	if _, err := auth.RetireKey("A1", "missing", time.Now()); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("retire a missing key: %v", err)
+	}
+
+	// Configured keys cannot be deleted, stored ones can.
+	if err := auth.DeleteKey("A1", DefaultKeyID); !errors.Is(err, ErrKeyConfigured) {
+		t.Errorf("delete the configured key: %v", err)
+	}
+	if err := auth.DeleteKey("A1", "k2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := login(auth, "", "K_NEW"); err == nil {
+		t.Error("deleted key accepted")
+	}
+	if _, err := auth.ActiveKey("A1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("active key after deleting: %v", err)
+	}
+	if !auth.HasApp("A1") {
+		t.Error("A1 lost with only retired keys left")
+	}
+}
+
+func TestKeyStoreRequired(t *testing.T) {
+	auth := NewAuthenticator(map[string]string{"A1": "K1"}, 300, NewMemoryNonceStore())
+
+	if err := auth.PutKey(&AppKey{AppID: "A1", ID: "k2", Key: "K2"}); err == nil {
+		t.Error("key added without a key store")
+	}
+	if err := auth.DeleteKey("A1", "k2"); err == nil {
+		t.Error("key deleted without a key store")
+	}
+}
+
+func TestFileKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := NewFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, key := range []*AppKey{
+		{AppID: "A2", ID: "k1", Key: "K21"},
+		{AppID: "A1", ID: "k2", Key: "K12", NotAfter: &notAfter},
+		{AppID: "A1", ID: "k1", Key: "K11"},
+	} {
+		if err := store.Put(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("A2", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("A2", "k1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("delete a missing key: %v", err)
+	}
+
+	reopened, err := NewFileKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := reopened.List("")
+	if len(keys) != 2 || keys[0].ID != "k1" || keys[1].ID != "k2" {
+		t.Fatalf("keys after reopening: %+v", keys)
+	}
+	if keys[1].NotAfter == nil || !keys[1].NotAfter.Equal(notAfter) {
+		t.Errorf("k2 after reopening: %+v", keys[1])
+	}
+}
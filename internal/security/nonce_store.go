@@ -0,0 +1,182 @@
+package security
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// nonceCleanupInterval is how often AddNonce sweeps out expired nonces.
+const nonceCleanupInterval = time.Minute
+
+// MemoryNonceStore keeps nonces in memory. It is safe for concurrent use
+// and drops expired nonces as new ones are added.
+type MemoryNonceStore struct {
+	nonces      map[string]time.Time
+	lastCleanup time.Time
+	mu          sync.Mutex
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{
+		nonces:      make(map[string]time.Time),
+		lastCleanup: time.Now(),
+	}
+}
+
+func (m *MemoryNonceStore) HasNonce(nonce string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expiry, exists := m.nonces[nonce]
+	return exists && time.Now().Before(expiry)
+}
+
+func (m *MemoryNonceStore) AddNonce(nonce string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if expiry, exists := m.nonces[nonce]; exists && now.Before(expiry) {
+		return ErrNonceUsed
+	}
+	m.nonces[nonce] = now.Add(ttl)
+
+	if now.Sub(m.lastCleanup) > nonceCleanupInterval {
+		m.cleanupLocked(now)
+	}
+	return nil
+}
+
+func (m *MemoryNonceStore) Cleanup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cleanupLocked(time.Now())
+}
+
+func (m *MemoryNonceStore) cleanupLocked(now time.Time) {
+	for nonce, expiry := range m.nonces {
+		if now.After(expiry) {
+			delete(m.nonces, nonce)
+		}
+	}
+	m.lastCleanup = now
+}
+
+var nonceBucket = []byte("nonces")
+
+// FileNonceStore keeps nonces in a bbolt database file, so a gateway restart
+// does not reopen the replay window. Values are expiry times in Unix
+// nanoseconds.
+type FileNonceStore struct {
+	db          *bolt.DB
+	lastCleanup time.Time
+	mu          sync.Mutex // guards lastCleanup
+}
+
+func NewFileNonceStore(path string) (*FileNonceStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create directory: %w", err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open nonce store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(nonceBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init nonce store: %w", err)
+	}
+
+	store := &FileNonceStore{db: db}
+	store.Cleanup()
+	return store, nil
+}
+
+// HasNonce reports a nonce as used when the store cannot be read, so a
+// storage failure rejects logins rather than allowing replays.
+func (f *FileNonceStore) HasNonce(nonce string) bool {
+	now := time.Now()
+	used := true
+	err := f.db.View(func(tx *bolt.Tx) error {
+		used = unexpired(tx.Bucket(nonceBucket).Get([]byte(nonce)), now)
+		return nil
+	})
+	return err != nil || used
+}
+
+func (f *FileNonceStore) AddNonce(nonce string, ttl time.Duration) error {
+	now := time.Now()
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nonceBucket)
+		if unexpired(bucket.Get([]byte(nonce)), now) {
+			return ErrNonceUsed
+		}
+
+		var expiry [8]byte
+		binary.BigEndian.PutUint64(expiry[:], uint64(now.Add(ttl).UnixNano()))
+		return bucket.Put([]byte(nonce), expiry[:])
+	})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	due := now.Sub(f.lastCleanup) > nonceCleanupInterval
+	f.mu.Unlock()
+	if due {
+		f.Cleanup()
+	}
+	return nil
+}
+
+func (f *FileNonceStore) Cleanup() {
+	now := time.Now()
+
+	f.mu.Lock()
+	f.lastCleanup = now
+	f.mu.Unlock()
+
+	f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nonceBucket)
+
+		// Deleting while iterating can skip keys, so collect them first.
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if !unexpired(v, now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *FileNonceStore) Close() error {
+	return f.db.Close()
+}
+
+func unexpired(value []byte, now time.Time) bool {
+	if len(value) != 8 {
+		return false
+	}
+	return now.UnixNano() < int64(binary.BigEndian.Uint64(value))
+}
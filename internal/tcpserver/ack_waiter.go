@@ -18,37 +18,66 @@ func NewACKWaiter() *ACKWaiter {
 	}
 }
 
-func (aw *ACKWaiter) Wait(cmdID string, timeout time.Duration) (*ACKMessage, error) {
+// PendingACK is an ACK being waited for.
+type PendingACK struct {
+	waiter *ACKWaiter
+	cmdID  string
+	ch     chan *ACKMessage
+}
+
+// Expect starts waiting for cmdID's ACK. Call it before sending the command,
+// so an ACK that arrives before Wait is called is not missed, and then call
+// Wait or Release.
+func (aw *ACKWaiter) Expect(cmdID string) *PendingACK {
 	ch := make(chan *ACKMessage, 1)
 
 	aw.mu.Lock()
 	aw.waiters[cmdID] = ch
 	aw.mu.Unlock()
 
-	defer func() {
-		aw.mu.Lock()
-		delete(aw.waiters, cmdID)
-		close(ch)
-		aw.mu.Unlock()
-	}()
+	return &PendingACK{waiter: aw, cmdID: cmdID, ch: ch}
+}
+
+// Wait registers a waiter for cmdID and waits for its ACK. The ACK is missed
+// if it arrived before the call; use Expect when the command is not sent
+// yet.
+func (aw *ACKWaiter) Wait(cmdID string, timeout time.Duration) (*ACKMessage, error) {
+	return aw.Expect(cmdID).Wait(timeout)
+}
+
+// Wait waits up to timeout for the ACK, then releases the waiter.
+func (p *PendingACK) Wait(timeout time.Duration) (*ACKMessage, error) {
+	defer p.Release()
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	select {
-	case ack := <-ch:
+	case ack, ok := <-p.ch:
+		if !ok {
+			return nil, fmt.Errorf("wait for command %s canceled", p.cmdID)
+		}
 		return ack, nil
 	case <-ctx.Done():
-		return nil, fmt.Errorf("ack timeout for command %s", cmdID)
+		return nil, fmt.Errorf("ack timeout for command %s", p.cmdID)
+	}
+}
+
+// Release stops waiting, for instance because sending the command failed.
+func (p *PendingACK) Release() {
+	p.waiter.mu.Lock()
+	defer p.waiter.mu.Unlock()
+
+	if p.waiter.waiters[p.cmdID] == p.ch {
+		delete(p.waiter.waiters, p.cmdID)
 	}
 }
 
 func (aw *ACKWaiter) Notify(cmdID string, ack *ACKMessage) {
 	aw.mu.RLock()
-	ch, exists := aw.waiters[cmdID]
-	aw.mu.RUnlock()
+	defer aw.mu.RUnlock()
 
-	if exists {
+	if ch, exists := aw.waiters[cmdID]; exists {
 		select {
 		case ch <- ack:
 		default:
@@ -64,4 +93,4 @@ func (aw *ACKWaiter) Cancel(cmdID string) {
 		close(ch)
 		delete(aw.waiters, cmdID)
 	}
-}
\ No newline at end of file
+}
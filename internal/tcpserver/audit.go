@@ -0,0 +1,443 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAuditBufferSize = 10000
+	DefaultAuditMaxSize    = 100 << 20 // 100MB
+	DefaultAuditMaxFiles   = 10
+
+	// maxAuditLine bounds one event; longer lines are skipped as corrupt.
+	maxAuditLine = 1024 * 1024
+	// auditClockSlack is how far out of order events may be written, since
+	// their time is taken before the write lock.
+	auditClockSlack = time.Minute
+)
+
+const (
+	// AuditAPI is a management API call that changes state.
+	AuditAPI = "api"
+	// AuditAuth is a device login, successful or not.
+	AuditAuth = "auth"
+	// AuditACK is a device's reply to a command.
+	AuditACK = "ack"
+	// AuditTimeout is a command whose ACK did not arrive in time.
+	AuditTimeout = "timeout"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEvent is one entry of the audit log. Result is success or failure,
+// except for ACKs where it is the status the device replied with.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Action     string    `json:"action"`
+	Actor      string    `json:"actor,omitempty"`
+	Role       string    `json:"role,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	AppID      string    `json:"appid,omitempty"`
+	SN         string    `json:"sn,omitempty"`
+	CmdID      string    `json:"cmd_id,omitempty"`
+	Cmd        string    `json:"cmd,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	Result     string    `json:"result"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// AuditFilter selects audit events. Zero fields match everything.
+type AuditFilter struct {
+	Since time.Time
+	Until time.Time
+	Kind  string
+	AppID string
+	SN    string
+	// AppIDs, when set, limits events to those apps.
+	AppIDs []string
+	Limit  int
+}
+
+func (f *AuditFilter) Matches(event *AuditEvent) bool {
+	if !f.Since.IsZero() && event.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !event.Time.Before(f.Until) {
+		return false
+	}
+	if f.Kind != "" && event.Kind != f.Kind {
+		return false
+	}
+	if f.AppID != "" && event.AppID != f.AppID {
+		return false
+	}
+	if f.SN != "" && event.SN != f.SN {
+		return false
+	}
+	if f.AppIDs != nil {
+		for _, appID := range f.AppIDs {
+			if event.AppID == appID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// AuditLog records control-plane actions. Events are only ever appended.
+type AuditLog interface {
+	Append(event *AuditEvent) error
+	// Query returns the events matching filter, newest first. With a limit
+	// only the newest matches are returned.
+	Query(filter AuditFilter) ([]AuditEvent, error)
+	// Scan calls fn with each event matching filter, oldest first, until fn
+	// returns an error, which Scan returns. The limit is ignored.
+	Scan(filter AuditFilter, fn func(event *AuditEvent) error) error
+}
+
+// MemoryAuditLog keeps the most recent events in memory.
+type MemoryAuditLog struct {
+	events   []AuditEvent
+	capacity int
+	mu       sync.RWMutex
+}
+
+func NewMemoryAuditLog(capacity int) *MemoryAuditLog {
+	if capacity <= 0 {
+		capacity = DefaultAuditBufferSize
+	}
+	return &MemoryAuditLog{
+		capacity: capacity,
+	}
+}
+
+func (m *MemoryAuditLog) Append(event *AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events = append(m.events, *event)
+	if len(m.events) > m.capacity {
+		m.events = m.events[len(m.events)-m.capacity:]
+	}
+	return nil
+}
+
+func (m *MemoryAuditLog) Query(filter AuditFilter) ([]AuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := []AuditEvent{}
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if !filter.Matches(&m.events[i]) {
+			continue
+		}
+		result = append(result, m.events[i])
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryAuditLog) Scan(filter AuditFilter, fn func(event *AuditEvent) error) error {
+	m.mu.RLock()
+	var matches []AuditEvent
+	for i := range m.events {
+		if filter.Matches(&m.events[i]) {
+			matches = append(matches, m.events[i])
+		}
+	}
+	m.mu.RUnlock()
+
+	for i := range matches {
+		if err := fn(&matches[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileAuditLog appends events to a JSON Lines file. Once the file reaches
+// maxSize it is renamed to <path>.<timestamp> and a new one is started;
+// only the newest maxFiles rotated files are kept. Queries read the files
+// newest first from the end and stop at the limit or at events older than
+// the filter's Since.
+type FileAuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+func NewFileAuditLog(path string, maxSize int64, maxFiles int) (*FileAuditLog, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultAuditMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultAuditMaxFiles
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create directory: %w", err)
+		}
+	}
+
+	f := &FileAuditLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := f.openLocked(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileAuditLog) openLocked() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat audit log: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *FileAuditLog) Append(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+// rotateLocked moves the current file aside, starts a new one and removes
+// the oldest rotated files.
+func (f *FileAuditLog) rotateLocked() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("close audit log: %w", err)
+	}
+	rotated := f.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(f.path, rotated); err != nil {
+		return fmt.Errorf("rotate audit log: %w", err)
+	}
+	if err := f.openLocked(); err != nil {
+		return err
+	}
+
+	segments, err := f.rotatedFiles()
+	if err != nil {
+		return fmt.Errorf("list rotated audit logs: %w", err)
+	}
+	for len(segments) > f.maxFiles {
+		os.Remove(segments[0])
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// rotatedFiles returns the rotated files, oldest first.
+func (f *FileAuditLog) rotatedFiles() ([]string, error) {
+	segments, err := filepath.Glob(f.path + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// files returns every file of the log, oldest first, skipping those last
+// written before since.
+func (f *FileAuditLog) files(since time.Time) ([]string, error) {
+	segments, err := f.rotatedFiles()
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, f.path)
+	if since.IsZero() {
+		return segments, nil
+	}
+
+	var recent []string
+	for _, segment := range segments {
+		if info, err := os.Stat(segment); err == nil && !info.ModTime().Before(since) {
+			recent = append(recent, segment)
+		}
+	}
+	return recent, nil
+}
+
+func (f *FileAuditLog) Query(filter AuditFilter) ([]AuditEvent, error) {
+	files, err := f.files(filter.Since)
+	if err != nil {
+		return nil, fmt.Errorf("list audit log files: %w", err)
+	}
+
+	result := []AuditEvent{}
+	done := false
+	for i := len(files) - 1; i >= 0 && !done; i-- {
+		err := readAuditBackward(files[i], func(event *AuditEvent) bool {
+			if !filter.Since.IsZero() && event.Time.Before(filter.Since.Add(-auditClockSlack)) {
+				done = true
+				return false
+			}
+			if !filter.Matches(event) {
+				return true
+			}
+			result = append(result, *event)
+			if filter.Limit > 0 && len(result) >= filter.Limit {
+				done = true
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (f *FileAuditLog) Scan(filter AuditFilter, fn func(event *AuditEvent) error) error {
+	files, err := f.files(filter.Since)
+	if err != nil {
+		return fmt.Errorf("list audit log files: %w", err)
+	}
+
+	for _, name := range files {
+		if err := scanAuditFile(name, filter, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanAuditFile(name string, filter AuditFilter, fn func(event *AuditEvent) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Rotated away and removed since the files were listed.
+			return nil
+		}
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditLine)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A line cut short by a crash should not hide the rest of the log.
+			continue
+		}
+		if !filter.Matches(&event) {
+			continue
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read audit log: %w", err)
+	}
+	return nil
+}
+
+// readAuditBackward calls fn with the events of a file from last to first
+// until fn returns false.
+func readAuditBackward(name string, fn func(event *AuditEvent) bool) error {
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat audit log: %w", err)
+	}
+
+	emit := func(line []byte) bool {
+		var event AuditEvent
+		if len(line) == 0 || json.Unmarshal(line, &event) != nil {
+			return true
+		}
+		return fn(&event)
+	}
+
+	buf := make([]byte, 64*1024)
+	var partial []byte // start of a line continued in the chunk read before
+	for offset := info.Size(); offset > 0; {
+		n := int64(len(buf))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err := file.ReadAt(buf[:n], offset); err != nil {
+			return fmt.Errorf("read audit log: %w", err)
+		}
+
+		data := append(buf[:n:n], partial...)
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if !emit(data[i+1:]) {
+				return nil
+			}
+			data = data[:i]
+		}
+		partial = append(partial[:0:0], data...)
+		if len(partial) > maxAuditLine {
+			partial = nil
+		}
+	}
+	emit(partial)
+	return nil
+}
+
+func (f *FileAuditLog) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
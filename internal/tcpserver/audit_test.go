@@ -0,0 +1,94 @@
+package tcpserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFileAuditLogRotation writes enough events to rotate the file several
+// times and reads them back across the rotated files.
+func TestFileAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := NewFileAuditLog(path, 1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < 100; i++ {
+		event := &AuditEvent{
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Kind:   AuditAPI,
+			Action: fmt.Sprintf("POST /api/%d", i),
+			Result: AuditSuccess,
+		}
+		if err := auditLog.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, err := auditLog.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 3 {
+		t.Fatalf("%d rotated files kept, want 3", len(rotated))
+	}
+
+	newest, err := auditLog.Query(AuditFilter{Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newest) != 5 || newest[0].Action != "POST /api/99" || newest[4].Action != "POST /api/95" {
+		t.Fatalf("newest events: %+v", newest)
+	}
+
+	since := start.Add(90 * time.Second)
+	recent, err := auditLog.Query(AuditFilter{Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 10 {
+		t.Errorf("%d events since %s, want 10", len(recent), since)
+	}
+
+	var scanned []string
+	err = auditLog.Scan(AuditFilter{Since: since}, func(event *AuditEvent) error {
+		scanned = append(scanned, event.Action)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != 10 || scanned[0] != "POST /api/90" || scanned[9] != "POST /api/99" {
+		t.Errorf("scanned events: %v", scanned)
+	}
+}
+
+// TestFileAuditLogRotationError checks a rotation that cannot list the
+// rotated files reports it. The bracket makes the file pattern invalid.
+func TestFileAuditLogRotationError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs[")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	auditLog, err := NewFileAuditLog(filepath.Join(dir, "audit.jsonl"), 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	event := &AuditEvent{Time: time.Now(), Kind: AuditAPI, Action: "GET /api/devices", Result: AuditSuccess}
+	if err := auditLog.Append(event); err != nil {
+		t.Fatal(err)
+	}
+	err = auditLog.Append(event)
+	if err == nil || !strings.Contains(err.Error(), "list rotated audit logs") {
+		t.Fatalf("append that rotated: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package tcpserver
+
+import (
+	"testing"
+
+	"device-agent/internal/security"
+)
+
+func TestForgedLoginKeepsNonce(t *testing.T) {
+	nonces := security.NewMemoryNonceStore()
+	server := startTestServer(t, func(config *Config) {
+		config.NonceStore = nonces
+	})
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	auth, authOK, err := device.login(testAppID, "s1", "wrong-key", nil)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if authOK.Success {
+		t.Fatal("login with the wrong key succeeded")
+	}
+	if nonces.HasNonce(auth.Nonce) {
+		t.Error("refused login used up the nonce")
+	}
+}
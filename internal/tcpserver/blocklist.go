@@ -0,0 +1,351 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"device-agent/internal/jsonfile"
+
+	"github.com/google/uuid"
+)
+
+const (
+	BlockBySN    = "sn"
+	BlockByAppID = "appid"
+	BlockByCIDR  = "cidr"
+)
+
+// BlockRule refuses logins from devices matching Type and Value: an SN, an
+// AppID, or a CIDR range of remote addresses. An SN rule with an AppID only
+// applies to that app's device.
+type BlockRule struct {
+	ID        string     `json:"rule_id"`
+	Type      string     `json:"type"`
+	Value     string     `json:"value"`
+	AppID     string     `json:"appid,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (r *BlockRule) expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// Matches reports whether the rule applies to a device. remoteAddr may
+// include a port.
+func (r *BlockRule) Matches(appID, sn, remoteAddr string) bool {
+	switch r.Type {
+	case BlockBySN:
+		return sn != "" && sn == r.Value && (r.AppID == "" || r.AppID == appID)
+	case BlockByAppID:
+		return appID != "" && appID == r.Value
+	case BlockByCIDR:
+		prefix, err := netip.ParsePrefix(r.Value)
+		if err != nil {
+			return false
+		}
+		addr, err := netip.ParseAddr(remoteHost(remoteAddr))
+		return err == nil && prefix.Contains(addr.Unmap())
+	}
+	return false
+}
+
+// normalize checks the rule and rewrites a bare IP address into a
+// single-address CIDR.
+func (r *BlockRule) normalize() error {
+	if r.Value == "" {
+		return fmt.Errorf("value is required")
+	}
+
+	if r.AppID != "" && r.Type != BlockBySN {
+		return fmt.Errorf("appid only applies to sn rules")
+	}
+
+	switch r.Type {
+	case BlockBySN, BlockByAppID:
+		return nil
+	case BlockByCIDR:
+		if prefix, err := netip.ParsePrefix(r.Value); err == nil {
+			r.Value = prefix.Masked().String()
+			return nil
+		}
+		addr, err := netip.ParseAddr(r.Value)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q", r.Value)
+		}
+		addr = addr.Unmap()
+		r.Value = netip.PrefixFrom(addr, addr.BitLen()).String()
+		return nil
+	default:
+		return fmt.Errorf("unknown block type %q", r.Type)
+	}
+}
+
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+type BlockStore interface {
+	Put(rule *BlockRule) error
+	Delete(id string) error
+	List() ([]*BlockRule, error)
+}
+
+var ErrBlockRuleNotFound = fmt.Errorf("block rule not found")
+
+type MemoryBlockStore struct {
+	rules map[string]*BlockRule
+	mu    sync.RWMutex
+}
+
+func NewMemoryBlockStore() *MemoryBlockStore {
+	return &MemoryBlockStore{
+		rules: make(map[string]*BlockRule),
+	}
+}
+
+func (m *MemoryBlockStore) Put(rule *BlockRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *rule
+	m.rules[rule.ID] = &copied
+	return nil
+}
+
+func (m *MemoryBlockStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.rules[id]; !exists {
+		return ErrBlockRuleNotFound
+	}
+	delete(m.rules, id)
+	return nil
+}
+
+// List returns every rule, oldest first.
+func (m *MemoryBlockStore) List() ([]*BlockRule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rules := make([]*BlockRule, 0, len(m.rules))
+	for _, rule := range m.rules {
+		copied := *rule
+		rules = append(rules, &copied)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+	return rules, nil
+}
+
+// FileBlockStore is a MemoryBlockStore persisted to a JSON file after every
+// change, so bans survive gateway restarts.
+type FileBlockStore struct {
+	*MemoryBlockStore
+	path    string
+	writeMu sync.Mutex
+}
+
+func NewFileBlockStore(path string) (*FileBlockStore, error) {
+	store := &FileBlockStore{
+		MemoryBlockStore: NewMemoryBlockStore(),
+		path:             path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("read block store: %w", err)
+	}
+
+	var rules []*BlockRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse block store: %w", err)
+	}
+	for _, rule := range rules {
+		store.rules[rule.ID] = rule
+	}
+	return store, nil
+}
+
+func (f *FileBlockStore) Put(rule *BlockRule) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryBlockStore.Put(rule); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileBlockStore) Delete(id string) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryBlockStore.Delete(id); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileBlockStore) save() error {
+	rules, err := f.MemoryBlockStore.List()
+	if err != nil {
+		return err
+	}
+	return jsonfile.Write(f.path, rules, 0o644)
+}
+
+// Blocklist checks logins against the block rules in its store.
+type Blocklist struct {
+	store BlockStore
+}
+
+func NewBlocklist(store BlockStore) *Blocklist {
+	return &Blocklist{store: store}
+}
+
+// Add validates and stores a new rule. Expired rules are dropped from the
+// store on every change rather than on reads.
+func (b *Blocklist) Add(rule *BlockRule) (*BlockRule, error) {
+	if err := rule.normalize(); err != nil {
+		return nil, err
+	}
+	rule.ID = uuid.New().String()
+	rule.CreatedAt = time.Now()
+	if err := b.store.Put(rule); err != nil {
+		return nil, err
+	}
+	b.prune(rule.CreatedAt)
+	return rule, nil
+}
+
+func (b *Blocklist) Remove(id string) error {
+	if err := b.store.Delete(id); err != nil {
+		return err
+	}
+	b.prune(time.Now())
+	return nil
+}
+
+// List returns the rules in force.
+func (b *Blocklist) List() ([]*BlockRule, error) {
+	rules, err := b.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := rules[:0]
+	for _, rule := range rules {
+		if !rule.expired(now) {
+			active = append(active, rule)
+		}
+	}
+	return active, nil
+}
+
+// prune deletes expired rules from the store.
+func (b *Blocklist) prune(now time.Time) {
+	rules, err := b.store.List()
+	if err != nil {
+		return
+	}
+	for _, rule := range rules {
+		if rule.expired(now) {
+			b.store.Delete(rule.ID)
+		}
+	}
+}
+
+// Match returns the first rule in force that applies to a device, or nil.
+func (b *Blocklist) Match(appID, sn, remoteAddr string) (*BlockRule, error) {
+	rules, err := b.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, rule := range rules {
+		if !rule.expired(now) && rule.Matches(appID, sn, remoteAddr) {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+const (
+	minReconnectPenalty = time.Second
+	maxReconnectPenalty = 5 * time.Minute
+)
+
+// reconnectLimiter turns away devices or addresses whose logins keep being
+// refused. Each refusal doubles how long the key is refused, up to
+// maxReconnectPenalty; the count is forgotten after a quiet period.
+type reconnectLimiter struct {
+	penalties map[string]*reconnectPenalty
+	mu        sync.Mutex
+}
+
+type reconnectPenalty struct {
+	strikes int
+	until   time.Time
+}
+
+func newReconnectLimiter() *reconnectLimiter {
+	return &reconnectLimiter{
+		penalties: make(map[string]*reconnectPenalty),
+	}
+}
+
+// Penalize records a refused login for key and returns how long it will be
+// turned away.
+func (l *reconnectLimiter) Penalize(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, p := range l.penalties {
+		if now.Sub(p.until) > maxReconnectPenalty {
+			delete(l.penalties, k)
+		}
+	}
+
+	p, exists := l.penalties[key]
+	if !exists {
+		p = &reconnectPenalty{}
+		l.penalties[key] = p
+	}
+
+	wait := minReconnectPenalty << p.strikes
+	if wait > maxReconnectPenalty || wait <= 0 {
+		wait = maxReconnectPenalty
+	} else {
+		p.strikes++
+	}
+	p.until = now.Add(wait)
+	return wait
+}
+
+// Refused reports whether key is still serving a penalty.
+func (l *reconnectLimiter) Refused(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, exists := l.penalties[key]
+	return exists && time.Now().Before(p.until)
+}
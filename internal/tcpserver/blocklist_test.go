@@ -0,0 +1,176 @@
+package tcpserver
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlockRuleMatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		rule       BlockRule
+		appID      string
+		sn         string
+		remoteAddr string
+		want       bool
+	}{
+		{"sn in any app", BlockRule{Type: BlockBySN, Value: "s1"}, "A2", "s1", "10.0.0.1:5000", true},
+		{"other sn", BlockRule{Type: BlockBySN, Value: "s1"}, testAppID, "s2", "10.0.0.1:5000", false},
+		{"sn of the app", BlockRule{Type: BlockBySN, Value: "s1", AppID: testAppID}, testAppID, "s1", "", true},
+		{"sn of another app", BlockRule{Type: BlockBySN, Value: "s1", AppID: testAppID}, "A2", "s1", "", false},
+		{"app", BlockRule{Type: BlockByAppID, Value: testAppID}, testAppID, "s9", "", true},
+		{"other app", BlockRule{Type: BlockByAppID, Value: testAppID}, "A2", "s9", "", false},
+		{"address in range", BlockRule{Type: BlockByCIDR, Value: "10.0.0.0/8"}, testAppID, "s1", "10.1.2.3:5000", true},
+		{"address outside range", BlockRule{Type: BlockByCIDR, Value: "10.0.0.0/8"}, testAppID, "s1", "192.168.0.1:5000", false},
+		{"mapped address", BlockRule{Type: BlockByCIDR, Value: "10.0.0.0/8"}, testAppID, "s1", "[::ffff:10.1.2.3]:5000", true},
+		{"address without port", BlockRule{Type: BlockByCIDR, Value: "10.0.0.0/8"}, testAppID, "s1", "10.1.2.3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Matches(tt.appID, tt.sn, tt.remoteAddr); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlocklistAdd(t *testing.T) {
+	blocklist := NewBlocklist(NewMemoryBlockStore())
+
+	tests := []struct {
+		name  string
+		rule  BlockRule
+		value string
+		ok    bool
+	}{
+		{"bare address", BlockRule{Type: BlockByCIDR, Value: "10.1.2.3"}, "10.1.2.3/32", true},
+		{"unmasked range", BlockRule{Type: BlockByCIDR, Value: "10.1.2.3/16"}, "10.1.0.0/16", true},
+		{"sn with app", BlockRule{Type: BlockBySN, Value: "s1", AppID: testAppID}, "s1", true},
+		{"no value", BlockRule{Type: BlockBySN}, "", false},
+		{"invalid range", BlockRule{Type: BlockByCIDR, Value: "10.1.2"}, "", false},
+		{"app on an address rule", BlockRule{Type: BlockByCIDR, Value: "10.1.2.3", AppID: testAppID}, "", false},
+		{"unknown type", BlockRule{Type: "mac", Value: "00:11:22:33:44:55"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			added, err := blocklist.Add(&rule)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Add: %v", err)
+			}
+			if err == nil && (added.ID == "" || added.Value != tt.value) {
+				t.Errorf("added %+v", added)
+			}
+		})
+	}
+}
+
+func TestBlocklistExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.json")
+	store, err := NewFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocklist := NewBlocklist(store)
+
+	past := time.Now().Add(-time.Second)
+	expired, err := blocklist.Add(&BlockRule{Type: BlockBySN, Value: "s1", ExpiresAt: &past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	active, err := blocklist.Add(&BlockRule{Type: BlockBySN, Value: "s2", Reason: "stolen", ExpiresAt: &future})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rule, _ := blocklist.Match(testAppID, "s1", ""); rule != nil {
+		t.Errorf("expired rule matched: %+v", rule)
+	}
+	if rule, _ := blocklist.Match(testAppID, "s2", ""); rule == nil || rule.ID != active.ID {
+		t.Errorf("active rule: %+v", rule)
+	}
+
+	reopened, err := NewFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ := NewBlocklist(reopened).List()
+	if len(rules) != 1 || rules[0].ID != active.ID || rules[0].Reason != "stolen" {
+		t.Errorf("rules after reopening: %+v", rules)
+	}
+	if err := reopened.Delete(expired.ID); err != ErrBlockRuleNotFound {
+		t.Errorf("expired rule still stored: %v", err)
+	}
+}
+
+func TestReconnectLimiter(t *testing.T) {
+	limiter := newReconnectLimiter()
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		if wait := limiter.Penalize("A1/s1"); wait != want {
+			t.Errorf("penalty %s, want %s", wait, want)
+		}
+	}
+	if !limiter.Refused("A1/s1") {
+		t.Error("penalized key not refused")
+	}
+	if limiter.Refused("A1/s2") {
+		t.Error("other key refused")
+	}
+
+	for i := 0; i < 20; i++ {
+		limiter.Penalize("A1/s3")
+	}
+	if wait := limiter.Penalize("A1/s3"); wait != maxReconnectPenalty {
+		t.Errorf("penalty %s, want the maximum %s", wait, maxReconnectPenalty)
+	}
+}
+
+// TestBlockedLogin checks a blocked device is refused with the rule's
+// reason and then throttled.
+func TestBlockedLogin(t *testing.T) {
+	server := startTestServer(t, nil)
+	if _, err := server.GetBlocklist().Add(&BlockRule{Type: BlockBySN, Value: "s1", AppID: testAppID, Reason: "stolen"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"device blocked: stolen", "too many refused logins, retry later"} {
+		device := dialTestDevice(t, serverAddr(server), nil)
+		_, authOK, err := device.login(testAppID, "s1", testKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authOK.Success || authOK.Message != want {
+			t.Errorf("login answered %+v, want %q", authOK, want)
+		}
+	}
+
+	// The penalty is per device, so other devices on the address log in.
+	other := dialTestDevice(t, serverAddr(server), nil)
+	other.mustLogin(testAppID, "s2", testKey)
+}
+
+// TestBlockedAddress checks an address rule refuses every device from the
+// address and then turns its connections away before login.
+func TestBlockedAddress(t *testing.T) {
+	server := startTestServer(t, nil)
+	if _, err := server.GetBlocklist().Add(&BlockRule{Type: BlockByCIDR, Value: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	_, authOK, err := device.login(testAppID, "s1", testKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authOK.Success || authOK.Message != "device blocked" {
+		t.Errorf("login answered %+v", authOK)
+	}
+
+	other := dialTestDevice(t, serverAddr(server), nil)
+	if _, _, err := other.login(testAppID, "s2", testKey, nil); err == nil {
+		t.Error("penalized address got to log in")
+	}
+}
@@ -0,0 +1,601 @@
+package tcpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSendPath  = "/cluster/v1/send"
+	clusterReplyPath = "/cluster/v1/reply"
+	clusterFlushPath = "/cluster/v1/flush"
+	// clusterRPCTimeout bounds every call to another node.
+	clusterRPCTimeout = 5 * time.Second
+	// clusterReplyQueueSize is how many ACKs and progress updates may wait
+	// to be sent back to the nodes that forwarded their commands.
+	clusterReplyQueueSize = 1024
+
+	// minClusterSecretLength is the shortest secret a node accepts.
+	minClusterSecretLength = 24
+	// clusterSecretPlaceholder marks the example secret in
+	// configs/gateway.yaml.
+	clusterSecretPlaceholder = "change-me"
+)
+
+var (
+	// ErrDeviceOffline means the node the registry named no longer has the
+	// device.
+	ErrDeviceOffline = fmt.Errorf("device offline")
+)
+
+// ClusterConfig turns on cluster mode. Every node records the devices
+// connected to it in a shared registry, and commands for devices on other
+// nodes are forwarded to them over an internal HTTP listener. That
+// listener only needs to be reachable by the other nodes; bind RPCAddr to
+// a private address, and use TLS when the network between nodes is not
+// trusted.
+type ClusterConfig struct {
+	// NodeID names this node; it defaults to the advertised address.
+	NodeID string
+	// RPCAddr is where this node listens for requests from other nodes.
+	RPCAddr string
+	// AdvertiseAddr is the address other nodes dial. It defaults to the
+	// listening address, with this machine's hostname when listening on
+	// every interface.
+	AdvertiseAddr string
+	// Secret must be the same on every node; requests without it are
+	// refused. It must be a random string of at least 24 characters.
+	Secret string
+	// NodeTTL is how long a node counts as alive after its last heartbeat.
+	NodeTTL time.Duration
+	// TLS, when enabled, serves the listener over TLS and dials other nodes
+	// over TLS, presenting the same certificate and verifying theirs with
+	// CAFile.
+	TLS *TLSConfig
+}
+
+// clusterSendRequest asks the node that owns a device to send it a command.
+// Origin is the node to send the ACK and progress back to.
+type clusterSendRequest struct {
+	AppID     string          `json:"appid"`
+	SN        string          `json:"sn"`
+	Command   *CommandMessage `json:"command"`
+	RequestID string          `json:"request_id,omitempty"`
+	Origin    string          `json:"origin"`
+}
+
+// clusterReplyRequest carries a device's ACK or progress update back to the
+// node that forwarded the command.
+type clusterReplyRequest struct {
+	ACK      *ACKMessage      `json:"ack,omitempty"`
+	Progress *ProgressMessage `json:"progress,omitempty"`
+}
+
+// clusterFlushRequest asks a node to forward the commands it queued for a
+// device to the node the device is now connected to.
+type clusterFlushRequest struct {
+	AppID string `json:"appid"`
+	SN    string `json:"sn"`
+}
+
+type clusterResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// clusterReply is a reply waiting to be sent back to its origin node.
+type clusterReply struct {
+	origin string
+	reply  clusterReplyRequest
+}
+
+// Cluster connects a server to the other nodes of its cluster. A nil
+// *Cluster is a server running on its own.
+type Cluster struct {
+	config   ClusterConfig
+	node     ClusterNode
+	registry ClusterRegistry
+	ttl      time.Duration
+
+	sessionManager *SessionManager
+	commandLedger  *CommandLedger
+	commandQueue   *CommandQueue
+	// replied applies an ACK or progress update for a command this node
+	// forwarded.
+	replied func(record *CommandRecord, reply *clusterReplyRequest)
+	logger  *slog.Logger
+
+	scheme     string
+	client     *http.Client
+	httpServer *http.Server
+	replies    chan clusterReply
+	done       chan struct{}
+	wg         sync.WaitGroup
+	// stopped is set under stopMu once Stop begins, after which no work is
+	// added to wg.
+	stopped bool
+	stopMu  sync.Mutex
+}
+
+func NewCluster(config ClusterConfig, registry ClusterRegistry) *Cluster {
+	ttl := config.NodeTTL
+	if ttl <= 0 {
+		ttl = DefaultClusterNodeTTL
+	}
+	return &Cluster{
+		config:   config,
+		node:     ClusterNode{ID: config.NodeID, Addr: config.AdvertiseAddr},
+		registry: registry,
+		ttl:      ttl,
+		scheme:   "http",
+		client:   &http.Client{Timeout: clusterRPCTimeout},
+		replies:  make(chan clusterReply, clusterReplyQueueSize),
+		logger:   slog.Default(),
+		done:     make(chan struct{}),
+	}
+}
+
+// NodeID returns this node's ID once it has started, or "" for a server
+// running on its own.
+func (c *Cluster) NodeID() string {
+	if c == nil {
+		return ""
+	}
+	return c.node.ID
+}
+
+// Registry returns the shared registry.
+func (c *Cluster) Registry() ClusterRegistry {
+	return c.registry
+}
+
+// Start joins the cluster and serves requests from other nodes.
+func (c *Cluster) Start() error {
+	if c == nil {
+		return nil
+	}
+	if c.config.RPCAddr == "" {
+		return fmt.Errorf("cluster rpc address is required")
+	}
+	secret := c.config.Secret
+	if len(secret) < minClusterSecretLength || strings.HasPrefix(secret, clusterSecretPlaceholder) {
+		return fmt.Errorf("cluster secret must be a random string of at least %d characters", minClusterSecretLength)
+	}
+
+	listener, err := net.Listen("tcp", c.config.RPCAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", c.config.RPCAddr, err)
+	}
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("cluster listen address: %w", err)
+	}
+	everyInterface := net.ParseIP(host).IsUnspecified()
+
+	if tlsConfig := c.config.TLS; tlsConfig != nil && tlsConfig.Enable {
+		serverConfig, err := tlsConfig.serverConfig()
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("cluster TLS: %w", err)
+		}
+		clientConfig, err := tlsConfig.clientConfig()
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("cluster TLS: %w", err)
+		}
+		listener = tls.NewListener(listener, serverConfig)
+		c.client.Transport = &http.Transport{TLSClientConfig: clientConfig}
+		c.scheme = "https"
+	} else if everyInterface {
+		c.logger.Warn("Cluster RPC listens on every interface without TLS; bind rpc_addr to a private address", "addr", c.config.RPCAddr)
+	}
+
+	if c.node.Addr == "" {
+		if everyInterface {
+			host, err = os.Hostname()
+		}
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("cluster advertise address: %w", err)
+		}
+		c.node.Addr = net.JoinHostPort(host, port)
+	}
+	if c.node.ID == "" {
+		c.node.ID = c.node.Addr
+	}
+
+	if err := c.registry.Heartbeat(c.node, nil); err != nil {
+		listener.Close()
+		return fmt.Errorf("join cluster: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(clusterSendPath, c.authorize(c.handleSend))
+	mux.HandleFunc(clusterReplyPath, c.authorize(c.handleReply))
+	mux.HandleFunc(clusterFlushPath, c.authorize(c.handleFlush))
+	c.httpServer = &http.Server{Handler: mux}
+
+	c.wg.Add(3)
+	go func() {
+		defer c.wg.Done()
+		if err := c.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			c.logger.Error("Cluster RPC server failed", "error", err)
+		}
+	}()
+	go c.heartbeatLoop()
+	go c.replyLoop()
+
+	c.logger.Info("Joined cluster", "node_id", c.node.ID, "addr", c.node.Addr, "tls", c.scheme == "https")
+	return nil
+}
+
+// Stop leaves the cluster, dropping this node's claims. Replies not yet
+// sent back to other nodes are dropped.
+func (c *Cluster) Stop() {
+	if c == nil {
+		return
+	}
+	c.stopMu.Lock()
+	stopped := c.stopped
+	c.stopped = true
+	c.stopMu.Unlock()
+	if stopped {
+		return
+	}
+
+	close(c.done)
+	if c.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c.httpServer.Shutdown(ctx)
+		cancel()
+	}
+	c.wg.Wait()
+
+	if err := c.registry.Leave(c.node.ID); err != nil {
+		c.logger.Error("Failed to leave cluster", "error", err)
+	}
+}
+
+// heartbeatLoop keeps this node alive in the registry and claims its
+// devices again, in case a claim was lost.
+func (c *Cluster) heartbeatLoop() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.registry.Heartbeat(c.node, c.sessionManager.GetOnlineDevices()); err != nil {
+				c.logger.Error("Cluster heartbeat failed", "error", err)
+			}
+		}
+	}
+}
+
+// claim records that session's device is connected here, and asks the
+// nodes holding queued commands for it to send them over.
+func (c *Cluster) claim(session *Session) {
+	if c == nil {
+		return
+	}
+	if err := c.registry.Claim(session.AppID, session.SN, c.node.ID); err != nil {
+		session.log.Error("Failed to claim device in cluster", "error", err)
+		return
+	}
+
+	nodes, err := c.registry.TakeQueued(session.AppID, session.SN)
+	if err != nil {
+		session.log.Error("Failed to look up queued commands in cluster", "error", err)
+		return
+	}
+	for _, node := range nodes {
+		if node.ID == c.node.ID {
+			continue
+		}
+		node := node
+		c.spawn(func() {
+			req := &clusterFlushRequest{AppID: session.AppID, SN: session.SN}
+			if _, err := c.call(&node, clusterFlushPath, req); err != nil {
+				session.log.Error("Failed to collect queued commands", "node_id", node.ID, "error", err)
+			}
+		})
+	}
+}
+
+// release drops the claim on session's device unless it has already
+// reconnected here.
+func (c *Cluster) release(session *Session) {
+	if c == nil || session.SN == "" {
+		return
+	}
+	if _, online := c.sessionManager.GetByDevice(session.AppID, session.SN); online {
+		return
+	}
+	if err := c.registry.Release(session.AppID, session.SN, c.node.ID); err != nil {
+		session.log.Error("Failed to release device in cluster", "error", err)
+	}
+}
+
+// Owner returns the other node a device is connected to. It returns
+// ErrNoOwner when no live node has the device, or when this node has it.
+func (c *Cluster) Owner(appID, sn string) (*ClusterNode, error) {
+	if c == nil {
+		return nil, ErrNoOwner
+	}
+	owner, err := c.registry.Owner(appID, sn)
+	if err != nil {
+		return nil, err
+	}
+	if owner.ID == c.node.ID {
+		return nil, ErrNoOwner
+	}
+	return owner, nil
+}
+
+// Forward asks owner to send cmd to a device connected to it. The command is
+// recorded here too, and the owner sends its ACK and progress back, so it
+// can be followed and waited for on this node like a local one. It returns
+// ErrDeviceOffline if the owner no longer has the device.
+func (c *Cluster) Forward(owner *ClusterNode, appID, sn string, cmd *CommandMessage, requestID string) error {
+	c.commandLedger.recordForwarded(appID, sn, cmd, requestID, owner.ID)
+
+	status, err := c.call(owner, clusterSendPath, &clusterSendRequest{
+		AppID:     appID,
+		SN:        sn,
+		Command:   cmd,
+		RequestID: requestID,
+		Origin:    c.node.ID,
+	})
+	if status == http.StatusNotFound {
+		err = ErrDeviceOffline
+	}
+	if err != nil {
+		c.commandLedger.RecordFailed(cmd.CmdID, err)
+		return err
+	}
+	return nil
+}
+
+// MarkQueued notes in the registry that this node queued commands for a
+// device, so the node it connects to next collects them. If the device
+// connected elsewhere meanwhile, they are sent there right away.
+func (c *Cluster) MarkQueued(appID, sn string) {
+	if c == nil {
+		return
+	}
+	if err := c.registry.MarkQueued(appID, sn, c.node.ID); err != nil {
+		c.logger.Error("Failed to mark queued commands in cluster", "appid", appID, "sn", sn, "error", err)
+		return
+	}
+	if _, err := c.Owner(appID, sn); err == nil {
+		c.spawn(func() { c.flushQueued(appID, sn) })
+	}
+}
+
+// spawn runs fn in a goroutine Stop waits for. Once Stop has begun, fn is
+// dropped and spawn reports false.
+func (c *Cluster) spawn(fn func()) bool {
+	c.stopMu.Lock()
+	defer c.stopMu.Unlock()
+
+	if c.stopped {
+		return false
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// flushQueued forwards the commands queued here for a device to the node it
+// is connected to. Commands that could not be sent stay queued and marked.
+func (c *Cluster) flushQueued(appID, sn string) {
+	owner, err := c.Owner(appID, sn)
+	if err != nil {
+		return
+	}
+
+	delivered, err := c.commandQueue.Flush(appID, sn, func(cmd *CommandMessage, requestID string) error {
+		return c.Forward(owner, appID, sn, cmd, requestID)
+	})
+	if err != nil {
+		c.logger.Error("Failed to persist command queue", "error", err)
+	}
+	if delivered > 0 {
+		c.logger.Info("Forwarded queued commands", "appid", appID, "sn", sn, "node_id", owner.ID, "count", delivered)
+	}
+	if c.commandQueue.PendingCount(appID, sn) > 0 {
+		if err := c.registry.MarkQueued(appID, sn, c.node.ID); err != nil {
+			c.logger.Error("Failed to mark queued commands in cluster", "appid", appID, "sn", sn, "error", err)
+		}
+	}
+}
+
+// returnReply queues an ACK or progress update to be sent back to the node
+// that forwarded its command, and reports whether the command was
+// forwarded. Replies are dropped, with a warning, when the queue is full;
+// the origin then times the command out.
+func (c *Cluster) returnReply(cmdID string, reply clusterReplyRequest) bool {
+	if c == nil {
+		return false
+	}
+	record, exists := c.commandLedger.Get(cmdID)
+	if !exists || record.Origin == "" || record.Origin == c.node.ID {
+		return false
+	}
+
+	select {
+	case c.replies <- clusterReply{origin: record.Origin, reply: reply}:
+	default:
+		c.logger.Warn("Cluster reply queue full, dropping reply", "node_id", record.Origin, "cmd_id", cmdID)
+	}
+	return true
+}
+
+// replyLoop sends replies back to their origin nodes in order.
+func (c *Cluster) replyLoop() {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case reply := <-c.replies:
+			origin, err := c.lookupNode(reply.origin)
+			if err == nil {
+				_, err = c.call(origin, clusterReplyPath, &reply.reply)
+			}
+			if err != nil {
+				c.logger.Warn("Failed to return reply to origin node", "node_id", reply.origin, "error", err)
+			}
+		}
+	}
+}
+
+func (c *Cluster) lookupNode(nodeID string) (*ClusterNode, error) {
+	nodes, err := c.registry.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		if node.ID == nodeID {
+			return &node, nil
+		}
+	}
+	return nil, fmt.Errorf("node %s is not alive", nodeID)
+}
+
+// call posts req to path on node and returns the response status. Any
+// status but 200 and 202 is an error.
+func (c *Cluster) call(node *ClusterNode, path string, req interface{}) (int, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, c.scheme+"://"+node.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+c.config.Secret)
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("call node %s: %w", node.ID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		return resp.StatusCode, nil
+	}
+	var result clusterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Error == "" {
+		result.Error = resp.Status
+	}
+	return resp.StatusCode, fmt.Errorf("call node %s: %s", node.ID, result.Error)
+}
+
+// authorize refuses requests that are not POSTs carrying the cluster
+// secret.
+func (c *Cluster) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + c.config.Secret)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeClusterResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeClusterResponse(w, http.StatusUnauthorized, "invalid cluster secret")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleSend sends a command forwarded by another node to a device
+// connected here.
+func (c *Cluster) handleSend(w http.ResponseWriter, r *http.Request) {
+	var req clusterSendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Command == nil || req.Command.CmdID == "" {
+		writeClusterResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	session, exists := c.sessionManager.GetByDevice(req.AppID, req.SN)
+	if !exists {
+		writeClusterResponse(w, http.StatusNotFound, ErrDeviceOffline.Error())
+		return
+	}
+
+	if err := c.commandLedger.sendTracked(session, req.Command, req.RequestID, req.Origin); err != nil {
+		writeClusterResponse(w, http.StatusInternalServerError, "failed to send command: "+err.Error())
+		return
+	}
+	writeClusterResponse(w, http.StatusOK, "")
+}
+
+// handleReply applies an ACK or progress update for a command this node
+// forwarded.
+func (c *Cluster) handleReply(w http.ResponseWriter, r *http.Request) {
+	var req clusterReplyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.ACK == nil) == (req.Progress == nil) {
+		writeClusterResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	cmdID := ""
+	if req.ACK != nil {
+		cmdID = req.ACK.CmdID
+	} else {
+		cmdID = req.Progress.CmdID
+	}
+	record, exists := c.commandLedger.Get(cmdID)
+	if !exists || record.Node == "" {
+		writeClusterResponse(w, http.StatusNotFound, "command not found")
+		return
+	}
+
+	c.replied(record, &req)
+	writeClusterResponse(w, http.StatusOK, "")
+}
+
+// handleFlush forwards the commands queued here for a device that has
+// connected to another node.
+func (c *Cluster) handleFlush(w http.ResponseWriter, r *http.Request) {
+	var req clusterFlushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SN == "" {
+		writeClusterResponse(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if !c.spawn(func() { c.flushQueued(req.AppID, req.SN) }) {
+		writeClusterResponse(w, http.StatusServiceUnavailable, "node stopping")
+		return
+	}
+	writeClusterResponse(w, http.StatusAccepted, "")
+}
+
+func writeClusterResponse(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&clusterResponse{Error: message})
+}
@@ -0,0 +1,476 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"device-agent/internal/jsonfile"
+)
+
+const DefaultClusterNodeTTL = 15 * time.Second
+
+var ErrNoOwner = fmt.Errorf("device is not connected to any node")
+
+// ClusterNode is a gateway instance taking part in a cluster. Addr is where
+// other nodes reach its internal RPC listener.
+type ClusterNode struct {
+	ID       string    `json:"node_id"`
+	Addr     string    `json:"addr"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (n *ClusterNode) alive(now time.Time, ttl time.Duration) bool {
+	return now.Sub(n.LastSeen) < ttl
+}
+
+// clusterClaim records which node a device is connected to.
+type clusterClaim struct {
+	AppID     string    `json:"appid"`
+	SN        string    `json:"sn"`
+	NodeID    string    `json:"node_id"`
+	ClaimedAt time.Time `json:"claimed_at"`
+}
+
+// ClusterRegistry is shared by every node of a cluster. It knows which
+// nodes are alive and which node each online device is connected to.
+// Claims of nodes that stop sending heartbeats are ignored once the nodes
+// are older than the registry's TTL.
+type ClusterRegistry interface {
+	// Heartbeat records that node is alive and that devices are connected
+	// to it. Devices another live node has claimed since are left to it.
+	Heartbeat(node ClusterNode, devices []DeviceRef) error
+	// Claim records that a device is connected to nodeID, replacing any
+	// other node's claim.
+	Claim(appID, sn, nodeID string) error
+	// Release drops the claim on a device if nodeID still holds it.
+	Release(appID, sn, nodeID string) error
+	// Owner returns the live node a device is connected to, or ErrNoOwner.
+	Owner(appID, sn string) (*ClusterNode, error)
+	// FindBySN returns the devices with sn connected to live nodes.
+	FindBySN(sn string) ([]DeviceRef, error)
+	// Nodes returns the live nodes, ordered by ID.
+	Nodes() ([]ClusterNode, error)
+	// Leave removes a node and its claims.
+	Leave(nodeID string) error
+	// MarkQueued records that nodeID holds queued commands for a device.
+	MarkQueued(appID, sn, nodeID string) error
+	// TakeQueued returns the live nodes holding queued commands for a
+	// device and forgets them.
+	TakeQueued(appID, sn string) ([]ClusterNode, error)
+}
+
+// clusterState is the contents of a registry.
+type clusterState struct {
+	Nodes  map[string]*ClusterNode  `json:"nodes"`
+	Claims map[string]*clusterClaim `json:"claims"` // deviceKey -> claim
+	Queued map[string][]string      `json:"queued"` // deviceKey -> node ids
+}
+
+func newClusterState() *clusterState {
+	return &clusterState{
+		Nodes:  make(map[string]*ClusterNode),
+		Claims: make(map[string]*clusterClaim),
+		Queued: make(map[string][]string),
+	}
+}
+
+// heartbeat refreshes node and claims its devices that no other live node
+// holds. A device that reconnected to another node is claimed by that node
+// when it logs in, so the older session here must not take it back.
+func (s *clusterState) heartbeat(node ClusterNode, devices []DeviceRef, ttl time.Duration) {
+	s.prune(ttl)
+	now := time.Now()
+	node.LastSeen = now
+	s.Nodes[node.ID] = &node
+	for _, device := range devices {
+		claim, exists := s.Claims[deviceKey(device.AppID, device.SN)]
+		if exists && claim.NodeID == node.ID {
+			continue
+		}
+		if exists {
+			if holder, alive := s.Nodes[claim.NodeID]; alive && holder.alive(now, ttl) {
+				continue
+			}
+		}
+		s.claim(device.AppID, device.SN, node.ID)
+	}
+}
+
+func (s *clusterState) claim(appID, sn, nodeID string) {
+	s.Claims[deviceKey(appID, sn)] = &clusterClaim{
+		AppID:     appID,
+		SN:        sn,
+		NodeID:    nodeID,
+		ClaimedAt: time.Now(),
+	}
+}
+
+func (s *clusterState) release(appID, sn, nodeID string) bool {
+	key := deviceKey(appID, sn)
+	if claim, exists := s.Claims[key]; exists && claim.NodeID == nodeID {
+		delete(s.Claims, key)
+		return true
+	}
+	return false
+}
+
+func (s *clusterState) owner(appID, sn string, ttl time.Duration) (*ClusterNode, error) {
+	claim, exists := s.Claims[deviceKey(appID, sn)]
+	if !exists {
+		return nil, ErrNoOwner
+	}
+	node, exists := s.Nodes[claim.NodeID]
+	if !exists || !node.alive(time.Now(), ttl) {
+		return nil, ErrNoOwner
+	}
+	copied := *node
+	return &copied, nil
+}
+
+func (s *clusterState) findBySN(sn string, ttl time.Duration) []DeviceRef {
+	now := time.Now()
+	var devices []DeviceRef
+	for _, claim := range s.Claims {
+		if claim.SN != sn {
+			continue
+		}
+		if node, exists := s.Nodes[claim.NodeID]; exists && node.alive(now, ttl) {
+			devices = append(devices, DeviceRef{AppID: claim.AppID, SN: claim.SN})
+		}
+	}
+	return devices
+}
+
+func (s *clusterState) nodes(ttl time.Duration) []ClusterNode {
+	now := time.Now()
+	nodes := make([]ClusterNode, 0, len(s.Nodes))
+	for _, node := range s.Nodes {
+		if node.alive(now, ttl) {
+			nodes = append(nodes, *node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+func (s *clusterState) markQueued(appID, sn, nodeID string) {
+	key := deviceKey(appID, sn)
+	if !containsString(s.Queued[key], nodeID) {
+		s.Queued[key] = append(s.Queued[key], nodeID)
+	}
+}
+
+// takeQueued returns the live nodes queuing commands for a device. Dead
+// nodes stay marked until they come back or are pruned.
+func (s *clusterState) takeQueued(appID, sn string, ttl time.Duration) []ClusterNode {
+	key := deviceKey(appID, sn)
+	now := time.Now()
+	var nodes []ClusterNode
+	var dead []string
+	for _, nodeID := range s.Queued[key] {
+		if node, exists := s.Nodes[nodeID]; exists && node.alive(now, ttl) {
+			nodes = append(nodes, *node)
+		} else {
+			dead = append(dead, nodeID)
+		}
+	}
+	if len(dead) == 0 {
+		delete(s.Queued, key)
+	} else {
+		s.Queued[key] = dead
+	}
+	return nodes
+}
+
+func (s *clusterState) leave(nodeID string, ttl time.Duration) {
+	delete(s.Nodes, nodeID)
+	s.prune(ttl)
+}
+
+// prune forgets nodes that have been dead for a while, and the claims of
+// nodes it no longer knows.
+func (s *clusterState) prune(ttl time.Duration) {
+	now := time.Now()
+	for id, node := range s.Nodes {
+		if now.Sub(node.LastSeen) > 10*ttl {
+			delete(s.Nodes, id)
+		}
+	}
+	for key, claim := range s.Claims {
+		if _, exists := s.Nodes[claim.NodeID]; !exists {
+			delete(s.Claims, key)
+		}
+	}
+	for key, nodeIDs := range s.Queued {
+		known := nodeIDs[:0]
+		for _, nodeID := range nodeIDs {
+			if _, exists := s.Nodes[nodeID]; exists {
+				known = append(known, nodeID)
+			}
+		}
+		if len(known) == 0 {
+			delete(s.Queued, key)
+		} else {
+			s.Queued[key] = known
+		}
+	}
+}
+
+// MemoryClusterRegistry is a registry for nodes running in one process,
+// such as several servers started by a test.
+type MemoryClusterRegistry struct {
+	state *clusterState
+	ttl   time.Duration
+	mu    sync.RWMutex
+}
+
+func NewMemoryClusterRegistry(ttl time.Duration) *MemoryClusterRegistry {
+	if ttl <= 0 {
+		ttl = DefaultClusterNodeTTL
+	}
+	return &MemoryClusterRegistry{
+		state: newClusterState(),
+		ttl:   ttl,
+	}
+}
+
+func (m *MemoryClusterRegistry) Heartbeat(node ClusterNode, devices []DeviceRef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.heartbeat(node, devices, m.ttl)
+	return nil
+}
+
+func (m *MemoryClusterRegistry) Claim(appID, sn, nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.claim(appID, sn, nodeID)
+	return nil
+}
+
+func (m *MemoryClusterRegistry) Release(appID, sn, nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.release(appID, sn, nodeID)
+	return nil
+}
+
+func (m *MemoryClusterRegistry) Owner(appID, sn string) (*ClusterNode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.owner(appID, sn, m.ttl)
+}
+
+func (m *MemoryClusterRegistry) FindBySN(sn string) ([]DeviceRef, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.findBySN(sn, m.ttl), nil
+}
+
+func (m *MemoryClusterRegistry) Nodes() ([]ClusterNode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.nodes(m.ttl), nil
+}
+
+func (m *MemoryClusterRegistry) Leave(nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.leave(nodeID, m.ttl)
+	return nil
+}
+
+func (m *MemoryClusterRegistry) MarkQueued(appID, sn, nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.markQueued(appID, sn, nodeID)
+	return nil
+}
+
+func (m *MemoryClusterRegistry) TakeQueued(appID, sn string) ([]ClusterNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.takeQueued(appID, sn, m.ttl), nil
+}
+
+const (
+	clusterLockRetry   = 10 * time.Millisecond
+	clusterLockTimeout = 5 * time.Second
+)
+
+// FileClusterRegistry keeps the registry in a JSON file that every node on
+// the machine points at, so several gateway processes can form a cluster
+// without any other infrastructure. Changes are serialized with an OS file
+// lock on a file next to it, which is released if its holder crashes.
+type FileClusterRegistry struct {
+	path string
+	ttl  time.Duration
+}
+
+func NewFileClusterRegistry(path string, ttl time.Duration) (*FileClusterRegistry, error) {
+	if ttl <= 0 {
+		ttl = DefaultClusterNodeTTL
+	}
+	// The lock file lives next to the registry, so its directory has to
+	// exist before the first update.
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create directory: %w", err)
+		}
+	}
+	registry := &FileClusterRegistry{
+		path: path,
+		ttl:  ttl,
+	}
+	if _, err := registry.read(); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+func (f *FileClusterRegistry) Heartbeat(node ClusterNode, devices []DeviceRef) error {
+	return f.update(func(state *clusterState) bool {
+		state.heartbeat(node, devices, f.ttl)
+		return true
+	})
+}
+
+func (f *FileClusterRegistry) Claim(appID, sn, nodeID string) error {
+	return f.update(func(state *clusterState) bool {
+		state.claim(appID, sn, nodeID)
+		return true
+	})
+}
+
+func (f *FileClusterRegistry) Release(appID, sn, nodeID string) error {
+	return f.update(func(state *clusterState) bool {
+		return state.release(appID, sn, nodeID)
+	})
+}
+
+func (f *FileClusterRegistry) Owner(appID, sn string) (*ClusterNode, error) {
+	state, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return state.owner(appID, sn, f.ttl)
+}
+
+func (f *FileClusterRegistry) FindBySN(sn string) ([]DeviceRef, error) {
+	state, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return state.findBySN(sn, f.ttl), nil
+}
+
+func (f *FileClusterRegistry) Nodes() ([]ClusterNode, error) {
+	state, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	return state.nodes(f.ttl), nil
+}
+
+func (f *FileClusterRegistry) Leave(nodeID string) error {
+	return f.update(func(state *clusterState) bool {
+		state.leave(nodeID, f.ttl)
+		return true
+	})
+}
+
+func (f *FileClusterRegistry) MarkQueued(appID, sn, nodeID string) error {
+	return f.update(func(state *clusterState) bool {
+		state.markQueued(appID, sn, nodeID)
+		return true
+	})
+}
+
+func (f *FileClusterRegistry) TakeQueued(appID, sn string) ([]ClusterNode, error) {
+	var nodes []ClusterNode
+	err := f.update(func(state *clusterState) bool {
+		nodes = state.takeQueued(appID, sn, f.ttl)
+		return len(nodes) > 0
+	})
+	return nodes, err
+}
+
+// read loads the registry. Writes replace the file atomically, so reads
+// need no lock.
+func (f *FileClusterRegistry) read() (*clusterState, error) {
+	state := newClusterState()
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("read cluster registry: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parse cluster registry: %w", err)
+	}
+	if state.Nodes == nil {
+		state.Nodes = make(map[string]*ClusterNode)
+	}
+	if state.Claims == nil {
+		state.Claims = make(map[string]*clusterClaim)
+	}
+	if state.Queued == nil {
+		state.Queued = make(map[string][]string)
+	}
+	return state, nil
+}
+
+// update applies change to the registry under the lock, saving it if
+// change reports that it modified the state.
+func (f *FileClusterRegistry) update(change func(state *clusterState) bool) error {
+	unlock, err := f.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := f.read()
+	if err != nil {
+		return err
+	}
+	if !change(state) {
+		return nil
+	}
+	return jsonfile.Write(f.path, state, 0o644)
+}
+
+func (f *FileClusterRegistry) lock() (func(), error) {
+	lockPath := f.path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("lock cluster registry: %w", err)
+	}
+
+	deadline := time.Now().Add(clusterLockTimeout)
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("lock cluster registry: %w", err)
+		}
+		if locked {
+			return func() {
+				unlockFile(file)
+				file.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("lock cluster registry: timed out waiting for %s", lockPath)
+		}
+		time.Sleep(clusterLockRetry)
+	}
+}
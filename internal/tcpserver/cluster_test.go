@@ -0,0 +1,228 @@
+package tcpserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClusterSecret = "0123456789abcdef0123456789abcdef"
+
+// startClusterNode starts a server that joins the cluster sharing registry
+// as nodeID.
+func startClusterNode(t *testing.T, registry ClusterRegistry, nodeID, secret string) *Server {
+	t.Helper()
+
+	return startTestServer(t, func(config *Config) {
+		config.Cluster = &ClusterConfig{
+			NodeID:  nodeID,
+			RPCAddr: "127.0.0.1:0",
+			Secret:  secret,
+			NodeTTL: time.Minute,
+		}
+		config.ClusterRegistry = registry
+	})
+}
+
+// clusterOwner waits until server sees sn as connected to another node.
+func clusterOwner(t *testing.T, server *Server, sn string) *ClusterNode {
+	t.Helper()
+
+	var owner *ClusterNode
+	waitFor(t, "owner of "+sn, func() bool {
+		var err error
+		owner, err = server.GetCluster().Owner(testAppID, sn)
+		return err == nil
+	})
+	return owner
+}
+
+// TestClusterForwardsCommand sends a command from node a to a device on
+// node b and checks its progress and ACK come back to a.
+func TestClusterForwardsCommand(t *testing.T) {
+	registry := NewMemoryClusterRegistry(time.Minute)
+	a := startClusterNode(t, registry, "a", testClusterSecret)
+	b := startClusterNode(t, registry, "b", testClusterSecret)
+
+	device := dialTestDevice(t, serverAddr(b), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+	owner := clusterOwner(t, a, "s1")
+	if owner.ID != "b" {
+		t.Fatalf("owner %s, want b", owner.ID)
+	}
+
+	events, cancel := a.GetEventBus().Subscribe(EventFilter{Types: []string{EventCommandAcked}})
+	defer cancel()
+
+	pending := a.GetACKWaiter().Expect("c1")
+	cmd := &CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB", Args: map[string]interface{}{"url": "https://example.com"}}
+	if err := a.GetCluster().Forward(owner, testAppID, "s1", cmd, "r1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got CommandMessage
+	device.expect(TypeCMD, &got)
+	if got.CmdID != "c1" {
+		t.Fatalf("got %+v", got)
+	}
+	device.send(TypeProgress, &ProgressMessage{CmdID: "c1", Percent: 50, Stage: "load"})
+	waitFor(t, "progress on a", func() bool {
+		record, _ := a.GetCommandLedger().Get("c1")
+		return record != nil && record.Progress != nil && record.Progress.Percent == 50
+	})
+	device.send(TypeACK, &ACKMessage{CmdID: "c1", Status: "ok", Detail: "opened"})
+
+	ack, err := pending.Wait(5 * time.Second)
+	if err != nil {
+		t.Fatalf("wait for ACK on a: %v", err)
+	}
+	if ack.Detail != "opened" {
+		t.Errorf("ACK %+v", ack)
+	}
+
+	record, _ := a.GetCommandLedger().Get("c1")
+	if record.State != CommandStateAcked || record.Node != "b" || record.RequestID != "r1" {
+		t.Errorf("record on a: %+v", record)
+	}
+	record, _ = b.GetCommandLedger().Get("c1")
+	if record == nil || record.Origin != "a" || record.State != CommandStateAcked {
+		t.Errorf("record on b: %+v", record)
+	}
+
+	select {
+	case event := <-events:
+		if event.CmdID != "c1" || event.SN != "s1" || event.RequestID != "r1" {
+			t.Errorf("event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command.acked event on a")
+	}
+}
+
+func TestClusterOfflineOwner(t *testing.T) {
+	registry := NewMemoryClusterRegistry(time.Minute)
+	a := startClusterNode(t, registry, "a", testClusterSecret)
+	startClusterNode(t, registry, "b", testClusterSecret)
+
+	// The registry still names b, but the device has left it.
+	if err := registry.Claim(testAppID, "s1", "b"); err != nil {
+		t.Fatal(err)
+	}
+	owner := clusterOwner(t, a, "s1")
+	cmd := &CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB"}
+	if err := a.GetCluster().Forward(owner, testAppID, "s1", cmd, ""); !errors.Is(err, ErrDeviceOffline) {
+		t.Fatalf("forward to a node without the device: %v", err)
+	}
+	if record, _ := a.GetCommandLedger().Get("c1"); record == nil || record.State != CommandStateFailed {
+		t.Errorf("record on a: %+v", record)
+	}
+
+	// Once b leaves, nothing owns the device.
+	if err := registry.Leave("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetCluster().Owner(testAppID, "s1"); !errors.Is(err, ErrNoOwner) {
+		t.Errorf("owner after b left: %v", err)
+	}
+}
+
+func TestClusterRejectsWrongSecret(t *testing.T) {
+	registry := NewMemoryClusterRegistry(time.Minute)
+	b := startClusterNode(t, registry, "b", testClusterSecret)
+	intruder := startClusterNode(t, registry, "x", strings.Repeat("x", minClusterSecretLength))
+
+	device := dialTestDevice(t, serverAddr(b), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+	owner := clusterOwner(t, intruder, "s1")
+
+	cmd := &CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB"}
+	err := intruder.GetCluster().Forward(owner, testAppID, "s1", cmd, "")
+	if err == nil || !strings.Contains(err.Error(), "invalid cluster secret") {
+		t.Fatalf("forward with the wrong secret: %v", err)
+	}
+	if _, exists := b.GetCommandLedger().Get("c1"); exists {
+		t.Error("command with the wrong secret was sent")
+	}
+}
+
+func TestClusterRequiresSecret(t *testing.T) {
+	for _, secret := range []string{"", "short", "change-me-cluster-secret-0123456789"} {
+		server := NewServer(&Config{
+			Addr: "127.0.0.1:0",
+			Cluster: &ClusterConfig{
+				NodeID:  "a",
+				RPCAddr: "127.0.0.1:0",
+				Secret:  secret,
+			},
+		})
+		if err := server.Start(); err == nil {
+			server.Stop()
+			t.Errorf("started with secret %q", secret)
+		}
+	}
+}
+
+// TestClusterCollectsQueuedCommands queues a command on node a for an
+// offline device and checks it is sent when the device connects to b.
+func TestClusterCollectsQueuedCommands(t *testing.T) {
+	registry := NewMemoryClusterRegistry(time.Minute)
+	a := startClusterNode(t, registry, "a", testClusterSecret)
+	b := startClusterNode(t, registry, "b", testClusterSecret)
+
+	cmd := &CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB"}
+	if _, err := a.GetCommandQueue().Enqueue(testAppID, "s1", cmd, "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	a.GetCluster().MarkQueued(testAppID, "s1")
+
+	device := dialTestDevice(t, serverAddr(b), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+
+	var got CommandMessage
+	device.expect(TypeCMD, &got)
+	if got.CmdID != "c1" {
+		t.Fatalf("got %+v", got)
+	}
+	device.send(TypeACK, &ACKMessage{CmdID: "c1", Status: "ok"})
+	waitFor(t, "ACK on a", func() bool {
+		record, _ := a.GetCommandLedger().Get("c1")
+		return record != nil && record.State == CommandStateAcked
+	})
+	if pending := a.GetCommandQueue().PendingCount(testAppID, "s1"); pending != 0 {
+		t.Errorf("%d commands still queued on a", pending)
+	}
+}
+
+// TestClusterStopRefusesWork checks a stopped node starts no more flushes,
+// whether another node asks for one or a command is queued here.
+func TestClusterStopRefusesWork(t *testing.T) {
+	registry := NewMemoryClusterRegistry(time.Minute)
+	a := startClusterNode(t, registry, "a", testClusterSecret)
+	b := startClusterNode(t, registry, "b", testClusterSecret)
+
+	device := dialTestDevice(t, serverAddr(b), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+	clusterOwner(t, a, "s1")
+
+	cluster := a.GetCluster()
+	cluster.Stop()
+
+	rec := httptest.NewRecorder()
+	cluster.handleFlush(rec, httptest.NewRequest(http.MethodPost, clusterFlushPath, strings.NewReader(`{"appid":"A1","sn":"s1"}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("flush on a stopped node answered %d", rec.Code)
+	}
+
+	cmd := &CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB"}
+	if _, err := a.GetCommandQueue().Enqueue(testAppID, "s1", cmd, "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	cluster.MarkQueued(testAppID, "s1")
+	cluster.wg.Wait()
+	if pending := a.GetCommandQueue().PendingCount(testAppID, "s1"); pending != 1 {
+		t.Errorf("%d commands queued on a stopped node, want 1", pending)
+	}
+}
@@ -0,0 +1,107 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	CodecJSON = "json"
+	CodecCBOR = "cbor"
+)
+
+// Codec encodes message payloads. Every connection starts with JSON for the
+// auth handshake and may switch to another codec once it is negotiated.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// cborCodec is a compact binary codec. It reuses the json struct tags, so
+// every message type works with it unchanged. Untyped maps decode as
+// map[string]interface{} like JSON, but untyped numbers decode as integers
+// rather than float64 when they have no fractional part.
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() *cborCodec {
+	enc, err := cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+	if err != nil {
+		panic(fmt.Sprintf("cbor encoder options: %v", err))
+	}
+
+	dec, err := cbor.DecOptions{
+		DefaultMapType:   reflect.TypeOf(map[string]interface{}(nil)),
+		MaxArrayElements: 131072,
+		MaxMapPairs:      131072,
+	}.DecMode()
+	if err != nil {
+		panic(fmt.Sprintf("cbor decoder options: %v", err))
+	}
+
+	return &cborCodec{enc: enc, dec: dec}
+}
+
+func (c *cborCodec) Name() string { return CodecCBOR }
+
+func (c *cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return c.enc.Marshal(v)
+}
+
+func (c *cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.dec.Unmarshal(data, v)
+}
+
+var (
+	JSONCodec Codec = jsonCodec{}
+	CBORCodec Codec = newCBORCodec()
+
+	codecs = map[string]Codec{
+		CodecJSON: JSONCodec,
+		CodecCBOR: CBORCodec,
+	}
+)
+
+func LookupCodec(name string) (Codec, bool) {
+	codec, exists := codecs[name]
+	return codec, exists
+}
+
+// SupportedCodecs lists every registered codec, most compact first.
+func SupportedCodecs() []string {
+	return []string{CodecCBOR, CodecJSON}
+}
+
+// NegotiateCodec picks the first codec in the peer's preference list that is
+// also allowed locally. Peers that offer nothing get JSON.
+func NegotiateCodec(offered, allowed []string) Codec {
+	for _, name := range offered {
+		for _, a := range allowed {
+			if name != a {
+				continue
+			}
+			if codec, exists := LookupCodec(name); exists {
+				return codec
+			}
+		}
+	}
+	return JSONCodec
+}
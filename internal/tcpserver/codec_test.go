@@ -0,0 +1,190 @@
+package tcpserver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// codecMessages holds one value of every payload type. Untyped args and
+// data only hold strings, bools and nested maps, which decode to the same
+// types with either codec.
+func codecMessages() []interface{} {
+	return []interface{}{
+		&AuthMessage{
+			AppID: "A1", SN: "s1", TS: 1700000000, Nonce: "abcd", Sign: "ef01", KeyID: "2025-01",
+			Meta:        map[string]string{"site": "store-12"},
+			Versions:    []uint8{1, 2},
+			Codecs:      []string{CodecCBOR, CodecJSON},
+			Compression: []string{CompressionGzip},
+		},
+		&AuthOKMessage{Success: true, Message: "authenticated", Version: 2, Codec: CodecCBOR, Compression: CompressionGzip},
+		&PingMessage{Timestamp: 1700000000},
+		&PongMessage{Timestamp: 1700000001},
+		&CommandMessage{
+			CmdID: "c1", Cmd: "OPEN_WEB", TimeoutMS: 5000,
+			Args: map[string]interface{}{
+				"url":     "https://example.com",
+				"kiosk":   true,
+				"options": map[string]interface{}{"zoom": "1.5"},
+			},
+		},
+		&ACKMessage{CmdID: "c1", Status: "ok", Detail: "opened"},
+		&ProgressMessage{CmdID: "c1", Percent: 42, Stage: "download", Detail: "4/10 MB"},
+		&ReportMessage{Kind: "status", Timestamp: 1700000000, Data: map[string]interface{}{"screen": "on", "ok": true}},
+		&FileBeginMessage{TransferID: "t1", Name: "bundle.zip", Size: 1 << 20, SHA256: "00ff"},
+		&FileChunkMessage{TransferID: "t1", Offset: 262144, Data: []byte{0, 1, 2, 254, 255}},
+		&FileCompleteMessage{TransferID: "t1", SHA256: "00ff"},
+		&FileStatusMessage{TransferID: "t1", Status: FileStatusReady, Offset: 262144, Detail: "resume"},
+		&UploadRequestMessage{UploadID: "u1", Path: "/var/log/agent.log"},
+		&EnrollMessage{Token: "tok", SN: "s1", EnrollmentID: "e1", Claim: "c1", Meta: map[string]string{"model": "k2"}},
+		&EnrollResultMessage{Status: EnrollmentApproved, EnrollmentID: "e1", AppID: "A1", SN: "s1", Key: "secret"},
+		&ErrorMessage{Code: 500, Message: "boom"},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range SupportedCodecs() {
+		codec, _ := LookupCodec(name)
+		for _, msg := range codecMessages() {
+			t.Run(fmt.Sprintf("%s/%T", name, msg), func(t *testing.T) {
+				data, err := codec.Marshal(msg)
+				if err != nil {
+					t.Fatalf("marshal: %v", err)
+				}
+
+				got := reflect.New(reflect.TypeOf(msg).Elem()).Interface()
+				if err := codec.Unmarshal(data, got); err != nil {
+					t.Fatalf("unmarshal: %v", err)
+				}
+				if !reflect.DeepEqual(got, msg) {
+					t.Errorf("got %+v, want %+v", got, msg)
+				}
+			})
+		}
+	}
+}
+
+func TestCBORNumbers(t *testing.T) {
+	cmd := &CommandMessage{CmdID: "c1", Args: map[string]interface{}{"count": 3, "ratio": 0.5}}
+	data, err := CBORCodec.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got CommandMessage
+	if err := CBORCodec.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Args["count"] != uint64(3) {
+		t.Errorf("count = %#v, want uint64(3)", got.Args["count"])
+	}
+	if got.Args["ratio"] != 0.5 {
+		t.Errorf("ratio = %#v, want 0.5", got.Args["ratio"])
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		offered []string
+		allowed []string
+		want    string
+	}{
+		{nil, SupportedCodecs(), CodecJSON},
+		{[]string{CodecCBOR, CodecJSON}, SupportedCodecs(), CodecCBOR},
+		{[]string{CodecCBOR, CodecJSON}, []string{CodecJSON}, CodecJSON},
+		{[]string{"msgpack", CodecJSON}, SupportedCodecs(), CodecJSON},
+	}
+	for _, tt := range tests {
+		if got := NegotiateCodec(tt.offered, tt.allowed).Name(); got != tt.want {
+			t.Errorf("NegotiateCodec(%v, %v) = %s, want %s", tt.offered, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+// TestCBORSession logs in offering CBOR and exchanges a command and its ACK
+// in it.
+func TestCBORSession(t *testing.T) {
+	server := startTestServer(t, nil)
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	_, authOK, err := device.login(testAppID, "s1", testKey, func(auth *AuthMessage) {
+		auth.Versions = SupportedVersions(0)
+		auth.Codecs = []string{CodecCBOR, CodecJSON}
+	})
+	if err != nil || !authOK.Success {
+		t.Fatalf("login: %v %+v", err, authOK)
+	}
+	if authOK.Codec != CodecCBOR {
+		t.Fatalf("negotiated codec %q, want %q", authOK.Codec, CodecCBOR)
+	}
+
+	session, _ := server.GetSessionManager().GetByDevice(testAppID, "s1")
+	cmd := &CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB", Args: map[string]interface{}{"url": "https://example.com"}}
+	if err := server.GetCommandLedger().SendTracked(session, cmd, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var got CommandMessage
+	device.expect(TypeCMD, &got)
+	if !reflect.DeepEqual(&got, cmd) {
+		t.Errorf("got %+v, want %+v", got, cmd)
+	}
+
+	device.send(TypeACK, &ACKMessage{CmdID: "c1", Status: "ok", Detail: "opened"})
+	waitFor(t, "ACK", func() bool {
+		record, _ := server.GetCommandLedger().Get("c1")
+		return record != nil && record.ACKDetail == "opened"
+	})
+}
+
+// benchmarkReport is a typical telemetry report.
+var benchmarkReport = &ReportMessage{
+	Kind:      "telemetry",
+	Timestamp: 1700000000,
+	Data: map[string]interface{}{
+		"cpu":         37.5,
+		"memory_mb":   812,
+		"disk_free":   10737418240,
+		"screen":      "on",
+		"temperature": 48.25,
+		"uptime_s":    86400,
+		"network":     map[string]interface{}{"rssi": -61, "ssid": "store-12", "online": true},
+		"apps":        []interface{}{"browser", "player", "agent"},
+	},
+}
+
+func BenchmarkCodecMarshal(b *testing.B) {
+	for _, name := range SupportedCodecs() {
+		codec, _ := LookupCodec(name)
+		b.Run(name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				data, err := codec.Marshal(benchmarkReport)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(data)
+			}
+			b.ReportMetric(float64(size), "payload-bytes")
+		})
+	}
+}
+
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	for _, name := range SupportedCodecs() {
+		codec, _ := LookupCodec(name)
+		data, err := codec.Marshal(benchmarkReport)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var report ReportMessage
+				if err := codec.Unmarshal(data, &report); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
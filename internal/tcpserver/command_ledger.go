@@ -0,0 +1,339 @@
+package tcpserver
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCommandHistorySize = 10000
+	// DefaultCommandTimeout is how long a command sent without timeout_ms
+	// waits for its ACK before the ledger marks it timed out.
+	DefaultCommandTimeout = 5 * time.Second
+)
+
+type CommandState string
+
+const (
+	CommandStateSent    CommandState = "sent"
+	CommandStateFailed  CommandState = "failed"
+	CommandStateAcked   CommandState = "acked"
+	CommandStateTimeout CommandState = "timeout"
+)
+
+type CommandRecord struct {
+	CmdID     string                 `json:"cmd_id"`
+	RequestID string                 `json:"request_id,omitempty"`
+	AppID     string                 `json:"appid"`
+	SN        string                 `json:"sn"`
+	Cmd       string                 `json:"cmd"`
+	Args      map[string]interface{} `json:"args"`
+	TimeoutMS int                    `json:"timeout_ms"`
+	State     CommandState           `json:"state"`
+	Error     string                 `json:"error,omitempty"`
+	SentAt    time.Time              `json:"sent_at"`
+	ACKStatus string                 `json:"ack_status,omitempty"`
+	ACKDetail string                 `json:"ack_detail,omitempty"`
+	ACKAt     *time.Time             `json:"ack_at,omitempty"`
+	LatencyMS int64                  `json:"latency_ms,omitempty"`
+	Progress  *ProgressMessage       `json:"progress,omitempty"`
+	// Node is the cluster node a command was forwarded to, on the node
+	// that forwarded it. Origin is that node, on the node the device is
+	// connected to, which sends the ACK and progress back to it.
+	Node   string `json:"node,omitempty"`
+	Origin string `json:"origin,omitempty"`
+}
+
+// CommandLedger remembers the most recent commands sent to devices and the
+// ACK each one received, so results of async sends can be looked up later.
+type CommandLedger struct {
+	records  map[string]*CommandRecord
+	byDevice map[string][]string  // deviceKey -> cmd ids, oldest first
+	order    []string             // cmd ids, oldest first
+	pending  map[string]time.Time // cmd id -> ACK deadline, for sent commands
+	capacity int
+	metrics  *Metrics
+	events   *EventBus
+	auditLog AuditLog
+	logger   *slog.Logger
+	mu       sync.RWMutex
+}
+
+func NewCommandLedger(capacity int) *CommandLedger {
+	if capacity <= 0 {
+		capacity = DefaultCommandHistorySize
+	}
+	return &CommandLedger{
+		records:  make(map[string]*CommandRecord),
+		byDevice: make(map[string][]string),
+		pending:  make(map[string]time.Time),
+		capacity: capacity,
+		logger:   slog.Default(),
+	}
+}
+
+// SendTracked sends cmd over the session and records it, along with the ID
+// of the API request that sent it. The record is written before sending so
+// a fast ACK always finds it.
+func (l *CommandLedger) SendTracked(session *Session, cmd *CommandMessage, requestID string) error {
+	return l.sendTracked(session, cmd, requestID, "")
+}
+
+// sendTracked is SendTracked for a command forwarded by the cluster node
+// origin.
+func (l *CommandLedger) sendTracked(session *Session, cmd *CommandMessage, requestID, origin string) error {
+	l.recordSent(session.AppID, session.SN, cmd, requestID, "", origin)
+	if err := session.SendCommand(cmd); err != nil {
+		l.RecordFailed(cmd.CmdID, err)
+		return err
+	}
+	return nil
+}
+
+func (l *CommandLedger) RecordSent(appID, sn string, cmd *CommandMessage, requestID string) {
+	l.recordSent(appID, sn, cmd, requestID, "", "")
+}
+
+// recordForwarded records a command this node forwarded to the cluster
+// node holding the device. Its replies are sent back here.
+func (l *CommandLedger) recordForwarded(appID, sn string, cmd *CommandMessage, requestID, node string) {
+	l.recordSent(appID, sn, cmd, requestID, node, "")
+}
+
+// recordSent records a sent command. A command sent again after failing,
+// such as a queued command, starts over; any other repeat is ignored.
+func (l *CommandLedger) recordSent(appID, sn string, cmd *CommandMessage, requestID, node, origin string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	existing, exists := l.records[cmd.CmdID]
+	if exists && existing.State != CommandStateFailed {
+		return
+	}
+
+	now := time.Now()
+	l.records[cmd.CmdID] = &CommandRecord{
+		CmdID:     cmd.CmdID,
+		RequestID: requestID,
+		AppID:     appID,
+		SN:        sn,
+		Cmd:       cmd.Cmd,
+		Args:      cmd.Args,
+		TimeoutMS: cmd.TimeoutMS,
+		State:     CommandStateSent,
+		SentAt:    now,
+		Node:      node,
+		Origin:    origin,
+	}
+	timeout := time.Duration(cmd.TimeoutMS) * time.Millisecond
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	}
+	l.pending[cmd.CmdID] = now.Add(timeout)
+	if !exists {
+		key := deviceKey(appID, sn)
+		l.byDevice[key] = append(l.byDevice[key], cmd.CmdID)
+		l.order = append(l.order, cmd.CmdID)
+	}
+	// Metrics are counted by the node the device is connected to, events
+	// are published by the node the command was sent from.
+	if node == "" {
+		l.metrics.commandSent()
+	}
+	if origin == "" {
+		l.events.Publish(Event{
+			Type:      EventCommandSent,
+			AppID:     appID,
+			SN:        sn,
+			CmdID:     cmd.CmdID,
+			Cmd:       cmd.Cmd,
+			RequestID: requestID,
+		})
+	}
+
+	for len(l.order) > l.capacity {
+		l.evictOldestLocked()
+	}
+}
+
+func (l *CommandLedger) RecordFailed(cmdID string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record, exists := l.records[cmdID]; exists {
+		record.State = CommandStateFailed
+		record.Error = err.Error()
+	}
+	delete(l.pending, cmdID)
+}
+
+// RecordACK stores the device's reply. Late ACKs for commands that already
+// timed out still overwrite the timeout so the final outcome is visible.
+func (l *CommandLedger) RecordACK(ack *ACKMessage) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, exists := l.records[ack.CmdID]
+	if !exists {
+		return false
+	}
+
+	now := time.Now()
+	delete(l.pending, ack.CmdID)
+	record.State = CommandStateAcked
+	record.ACKStatus = ack.Status
+	record.ACKDetail = ack.Detail
+	record.ACKAt = &now
+	record.LatencyMS = now.Sub(record.SentAt).Milliseconds()
+	if record.Node == "" {
+		l.metrics.ackReceived(now.Sub(record.SentAt))
+	}
+	return true
+}
+
+func (l *CommandLedger) RecordProgress(progress *ProgressMessage) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record, exists := l.records[progress.CmdID]
+	if !exists {
+		return false
+	}
+
+	copied := *progress
+	record.Progress = &copied
+	return true
+}
+
+// RecordTimeout marks cmdID timed out if it is still waiting for its ACK.
+func (l *CommandLedger) RecordTimeout(cmdID string) {
+	l.mu.Lock()
+	record, timedOut := l.timeoutLocked(cmdID)
+	l.mu.Unlock()
+
+	if timedOut {
+		l.auditTimeout(record)
+	}
+}
+
+// ExpireOverdue marks every command whose ACK deadline passed before now as
+// timed out, and returns how many were. Commands sent without waiting for
+// the ACK, such as async and queued sends, only time out this way.
+func (l *CommandLedger) ExpireOverdue(now time.Time) int {
+	l.mu.Lock()
+	var expired []CommandRecord
+	for cmdID, deadline := range l.pending {
+		if now.Before(deadline) {
+			continue
+		}
+		if record, timedOut := l.timeoutLocked(cmdID); timedOut {
+			expired = append(expired, record)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, record := range expired {
+		l.auditTimeout(record)
+	}
+	return len(expired)
+}
+
+// timeoutLocked moves a sent command to the timeout state, counts and
+// publishes it, and returns a copy of the record.
+func (l *CommandLedger) timeoutLocked(cmdID string) (CommandRecord, bool) {
+	delete(l.pending, cmdID)
+
+	record, exists := l.records[cmdID]
+	if !exists || record.State != CommandStateSent {
+		return CommandRecord{}, false
+	}
+
+	record.State = CommandStateTimeout
+	if record.Node == "" {
+		l.metrics.ackTimedOut()
+	}
+	if record.Origin == "" {
+		l.events.Publish(Event{
+			Type:      EventCommandTimeout,
+			AppID:     record.AppID,
+			SN:        record.SN,
+			CmdID:     record.CmdID,
+			Cmd:       record.Cmd,
+			RequestID: record.RequestID,
+		})
+	}
+	return *record, true
+}
+
+func (l *CommandLedger) auditTimeout(record CommandRecord) {
+	if l.auditLog == nil {
+		return
+	}
+
+	event := &AuditEvent{
+		Time:      time.Now(),
+		Kind:      AuditTimeout,
+		Action:    "timeout",
+		RequestID: record.RequestID,
+		AppID:     record.AppID,
+		SN:        record.SN,
+		CmdID:     record.CmdID,
+		Cmd:       record.Cmd,
+		Result:    AuditFailure,
+	}
+	if err := l.auditLog.Append(event); err != nil {
+		l.logger.Error("Failed to write audit log", "error", err)
+	}
+}
+
+func (l *CommandLedger) Get(cmdID string) (*CommandRecord, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	record, exists := l.records[cmdID]
+	if !exists {
+		return nil, false
+	}
+	copied := *record
+	return &copied, true
+}
+
+// ListByDevice returns up to limit commands sent to a device, newest first.
+func (l *CommandLedger) ListByDevice(appID, sn string, limit int) []CommandRecord {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ids := l.byDevice[deviceKey(appID, sn)]
+	result := make([]CommandRecord, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		result = append(result, *l.records[ids[i]])
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+func (l *CommandLedger) evictOldestLocked() {
+	oldest := l.order[0]
+	l.order = l.order[1:]
+
+	record, exists := l.records[oldest]
+	if !exists {
+		return
+	}
+	delete(l.records, oldest)
+	delete(l.pending, oldest)
+
+	key := deviceKey(record.AppID, record.SN)
+	ids := l.byDevice[key]
+	if len(ids) > 0 && ids[0] == oldest {
+		ids = ids[1:]
+	}
+	if len(ids) == 0 {
+		delete(l.byDevice, key)
+	} else {
+		l.byDevice[key] = ids
+	}
+}
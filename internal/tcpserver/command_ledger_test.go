@@ -0,0 +1,76 @@
+package tcpserver
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAsyncCommandTimesOut sends a command nobody waits on and checks the
+// ledger times it out, then lets a late ACK overwrite the timeout.
+func TestAsyncCommandTimesOut(t *testing.T) {
+	server := startTestServer(t, nil)
+	events, cancel := server.GetEventBus().Subscribe(EventFilter{Types: []string{EventCommandTimeout}})
+	defer cancel()
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+
+	session, _ := server.GetSessionManager().GetByDevice(testAppID, "s1")
+	cmd := &CommandMessage{CmdID: "c1", Cmd: "REBOOT", TimeoutMS: 50}
+	if err := server.GetCommandLedger().SendTracked(session, cmd, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	var got CommandMessage
+	device.expect(TypeCMD, &got)
+
+	select {
+	case event := <-events:
+		if event.CmdID != "c1" || event.RequestID != "r1" {
+			t.Errorf("timeout event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command.timeout event")
+	}
+
+	record, _ := server.GetCommandLedger().Get("c1")
+	if record.State != CommandStateTimeout {
+		t.Fatalf("state %s, want %s", record.State, CommandStateTimeout)
+	}
+	audited, err := server.GetAuditLog().Query(AuditFilter{Kind: AuditTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audited) != 1 || audited[0].CmdID != "c1" || audited[0].Cmd != "REBOOT" {
+		t.Errorf("audited timeouts: %+v", audited)
+	}
+
+	device.send(TypeACK, &ACKMessage{CmdID: "c1", Status: "ok"})
+	waitFor(t, "late ACK", func() bool {
+		record, _ := server.GetCommandLedger().Get("c1")
+		return record.State == CommandStateAcked
+	})
+}
+
+func TestExpireOverdueSkipsAnswered(t *testing.T) {
+	ledger := NewCommandLedger(0)
+	ledger.RecordSent(testAppID, "s1", &CommandMessage{CmdID: "acked"}, "")
+	ledger.RecordSent(testAppID, "s1", &CommandMessage{CmdID: "slow", TimeoutMS: 60000}, "")
+	ledger.RecordSent(testAppID, "s1", &CommandMessage{CmdID: "lost"}, "")
+	ledger.RecordACK(&ACKMessage{CmdID: "acked", Status: "ok"})
+
+	if expired := ledger.ExpireOverdue(time.Now()); expired != 0 {
+		t.Fatalf("%d commands expired before their deadline", expired)
+	}
+	if expired := ledger.ExpireOverdue(time.Now().Add(DefaultCommandTimeout)); expired != 1 {
+		t.Fatalf("%d commands expired, want 1", expired)
+	}
+	for cmdID, want := range map[string]CommandState{
+		"acked": CommandStateAcked,
+		"slow":  CommandStateSent,
+		"lost":  CommandStateTimeout,
+	} {
+		if record, _ := ledger.Get(cmdID); record.State != want {
+			t.Errorf("%s: state %s, want %s", cmdID, record.State, want)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"device-agent/internal/jsonfile"
+)
+
+const (
+	DefaultQueueTTL = 24 * time.Hour
+
+	// finished entries are kept this long so their final state can still be queried
+	queueRetention = 24 * time.Hour
+)
+
+type QueueState string
+
+const (
+	QueueStatePending   QueueState = "pending"
+	QueueStateDelivered QueueState = "delivered"
+	QueueStateExpired   QueueState = "expired"
+	QueueStateCanceled  QueueState = "canceled"
+)
+
+type QueuedCommand struct {
+	AppID       string         `json:"appid"`
+	SN          string         `json:"sn"`
+	Command     CommandMessage `json:"command"`
+	RequestID   string         `json:"request_id,omitempty"`
+	State       QueueState     `json:"state"`
+	QueuedAt    time.Time      `json:"queued_at"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	Error       string         `json:"error,omitempty"`
+	DeliveredTo string         `json:"delivered_to,omitempty"`
+
+	// sending is set while Flush is delivering the entry, so a concurrent
+	// flush for the same device does not send it twice.
+	sending bool
+}
+
+var (
+	ErrQueuedCommandNotFound = fmt.Errorf("queued command not found")
+	ErrQueuedCommandFinished = fmt.Errorf("queued command is no longer pending")
+)
+
+// CommandQueue holds commands for offline devices until they next
+// authenticate. When created with a path, every change is persisted so
+// queued commands survive a gateway restart.
+type CommandQueue struct {
+	commands   map[string][]*QueuedCommand // deviceKey -> commands in enqueue order
+	defaultTTL time.Duration
+	path       string
+	mu         sync.Mutex
+}
+
+func NewMemoryCommandQueue(defaultTTL time.Duration) *CommandQueue {
+	if defaultTTL <= 0 {
+		defaultTTL = DefaultQueueTTL
+	}
+	return &CommandQueue{
+		commands:   make(map[string][]*QueuedCommand),
+		defaultTTL: defaultTTL,
+	}
+}
+
+func NewFileCommandQueue(path string, defaultTTL time.Duration) (*CommandQueue, error) {
+	q := NewMemoryCommandQueue(defaultTTL)
+	q.path = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, fmt.Errorf("read command queue: %w", err)
+	}
+
+	var entries []*QueuedCommand
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse command queue: %w", err)
+	}
+	for _, entry := range entries {
+		key := deviceKey(entry.AppID, entry.SN)
+		q.commands[key] = append(q.commands[key], entry)
+	}
+	for _, list := range q.commands {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].QueuedAt.Before(list[j].QueuedAt)
+		})
+	}
+
+	return q, nil
+}
+
+// MigrateLegacy gives entries queued before commands were kept per app the
+// AppID of their device, looked up by SN in devices. Entries whose SN is
+// unknown or used by several apps cannot be delivered and are left alone.
+func (q *CommandQueue) MigrateLegacy(devices DeviceStore) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	migrated, stranded := 0, 0
+	for key, list := range q.commands {
+		if len(list) == 0 || list[0].AppID != "" {
+			continue
+		}
+		sn := list[0].SN
+		records, err := devices.FindBySN(sn)
+		if err != nil {
+			return err
+		}
+		if len(records) != 1 {
+			stranded += len(list)
+			continue
+		}
+
+		appID := records[0].AppID
+		target := deviceKey(appID, sn)
+		for _, entry := range list {
+			entry.AppID = appID
+		}
+		merged := append(q.commands[target], list...)
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].QueuedAt.Before(merged[j].QueuedAt)
+		})
+		q.commands[target] = merged
+		delete(q.commands, key)
+		migrated += len(list)
+	}
+
+	if stranded > 0 {
+		slog.Warn("Queued commands have no appid and will not be delivered", "count", stranded)
+	}
+	if migrated == 0 {
+		return nil
+	}
+	slog.Info("Assigned queued commands to their device's app", "count", migrated)
+	return q.saveLocked()
+}
+
+func (q *CommandQueue) Enqueue(appID, sn string, cmd *CommandMessage, requestID string, ttl time.Duration) (*QueuedCommand, error) {
+	if ttl <= 0 {
+		ttl = q.defaultTTL
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	entry := &QueuedCommand{
+		AppID:     appID,
+		SN:        sn,
+		Command:   *cmd,
+		RequestID: requestID,
+		State:     QueueStatePending,
+		QueuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+		UpdatedAt: now,
+	}
+	key := deviceKey(appID, sn)
+	q.commands[key] = append(q.commands[key], entry)
+
+	if err := q.saveLocked(); err != nil {
+		q.commands[key] = q.commands[key][:len(q.commands[key])-1]
+		return nil, err
+	}
+
+	copied := *entry
+	return &copied, nil
+}
+
+// List returns the commands queued for a device in delivery order. An empty
+// state returns entries in every state.
+func (q *CommandQueue) List(appID, sn string, state QueueState) []QueuedCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := deviceKey(appID, sn)
+	q.expireLocked(key, time.Now())
+
+	result := []QueuedCommand{}
+	for _, entry := range q.commands[key] {
+		if state != "" && entry.State != state {
+			continue
+		}
+		result = append(result, *entry)
+	}
+	return result
+}
+
+func (q *CommandQueue) Cancel(appID, sn, cmdID string) (*QueuedCommand, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := deviceKey(appID, sn)
+	q.expireLocked(key, time.Now())
+
+	for _, entry := range q.commands[key] {
+		if entry.Command.CmdID != cmdID {
+			continue
+		}
+		if entry.State != QueueStatePending || entry.sending {
+			copied := *entry
+			return &copied, ErrQueuedCommandFinished
+		}
+
+		entry.State = QueueStateCanceled
+		entry.UpdatedAt = time.Now()
+		if err := q.saveLocked(); err != nil {
+			return nil, err
+		}
+
+		copied := *entry
+		return &copied, nil
+	}
+
+	return nil, ErrQueuedCommandNotFound
+}
+
+// Flush delivers every pending, unexpired command for a device through send,
+// in the order they were queued, and returns how many were delivered. send
+// also gets the ID of the API request that queued the command. Commands are
+// sent without holding the queue lock. When a send fails the device has most
+// likely gone away again, so that command and the ones after it stay pending
+// for its next login.
+func (q *CommandQueue) Flush(appID, sn string, send func(cmd *CommandMessage, requestID string) error) (int, error) {
+	key := deviceKey(appID, sn)
+
+	q.mu.Lock()
+	q.expireLocked(key, time.Now())
+	var batch []*QueuedCommand
+	for _, entry := range q.commands[key] {
+		if entry.State == QueueStatePending && !entry.sending {
+			entry.sending = true
+			batch = append(batch, entry)
+		}
+	}
+	q.mu.Unlock()
+
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	sent := 0
+	var sendErr error
+	for _, entry := range batch {
+		// Entries are only changed under the lock; the command is never
+		// changed after it is queued.
+		cmd := entry.Command
+		if sendErr = send(&cmd, entry.RequestID); sendErr != nil {
+			break
+		}
+		sent++
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for i, entry := range batch {
+		entry.sending = false
+		switch {
+		case i < sent:
+			entry.State = QueueStateDelivered
+			entry.Error = ""
+			entry.UpdatedAt = now
+		case i == sent && sendErr != nil:
+			entry.Error = sendErr.Error()
+			entry.UpdatedAt = now
+		}
+	}
+
+	return sent, q.saveLocked()
+}
+
+func (q *CommandQueue) PendingCount(appID, sn string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := deviceKey(appID, sn)
+	q.expireLocked(key, time.Now())
+
+	count := 0
+	for _, entry := range q.commands[key] {
+		if entry.State == QueueStatePending {
+			count++
+		}
+	}
+	return count
+}
+
+func (q *CommandQueue) expireLocked(key string, now time.Time) {
+	for _, entry := range q.commands[key] {
+		if entry.State == QueueStatePending && now.After(entry.ExpiresAt) {
+			entry.State = QueueStateExpired
+			entry.UpdatedAt = now
+		}
+	}
+}
+
+func (q *CommandQueue) saveLocked() error {
+	q.pruneLocked(time.Now())
+
+	if q.path == "" {
+		return nil
+	}
+
+	var entries []*QueuedCommand
+	for _, list := range q.commands {
+		entries = append(entries, list...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].QueuedAt.Before(entries[j].QueuedAt)
+	})
+	return jsonfile.Write(q.path, entries, 0o644)
+}
+
+// pruneLocked expires overdue entries of every device, including devices
+// that never reconnect, and drops entries that finished long ago.
+func (q *CommandQueue) pruneLocked(now time.Time) {
+	for key, list := range q.commands {
+		q.expireLocked(key, now)
+		kept := list[:0]
+		for _, entry := range list {
+			if entry.State != QueueStatePending && now.Sub(entry.UpdatedAt) > queueRetention {
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		if len(kept) == 0 {
+			delete(q.commands, key)
+		} else {
+			q.commands[key] = kept
+		}
+	}
+}
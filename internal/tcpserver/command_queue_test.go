@@ -0,0 +1,139 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMigrateLegacyQueue loads entries written before commands were kept
+// per app and gives them their device's AppID.
+func TestMigrateLegacyQueue(t *testing.T) {
+	now := time.Now()
+	legacy := []*QueuedCommand{
+		{SN: "s1", Command: CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB"}, State: QueueStatePending, QueuedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{SN: "shared", Command: CommandMessage{CmdID: "c2", Cmd: "OPEN_WEB"}, State: QueueStatePending, QueuedAt: now, ExpiresAt: now.Add(time.Hour)},
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "queue.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := NewMemoryDeviceStore()
+	devices.Put(&DeviceRecord{AppID: "A1", SN: "s1"})
+	devices.Put(&DeviceRecord{AppID: "A1", SN: "shared"})
+	devices.Put(&DeviceRecord{AppID: "A2", SN: "shared"})
+
+	queue, err := NewFileCommandQueue(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.MigrateLegacy(devices); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := queue.PendingCount("A1", "s1"); got != 1 {
+		t.Errorf("A1/s1 has %d pending commands, want 1", got)
+	}
+	if got := queue.PendingCount("", "shared"); got != 1 {
+		t.Errorf("ambiguous SN: %d commands left unassigned, want 1", got)
+	}
+
+	reloaded, err := NewFileCommandQueue(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.PendingCount("A1", "s1"); got != 1 {
+		t.Errorf("migration not saved: A1/s1 has %d pending commands after reload", got)
+	}
+}
+
+// TestQueueExpiresIdleDevices checks commands for a device that never
+// reconnects expire, and are dropped from the file once retention passes.
+func TestQueueExpiresIdleDevices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	queue, err := NewFileCommandQueue(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Enqueue(testAppID, "idle", &CommandMessage{CmdID: "c1"}, "", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Any write sweeps every device, not only the one written to.
+	if _, err := queue.Enqueue(testAppID, "s2", &CommandMessage{CmdID: "c2"}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewFileCommandQueue(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := reloaded.commands[deviceKey(testAppID, "idle")]; len(entries) != 1 || entries[0].State != QueueStateExpired {
+		t.Fatalf("idle device entries in the file: %+v", entries)
+	}
+
+	queue.mu.Lock()
+	queue.commands[deviceKey(testAppID, "idle")][0].UpdatedAt = time.Now().Add(-queueRetention - time.Minute)
+	queue.mu.Unlock()
+	if _, err := queue.Enqueue(testAppID, "s2", &CommandMessage{CmdID: "c3"}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = NewFileCommandQueue(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := reloaded.List(testAppID, "idle", ""); len(entries) != 0 {
+		t.Errorf("expired entries kept past retention: %+v", entries)
+	}
+	if got := reloaded.PendingCount(testAppID, "s2"); got != 2 {
+		t.Errorf("s2 has %d pending commands, want 2", got)
+	}
+}
+
+// TestQueueFlushStopsAtFailure delivers queued commands in order and keeps
+// the ones from the first failed send pending.
+func TestQueueFlushStopsAtFailure(t *testing.T) {
+	queue := NewMemoryCommandQueue(time.Hour)
+	for _, cmdID := range []string{"c1", "c2", "c3"} {
+		if _, err := queue.Enqueue(testAppID, "s1", &CommandMessage{CmdID: cmdID}, "r-"+cmdID, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sent []string
+	delivered, err := queue.Flush(testAppID, "s1", func(cmd *CommandMessage, requestID string) error {
+		if cmd.CmdID == "c2" {
+			return ErrDeviceOffline
+		}
+		if requestID != "r-"+cmd.CmdID {
+			t.Errorf("%s sent with request ID %q", cmd.CmdID, requestID)
+		}
+		sent = append(sent, cmd.CmdID)
+		return nil
+	})
+	if err != nil || delivered != 1 || len(sent) != 1 || sent[0] != "c1" {
+		t.Fatalf("first flush: delivered %d, sent %v, err %v", delivered, sent, err)
+	}
+	pending := queue.List(testAppID, "s1", QueueStatePending)
+	if len(pending) != 2 || pending[0].Command.CmdID != "c2" || pending[0].Error != ErrDeviceOffline.Error() {
+		t.Fatalf("pending after a failed send: %+v", pending)
+	}
+
+	if _, err := queue.Cancel(testAppID, "s1", "c3"); err != nil {
+		t.Fatal(err)
+	}
+	delivered, _ = queue.Flush(testAppID, "s1", func(cmd *CommandMessage, requestID string) error {
+		sent = append(sent, cmd.CmdID)
+		return nil
+	})
+	if delivered != 1 || sent[len(sent)-1] != "c2" || queue.PendingCount(testAppID, "s1") != 0 {
+		t.Errorf("second flush: delivered %d, sent %v", delivered, sent)
+	}
+}
@@ -0,0 +1,74 @@
+package tcpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	CompressionGzip = "gzip"
+
+	// DefaultCompressThreshold is the payload size above which frames are
+	// compressed when compression was negotiated.
+	DefaultCompressThreshold = 1024
+
+	// MaxDecompressedSize caps the size a compressed payload may expand to,
+	// so a small frame cannot be used as a decompression bomb.
+	MaxDecompressedSize = 16 * 1024 * 1024 // 16MB
+)
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+func compressPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+
+	zw.Reset(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("compress payload: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compress payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressPayload(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload: %w", err)
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload: %w", err)
+	}
+	if len(out) > MaxDecompressedSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", MaxDecompressedSize)
+	}
+	return out, nil
+}
+
+// NegotiateCompression returns the compression to use on a connection, or
+// "" for none. Compression needs the v2 flags byte, so v1 connections never
+// use it.
+func NegotiateCompression(offered []string, enabled bool, version uint8) string {
+	if !enabled || version < ProtocolVersionV2 {
+		return ""
+	}
+	for _, name := range offered {
+		if name == CompressionGzip {
+			return name
+		}
+	}
+	return ""
+}
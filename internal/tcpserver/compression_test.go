@@ -0,0 +1,83 @@
+package tcpserver
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// pipeFrame writes msg with wire on one end of a pipe and reads it back
+// with read.
+func pipeFrame(t *testing.T, msg *Message, wire *WireParams, read func(conn net.Conn) (*Message, error)) (*Message, error) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		if err := WriteFrame(client, msg, wire); err != nil {
+			t.Errorf("write: %v", err)
+		}
+		client.Close()
+	}()
+	return read(server)
+}
+
+func compressedWire() *WireParams {
+	return &WireParams{Version: ProtocolVersionV2, Codec: JSONCodec, Compression: CompressionGzip, CompressThreshold: 16}
+}
+
+func TestCompressedFrameRoundTrip(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"html":"<div>kiosk</div>"}`, 100))
+	msg := &Message{Type: TypeCMD, Payload: payload}
+	wire := compressedWire()
+
+	got, err := pipeFrame(t, msg, wire, func(conn net.Conn) (*Message, error) {
+		return ReadFrame(conn, wire)
+	})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got.Payload, payload) || got.Flags != 0 {
+		t.Errorf("payload not restored: %d bytes, flags %#x", len(got.Payload), got.Flags)
+	}
+}
+
+func TestCompressedFrameNeedsNegotiation(t *testing.T) {
+	msg := &Message{Type: TypeCMD, Payload: []byte(strings.Repeat("a", 4096))}
+
+	_, err := pipeFrame(t, msg, compressedWire(), func(conn net.Conn) (*Message, error) {
+		return ReadFrame(conn, &WireParams{Version: ProtocolVersionV2, Codec: JSONCodec})
+	})
+	if err == nil {
+		t.Fatal("compressed frame accepted without negotiated compression")
+	}
+
+	_, err = pipeFrame(t, msg, compressedWire(), ReadMessage)
+	if err == nil {
+		t.Fatal("ReadMessage accepted a compressed frame")
+	}
+}
+
+func TestDecompressionBomb(t *testing.T) {
+	bomb, err := compressPayload(make([]byte, MaxDecompressedSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bomb) > MaxMessageSize {
+		t.Fatalf("bomb does not fit in a frame: %d bytes", len(bomb))
+	}
+
+	msg := &Message{Version: ProtocolVersionV2, Type: TypeCMD, Flags: FlagCompressed, Payload: bomb}
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		WriteMessage(client, msg)
+		client.Close()
+	}()
+
+	if _, err := ReadFrame(server, compressedWire()); err == nil {
+		t.Fatal("oversized decompressed payload accepted")
+	}
+}
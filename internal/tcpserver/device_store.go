@@ -0,0 +1,223 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"device-agent/internal/jsonfile"
+)
+
+type DeviceRecord struct {
+	SN               string            `json:"sn"`
+	AppID            string            `json:"appid"`
+	Meta             map[string]string `json:"meta"`
+	FirstSeen        time.Time         `json:"first_seen"`
+	LastSeen         time.Time         `json:"last_seen"`
+	LastRemoteAddr   string            `json:"last_remote_addr"`
+	DisconnectReason string            `json:"disconnect_reason,omitempty"`
+}
+
+// DeviceStore keeps a record of every device that has ever authenticated,
+// independent of whether it currently holds a session.
+type DeviceStore interface {
+	Get(appID, sn string) (*DeviceRecord, error)
+	Put(record *DeviceRecord) error
+	List() ([]*DeviceRecord, error)
+	// FindBySN returns the records of every app's device with sn, ordered
+	// by AppID.
+	FindBySN(sn string) ([]*DeviceRecord, error)
+}
+
+var ErrDeviceNotFound = fmt.Errorf("device not found")
+
+type MemoryDeviceStore struct {
+	records map[string]*DeviceRecord
+	bySN    map[string]map[string]*DeviceRecord // sn -> appid -> record
+	mu      sync.RWMutex
+}
+
+func NewMemoryDeviceStore() *MemoryDeviceStore {
+	return &MemoryDeviceStore{
+		records: make(map[string]*DeviceRecord),
+		bySN:    make(map[string]map[string]*DeviceRecord),
+	}
+}
+
+func (m *MemoryDeviceStore) Get(appID, sn string) (*DeviceRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	record, exists := m.records[deviceKey(appID, sn)]
+	if !exists {
+		return nil, ErrDeviceNotFound
+	}
+	copied := *record
+	return &copied, nil
+}
+
+func (m *MemoryDeviceStore) Put(record *DeviceRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *record
+	m.records[deviceKey(record.AppID, record.SN)] = &copied
+	apps, exists := m.bySN[record.SN]
+	if !exists {
+		apps = make(map[string]*DeviceRecord)
+		m.bySN[record.SN] = apps
+	}
+	apps[record.AppID] = &copied
+	return nil
+}
+
+func (m *MemoryDeviceStore) FindBySN(sn string) ([]*DeviceRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	apps := m.bySN[sn]
+	result := make([]*DeviceRecord, 0, len(apps))
+	for _, record := range apps {
+		copied := *record
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].AppID < result[j].AppID
+	})
+	return result, nil
+}
+
+func (m *MemoryDeviceStore) List() ([]*DeviceRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*DeviceRecord, 0, len(m.records))
+	for _, record := range m.records {
+		copied := *record
+		result = append(result, &copied)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AppID != result[j].AppID {
+			return result[i].AppID < result[j].AppID
+		}
+		return result[i].SN < result[j].SN
+	})
+	return result, nil
+}
+
+// DefaultDeviceFlushInterval is how long a FileDeviceStore lets writes
+// collect before saving them.
+const DefaultDeviceFlushInterval = 2 * time.Second
+
+// FileDeviceStore is a MemoryDeviceStore that persists its records to a JSON
+// file, so the registry survives gateway restarts. Every login and
+// disconnect updates a record, so writes are batched: the file is saved at
+// most once per flush interval, and on Close.
+type FileDeviceStore struct {
+	*MemoryDeviceStore
+	path string
+
+	dirty   bool
+	dirtyMu sync.Mutex
+	writeMu sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewFileDeviceStore(path string, flushInterval time.Duration) (*FileDeviceStore, error) {
+	if flushInterval <= 0 {
+		flushInterval = DefaultDeviceFlushInterval
+	}
+
+	store := &FileDeviceStore{
+		MemoryDeviceStore: NewMemoryDeviceStore(),
+		path:              path,
+		done:              make(chan struct{}),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read device store: %w", err)
+	}
+	if err == nil {
+		var records []*DeviceRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("parse device store: %w", err)
+		}
+		for _, record := range records {
+			store.MemoryDeviceStore.Put(record)
+		}
+	}
+
+	store.wg.Add(1)
+	go store.flushLoop(flushInterval)
+	return store, nil
+}
+
+func (f *FileDeviceStore) Put(record *DeviceRecord) error {
+	if err := f.MemoryDeviceStore.Put(record); err != nil {
+		return err
+	}
+
+	f.dirtyMu.Lock()
+	f.dirty = true
+	f.dirtyMu.Unlock()
+	return nil
+}
+
+// Flush saves the records if they changed since the last save.
+func (f *FileDeviceStore) Flush() error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	f.dirtyMu.Lock()
+	dirty := f.dirty
+	f.dirty = false
+	f.dirtyMu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	records, err := f.MemoryDeviceStore.List()
+	if err == nil {
+		err = jsonfile.Write(f.path, records, 0o644)
+	}
+	if err != nil {
+		// Try again on the next flush.
+		f.dirtyMu.Lock()
+		f.dirty = true
+		f.dirtyMu.Unlock()
+	}
+	return err
+}
+
+// Close stops the background saves and saves any pending changes.
+func (f *FileDeviceStore) Close() error {
+	close(f.done)
+	f.wg.Wait()
+	return f.Flush()
+}
+
+func (f *FileDeviceStore) flushLoop(interval time.Duration) {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			if err := f.Flush(); err != nil {
+				slog.Error("Failed to save device store", "error", err)
+			}
+		}
+	}
+}
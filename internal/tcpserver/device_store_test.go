@@ -0,0 +1,94 @@
+package tcpserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestDeviceStore(t *testing.T, path string) *FileDeviceStore {
+	t.Helper()
+
+	store, err := NewFileDeviceStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestFileDeviceStoreBatchesWrites checks records are only written on
+// Flush and Close, and read back when the store is reopened.
+func TestFileDeviceStoreBatchesWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	store := openTestDeviceStore(t, path)
+
+	seen := time.Now().Truncate(time.Second)
+	store.Put(&DeviceRecord{AppID: testAppID, SN: "s1", FirstSeen: seen, LastSeen: seen, Meta: map[string]string{"site": "store-12"}})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file written before a flush: %v", err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Put(&DeviceRecord{AppID: "A2", SN: "s2", FirstSeen: seen, LastSeen: seen, DisconnectReason: "read error: EOF"})
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestDeviceStore(t, path)
+	defer reopened.Close()
+	records, err := reopened.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].SN != "s1" || records[1].SN != "s2" {
+		t.Fatalf("records after reopening: %+v", records)
+	}
+	if !records[0].FirstSeen.Equal(seen) || records[0].Meta["site"] != "store-12" {
+		t.Errorf("s1 after reopening: %+v", records[0])
+	}
+	if records[1].DisconnectReason != "read error: EOF" {
+		t.Errorf("s2 after reopening: %+v", records[1])
+	}
+
+	found, err := reopened.FindBySN("s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].AppID != "A2" {
+		t.Errorf("FindBySN after reopening: %+v", found)
+	}
+}
+
+// TestDeviceRecordLifecycle logs a device in twice and checks its record
+// keeps the first login and notes why it disconnected.
+func TestDeviceRecordLifecycle(t *testing.T) {
+	server := startTestServer(t, nil)
+	devices := server.GetDeviceStore()
+
+	first := dialTestDevice(t, serverAddr(server), nil)
+	first.mustLogin(testAppID, "s1", testKey)
+	record, err := devices.Get(testAppID, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstSeen := record.FirstSeen
+	if record.LastRemoteAddr == "" || firstSeen.IsZero() {
+		t.Errorf("record after login: %+v", record)
+	}
+
+	first.conn.Close()
+	waitFor(t, "disconnect reason", func() bool {
+		record, _ := devices.Get(testAppID, "s1")
+		return record.DisconnectReason != ""
+	})
+
+	second := dialTestDevice(t, serverAddr(server), nil)
+	second.mustLogin(testAppID, "s1", testKey)
+	record, _ = devices.Get(testAppID, "s1")
+	if !record.FirstSeen.Equal(firstSeen) || record.DisconnectReason != "" {
+		t.Errorf("record after logging in again: %+v", record)
+	}
+}
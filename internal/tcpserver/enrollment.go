@@ -0,0 +1,347 @@
+package tcpserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"device-agent/internal/security"
+
+	"github.com/google/uuid"
+)
+
+const DefaultEnrollmentTokenTTL = 24 * time.Hour
+
+var (
+	ErrInvalidEnrollmentToken = errors.New("invalid enrollment token")
+	ErrEnrollmentDecided      = errors.New("enrollment already decided")
+)
+
+// EnrollmentManager lets devices without a key obtain one. A device presents
+// a one-time token; once its enrollment is approved, by the operator or
+// straight away if the token does not require approval, the device is given
+// a generated key stored in the credential store.
+type EnrollmentManager struct {
+	store         EnrollmentStore
+	authenticator *security.Authenticator
+	credentials   security.CredentialStore
+	mu            sync.Mutex // serializes token use and decisions
+}
+
+func NewEnrollmentManager(store EnrollmentStore, authenticator *security.Authenticator, credentials security.CredentialStore) *EnrollmentManager {
+	return &EnrollmentManager{
+		store:         store,
+		authenticator: authenticator,
+		credentials:   credentials,
+	}
+}
+
+// CreateToken returns a new token for appID, as given to the device, along
+// with its record. A non-empty sn restricts the token to that device, which
+// also allows re-enrolling a device that already has a key.
+func (m *EnrollmentManager) CreateToken(appID, sn string, requireApproval bool, ttl time.Duration) (string, *EnrollmentToken, error) {
+	if !m.authenticator.HasApp(appID) {
+		return "", nil, fmt.Errorf("unknown appid %s", appID)
+	}
+	if ttl <= 0 {
+		ttl = DefaultEnrollmentTokenTTL
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	secretHex := hex.EncodeToString(secret)
+
+	now := time.Now()
+	token := &EnrollmentToken{
+		ID:              uuid.New().String(),
+		AppID:           appID,
+		SN:              sn,
+		RequireApproval: requireApproval,
+		SecretHash:      hashEnrollmentSecret(secretHex),
+		ExpiresAt:       now.Add(ttl),
+		CreatedAt:       now,
+	}
+	if err := m.store.PutToken(token); err != nil {
+		return "", nil, err
+	}
+	return token.ID + "." + secretHex, token, nil
+}
+
+func (m *EnrollmentManager) DeleteToken(id string) error {
+	return m.store.DeleteToken(id)
+}
+
+func (m *EnrollmentManager) GetToken(id string) (*EnrollmentToken, error) {
+	return m.store.GetToken(id)
+}
+
+func (m *EnrollmentManager) ListTokens() ([]*EnrollmentToken, error) {
+	return m.store.ListTokens()
+}
+
+func (m *EnrollmentManager) Get(id string) (*Enrollment, error) {
+	return m.store.GetEnrollment(id)
+}
+
+// List returns the enrollments in state, or all of them when state is
+// empty, oldest first.
+func (m *EnrollmentManager) List(state string) ([]*Enrollment, error) {
+	enrollments, err := m.store.ListEnrollments()
+	if err != nil || state == "" {
+		return enrollments, err
+	}
+
+	var filtered []*Enrollment
+	for _, enrollment := range enrollments {
+		if enrollment.State == state {
+			filtered = append(filtered, enrollment)
+		}
+	}
+	return filtered, nil
+}
+
+// Enroll handles an enrollment request from a device at remoteAddr. Errors
+// are meant to be reported to the device as a rejection.
+func (m *EnrollmentManager) Enroll(req *EnrollMessage, remoteAddr string) (*EnrollResultMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, err := m.checkTokenLocked(req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	var enrollment *Enrollment
+	if req.EnrollmentID != "" {
+		enrollment, err = m.store.GetEnrollment(req.EnrollmentID)
+		switch {
+		case err == nil:
+			if enrollment.TokenID != token.ID || !enrollment.claimedBy(req.Claim) {
+				return nil, ErrInvalidEnrollmentToken
+			}
+		case errors.Is(err, ErrEnrollmentNotFound) && req.Claim != "":
+			// The device named its enrollment before asking.
+			enrollment, err = m.startLocked(token, req, remoteAddr)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrInvalidEnrollmentToken
+		}
+	} else {
+		enrollment, err = m.startLocked(token, req, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &EnrollResultMessage{
+		Status:       enrollment.State,
+		EnrollmentID: enrollment.ID,
+		AppID:        enrollment.AppID,
+		SN:           enrollment.SN,
+		Message:      enrollment.Reason,
+	}
+	if enrollment.State == EnrollmentApproved {
+		// Without a claim, anyone who saw the token and the enrollment ID
+		// could fetch the key, so it is handed out once.
+		if enrollment.ClaimHash == "" && enrollment.DeliveredAt != nil {
+			return nil, fmt.Errorf("key for enrollment %s was already delivered", enrollment.ID)
+		}
+		cred, err := m.credentials.Get(enrollment.AppID, enrollment.SN)
+		if err != nil || cred.Key == "" {
+			return nil, fmt.Errorf("credential for %s is no longer available", enrollment.SN)
+		}
+		if cred.Revoked {
+			return nil, fmt.Errorf("device revoked")
+		}
+		if enrollment.DeliveredAt == nil {
+			now := time.Now()
+			enrollment.DeliveredAt = &now
+			enrollment.UpdatedAt = now
+			if err := m.store.PutEnrollment(enrollment); err != nil {
+				return nil, err
+			}
+		}
+		result.Key = cred.Key
+	}
+	return result, nil
+}
+
+// claimedBy reports whether claim is the secret the enrollment was opened
+// with. Enrollments opened without one match any request.
+func (e *Enrollment) claimedBy(claim string) bool {
+	if e.ClaimHash == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(hashEnrollmentSecret(claim)), []byte(e.ClaimHash)) == 1
+}
+
+// checkTokenLocked returns the token named by a "<token_id>.<secret>"
+// string if the secret matches. Used and expired tokens are returned too;
+// the caller decides whether that matters.
+func (m *EnrollmentManager) checkTokenLocked(raw string) (*EnrollmentToken, error) {
+	id, secret, ok := strings.Cut(raw, ".")
+	if !ok {
+		return nil, ErrInvalidEnrollmentToken
+	}
+
+	token, err := m.store.GetToken(id)
+	if err != nil {
+		return nil, ErrInvalidEnrollmentToken
+	}
+	if subtle.ConstantTimeCompare([]byte(hashEnrollmentSecret(secret)), []byte(token.SecretHash)) != 1 {
+		return nil, ErrInvalidEnrollmentToken
+	}
+	return token, nil
+}
+
+// startLocked uses up token to open an enrollment for the requesting device.
+func (m *EnrollmentManager) startLocked(token *EnrollmentToken, req *EnrollMessage, remoteAddr string) (*Enrollment, error) {
+	now := time.Now()
+	if token.UsedAt != nil {
+		return nil, fmt.Errorf("enrollment token already used")
+	}
+	if now.After(token.ExpiresAt) {
+		return nil, fmt.Errorf("enrollment token expired")
+	}
+
+	sn := req.SN
+	switch {
+	case token.SN != "" && sn != "" && sn != token.SN:
+		return nil, fmt.Errorf("enrollment token is for another device")
+	case token.SN != "":
+		sn = token.SN
+	case sn == "":
+		sn = "DEV-" + strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:12])
+	}
+
+	// A token not tied to an SN must not take over an enrolled device.
+	if token.SN == "" {
+		if cred, err := m.credentials.Get(token.AppID, sn); err == nil && cred.Key != "" {
+			return nil, fmt.Errorf("device %s is already enrolled", sn)
+		}
+	}
+
+	id := req.EnrollmentID
+	if id == "" {
+		id = uuid.New().String()
+	} else if parsed, err := uuid.Parse(id); err != nil || parsed.String() != id {
+		return nil, fmt.Errorf("invalid enrollment id")
+	}
+
+	enrollment := &Enrollment{
+		ID:         id,
+		TokenID:    token.ID,
+		AppID:      token.AppID,
+		SN:         sn,
+		State:      EnrollmentPending,
+		Meta:       req.Meta,
+		RemoteAddr: remoteAddr,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if req.Claim != "" {
+		enrollment.ClaimHash = hashEnrollmentSecret(req.Claim)
+	}
+
+	token.UsedAt = &now
+	token.EnrollmentID = enrollment.ID
+	if err := m.store.PutToken(token); err != nil {
+		return nil, err
+	}
+	if err := m.store.PutEnrollment(enrollment); err != nil {
+		return nil, err
+	}
+
+	if !token.RequireApproval {
+		if err := m.approveLocked(enrollment); err != nil {
+			return nil, err
+		}
+	}
+	return enrollment, nil
+}
+
+// Approve issues the device its key. The device picks it up the next time
+// it asks about the enrollment.
+func (m *EnrollmentManager) Approve(id string) (*Enrollment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	enrollment, err := m.store.GetEnrollment(id)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.State != EnrollmentPending {
+		return nil, fmt.Errorf("%w: %s", ErrEnrollmentDecided, enrollment.State)
+	}
+	if err := m.approveLocked(enrollment); err != nil {
+		return nil, err
+	}
+	return enrollment, nil
+}
+
+func (m *EnrollmentManager) approveLocked(enrollment *Enrollment) error {
+	key, err := security.GenerateDeviceKey()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	cred, err := m.credentials.Get(enrollment.AppID, enrollment.SN)
+	if err != nil {
+		if !errors.Is(err, security.ErrCredentialNotFound) {
+			return err
+		}
+		cred = &security.DeviceCredential{AppID: enrollment.AppID, SN: enrollment.SN, CreatedAt: now}
+	}
+	cred.Key = key
+	cred.UpdatedAt = now
+	if err := m.credentials.Put(cred); err != nil {
+		return fmt.Errorf("store credential: %w", err)
+	}
+
+	return m.decideLocked(enrollment, EnrollmentApproved, "")
+}
+
+func (m *EnrollmentManager) Reject(id, reason string) (*Enrollment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	enrollment, err := m.store.GetEnrollment(id)
+	if err != nil {
+		return nil, err
+	}
+	if enrollment.State != EnrollmentPending {
+		return nil, fmt.Errorf("%w: %s", ErrEnrollmentDecided, enrollment.State)
+	}
+	if reason == "" {
+		reason = "rejected by operator"
+	}
+	if err := m.decideLocked(enrollment, EnrollmentRejected, reason); err != nil {
+		return nil, err
+	}
+	return enrollment, nil
+}
+
+func (m *EnrollmentManager) decideLocked(enrollment *Enrollment, state, reason string) error {
+	now := time.Now()
+	enrollment.State = state
+	enrollment.Reason = reason
+	enrollment.UpdatedAt = now
+	enrollment.DecidedAt = &now
+	return m.store.PutEnrollment(enrollment)
+}
+
+func hashEnrollmentSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
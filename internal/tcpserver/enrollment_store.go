@@ -0,0 +1,234 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"device-agent/internal/jsonfile"
+)
+
+// EnrollmentToken lets one device enroll into AppID. Only a hash of the
+// token's secret is kept.
+type EnrollmentToken struct {
+	ID              string     `json:"token_id"`
+	AppID           string     `json:"appid"`
+	SN              string     `json:"sn,omitempty"` // the only SN the token may enroll, if set
+	RequireApproval bool       `json:"require_approval"`
+	SecretHash      string     `json:"secret_hash"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	UsedAt          *time.Time `json:"used_at,omitempty"`
+	EnrollmentID    string     `json:"enrollment_id,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type Enrollment struct {
+	ID         string            `json:"enrollment_id"`
+	TokenID    string            `json:"token_id"`
+	AppID      string            `json:"appid"`
+	SN         string            `json:"sn"`
+	State      string            `json:"state"`
+	Reason     string            `json:"reason,omitempty"`
+	Meta       map[string]string `json:"meta,omitempty"`
+	RemoteAddr string            `json:"remote_addr"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	DecidedAt  *time.Time        `json:"decided_at,omitempty"`
+	// ClaimHash is the hash of the secret the device chose; only a request
+	// with that secret is answered.
+	ClaimHash   string     `json:"claim_hash,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+type EnrollmentStore interface {
+	GetToken(id string) (*EnrollmentToken, error)
+	PutToken(token *EnrollmentToken) error
+	DeleteToken(id string) error
+	ListTokens() ([]*EnrollmentToken, error)
+	GetEnrollment(id string) (*Enrollment, error)
+	PutEnrollment(enrollment *Enrollment) error
+	ListEnrollments() ([]*Enrollment, error)
+}
+
+var (
+	ErrEnrollmentTokenNotFound = fmt.Errorf("enrollment token not found")
+	ErrEnrollmentNotFound      = fmt.Errorf("enrollment not found")
+)
+
+type MemoryEnrollmentStore struct {
+	tokens      map[string]*EnrollmentToken
+	enrollments map[string]*Enrollment
+	mu          sync.RWMutex
+}
+
+func NewMemoryEnrollmentStore() *MemoryEnrollmentStore {
+	return &MemoryEnrollmentStore{
+		tokens:      make(map[string]*EnrollmentToken),
+		enrollments: make(map[string]*Enrollment),
+	}
+}
+
+func (m *MemoryEnrollmentStore) GetToken(id string) (*EnrollmentToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, exists := m.tokens[id]
+	if !exists {
+		return nil, ErrEnrollmentTokenNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (m *MemoryEnrollmentStore) PutToken(token *EnrollmentToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *token
+	m.tokens[token.ID] = &copied
+	return nil
+}
+
+func (m *MemoryEnrollmentStore) DeleteToken(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.tokens[id]; !exists {
+		return ErrEnrollmentTokenNotFound
+	}
+	delete(m.tokens, id)
+	return nil
+}
+
+// ListTokens returns every token, oldest first.
+func (m *MemoryEnrollmentStore) ListTokens() ([]*EnrollmentToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := make([]*EnrollmentToken, 0, len(m.tokens))
+	for _, token := range m.tokens {
+		copied := *token
+		tokens = append(tokens, &copied)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (m *MemoryEnrollmentStore) GetEnrollment(id string) (*Enrollment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	enrollment, exists := m.enrollments[id]
+	if !exists {
+		return nil, ErrEnrollmentNotFound
+	}
+	copied := *enrollment
+	return &copied, nil
+}
+
+func (m *MemoryEnrollmentStore) PutEnrollment(enrollment *Enrollment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *enrollment
+	m.enrollments[enrollment.ID] = &copied
+	return nil
+}
+
+// ListEnrollments returns every enrollment, oldest first.
+func (m *MemoryEnrollmentStore) ListEnrollments() ([]*Enrollment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	enrollments := make([]*Enrollment, 0, len(m.enrollments))
+	for _, enrollment := range m.enrollments {
+		copied := *enrollment
+		enrollments = append(enrollments, &copied)
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		return enrollments[i].CreatedAt.Before(enrollments[j].CreatedAt)
+	})
+	return enrollments, nil
+}
+
+// FileEnrollmentStore is a MemoryEnrollmentStore persisted to a JSON file
+// after every change.
+type FileEnrollmentStore struct {
+	*MemoryEnrollmentStore
+	path    string
+	writeMu sync.Mutex
+}
+
+type enrollmentFile struct {
+	Tokens      []*EnrollmentToken `json:"tokens"`
+	Enrollments []*Enrollment      `json:"enrollments"`
+}
+
+func NewFileEnrollmentStore(path string) (*FileEnrollmentStore, error) {
+	store := &FileEnrollmentStore{
+		MemoryEnrollmentStore: NewMemoryEnrollmentStore(),
+		path:                  path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("read enrollment store: %w", err)
+	}
+
+	var file enrollmentFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse enrollment store: %w", err)
+	}
+	for _, token := range file.Tokens {
+		store.MemoryEnrollmentStore.PutToken(token)
+	}
+	for _, enrollment := range file.Enrollments {
+		store.MemoryEnrollmentStore.PutEnrollment(enrollment)
+	}
+	return store, nil
+}
+
+func (f *FileEnrollmentStore) PutToken(token *EnrollmentToken) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryEnrollmentStore.PutToken(token); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileEnrollmentStore) DeleteToken(id string) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryEnrollmentStore.DeleteToken(id); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileEnrollmentStore) PutEnrollment(enrollment *Enrollment) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryEnrollmentStore.PutEnrollment(enrollment); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileEnrollmentStore) save() error {
+	var file enrollmentFile
+	file.Tokens, _ = f.MemoryEnrollmentStore.ListTokens()
+	file.Enrollments, _ = f.MemoryEnrollmentStore.ListEnrollments()
+	return jsonfile.Write(f.path, file, 0o644)
+}
@@ -0,0 +1,73 @@
+package tcpserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// enroll sends req on a new connection and returns the gateway's answer.
+func enroll(t *testing.T, server *Server, req *EnrollMessage) *EnrollResultMessage {
+	t.Helper()
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	device.send(TypeEnroll, req)
+
+	var result EnrollResultMessage
+	device.expect(TypeEnrollResult, &result)
+	return &result
+}
+
+// TestEnrollLostAnswer asks again with the enrollment ID and claim chosen
+// before the first request, as a device does whose first answer was lost.
+func TestEnrollLostAnswer(t *testing.T) {
+	server := startTestServer(t, nil)
+	token, _, err := server.GetEnrollmentManager().CreateToken(testAppID, "", false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &EnrollMessage{Token: token, SN: "s1", EnrollmentID: uuid.New().String(), Claim: "device-secret"}
+	first := enroll(t, server, req)
+	if first.Status != EnrollmentApproved || first.Key == "" || first.EnrollmentID != req.EnrollmentID {
+		t.Fatalf("first answer: %+v", first)
+	}
+
+	again := enroll(t, server, req)
+	if again.Status != EnrollmentApproved || again.Key != first.Key {
+		t.Fatalf("asking again: %+v", again)
+	}
+
+	forged := *req
+	forged.Claim = "guess"
+	if result := enroll(t, server, &forged); result.Status != EnrollmentRejected || result.Key != "" {
+		t.Fatalf("wrong claim answered: %+v", result)
+	}
+}
+
+// TestEnrollKeyDeliveredOnce checks that an enrollment opened without a
+// claim hands out its key only once.
+func TestEnrollKeyDeliveredOnce(t *testing.T) {
+	server := startTestServer(t, nil)
+	token, _, err := server.GetEnrollmentManager().CreateToken(testAppID, "", true, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := enroll(t, server, &EnrollMessage{Token: token, SN: "s1"})
+	if pending.Status != EnrollmentPending {
+		t.Fatalf("first answer: %+v", pending)
+	}
+	if _, err := server.GetEnrollmentManager().Approve(pending.EnrollmentID); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &EnrollMessage{Token: token, EnrollmentID: pending.EnrollmentID}
+	if approved := enroll(t, server, req); approved.Status != EnrollmentApproved || approved.Key == "" {
+		t.Fatalf("after approval: %+v", approved)
+	}
+	if again := enroll(t, server, req); again.Status != EnrollmentRejected || again.Key != "" {
+		t.Fatalf("key handed out twice: %+v", again)
+	}
+}
@@ -0,0 +1,153 @@
+package tcpserver
+
+import (
+	"sync"
+	"time"
+)
+
+// Device and command events published on the EventBus.
+const (
+	// EventDeviceConnected is a new connection, before it has logged in.
+	EventDeviceConnected     = "device.connected"
+	EventDeviceAuthenticated = "device.authenticated"
+	EventDeviceDisconnected  = "device.disconnected"
+	EventDeviceExpired       = "device.expired"
+	// EventDeviceAuthFailed is a refused login; Reason says why.
+	EventDeviceAuthFailed = "device.auth_failed"
+	EventCommandSent      = "command.sent"
+	EventCommandAcked     = "command.acked"
+	EventCommandTimeout   = "command.timeout"
+	EventReport           = "report"
+)
+
+const eventSubscriberBufferSize = 256
+
+// Event is something that happened to a device or one of its commands.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	AppID      string    `json:"appid,omitempty"`
+	SN         string    `json:"sn,omitempty"`
+	SessionID  string    `json:"session_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	CmdID      string    `json:"cmd_id,omitempty"`
+	Cmd        string    `json:"cmd,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	LatencyMS  int64     `json:"latency_ms,omitempty"`
+	Report     *Report   `json:"report,omitempty"`
+}
+
+// EventFilter selects events. Zero fields match everything.
+type EventFilter struct {
+	Types []string
+	AppID string
+	SN    string
+	// AppIDs, when set, limits events to those apps. Events without an app,
+	// such as connections that have not logged in, never match.
+	AppIDs []string
+}
+
+func (f *EventFilter) Matches(event *Event) bool {
+	if len(f.Types) > 0 && !containsString(f.Types, event.Type) {
+		return false
+	}
+	if f.AppID != "" && event.AppID != f.AppID {
+		return false
+	}
+	if f.SN != "" && event.SN != f.SN {
+		return false
+	}
+	if f.AppIDs != nil && !containsString(f.AppIDs, event.AppID) {
+		return false
+	}
+	return true
+}
+
+// EventBus fans out device events to any number of subscribers, each with
+// its own filter. A nil *EventBus drops everything published to it.
+type EventBus struct {
+	subscribers map[chan Event]EventFilter
+	mu          sync.RWMutex
+	// webhooks, when set, get every event before the subscribers do.
+	webhooks *Webhooks
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]EventFilter),
+	}
+}
+
+// Subscribe returns a channel of the events matching filter and a function
+// that must be called to release it.
+func (b *EventBus) Subscribe(filter EventFilter) (<-chan Event, func()) {
+	ch := make(chan Event, eventSubscriberBufferSize)
+
+	b.mu.Lock()
+	b.subscribers[ch] = filter
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			delete(b.subscribers, ch)
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// Publish delivers event to every matching subscriber. Slow subscribers
+// drop events rather than block the publisher; webhooks are handed the
+// event directly so none is lost to a full buffer.
+func (b *EventBus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if b.webhooks != nil {
+		b.webhooks.Dispatch(event)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch, filter := range b.subscribers {
+		if !filter.Matches(&event) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// sessionEvent describes session for an event of eventType.
+func sessionEvent(eventType string, session *Session) Event {
+	return Event{
+		Type:       eventType,
+		AppID:      session.AppID,
+		SN:         session.SN,
+		SessionID:  session.ID,
+		RemoteAddr: session.RemoteAddr,
+		Reason:     session.CloseReason(),
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package tcpserver
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEventFilterMatches(t *testing.T) {
+	event := Event{Type: EventCommandAcked, AppID: testAppID, SN: "s1"}
+	tests := []struct {
+		name   string
+		filter EventFilter
+		want   bool
+	}{
+		{"empty filter", EventFilter{}, true},
+		{"matching type", EventFilter{Types: []string{EventCommandSent, EventCommandAcked}}, true},
+		{"other type", EventFilter{Types: []string{EventReport}}, false},
+		{"matching app and sn", EventFilter{AppID: testAppID, SN: "s1"}, true},
+		{"other sn", EventFilter{AppID: testAppID, SN: "s2"}, false},
+		{"other app", EventFilter{AppID: "A2"}, false},
+		{"allowed apps", EventFilter{AppIDs: []string{"A2", testAppID}}, true},
+		{"other allowed apps", EventFilter{AppIDs: []string{"A2"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(&event); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Connections that have not logged in have no app and are hidden from
+	// subscribers limited to apps.
+	scoped := EventFilter{AppIDs: []string{testAppID}}
+	if scoped.Matches(&Event{Type: EventDeviceConnected}) {
+		t.Error("event without an app matched a filter limited to apps")
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe(EventFilter{SN: "s1"})
+
+	bus.Publish(Event{Type: EventReport, SN: "s2"})
+	bus.Publish(Event{Type: EventReport, SN: "s1"})
+	event := <-events
+	if event.SN != "s1" || event.Time.IsZero() {
+		t.Errorf("event %+v", event)
+	}
+
+	cancel()
+	cancel()
+	bus.Publish(Event{Type: EventReport, SN: "s1"})
+	if _, open := <-events; open {
+		t.Error("event delivered after unsubscribing")
+	}
+}
+
+// TestEventBusSlowSubscriber checks a subscriber that stops reading drops
+// events past its buffer without holding up the publisher or others.
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	slow, cancelSlow := bus.Subscribe(EventFilter{})
+	defer cancelSlow()
+	fast, cancelFast := bus.Subscribe(EventFilter{})
+	defer cancelFast()
+
+	const published = eventSubscriberBufferSize + 10
+	for i := 0; i < published; i++ {
+		bus.Publish(Event{Type: EventReport, SN: "s1"})
+		select {
+		case <-fast:
+		default:
+			t.Fatalf("reading subscriber missed event %d", i)
+		}
+	}
+	if len(slow) != eventSubscriberBufferSize {
+		t.Errorf("slow subscriber holds %d events, want %d", len(slow), eventSubscriberBufferSize)
+	}
+}
+
+func TestNilEventBus(t *testing.T) {
+	var bus *EventBus
+	bus.Publish(Event{Type: EventReport})
+}
+
+// nextEvent returns the next event on events and fails the test unless it
+// has eventType.
+func nextEvent(t *testing.T, events <-chan Event, eventType string) Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.Type != eventType {
+			t.Fatalf("got %s event %+v, want %s", event.Type, event, eventType)
+		}
+		if event.Time.IsZero() {
+			t.Errorf("%s event without a time", eventType)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event", eventType)
+	}
+	return Event{}
+}
+
+// TestServerPublishesEvents walks a device through a login, a report and
+// two commands and checks the gateway publishes each step.
+func TestServerPublishesEvents(t *testing.T) {
+	server := startTestServer(t, nil)
+	events, cancel := server.GetEventBus().Subscribe(EventFilter{})
+	defer cancel()
+
+	intruder := dialTestDevice(t, serverAddr(server), nil)
+	nextEvent(t, events, EventDeviceConnected)
+	intruder.login(testAppID, "s9", "K_WRONG", nil)
+	if event := nextEvent(t, events, EventDeviceAuthFailed); event.SN != "s9" || event.Reason == "" {
+		t.Errorf("auth failed event %+v", event)
+	}
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	if event := nextEvent(t, events, EventDeviceConnected); event.RemoteAddr == "" || event.SN != "" {
+		t.Errorf("connected event %+v", event)
+	}
+	device.mustLogin(testAppID, "s1", testKey)
+	authenticated := nextEvent(t, events, EventDeviceAuthenticated)
+	if authenticated.AppID != testAppID || authenticated.SN != "s1" || authenticated.SessionID == "" {
+		t.Errorf("authenticated event %+v", authenticated)
+	}
+
+	device.send(TypeReport, &ReportMessage{Kind: "status", Data: map[string]interface{}{"screen": "on"}})
+	if event := nextEvent(t, events, EventReport); event.SN != "s1" || event.Report == nil || event.Report.Kind != "status" {
+		t.Errorf("report event %+v", event)
+	}
+
+	session, _ := server.GetSessionManager().GetByDevice(testAppID, "s1")
+	ledger := server.GetCommandLedger()
+	if err := ledger.SendTracked(session, &CommandMessage{CmdID: "c1", Cmd: "OPEN_WEB"}, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events, EventCommandSent); event.CmdID != "c1" || event.Cmd != "OPEN_WEB" || event.RequestID != "r1" {
+		t.Errorf("sent event %+v", event)
+	}
+	var cmd CommandMessage
+	device.expect(TypeCMD, &cmd)
+	device.send(TypeACK, &ACKMessage{CmdID: "c1", Status: "ok", Detail: "opened"})
+	if event := nextEvent(t, events, EventCommandAcked); event.CmdID != "c1" || event.Status != "ok" || event.Detail != "opened" || event.RequestID != "r1" {
+		t.Errorf("acked event %+v", event)
+	}
+
+	if err := ledger.SendTracked(session, &CommandMessage{CmdID: "c2", Cmd: "REBOOT"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, events, EventCommandSent)
+	ledger.ExpireOverdue(time.Now().Add(time.Hour))
+	if event := nextEvent(t, events, EventCommandTimeout); event.CmdID != "c2" || event.Cmd != "REBOOT" {
+		t.Errorf("timeout event %+v", event)
+	}
+
+	device.conn.Close()
+	disconnected := nextEvent(t, events, EventDeviceDisconnected)
+	if disconnected.SessionID != authenticated.SessionID || disconnected.Reason == "" {
+		t.Errorf("disconnected event %+v", disconnected)
+	}
+}
+
+func TestSessionExpiredEvent(t *testing.T) {
+	sm := NewSessionManager()
+	sm.events = NewEventBus()
+	events, cancel := sm.events.Subscribe(EventFilter{Types: []string{EventDeviceExpired}})
+	defer cancel()
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session := NewSession(conn)
+	session.AppID, session.SN = testAppID, "s1"
+	session.LastPing = time.Now().Add(-time.Hour)
+	sm.Add(session)
+
+	if expired := sm.CleanupExpired(time.Minute); expired != 1 {
+		t.Fatalf("%d sessions expired, want 1", expired)
+	}
+	if event := nextEvent(t, events, EventDeviceExpired); event.SN != "s1" || event.Reason != "session expired" {
+		t.Errorf("expired event %+v", event)
+	}
+	if _, online := sm.GetByDevice(testAppID, "s1"); online {
+		t.Error("expired device still online")
+	}
+}
@@ -0,0 +1,434 @@
+package tcpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultTransferChunkSize = 256 * 1024
+	// MaxTransferChunkSize keeps a base64 encoded chunk well inside
+	// MaxMessageSize.
+	MaxTransferChunkSize   = 512 * 1024
+	DefaultMaxTransferSize = 256 * 1024 * 1024 // 256MB
+
+	transferRetention = 24 * time.Hour
+)
+
+type TransferState string
+
+const (
+	// TransferStatePending transfers wait for the device to (re)connect.
+	TransferStatePending   TransferState = "pending"
+	TransferStateSending   TransferState = "sending"
+	TransferStateVerifying TransferState = "verifying"
+	TransferStateDone      TransferState = "done"
+	TransferStateFailed    TransferState = "failed"
+)
+
+var (
+	ErrTransferNotFound = errors.New("transfer not found")
+	ErrTransferTooLarge = errors.New("file exceeds maximum transfer size")
+)
+
+type Transfer struct {
+	ID         string        `json:"transfer_id"`
+	AppID      string        `json:"appid"`
+	SN         string        `json:"sn"`
+	Name       string        `json:"name"`
+	Size       int64         `json:"size"`
+	SHA256     string        `json:"sha256"`
+	State      TransferState `json:"state"`
+	Offset     int64         `json:"offset"`
+	Error      string        `json:"error,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+
+	path    string
+	attempt int
+}
+
+func (t *Transfer) finished() bool {
+	return t.State == TransferStateDone || t.State == TransferStateFailed
+}
+
+// TransferManager pushes files to devices in chunks. Uploaded files are
+// spooled to disk first so a transfer can resume from the offset the device
+// reports after a reconnect.
+type TransferManager struct {
+	dir       string
+	chunkSize int
+	maxSize   int64
+	transfers map[string]*Transfer
+	logger    *slog.Logger
+	mu        sync.Mutex
+}
+
+func NewTransferManager(dir string, chunkSize int, maxSize int64) *TransferManager {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "device-agent-transfers")
+	}
+	if chunkSize <= 0 {
+		chunkSize = DefaultTransferChunkSize
+	}
+	if chunkSize > MaxTransferChunkSize {
+		chunkSize = MaxTransferChunkSize
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxTransferSize
+	}
+	return &TransferManager{
+		dir:       dir,
+		chunkSize: chunkSize,
+		maxSize:   maxSize,
+		transfers: make(map[string]*Transfer),
+		logger:    slog.Default(),
+	}
+}
+
+// RemoveStaleSpool deletes spool files left behind by a previous run.
+// Transfers are only kept in memory, so none of them can be resumed.
+func (m *TransferManager) RemoveStaleSpool() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	spools, err := filepath.Glob(filepath.Join(m.dir, "*.data"))
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, spool := range spools {
+		id := strings.TrimSuffix(filepath.Base(spool), ".data")
+		if _, exists := m.transfers[id]; exists {
+			continue
+		}
+		if err := os.Remove(spool); err != nil {
+			m.logger.Warn("Failed to remove stale spool file", "path", spool, "error", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		m.logger.Info("Removed stale transfer spool files", "count", removed)
+	}
+}
+
+// CleanTransferName validates a destination name sent with a transfer. Names
+// are slash separated paths relative to the device's file directory.
+func CleanTransferName(name string) (string, error) {
+	cleaned := path.Clean(name)
+	if name == "" || !filepath.IsLocal(filepath.FromSlash(cleaned)) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return cleaned, nil
+}
+
+// Create spools r to disk and registers a pending transfer of it to a device.
+func (m *TransferManager) Create(appID, sn, name string, r io.Reader) (*Transfer, error) {
+	name, err := CleanTransferName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create transfer directory: %w", err)
+	}
+
+	id := uuid.New().String()
+	spool := filepath.Join(m.dir, id+".data")
+	f, err := os.Create(spool)
+	if err != nil {
+		return nil, fmt.Errorf("create spool file: %w", err)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(r, m.maxSize+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > m.maxSize {
+		err = ErrTransferTooLarge
+	}
+	if err != nil {
+		os.Remove(spool)
+		return nil, err
+	}
+
+	now := time.Now()
+	transfer := &Transfer{
+		ID:        id,
+		AppID:     appID,
+		SN:        sn,
+		Name:      name,
+		Size:      size,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		State:     TransferStatePending,
+		CreatedAt: now,
+		UpdatedAt: now,
+		path:      spool,
+	}
+
+	m.mu.Lock()
+	m.pruneLocked(now)
+	m.transfers[id] = transfer
+	copied := *transfer
+	m.mu.Unlock()
+
+	return &copied, nil
+}
+
+func (m *TransferManager) Get(id string) (*Transfer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transfer, exists := m.transfers[id]
+	if !exists {
+		return nil, ErrTransferNotFound
+	}
+	copied := *transfer
+	return &copied, nil
+}
+
+// ListByDevice returns the transfers for a device, oldest first.
+func (m *TransferManager) ListByDevice(appID, sn string) []*Transfer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var transfers []*Transfer
+	for _, transfer := range m.transfers {
+		if transfer.AppID == appID && transfer.SN == sn {
+			copied := *transfer
+			transfers = append(transfers, &copied)
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].CreatedAt.Before(transfers[j].CreatedAt)
+	})
+	return transfers
+}
+
+// Begin announces transfer id on session. Streaming starts once the device
+// answers with the offset it already holds.
+func (m *TransferManager) Begin(session *Session, id string) error {
+	m.mu.Lock()
+	transfer, exists := m.transfers[id]
+	if !exists {
+		m.mu.Unlock()
+		return ErrTransferNotFound
+	}
+	if transfer.finished() {
+		m.mu.Unlock()
+		return nil
+	}
+	transfer.attempt++
+	transfer.State = TransferStatePending
+	transfer.UpdatedAt = time.Now()
+	begin := &FileBeginMessage{
+		TransferID: transfer.ID,
+		Name:       transfer.Name,
+		Size:       transfer.Size,
+		SHA256:     transfer.SHA256,
+	}
+	m.mu.Unlock()
+
+	return session.SendPayload(TypeFileBegin, begin)
+}
+
+// Resume restarts every unfinished transfer for the device on session.
+func (m *TransferManager) Resume(session *Session) {
+	for _, transfer := range m.ListByDevice(session.AppID, session.SN) {
+		if transfer.finished() {
+			continue
+		}
+		if err := m.Begin(session, transfer.ID); err != nil {
+			session.log.Error("Failed to resume transfer", "transfer_id", transfer.ID, "error", err)
+			return
+		}
+	}
+}
+
+// HandleStatus applies a status reported by the device.
+func (m *TransferManager) HandleStatus(session *Session, status *FileStatusMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transfer, exists := m.transfers[status.TransferID]
+	if !exists || transfer.AppID != session.AppID || transfer.SN != session.SN {
+		return fmt.Errorf("%w: %s", ErrTransferNotFound, status.TransferID)
+	}
+	if transfer.finished() {
+		return nil
+	}
+
+	now := time.Now()
+	transfer.UpdatedAt = now
+
+	switch status.Status {
+	case FileStatusReady:
+		if status.Offset < 0 || status.Offset > transfer.Size {
+			m.finishLocked(transfer, fmt.Sprintf("device reported invalid offset %d", status.Offset))
+			return nil
+		}
+		if status.Offset > 0 {
+			session.log.Info("Resuming transfer", "transfer_id", transfer.ID, "offset", status.Offset)
+		}
+		// A device that lost track of a chunk reports its offset again
+		// mid-stream; a new attempt stops the stream already running.
+		transfer.attempt++
+		transfer.State = TransferStateSending
+		transfer.Offset = status.Offset
+		go m.stream(session, transfer.ID, transfer.attempt, status.Offset)
+	case FileStatusDone:
+		transfer.Offset = transfer.Size
+		m.finishLocked(transfer, "")
+	case FileStatusError:
+		m.finishLocked(transfer, status.Detail)
+	default:
+		return fmt.Errorf("unknown file status %q", status.Status)
+	}
+	return nil
+}
+
+// stream sends the spooled file from offset and then asks the device to
+// verify it. It stops as soon as the transfer is restarted or finished.
+func (m *TransferManager) stream(session *Session, id string, attempt int, offset int64) {
+	m.mu.Lock()
+	transfer, exists := m.transfers[id]
+	var spool string
+	if exists {
+		spool = transfer.path
+	}
+	m.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	f, err := os.Open(spool)
+	if err != nil {
+		m.fail(id, attempt, fmt.Sprintf("open spool file: %v", err))
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		m.fail(id, attempt, fmt.Sprintf("seek spool file: %v", err))
+		return
+	}
+
+	buf := make([]byte, m.chunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if !m.current(id, attempt) {
+				return
+			}
+			chunk := &FileChunkMessage{TransferID: id, Offset: offset, Data: buf[:n]}
+			if sendErr := session.SendPayload(TypeFileChunk, chunk); sendErr != nil {
+				// The device resumes from its own offset on reconnect.
+				m.interrupt(id, attempt)
+				return
+			}
+			offset += int64(n)
+			m.advance(id, attempt, offset)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			m.fail(id, attempt, fmt.Sprintf("read spool file: %v", err))
+			return
+		}
+	}
+
+	m.mu.Lock()
+	transfer, exists = m.transfers[id]
+	if !exists || transfer.attempt != attempt || transfer.finished() {
+		m.mu.Unlock()
+		return
+	}
+	transfer.State = TransferStateVerifying
+	transfer.UpdatedAt = time.Now()
+	m.mu.Unlock()
+
+	if err := session.SendPayload(TypeFileComplete, &FileCompleteMessage{TransferID: id}); err != nil {
+		m.interrupt(id, attempt)
+	}
+}
+
+// current reports whether attempt is still the one streaming transfer id.
+// It is false once the transfer was restarted, finished or pruned.
+func (m *TransferManager) current(id string, attempt int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transfer, exists := m.transfers[id]
+	return exists && transfer.attempt == attempt && transfer.State == TransferStateSending
+}
+
+func (m *TransferManager) advance(id string, attempt int, offset int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if transfer, exists := m.transfers[id]; exists && transfer.attempt == attempt {
+		transfer.Offset = offset
+		transfer.UpdatedAt = time.Now()
+	}
+}
+
+func (m *TransferManager) interrupt(id string, attempt int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if transfer, exists := m.transfers[id]; exists && transfer.attempt == attempt && !transfer.finished() {
+		transfer.State = TransferStatePending
+		transfer.UpdatedAt = time.Now()
+	}
+}
+
+func (m *TransferManager) fail(id string, attempt int, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if transfer, exists := m.transfers[id]; exists && transfer.attempt == attempt && !transfer.finished() {
+		m.finishLocked(transfer, reason)
+	}
+}
+
+// finishLocked marks transfer done, or failed when reason is set, and
+// removes its spool file.
+func (m *TransferManager) finishLocked(transfer *Transfer, reason string) {
+	now := time.Now()
+	transfer.State = TransferStateDone
+	if reason != "" {
+		transfer.State = TransferStateFailed
+		transfer.Error = reason
+	}
+	transfer.UpdatedAt = now
+	transfer.FinishedAt = &now
+
+	if err := os.Remove(transfer.path); err != nil && !os.IsNotExist(err) {
+		m.logger.Warn("Failed to remove spool file", "transfer_id", transfer.ID, "error", err)
+	}
+}
+
+func (m *TransferManager) pruneLocked(now time.Time) {
+	for id, transfer := range m.transfers {
+		if transfer.finished() && now.Sub(transfer.UpdatedAt) > transferRetention {
+			delete(m.transfers, id)
+		}
+	}
+}
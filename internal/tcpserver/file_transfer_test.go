@@ -0,0 +1,175 @@
+package tcpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanTransferName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"app.apk", "app.apk", true},
+		{"media/intro.mp4", "media/intro.mp4", true},
+		{"media/../app.apk", "app.apk", true},
+		{"", "", false},
+		{"../app.apk", "", false},
+		{"media/../../app.apk", "", false},
+		{"/etc/passwd", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CleanTransferName(tt.name)
+			if (err == nil) != tt.ok || got != tt.want {
+				t.Errorf("CleanTransferName(%q) = %q, %v", tt.name, got, err)
+			}
+		})
+	}
+}
+
+// receiveChunks reads chunks of transferID until the gateway asks the
+// device to verify the file, and returns the data received.
+func (d *testDevice) receiveChunks(transferID string, offset int64) []byte {
+	d.t.Helper()
+
+	var data []byte
+	for {
+		msg, err := d.readMessage()
+		if err != nil {
+			d.t.Fatalf("waiting for chunks: %v", err)
+		}
+		switch msg.Type {
+		case TypePing:
+			continue
+		case TypeFileComplete:
+			return data
+		case TypeFileChunk:
+		default:
+			d.t.Fatalf("got %s, want a chunk", msg.Type)
+		}
+
+		var chunk FileChunkMessage
+		if err := d.wire.Codec.Unmarshal(msg.Payload, &chunk); err != nil {
+			d.t.Fatal(err)
+		}
+		if chunk.TransferID != transferID || chunk.Offset != offset {
+			d.t.Fatalf("chunk %s at %d, want %s at %d", chunk.TransferID, chunk.Offset, transferID, offset)
+		}
+		data = append(data, chunk.Data...)
+		offset += int64(len(chunk.Data))
+	}
+}
+
+// TestTransferResumes queues a file for an offline device, drops the
+// connection after the first chunk and checks the transfer resumes from the
+// offset the device reports when it logs in again.
+func TestTransferResumes(t *testing.T) {
+	dir := t.TempDir()
+	server := startTestServer(t, func(config *Config) {
+		config.TransferDir = dir
+		config.TransferChunkSize = 4
+	})
+	transfers := server.GetTransferManager()
+
+	content := "0123456789"
+	transfer, err := transfers.Create(testAppID, "s1", "media/../notes.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	if transfer.Name != "notes.txt" || transfer.Size != 10 || transfer.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("created %+v", transfer)
+	}
+
+	first := dialTestDevice(t, serverAddr(server), nil)
+	first.mustLogin(testAppID, "s1", testKey)
+	var begin FileBeginMessage
+	first.expect(TypeFileBegin, &begin)
+	if begin.TransferID != transfer.ID || begin.Size != 10 || begin.SHA256 != transfer.SHA256 {
+		t.Fatalf("begin %+v", begin)
+	}
+	first.send(TypeFileStatus, &FileStatusMessage{TransferID: transfer.ID, Status: FileStatusReady})
+	var chunk FileChunkMessage
+	first.expect(TypeFileChunk, &chunk)
+	if chunk.Offset != 0 || string(chunk.Data) != "0123" {
+		t.Fatalf("first chunk %+v", chunk)
+	}
+	first.conn.Close()
+
+	second := dialTestDevice(t, serverAddr(server), nil)
+	second.mustLogin(testAppID, "s1", testKey)
+	second.expect(TypeFileBegin, &begin)
+	if begin.TransferID != transfer.ID {
+		t.Fatalf("begin after reconnecting %+v", begin)
+	}
+	second.send(TypeFileStatus, &FileStatusMessage{TransferID: transfer.ID, Status: FileStatusReady, Offset: 4})
+	if rest := second.receiveChunks(transfer.ID, 4); string(rest) != "456789" {
+		t.Fatalf("resumed with %q", rest)
+	}
+	if got, _ := transfers.Get(transfer.ID); got.State != TransferStateVerifying || got.Offset != 10 {
+		t.Errorf("transfer before the device verified it: %+v", got)
+	}
+
+	second.send(TypeFileStatus, &FileStatusMessage{TransferID: transfer.ID, Status: FileStatusDone, Offset: 10})
+	waitFor(t, "transfer to finish", func() bool {
+		got, _ := transfers.Get(transfer.ID)
+		return got.State == TransferStateDone
+	})
+	if spools, _ := filepath.Glob(filepath.Join(dir, "*.data")); len(spools) != 0 {
+		t.Errorf("spool files left: %v", spools)
+	}
+}
+
+func TestTransferFailures(t *testing.T) {
+	dir := t.TempDir()
+	server := startTestServer(t, func(config *Config) {
+		config.TransferDir = dir
+		config.MaxTransferSize = 8
+	})
+	transfers := server.GetTransferManager()
+
+	if _, err := transfers.Create(testAppID, "s1", "big.bin", strings.NewReader("0123456789")); err != ErrTransferTooLarge {
+		t.Errorf("create over the size limit: %v", err)
+	}
+	if _, err := transfers.Create(testAppID, "s1", "../escape.bin", strings.NewReader("0")); err == nil {
+		t.Error("created a transfer outside the file directory")
+	}
+
+	invalid, err := transfers.Create(testAppID, "s1", "a.bin", strings.NewReader("0123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected, err := transfers.Create(testAppID, "s1", "b.bin", strings.NewReader("4567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+	var begin FileBeginMessage
+	device.expect(TypeFileBegin, &begin)
+	device.expect(TypeFileBegin, &begin)
+
+	device.send(TypeFileStatus, &FileStatusMessage{TransferID: invalid.ID, Status: FileStatusReady, Offset: 5})
+	device.send(TypeFileStatus, &FileStatusMessage{TransferID: rejected.ID, Status: FileStatusError, Detail: "disk full"})
+	waitFor(t, "transfers to fail", func() bool {
+		a, _ := transfers.Get(invalid.ID)
+		b, _ := transfers.Get(rejected.ID)
+		return a.State == TransferStateFailed && b.State == TransferStateFailed
+	})
+	if got, _ := transfers.Get(invalid.ID); got.Error != "device reported invalid offset 5" {
+		t.Errorf("invalid offset: %+v", got)
+	}
+	if got, _ := transfers.Get(rejected.ID); got.Error != "disk full" {
+		t.Errorf("rejected: %+v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, rejected.ID+".data")); !os.IsNotExist(err) {
+		t.Errorf("spool of a failed transfer: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package tcpserver
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"device-agent/internal/security"
+)
+
+const (
+	testAppID = "A1"
+	testKey   = "K_TEST"
+)
+
+// startTestServer starts a server on a free local port that knows app
+// testAppID with testKey. configure may change the config first.
+func startTestServer(t *testing.T, configure func(config *Config)) *Server {
+	t.Helper()
+
+	config := &Config{
+		Addr:              "127.0.0.1:0",
+		HeartbeatInterval: time.Minute,
+		SessionTimeout:    time.Minute,
+		Keys:              map[string]string{testAppID: testKey},
+		TimeWindowSec:     300,
+	}
+	if configure != nil {
+		configure(config)
+	}
+
+	server := NewServer(config)
+	if err := server.Start(); err != nil {
+		t.Fatalf("start server: %v", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+	return server
+}
+
+func serverAddr(server *Server) string {
+	return server.Addr().String()
+}
+
+// testDevice speaks the device side of the protocol.
+type testDevice struct {
+	t    *testing.T
+	conn net.Conn
+	wire *WireParams
+}
+
+// dialTestDevice connects to addr, over TLS when tlsConfig is set.
+func dialTestDevice(t *testing.T, addr string, tlsConfig *tls.Config) *testDevice {
+	t.Helper()
+
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testDevice{t: t, conn: conn, wire: HandshakeParams()}
+}
+
+// login authenticates as sn of appID. offer may change the auth message
+// before it is signed and sent. On success the device switches to the
+// negotiated wire params.
+func (d *testDevice) login(appID, sn, key string, offer func(auth *AuthMessage)) (*AuthMessage, *AuthOKMessage, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	auth := &AuthMessage{
+		AppID: appID,
+		SN:    sn,
+		TS:    time.Now().Unix(),
+		Nonce: hex.EncodeToString(nonce),
+	}
+	if offer != nil {
+		offer(auth)
+	}
+	signer := security.NewAuthenticator(nil, 300, nil)
+	auth.Sign = signer.GenerateSignature(auth.AppID, auth.SN, auth.TS, auth.Nonce, key)
+
+	msg, err := NewMessage(TypeAuth, auth)
+	if err != nil {
+		return auth, nil, err
+	}
+	if err := WriteFrame(d.conn, msg, d.wire); err != nil {
+		return auth, nil, err
+	}
+
+	resp, err := d.readMessage()
+	if err != nil {
+		return auth, nil, err
+	}
+	if resp.Type != TypeAuthOK {
+		return auth, nil, fmt.Errorf("unexpected auth response type %s", resp.Type)
+	}
+
+	var authOK AuthOKMessage
+	if err := UnmarshalPayload(resp.Payload, &authOK); err != nil {
+		return auth, nil, err
+	}
+	if !authOK.Success {
+		return auth, &authOK, nil
+	}
+
+	wire := HandshakeParams()
+	if authOK.Version != 0 {
+		wire.Version = authOK.Version
+	}
+	if authOK.Codec != "" {
+		codec, exists := LookupCodec(authOK.Codec)
+		if !exists {
+			return auth, &authOK, fmt.Errorf("unknown codec %q", authOK.Codec)
+		}
+		wire.Codec = codec
+	}
+	wire.Compression = authOK.Compression
+	d.wire = wire
+	return auth, &authOK, nil
+}
+
+// mustLogin logs in and fails the test unless the gateway accepts it.
+func (d *testDevice) mustLogin(appID, sn, key string) {
+	d.t.Helper()
+
+	_, authOK, err := d.login(appID, sn, key, nil)
+	if err != nil {
+		d.t.Fatalf("login %s: %v", sn, err)
+	}
+	if !authOK.Success {
+		d.t.Fatalf("login %s refused: %s", sn, authOK.Message)
+	}
+}
+
+func (d *testDevice) send(msgType MessageType, payload interface{}) {
+	d.t.Helper()
+
+	msg, err := NewMessageWithCodec(d.wire.Codec, msgType, payload)
+	if err != nil {
+		d.t.Fatalf("encode %s: %v", msgType, err)
+	}
+	if err := WriteFrame(d.conn, msg, d.wire); err != nil {
+		d.t.Fatalf("send %s: %v", msgType, err)
+	}
+}
+
+func (d *testDevice) readMessage() (*Message, error) {
+	d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return ReadFrame(d.conn, d.wire)
+}
+
+// expect reads messages, skipping pings, until one of msgType arrives and
+// decodes it into v.
+func (d *testDevice) expect(msgType MessageType, v interface{}) {
+	d.t.Helper()
+
+	for {
+		msg, err := d.readMessage()
+		if err != nil {
+			d.t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == TypePing {
+			continue
+		}
+		if msg.Type != msgType {
+			d.t.Fatalf("got %s, want %s", msg.Type, msgType)
+		}
+		if err := d.wire.Codec.Unmarshal(msg.Payload, v); err != nil {
+			d.t.Fatalf("decode %s: %v", msgType, err)
+		}
+		return
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
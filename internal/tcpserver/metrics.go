@@ -0,0 +1,245 @@
+package tcpserver
+
+import (
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "gateway"
+
+// Reasons a device login is refused, as counted in gateway_auth_total.
+const (
+	authReasonPayload   = "invalid_payload"
+	authReasonThrottled = "throttled"
+	authReasonBlocked   = "blocked"
+	authReasonSignature = "signature"
+	authReasonPeerCert  = "peer_certificate"
+	authReasonQuota     = "connection_limit"
+	authReasonVersion   = "protocol_version"
+)
+
+// Metrics holds the gateway's Prometheus metrics. Each server has its own
+// registry, which the HTTP API serves on /metrics. A nil *Metrics records
+// nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	auth             *prometheus.CounterVec
+	messagesReceived *prometheus.CounterVec
+	messagesSent     *prometheus.CounterVec
+	bytesReceived    prometheus.Counter
+	bytesSent        prometheus.Counter
+	commandsSent     prometheus.Counter
+	ackLatency       prometheus.Histogram
+	ackTimeouts      prometheus.Counter
+	repliesRejected  *prometheus.CounterVec
+	heartbeatFailed  prometheus.Counter
+	sessionsEvicted  prometheus.Counter
+}
+
+func NewMetrics(sessionManager *SessionManager) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		auth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_total",
+			Help:      "Device logins by result and, for failures, reason.",
+		}, []string{"result", "reason"}),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_received_total",
+			Help:      "Messages received from devices by message type.",
+		}, []string{"type"}),
+		messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_sent_total",
+			Help:      "Messages sent to devices by message type.",
+		}, []string{"type"}),
+		bytesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_received_total",
+			Help:      "Bytes read from device connections.",
+		}),
+		bytesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_sent_total",
+			Help:      "Bytes written to device connections.",
+		}),
+		commandsSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_sent_total",
+			Help:      "Commands sent to devices.",
+		}),
+		ackLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "ack_latency_seconds",
+			Help:      "Time from sending a command to receiving its ACK.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}),
+		ackTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ack_timeouts_total",
+			Help:      "Commands whose ACK did not arrive in time.",
+		}),
+		repliesRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "replies_rejected_total",
+			Help:      "ACKs and progress messages dropped because the command was not sent to the replying device, by message type.",
+		}, []string{"type"}),
+		heartbeatFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "heartbeat_failures_total",
+			Help:      "Sessions closed because a ping could not be sent.",
+		}),
+		sessionsEvicted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_evicted_total",
+			Help:      "Sessions closed for not answering heartbeats in time.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.auth,
+		m.messagesReceived,
+		m.messagesSent,
+		m.bytesReceived,
+		m.bytesSent,
+		m.commandsSent,
+		m.ackLatency,
+		m.ackTimeouts,
+		m.repliesRejected,
+		m.heartbeatFailed,
+		m.sessionsEvicted,
+		&sessionCollector{sessionManager: sessionManager},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Registry returns the registry the metrics are registered in. Other
+// packages may register their own metrics there.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+func (m *Metrics) authSucceeded() {
+	if m == nil {
+		return
+	}
+	m.auth.WithLabelValues(AuditSuccess, "").Inc()
+}
+
+func (m *Metrics) authFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.auth.WithLabelValues(AuditFailure, reason).Inc()
+}
+
+func (m *Metrics) messageReceived(msgType MessageType) {
+	if m == nil {
+		return
+	}
+	m.messagesReceived.WithLabelValues(msgType.String()).Inc()
+}
+
+func (m *Metrics) messageSent(msgType MessageType) {
+	if m == nil {
+		return
+	}
+	m.messagesSent.WithLabelValues(msgType.String()).Inc()
+}
+
+func (m *Metrics) commandSent() {
+	if m == nil {
+		return
+	}
+	m.commandsSent.Inc()
+}
+
+func (m *Metrics) ackReceived(latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.ackLatency.Observe(latency.Seconds())
+}
+
+func (m *Metrics) ackTimedOut() {
+	if m == nil {
+		return
+	}
+	m.ackTimeouts.Inc()
+}
+
+func (m *Metrics) replyRejected(msgType MessageType) {
+	if m == nil {
+		return
+	}
+	m.repliesRejected.WithLabelValues(msgType.String()).Inc()
+}
+
+func (m *Metrics) heartbeatFailure() {
+	if m == nil {
+		return
+	}
+	m.heartbeatFailed.Inc()
+}
+
+func (m *Metrics) evicted(count int) {
+	if m == nil {
+		return
+	}
+	m.sessionsEvicted.Add(float64(count))
+}
+
+// sessionCollector reports the online sessions of each app when scraped.
+type sessionCollector struct {
+	sessionManager *SessionManager
+}
+
+var sessionsOnlineDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "sessions_online"),
+	"Authenticated device sessions by AppID.",
+	[]string{"appid"}, nil,
+)
+
+func (sc *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsOnlineDesc
+}
+
+func (sc *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	for appID, count := range sc.sessionManager.OnlineByApp() {
+		ch <- prometheus.MustNewConstMetric(sessionsOnlineDesc, prometheus.GaugeValue, float64(count), appID)
+	}
+}
+
+// meteredConn counts the bytes read from and written to a device
+// connection.
+type meteredConn struct {
+	net.Conn
+	metrics *Metrics
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.bytesReceived.Add(float64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.bytesSent.Add(float64(n))
+	return n, err
+}
+
+// meter wraps conn to count its traffic.
+func (m *Metrics) meter(conn net.Conn) net.Conn {
+	if m == nil {
+		return conn
+	}
+	return &meteredConn{Conn: conn, metrics: m}
+}
@@ -0,0 +1,70 @@
+package tcpserver
+
+import "sync"
+
+const (
+	CommandEventProgress = "progress"
+	CommandEventACK      = "ack"
+)
+
+type CommandEvent struct {
+	Type     string           `json:"type"`
+	Progress *ProgressMessage `json:"progress,omitempty"`
+	ACK      *ACKMessage      `json:"ack,omitempty"`
+}
+
+// ProgressHub fans out progress updates and the final ACK for a command to
+// any number of watchers. Unlike ACKWaiter it never consumes the ACK, so
+// synchronous senders and streaming watchers can coexist.
+type ProgressHub struct {
+	subscribers map[string]map[chan CommandEvent]struct{}
+	mu          sync.RWMutex
+}
+
+func NewProgressHub() *ProgressHub {
+	return &ProgressHub{
+		subscribers: make(map[string]map[chan CommandEvent]struct{}),
+	}
+}
+
+// Subscribe returns a channel of events for cmdID and a function that must be
+// called to release it.
+func (h *ProgressHub) Subscribe(cmdID string) (<-chan CommandEvent, func()) {
+	ch := make(chan CommandEvent, 32)
+
+	h.mu.Lock()
+	if h.subscribers[cmdID] == nil {
+		h.subscribers[cmdID] = make(map[chan CommandEvent]struct{})
+	}
+	h.subscribers[cmdID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			delete(h.subscribers[cmdID], ch)
+			if len(h.subscribers[cmdID]) == 0 {
+				delete(h.subscribers, cmdID)
+			}
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+// Publish delivers event to every watcher of cmdID. Slow watchers drop
+// events rather than block the connection's read loop.
+func (h *ProgressHub) Publish(cmdID string, event CommandEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch := range h.subscribers[cmdID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
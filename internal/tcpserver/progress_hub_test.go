@@ -0,0 +1,72 @@
+package tcpserver
+
+import (
+	"testing"
+)
+
+func TestProgressHubFanOut(t *testing.T) {
+	hub := NewProgressHub()
+	first, cancelFirst := hub.Subscribe("c1")
+	second, cancelSecond := hub.Subscribe("c1")
+	defer cancelSecond()
+	other, cancelOther := hub.Subscribe("c2")
+	defer cancelOther()
+
+	hub.Publish("c1", CommandEvent{Type: CommandEventProgress, Progress: &ProgressMessage{CmdID: "c1", Percent: 10}})
+	for _, events := range []<-chan CommandEvent{first, second} {
+		if event := <-events; event.Progress.Percent != 10 {
+			t.Errorf("event %+v", event)
+		}
+	}
+	if len(other) != 0 {
+		t.Error("watcher of another command got the event")
+	}
+
+	cancelFirst()
+	hub.Publish("c1", CommandEvent{Type: CommandEventACK, ACK: &ACKMessage{CmdID: "c1", Status: "ok"}})
+	if _, open := <-first; open {
+		t.Error("event delivered after unsubscribing")
+	}
+	if event := <-second; event.Type != CommandEventACK {
+		t.Errorf("event %+v", event)
+	}
+}
+
+// TestProgressHandler sends progress for a command and checks it reaches
+// the ledger and watchers, and that bad updates are refused or dropped.
+func TestProgressHandler(t *testing.T) {
+	server := startTestServer(t, nil)
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+	session, _ := server.GetSessionManager().GetByDevice(testAppID, "s1")
+	if err := server.GetCommandLedger().SendTracked(session, &CommandMessage{CmdID: "c1", Cmd: "DOWNLOAD"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	var cmd CommandMessage
+	device.expect(TypeCMD, &cmd)
+
+	events, cancel := server.GetProgressHub().Subscribe("c1")
+	defer cancel()
+
+	device.send(TypeProgress, &ProgressMessage{CmdID: "c1", Percent: 101})
+	var refused ErrorMessage
+	device.expect(TypeErr, &refused)
+
+	// Progress for a command never sent to this device is dropped.
+	server.GetCommandLedger().RecordSent(testAppID, "s2", &CommandMessage{CmdID: "c2"}, "")
+	device.send(TypeProgress, &ProgressMessage{CmdID: "c2", Percent: 50})
+
+	device.send(TypeProgress, &ProgressMessage{CmdID: "c1", Percent: 60, Stage: "download"})
+	event := <-events
+	if event.Type != CommandEventProgress || event.Progress.Percent != 60 {
+		t.Fatalf("event %+v", event)
+	}
+	record, _ := server.GetCommandLedger().Get("c1")
+	if record.Progress == nil || record.Progress.Stage != "download" {
+		t.Errorf("record %+v", record)
+	}
+	if record, _ := server.GetCommandLedger().Get("c2"); record.Progress != nil {
+		t.Errorf("progress recorded for another device's command: %+v", record.Progress)
+	}
+}
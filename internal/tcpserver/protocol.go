@@ -2,48 +2,106 @@ package tcpserver
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 )
 
 const (
-	ProtocolVersion = 1
-	MaxMessageSize  = 1024 * 1024 // 1MB
+	// ProtocolVersion is the framing every connection starts with; the auth
+	// handshake is always exchanged in it before switching to the
+	// negotiated version.
+	ProtocolVersion    = ProtocolVersionV1
+	MaxProtocolVersion = ProtocolVersionV2
+	MaxMessageSize     = 1024 * 1024 // 1MB
 )
 
+const (
+	// v1 frame: length(4) | version(1) | type(1) | payload
+	ProtocolVersionV1 uint8 = 1
+	// v2 frame: length(4) | version(1) | type(1) | flags(1) | payload
+	ProtocolVersionV2 uint8 = 2
+)
+
+// FlagCompressed marks a v2 frame whose payload is gzip compressed.
+const FlagCompressed uint8 = 0x01
+
+// knownFrameFlags lists the v2 flag bits this build understands.
+const knownFrameFlags = FlagCompressed
+
 type MessageType uint8
 
 const (
-	TypeAuth    MessageType = 1
-	TypeAuthOK  MessageType = 2
-	TypePing    MessageType = 3
-	TypePong    MessageType = 4
-	TypeReport  MessageType = 5
-	TypeCMD     MessageType = 6
-	TypeACK     MessageType = 7
-	TypeErr     MessageType = 8
+	TypeAuth          MessageType = 1
+	TypeAuthOK        MessageType = 2
+	TypePing          MessageType = 3
+	TypePong          MessageType = 4
+	TypeReport        MessageType = 5
+	TypeCMD           MessageType = 6
+	TypeACK           MessageType = 7
+	TypeErr           MessageType = 8
+	TypeProgress      MessageType = 9
+	TypeFileBegin     MessageType = 10
+	TypeFileChunk     MessageType = 11
+	TypeFileComplete  MessageType = 12
+	TypeFileStatus    MessageType = 13
+	TypeUploadRequest MessageType = 14
+	TypeEnroll        MessageType = 15
+	TypeEnrollResult  MessageType = 16
 )
 
+var messageTypeNames = map[MessageType]string{
+	TypeAuth:          "auth",
+	TypeAuthOK:        "auth_ok",
+	TypePing:          "ping",
+	TypePong:          "pong",
+	TypeReport:        "report",
+	TypeCMD:           "cmd",
+	TypeACK:           "ack",
+	TypeErr:           "err",
+	TypeProgress:      "progress",
+	TypeFileBegin:     "file_begin",
+	TypeFileChunk:     "file_chunk",
+	TypeFileComplete:  "file_complete",
+	TypeFileStatus:    "file_status",
+	TypeUploadRequest: "upload_request",
+	TypeEnroll:        "enroll",
+	TypeEnrollResult:  "enroll_result",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 type Message struct {
 	Version uint8       `json:"version"`
 	Type    MessageType `json:"type"`
+	Flags   uint8       `json:"flags"`
 	Payload []byte      `json:"payload"`
 }
 
 type AuthMessage struct {
-	AppID string            `json:"appid"`
-	SN    string            `json:"sn"`
-	TS    int64             `json:"ts"`
-	Nonce string            `json:"nonce"`
-	Sign  string            `json:"sign"`
-	Meta  map[string]string `json:"meta"`
+	AppID       string            `json:"appid"`
+	SN          string            `json:"sn"`
+	TS          int64             `json:"ts"`
+	Nonce       string            `json:"nonce"`
+	Sign        string            `json:"sign"`
+	KeyID       string            `json:"kid,omitempty"`
+	Meta        map[string]string `json:"meta"`
+	Versions    []uint8           `json:"versions,omitempty"`
+	Codecs      []string          `json:"codecs,omitempty"`
+	Compression []string          `json:"compression,omitempty"`
 }
 
 type AuthOKMessage struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	Version     uint8  `json:"version,omitempty"`
+	Codec       string `json:"codec,omitempty"`
+	Compression string `json:"compression,omitempty"`
 }
 
 type PingMessage struct {
@@ -67,12 +125,116 @@ type ACKMessage struct {
 	Detail string `json:"detail"`
 }
 
+type ProgressMessage struct {
+	CmdID   string `json:"cmd_id"`
+	Percent int    `json:"percent"`
+	Stage   string `json:"stage"`
+	Detail  string `json:"detail"`
+}
+
+type ReportMessage struct {
+	Kind      string                 `json:"kind"`
+	Data      map[string]interface{} `json:"data"`
+	Timestamp int64                  `json:"timestamp"`
+}
+
+// FileBeginMessage announces a file transfer. For pushes to a device, the
+// device answers with a FileStatusMessage carrying the offset it already
+// holds. Device uploads reuse the same begin/chunk/complete messages with the
+// upload ID as TransferID.
+type FileBeginMessage struct {
+	TransferID string `json:"transfer_id"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+type FileChunkMessage struct {
+	TransferID string `json:"transfer_id"`
+	Offset     int64  `json:"offset"`
+	Data       []byte `json:"data"`
+}
+
+type FileCompleteMessage struct {
+	TransferID string `json:"transfer_id"`
+	// SHA256 is set by uploads, which hash the file while sending it.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+const (
+	FileStatusReady = "ready"
+	FileStatusDone  = "done"
+	FileStatusError = "error"
+)
+
+type FileStatusMessage struct {
+	TransferID string `json:"transfer_id"`
+	Status     string `json:"status"`
+	Offset     int64  `json:"offset"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+// UploadRequestMessage asks the device to upload a file. The device refuses
+// with a FileStatusMessage error when the path is not allow-listed.
+type UploadRequestMessage struct {
+	UploadID string `json:"upload_id"`
+	Path     string `json:"path"`
+}
+
+// EnrollMessage is sent instead of AuthMessage by a device that has no key
+// yet. The token must be sent each time. SN may be empty to have one
+// assigned.
+//
+// A device picks EnrollmentID and a random Claim and keeps both before its
+// first request, so it can ask again if an answer is lost. Devices that
+// predate this send neither at first and EnrollmentID from the answer
+// afterwards; their key is handed out only once.
+type EnrollMessage struct {
+	Token        string            `json:"token"`
+	SN           string            `json:"sn,omitempty"`
+	EnrollmentID string            `json:"enrollment_id,omitempty"`
+	Claim        string            `json:"claim,omitempty"`
+	Meta         map[string]string `json:"meta,omitempty"`
+}
+
+const (
+	EnrollmentPending  = "pending"
+	EnrollmentApproved = "approved"
+	EnrollmentRejected = "rejected"
+)
+
+// EnrollResultMessage answers an EnrollMessage, after which the gateway
+// closes the connection. An approved result carries the credential to log
+// in with.
+type EnrollResultMessage struct {
+	Status       string `json:"status"`
+	EnrollmentID string `json:"enrollment_id,omitempty"`
+	AppID        string `json:"appid,omitempty"`
+	SN           string `json:"sn,omitempty"`
+	Key          string `json:"key,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
 type ErrorMessage struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 }
 
+// ReadMessage reads a frame sent without compression, as used for the auth
+// handshake. Compressed frames are refused.
 func ReadMessage(conn net.Conn) (*Message, error) {
+	return readMessage(conn, false)
+}
+
+// ReadFrame reads a frame sent with the connection's wire params.
+// Compressed frames are only accepted, and inflated, when compression was
+// negotiated, so a peer cannot make this side decompress data it never
+// agreed to.
+func ReadFrame(conn net.Conn, wire *WireParams) (*Message, error) {
+	return readMessage(conn, wire.Compression != "")
+}
+
+func readMessage(conn net.Conn, compressed bool) (*Message, error) {
 	var lengthBuf [4]byte
 	if _, err := io.ReadFull(conn, lengthBuf[:]); err != nil {
 		return nil, fmt.Errorf("read length: %w", err)
@@ -95,10 +257,32 @@ func ReadMessage(conn net.Conn) (*Message, error) {
 	msg := &Message{
 		Version: msgBuf[0],
 		Type:    MessageType(msgBuf[1]),
-		Payload: msgBuf[2:],
 	}
 
-	if msg.Version != ProtocolVersion {
+	switch msg.Version {
+	case ProtocolVersionV1:
+		msg.Payload = msgBuf[2:]
+	case ProtocolVersionV2:
+		if length < 3 {
+			return nil, fmt.Errorf("message too short")
+		}
+		msg.Flags = msgBuf[2]
+		if msg.Flags&^knownFrameFlags != 0 {
+			return nil, fmt.Errorf("unsupported frame flags: %#x", msg.Flags)
+		}
+		msg.Payload = msgBuf[3:]
+		if msg.Flags&FlagCompressed != 0 {
+			if !compressed {
+				return nil, fmt.Errorf("compressed frame without negotiated compression")
+			}
+			payload, err := decompressPayload(msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+			msg.Payload = payload
+			msg.Flags &^= FlagCompressed
+		}
+	default:
 		return nil, fmt.Errorf("unsupported protocol version: %d", msg.Version)
 	}
 
@@ -106,10 +290,25 @@ func ReadMessage(conn net.Conn) (*Message, error) {
 }
 
 func WriteMessage(conn net.Conn, msg *Message) error {
-	msgBuf := make([]byte, 2+len(msg.Payload))
-	msgBuf[0] = msg.Version
-	msgBuf[1] = uint8(msg.Type)
-	copy(msgBuf[2:], msg.Payload)
+	var msgBuf []byte
+	switch msg.Version {
+	case ProtocolVersionV1:
+		if msg.Flags != 0 {
+			return fmt.Errorf("frame flags require protocol version %d", ProtocolVersionV2)
+		}
+		msgBuf = make([]byte, 2+len(msg.Payload))
+		msgBuf[0] = msg.Version
+		msgBuf[1] = uint8(msg.Type)
+		copy(msgBuf[2:], msg.Payload)
+	case ProtocolVersionV2:
+		msgBuf = make([]byte, 3+len(msg.Payload))
+		msgBuf[0] = msg.Version
+		msgBuf[1] = uint8(msg.Type)
+		msgBuf[2] = msg.Flags
+		copy(msgBuf[3:], msg.Payload)
+	default:
+		return fmt.Errorf("unsupported protocol version: %d", msg.Version)
+	}
 
 	lengthBuf := make([]byte, 4)
 	binary.BigEndian.PutUint32(lengthBuf, uint32(len(msgBuf)))
@@ -119,16 +318,53 @@ func WriteMessage(conn net.Conn, msg *Message) error {
 	return err
 }
 
+// WriteFrame writes msg with the connection's wire params: it stamps the
+// negotiated version and, when compression was agreed, compresses payloads
+// above the threshold. ReadFrame undoes the compression; ReadMessage
+// refuses compressed frames.
+func WriteFrame(conn net.Conn, msg *Message, wire *WireParams) error {
+	framed := *msg
+	framed.Version = wire.Version
+
+	if wire.Compression != "" && len(framed.Payload) > wire.compressThreshold() {
+		if len(framed.Payload) > MaxDecompressedSize {
+			return fmt.Errorf("payload too large: %d bytes", len(framed.Payload))
+		}
+		compressed, err := compressPayload(framed.Payload)
+		if err != nil {
+			return err
+		}
+		// Incompressible payloads go out as they are.
+		if len(compressed) < len(framed.Payload) {
+			framed.Payload = compressed
+			framed.Flags |= FlagCompressed
+		}
+	}
+
+	// Fail here rather than have the peer drop the connection.
+	if len(framed.Payload)+3 > MaxMessageSize {
+		return fmt.Errorf("message too large: %d bytes", len(framed.Payload))
+	}
+
+	return WriteMessage(conn, &framed)
+}
+
+// MarshalPayload encodes v with the handshake codec (JSON).
 func MarshalPayload(v interface{}) ([]byte, error) {
-	return json.Marshal(v)
+	return JSONCodec.Marshal(v)
 }
 
+// UnmarshalPayload decodes data with the handshake codec (JSON).
 func UnmarshalPayload(data []byte, v interface{}) error {
-	return json.Unmarshal(data, v)
+	return JSONCodec.Unmarshal(data, v)
 }
 
 func NewMessage(msgType MessageType, payload interface{}) (*Message, error) {
-	data, err := MarshalPayload(payload)
+	return NewMessageWithCodec(JSONCodec, msgType, payload)
+}
+
+func NewMessageWithCodec(codec Codec, msgType MessageType, payload interface{}) (*Message, error) {
+	data, err := codec.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
@@ -137,4 +373,66 @@ func NewMessage(msgType MessageType, payload interface{}) (*Message, error) {
 		Type:    msgType,
 		Payload: data,
 	}, nil
-}
\ No newline at end of file
+}
+
+// WireParams are the per-connection settings agreed during the auth handshake.
+type WireParams struct {
+	Version uint8
+	Codec   Codec
+
+	// Compression is the negotiated compression, or "" for none.
+	// CompressThreshold is the local size above which payloads are
+	// compressed; zero means DefaultCompressThreshold.
+	Compression       string
+	CompressThreshold int
+}
+
+func (w *WireParams) compressThreshold() int {
+	if w.CompressThreshold > 0 {
+		return w.CompressThreshold
+	}
+	return DefaultCompressThreshold
+}
+
+// HandshakeParams are the settings every connection starts with.
+func HandshakeParams() *WireParams {
+	return &WireParams{
+		Version: ProtocolVersion,
+		Codec:   JSONCodec,
+	}
+}
+
+// SupportedVersions lists every protocol version up to max, lowest first.
+func SupportedVersions(max uint8) []uint8 {
+	if max == 0 || max > MaxProtocolVersion {
+		max = MaxProtocolVersion
+	}
+	versions := make([]uint8, 0, max)
+	for v := ProtocolVersionV1; v <= max; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// NegotiateVersion picks the highest version offered by the peer that is
+// also in supported. A peer that offers nothing predates negotiation and
+// only speaks v1.
+func NegotiateVersion(offered, supported []uint8) (uint8, error) {
+	if len(offered) == 0 {
+		offered = []uint8{ProtocolVersionV1}
+	}
+
+	var best uint8
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s && o > best {
+				best = o
+			}
+		}
+	}
+
+	if best == 0 {
+		return 0, fmt.Errorf("no common protocol version (offered %v, supported %v)", offered, supported)
+	}
+	return best, nil
+}
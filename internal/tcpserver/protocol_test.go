@@ -0,0 +1,155 @@
+package tcpserver
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		offered   []uint8
+		supported []uint8
+		want      uint8
+		wantErr   bool
+	}{
+		{"legacy device", nil, []uint8{1, 2}, 1, false},
+		{"both sides v2", []uint8{1, 2}, []uint8{1, 2}, 2, false},
+		{"gateway capped at v1", []uint8{1, 2}, []uint8{1}, 1, false},
+		{"device ahead of gateway", []uint8{1, 2, 3}, []uint8{1, 2}, 2, false},
+		{"no common version", []uint8{2}, []uint8{1}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NegotiateVersion(tt.offered, tt.supported)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("version = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, version := range SupportedVersions(0) {
+		client, server := net.Pipe()
+		msg := &Message{Version: version, Type: TypeReport, Payload: []byte(`{"kind":"x"}`)}
+
+		go func() {
+			WriteMessage(client, msg)
+			client.Close()
+		}()
+		got, err := ReadMessage(server)
+		if err != nil {
+			t.Fatalf("v%d: read: %v", version, err)
+		}
+		if got.Version != version || got.Type != msg.Type || !bytes.Equal(got.Payload, msg.Payload) {
+			t.Errorf("v%d: got %+v, want %+v", version, got, msg)
+		}
+		server.Close()
+	}
+}
+
+func TestFrameFlagsNeedV2(t *testing.T) {
+	msg := &Message{Version: ProtocolVersionV1, Type: TypeCMD, Flags: FlagCompressed}
+	if err := WriteMessage(nil, msg); err == nil {
+		t.Fatal("v1 frame with flags was written")
+	}
+}
+
+// TestRollingUpgrade connects a device that predates negotiation and one
+// that speaks v2 to the same gateway, and commands both.
+func TestRollingUpgrade(t *testing.T) {
+	server := startTestServer(t, nil)
+	addr := serverAddr(server)
+
+	legacy := dialTestDevice(t, addr, nil)
+	legacy.mustLogin(testAppID, "old", testKey)
+
+	upgraded := dialTestDevice(t, addr, nil)
+	_, authOK, err := upgraded.login(testAppID, "new", testKey, func(auth *AuthMessage) {
+		auth.Versions = SupportedVersions(0)
+	})
+	if err != nil || !authOK.Success {
+		t.Fatalf("v2 login: %v %+v", err, authOK)
+	}
+	if authOK.Version != ProtocolVersionV2 {
+		t.Fatalf("negotiated version %d, want %d", authOK.Version, ProtocolVersionV2)
+	}
+
+	for _, device := range []struct {
+		sn      string
+		conn    *testDevice
+		version uint8
+	}{
+		{"old", legacy, ProtocolVersionV1},
+		{"new", upgraded, ProtocolVersionV2},
+	} {
+		session, online := server.GetSessionManager().GetByDevice(testAppID, device.sn)
+		if !online {
+			t.Fatalf("%s is not online", device.sn)
+		}
+		if session.ProtocolVersion() != device.version {
+			t.Errorf("%s: session version %d, want %d", device.sn, session.ProtocolVersion(), device.version)
+		}
+
+		cmd := &CommandMessage{CmdID: "cmd-" + device.sn, Cmd: "OPEN_WEB", Args: map[string]interface{}{"url": "https://example.com"}}
+		if err := server.GetCommandLedger().SendTracked(session, cmd, ""); err != nil {
+			t.Fatalf("%s: send: %v", device.sn, err)
+		}
+
+		msg, err := device.conn.readMessage()
+		if err != nil {
+			t.Fatalf("%s: read command: %v", device.sn, err)
+		}
+		if msg.Version != device.version {
+			t.Errorf("%s: command framed as v%d, want v%d", device.sn, msg.Version, device.version)
+		}
+		var got CommandMessage
+		if err := device.conn.wire.Codec.Unmarshal(msg.Payload, &got); err != nil {
+			t.Fatalf("%s: decode command: %v", device.sn, err)
+		}
+		if !reflect.DeepEqual(&got, cmd) {
+			t.Errorf("%s: got command %+v, want %+v", device.sn, got, cmd)
+		}
+
+		device.conn.send(TypeACK, &ACKMessage{CmdID: cmd.CmdID, Status: "ok"})
+		waitFor(t, device.sn+" ACK", func() bool {
+			record, _ := server.GetCommandLedger().Get(cmd.CmdID)
+			return record != nil && record.State == CommandStateAcked
+		})
+	}
+}
+
+func TestGatewayCappedAtV1(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.MaxProtocolVersion = ProtocolVersionV1
+	})
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	_, authOK, err := device.login(testAppID, "s1", testKey, func(auth *AuthMessage) {
+		auth.Versions = SupportedVersions(0)
+	})
+	if err != nil || !authOK.Success {
+		t.Fatalf("login: %v %+v", err, authOK)
+	}
+	if authOK.Version != ProtocolVersionV1 {
+		t.Errorf("negotiated version %d, want %d", authOK.Version, ProtocolVersionV1)
+	}
+
+	only := dialTestDevice(t, serverAddr(server), nil)
+	_, authOK, err = only.login(testAppID, "s2", testKey, func(auth *AuthMessage) {
+		auth.Versions = []uint8{ProtocolVersionV2}
+	})
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if authOK.Success {
+		t.Error("v2-only device logged in to a v1 gateway")
+	}
+}
@@ -0,0 +1,100 @@
+package tcpserver
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultReportBufferSize = 100
+
+type Report struct {
+	SN         string                 `json:"sn"`
+	AppID      string                 `json:"appid"`
+	Kind       string                 `json:"kind"`
+	Data       map[string]interface{} `json:"data"`
+	DeviceTS   int64                  `json:"device_ts"`
+	ReceivedAt time.Time              `json:"received_at"`
+}
+
+// reportRing is a fixed-size circular buffer of the most recent reports for one device.
+type reportRing struct {
+	items []Report
+	next  int
+	full  bool
+}
+
+func (r *reportRing) push(report Report) {
+	r.items[r.next] = report
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// newestFirst returns up to limit reports, most recent first.
+func (r *reportRing) newestFirst(limit int, kind string) []Report {
+	count := r.next
+	if r.full {
+		count = len(r.items)
+	}
+
+	result := make([]Report, 0, count)
+	for i := 0; i < count; i++ {
+		idx := (r.next - 1 - i + len(r.items)) % len(r.items)
+		report := r.items[idx]
+		if kind != "" && report.Kind != kind {
+			continue
+		}
+		result = append(result, report)
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+	}
+	return result
+}
+
+type ReportStore struct {
+	buffers  map[string]*reportRing
+	capacity int
+	mu       sync.RWMutex
+}
+
+func NewReportStore(capacity int) *ReportStore {
+	if capacity <= 0 {
+		capacity = DefaultReportBufferSize
+	}
+	return &ReportStore{
+		buffers:  make(map[string]*reportRing),
+		capacity: capacity,
+	}
+}
+
+func (rs *ReportStore) Add(report Report) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	key := deviceKey(report.AppID, report.SN)
+	ring, exists := rs.buffers[key]
+	if !exists {
+		ring = &reportRing{items: make([]Report, rs.capacity)}
+		rs.buffers[key] = ring
+	}
+	ring.push(report)
+}
+
+// Recent returns the latest reports for a device, newest first. A limit <= 0
+// returns everything buffered, and a non-empty kind filters by report kind.
+func (rs *ReportStore) Recent(appID, sn string, limit int, kind string) []Report {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	ring, exists := rs.buffers[deviceKey(appID, sn)]
+	if !exists {
+		return []Report{}
+	}
+	return ring.newestFirst(limit, kind)
+}
+
+func (rs *ReportStore) Capacity() int {
+	return rs.capacity
+}
@@ -0,0 +1,77 @@
+package tcpserver
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReportStoreRecent(t *testing.T) {
+	store := NewReportStore(3)
+	for i := 1; i <= 5; i++ {
+		kind := "status"
+		if i%2 == 0 {
+			kind = "telemetry"
+		}
+		store.Add(Report{AppID: testAppID, SN: "s1", Kind: kind, DeviceTS: int64(i)})
+	}
+	store.Add(Report{AppID: "A2", SN: "s1", Kind: "status", DeviceTS: 99})
+
+	tests := []struct {
+		limit int
+		kind  string
+		want  []int64
+	}{
+		{0, "", []int64{5, 4, 3}},
+		{2, "", []int64{5, 4}},
+		{0, "status", []int64{5, 3}},
+		{1, "telemetry", []int64{4}},
+		{0, "missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("limit=%d,kind=%s", tt.limit, tt.kind), func(t *testing.T) {
+			reports := store.Recent(testAppID, "s1", tt.limit, tt.kind)
+			var got []int64
+			for _, report := range reports {
+				got = append(got, report.DeviceTS)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("device timestamps %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if reports := store.Recent(testAppID, "unknown", 0, ""); reports == nil || len(reports) != 0 {
+		t.Errorf("unknown device: %#v, want an empty list", reports)
+	}
+}
+
+// TestReportHandler sends reports from a device and checks they are stored
+// under its app and SN, and that reports without a kind are refused.
+func TestReportHandler(t *testing.T) {
+	server := startTestServer(t, nil)
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+
+	device.send(TypeReport, &ReportMessage{Kind: "status", Data: map[string]interface{}{"screen": "on"}})
+	waitFor(t, "report", func() bool {
+		return len(server.GetReportStore().Recent(testAppID, "s1", 0, "")) == 1
+	})
+	report := server.GetReportStore().Recent(testAppID, "s1", 0, "")[0]
+	if report.Kind != "status" || report.Data["screen"] != "on" {
+		t.Errorf("stored %+v", report)
+	}
+	if report.DeviceTS == 0 || report.ReceivedAt.IsZero() {
+		t.Errorf("report not timestamped: %+v", report)
+	}
+
+	device.send(TypeReport, &ReportMessage{Data: map[string]interface{}{"screen": "off"}})
+	var refused ErrorMessage
+	device.expect(TypeErr, &refused)
+	if refused.Message != "report kind is required" {
+		t.Errorf("error %+v", refused)
+	}
+	if got := len(server.GetReportStore().Recent(testAppID, "s1", 0, "")); got != 1 {
+		t.Errorf("%d reports stored, want 1", got)
+	}
+}
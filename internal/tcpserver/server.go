@@ -2,21 +2,48 @@ package tcpserver
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
+	"device-agent/internal/logging"
 	"device-agent/internal/security"
 )
 
 type Server struct {
 	addr           string
 	listener       net.Listener
+	tlsConfig      *TLSConfig
+	versions       []uint8
+	codecs         []string
+
+	compression       bool
+	compressThreshold int
+
 	sessionManager *SessionManager
 	authenticator  *security.Authenticator
+	credentials    security.CredentialStore
 	ackWaiter      *ACKWaiter
+	reportStore    *ReportStore
+	deviceStore    DeviceStore
+	commandQueue   *CommandQueue
+	commandLedger  *CommandLedger
+	progressHub    *ProgressHub
+	events         *EventBus
+	transfers      *TransferManager
+	uploads        *UploadManager
+	enrollments    *EnrollmentManager
+	blocklist      *Blocklist
+	reconnects     *reconnectLimiter
+	tenants        *Tenants
+	auditLog       AuditLog
+	webhooks       *Webhooks
+	cluster        *Cluster
+	metrics        *Metrics
+	logger         *slog.Logger
 
 	handlers       map[MessageType]MessageHandler
 
@@ -32,24 +59,170 @@ type Server struct {
 type MessageHandler func(*Session, *Message) error
 
 type Config struct {
-	Addr              string
-	HeartbeatInterval time.Duration
-	SessionTimeout    time.Duration
-	Keys              map[string]string
-	TimeWindowSec     int64
+	Addr               string
+	HeartbeatInterval  time.Duration
+	SessionTimeout     time.Duration
+	Keys               map[string]string
+	TimeWindowSec      int64
+	ReportBufferSize   int
+	DeviceStore        DeviceStore
+	CommandQueue       *CommandQueue
+	CommandHistorySize int
+	TLS                *TLSConfig
+	MaxProtocolVersion uint8
+	Codecs             []string
+	Compression        bool
+	CompressThreshold  int
+	TransferDir        string
+	TransferChunkSize  int
+	MaxTransferSize    int64
+	UploadDir          string
+	MaxUploadSize      int64
+	NonceStore         security.NonceStore
+	CredentialStore    security.CredentialStore
+	KeyRing            []*security.AppKey
+	KeyStore           security.KeyStore
+	KeyModes           map[string]string
+	EnrollmentStore    EnrollmentStore
+	BlockStore         BlockStore
+	TenantDefaults     TenantConfig
+	Tenants            map[string]TenantConfig
+	AuditLog           AuditLog
+	WebhookStore       WebhookStore
+	Webhooks           WebhookConfig
+	// Cluster, when set, makes the server a node of a cluster sharing
+	// ClusterRegistry; a nil registry keeps it in memory.
+	Cluster         *ClusterConfig
+	ClusterRegistry ClusterRegistry
+	// Logger receives the server's logs; nil uses slog.Default().
+	Logger *slog.Logger
 }
 
 func NewServer(config *Config) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	nonceStore := security.NewMemoryNonceStore()
+	var nonceStore security.NonceStore = security.NewMemoryNonceStore()
+	if config.NonceStore != nil {
+		nonceStore = config.NonceStore
+	}
 	authenticator := security.NewAuthenticator(config.Keys, config.TimeWindowSec, nonceStore)
+	authenticator.AddKeys(config.KeyRing)
+	authenticator.SetKeyModes(config.KeyModes)
+
+	keyStore := config.KeyStore
+	if keyStore == nil {
+		keyStore = security.NewMemoryKeyStore()
+	}
+	authenticator.SetKeyStore(keyStore)
+
+	credentialStore := config.CredentialStore
+	if credentialStore == nil {
+		credentialStore = security.NewMemoryCredentialStore()
+	}
+	authenticator.SetCredentialStore(credentialStore)
+
+	deviceStore := config.DeviceStore
+	if deviceStore == nil {
+		deviceStore = NewMemoryDeviceStore()
+	}
+
+	codecs := config.Codecs
+	if len(codecs) == 0 {
+		codecs = SupportedCodecs()
+	}
+
+	enrollmentStore := config.EnrollmentStore
+	if enrollmentStore == nil {
+		enrollmentStore = NewMemoryEnrollmentStore()
+	}
+
+	blockStore := config.BlockStore
+	if blockStore == nil {
+		blockStore = NewMemoryBlockStore()
+	}
+
+	commandQueue := config.CommandQueue
+	if commandQueue == nil {
+		commandQueue = NewMemoryCommandQueue(DefaultQueueTTL)
+	}
+
+	auditLog := config.AuditLog
+	if auditLog == nil {
+		auditLog = NewMemoryAuditLog(DefaultAuditBufferSize)
+	}
+
+	webhookStore := config.WebhookStore
+	if webhookStore == nil {
+		webhookStore = NewMemoryWebhookStore()
+	}
+
+	logger := logging.Or(config.Logger)
+	if err := commandQueue.MigrateLegacy(deviceStore); err != nil {
+		logger.Error("Failed to migrate queued commands", "error", err)
+	}
+
+	events := NewEventBus()
+	sessionManager := NewSessionManager()
+	sessionManager.events = events
+	metrics := NewMetrics(sessionManager)
+
+	transfers := NewTransferManager(config.TransferDir, config.TransferChunkSize, config.MaxTransferSize)
+	transfers.logger = logger
+	transfers.RemoveStaleSpool()
+
+	commandLedger := NewCommandLedger(config.CommandHistorySize)
+	commandLedger.metrics = metrics
+	commandLedger.events = events
+	commandLedger.auditLog = auditLog
+	commandLedger.logger = logger
+
+	webhooks := NewWebhooks(webhookStore, config.Webhooks)
+	webhooks.logger = logger
+	events.webhooks = webhooks
+
+	ackWaiter := NewACKWaiter()
+
+	var cluster *Cluster
+	if config.Cluster != nil {
+		registry := config.ClusterRegistry
+		if registry == nil {
+			registry = NewMemoryClusterRegistry(config.Cluster.NodeTTL)
+		}
+		cluster = NewCluster(*config.Cluster, registry)
+		cluster.sessionManager = sessionManager
+		cluster.commandLedger = commandLedger
+		cluster.commandQueue = commandQueue
+		cluster.logger = logger
+	}
 
 	s := &Server{
 		addr:              config.Addr,
-		sessionManager:    NewSessionManager(),
+		tlsConfig:         config.TLS,
+		versions:          SupportedVersions(config.MaxProtocolVersion),
+		codecs:            codecs,
+		compression:       config.Compression,
+		compressThreshold: config.CompressThreshold,
+		sessionManager:    sessionManager,
 		authenticator:     authenticator,
-		ackWaiter:         NewACKWaiter(),
+		credentials:       credentialStore,
+		ackWaiter:         ackWaiter,
+		reportStore:       NewReportStore(config.ReportBufferSize),
+		deviceStore:       deviceStore,
+		commandQueue:      commandQueue,
+		commandLedger:     commandLedger,
+		progressHub:       NewProgressHub(),
+		events:            events,
+		transfers:         transfers,
+		uploads:           NewUploadManager(config.UploadDir, config.MaxUploadSize),
+		enrollments:       NewEnrollmentManager(enrollmentStore, authenticator, credentialStore),
+		blocklist:         NewBlocklist(blockStore),
+		reconnects:        newReconnectLimiter(),
+		tenants:           NewTenants(config.TenantDefaults, config.Tenants),
+		auditLog:          auditLog,
+		webhooks:          webhooks,
+		cluster:           cluster,
+		metrics:           metrics,
+		logger:            logger,
 		handlers:          make(map[MessageType]MessageHandler),
 		heartbeatInterval: config.HeartbeatInterval,
 		sessionTimeout:    config.SessionTimeout,
@@ -57,6 +230,9 @@ func NewServer(config *Config) *Server {
 		cancel:            cancel,
 		shutdown:          make(chan struct{}),
 	}
+	if cluster != nil {
+		cluster.replied = s.handleClusterReply
+	}
 
 	s.registerDefaultHandlers()
 	return s
@@ -67,6 +243,13 @@ func (s *Server) registerDefaultHandlers() {
 	s.handlers[TypePing] = s.handlePing
 	s.handlers[TypePong] = s.handlePong
 	s.handlers[TypeACK] = s.handleACK
+	s.handlers[TypeReport] = s.handleReport
+	s.handlers[TypeProgress] = s.handleProgress
+	s.handlers[TypeFileStatus] = s.handleFileStatus
+	s.handlers[TypeFileBegin] = s.handleUploadBegin
+	s.handlers[TypeFileChunk] = s.handleUploadChunk
+	s.handlers[TypeFileComplete] = s.handleUploadComplete
+	s.handlers[TypeEnroll] = s.handleEnroll
 }
 
 func (s *Server) RegisterHandler(msgType MessageType, handler MessageHandler) {
@@ -79,13 +262,29 @@ func (s *Server) Start() error {
 		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
 	}
 
+	if s.tlsConfig != nil && s.tlsConfig.Enable {
+		tlsConfig, err := s.tlsConfig.serverConfig()
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		s.logger.Info("TLS enabled", "addr", s.addr, "client_cert_required", s.tlsConfig.RequireClientCert)
+	}
+
+	if err := s.cluster.Start(); err != nil {
+		listener.Close()
+		return err
+	}
+
 	s.listener = listener
-	log.Printf("TCP server listening on %s", s.addr)
+	s.logger.Info("TCP server listening", "addr", s.addr)
 
-	s.wg.Add(3)
+	s.wg.Add(4)
 	go s.acceptLoop()
 	go s.heartbeatLoop()
 	go s.cleanupLoop()
+	go s.commandTimeoutLoop()
 
 	return nil
 }
@@ -100,8 +299,10 @@ func (s *Server) Stop() error {
 
 	s.sessionManager.Shutdown(s.ctx)
 	s.wg.Wait()
+	s.cluster.Stop()
+	s.webhooks.Close()
 
-	log.Println("TCP server stopped")
+	s.logger.Info("TCP server stopped")
 	return nil
 }
 
@@ -121,7 +322,7 @@ func (s *Server) acceptLoop() {
 			case <-s.shutdown:
 				return
 			default:
-				log.Printf("Failed to accept connection: %v", err)
+				s.logger.Error("Failed to accept connection", "error", err)
 				continue
 			}
 		}
@@ -131,14 +332,32 @@ func (s *Server) acceptLoop() {
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
-	session := NewSession(conn)
-	defer session.Close()
+	// Addresses serving a penalty for refused logins get no further.
+	if s.reconnects.Refused(remoteHost(conn.RemoteAddr().String())) {
+		conn.Close()
+		return
+	}
+
+	session := NewSession(s.metrics.meter(conn))
+	session.metrics = s.metrics
+	session.log = s.logger.With(logging.KeySessionID, session.ID, logging.KeyRemote, session.RemoteAddr)
+
+	reason := "connection closed"
+	defer func() {
+		session.CloseWithReason(reason)
+		s.recordDisconnect(session)
+		s.sessionManager.Remove(session.ID)
+		s.cluster.release(session)
+		s.uploads.SessionClosed(session)
+	}()
 
-	log.Printf("New connection from %s (session: %s)", session.RemoteAddr, session.ID)
+	session.log.Debug("New connection")
+	s.events.Publish(sessionEvent(EventDeviceConnected, session))
 
 	for {
 		select {
 		case <-s.shutdown:
+			reason = "server shutdown"
 			return
 		case <-session.closeCh:
 			return
@@ -146,14 +365,22 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 
 		conn.SetReadDeadline(time.Now().Add(s.sessionTimeout))
-		msg, err := ReadMessage(conn)
+		msg, err := ReadFrame(session.Conn, session.Wire())
 		if err != nil {
-			log.Printf("Session %s read error: %v", session.ID, err)
+			session.log.Info("Session read error", "error", err)
+			reason = "read error: " + err.Error()
 			return
 		}
 
+		if msg.Version != session.ProtocolVersion() {
+			session.log.Warn("Session sent wrong protocol version", "version", msg.Version, "expected", session.ProtocolVersion())
+			reason = fmt.Sprintf("protocol version mismatch: got %d, expected %d", msg.Version, session.ProtocolVersion())
+			return
+		}
+
+		s.metrics.messageReceived(msg.Type)
 		if err := s.handleMessage(session, msg); err != nil {
-			log.Printf("Session %s handle error: %v", session.ID, err)
+			session.log.Warn("Failed to handle message", "type", msg.Type.String(), "error", err)
 			s.sendError(session, 500, err.Error())
 		}
 	}
@@ -169,42 +396,277 @@ func (s *Server) handleMessage(session *Session, msg *Message) error {
 }
 
 func (s *Server) handleAuth(session *Session, msg *Message) error {
+	// Sessions are registered under the device they logged in as, so one
+	// cannot become another device by logging in again.
+	if session.SN != "" {
+		return fmt.Errorf("session already authenticated as %s", session.SN)
+	}
+
 	var auth AuthMessage
-	if err := UnmarshalPayload(msg.Payload, &auth); err != nil {
+	if err := session.DecodePayload(msg.Payload, &auth); err != nil {
+		s.trackAuth(session, &auth, authReasonPayload, "invalid auth payload")
 		return fmt.Errorf("invalid auth payload: %w", err)
 	}
 
-	if err := s.authenticator.VerifySignature(auth.AppID, auth.SN, auth.TS, auth.Nonce, auth.Sign); err != nil {
-		s.sendAuthResult(session, false, err.Error())
+	device := deviceKey(auth.AppID, auth.SN)
+	if s.reconnects.Refused(device) {
+		s.refuseAuth(session, &auth, authReasonThrottled, "too many refused logins, retry later")
+		session.CloseWithReason("reconnecting too fast")
+		return nil
+	}
+
+	if rule, reason := s.checkBlocklist(session, &auth); reason != "" {
+		// Penalize the address only for address rules, so other devices
+		// behind the same NAT are not turned away with a banned one.
+		key := device
+		if rule != nil && rule.Type == BlockByCIDR {
+			key = remoteHost(session.RemoteAddr)
+		}
+		wait := s.reconnects.Penalize(key)
+		session.log.Warn("Refused blocked device", logging.KeyAppID, auth.AppID, logging.KeySN, auth.SN, "reason", reason, "penalty", wait)
+		s.refuseAuth(session, &auth, authReasonBlocked, reason)
+		session.CloseWithReason(reason)
+		return nil
+	}
+
+	// The certificate is checked first, so a device presenting the wrong
+	// one does not use up its nonce.
+	if err := s.verifyPeerSN(session, auth.SN); err != nil {
+		s.refuseAuth(session, &auth, authReasonPeerCert, err.Error())
+		return fmt.Errorf("auth failed: %w", err)
+	}
+
+	if err := s.authenticator.VerifySignature(auth.AppID, auth.SN, auth.KeyID, auth.TS, auth.Nonce, auth.Sign); err != nil {
+		s.refuseAuth(session, &auth, authReasonSignature, err.Error())
+		return fmt.Errorf("auth failed: %w", err)
+	}
+
+	release, err := s.reserveConnection(auth.AppID, auth.SN)
+	if err != nil {
+		s.refuseAuth(session, &auth, authReasonQuota, err.Error())
 		return fmt.Errorf("auth failed: %w", err)
 	}
+	defer release()
+
+	version, err := NegotiateVersion(auth.Versions, s.versions)
+	if err != nil {
+		s.refuseAuth(session, &auth, authReasonVersion, err.Error())
+		return fmt.Errorf("auth failed: %w", err)
+	}
+	wire := &WireParams{
+		Version:           version,
+		Codec:             NegotiateCodec(auth.Codecs, s.codecs),
+		Compression:       NegotiateCompression(auth.Compression, s.compression, version),
+		CompressThreshold: s.compressThreshold,
+	}
 
 	session.SN = auth.SN
 	session.AppID = auth.AppID
 	session.Meta = auth.Meta
+	session.log = session.log.With(logging.KeyAppID, auth.AppID, logging.KeySN, auth.SN)
 
+	// The device must see the auth result before anything else is sent on
+	// the negotiated version, so only register the session afterwards.
+	if err := s.sendAuthSuccess(session, wire); err != nil {
+		return fmt.Errorf("send auth result: %w", err)
+	}
 	s.sessionManager.Add(session)
-	s.sendAuthResult(session, true, "authenticated")
+	s.cluster.claim(session)
+	s.recordAuth(session)
+	s.trackAuth(session, &auth, "", "")
 
-	log.Printf("Device %s authenticated (session: %s)", auth.SN, session.ID)
+	session.log.Info("Device authenticated", "protocol_version", wire.Version, "codec", wire.Codec.Name(), "compression", wire.Compression)
+
+	s.flushQueuedCommands(session)
+	s.transfers.Resume(session)
 	return nil
 }
 
+// refuseAuth tells the device why its login was refused and records it.
+func (s *Server) refuseAuth(session *Session, auth *AuthMessage, code, reason string) {
+	s.trackAuth(session, auth, code, reason)
+	s.sendAuthResult(session, false, reason)
+}
+
+// trackAuth audits and counts a login. A failed login has a short code,
+// used as the metrics label, and a reason for the audit log.
+func (s *Server) trackAuth(session *Session, auth *AuthMessage, code, reason string) {
+	event := &AuditEvent{
+		Time:       time.Now(),
+		Kind:       AuditAuth,
+		Action:     "login",
+		Actor:      auth.SN,
+		AppID:      auth.AppID,
+		SN:         auth.SN,
+		RemoteAddr: session.RemoteAddr,
+		Result:     AuditSuccess,
+	}
+	if code != "" {
+		event.Result = AuditFailure
+		event.Detail = reason
+		s.metrics.authFailed(code)
+		s.events.Publish(Event{
+			Type:       EventDeviceAuthFailed,
+			AppID:      auth.AppID,
+			SN:         auth.SN,
+			SessionID:  session.ID,
+			RemoteAddr: session.RemoteAddr,
+			Reason:     reason,
+		})
+	} else {
+		s.metrics.authSucceeded()
+	}
+	s.appendAudit(event)
+}
+
+func (s *Server) appendAudit(event *AuditEvent) {
+	if err := s.auditLog.Append(event); err != nil {
+		s.logger.Error("Failed to write audit log", "error", err)
+	}
+}
+
+// handleEnroll answers an enrollment request and closes the connection; the
+// device logs in on a new one once it has its key.
+func (s *Server) handleEnroll(session *Session, msg *Message) error {
+	if session.SN != "" {
+		return fmt.Errorf("enroll on an authenticated session")
+	}
+
+	var req EnrollMessage
+	if err := session.DecodePayload(msg.Payload, &req); err != nil {
+		return fmt.Errorf("invalid enroll payload: %w", err)
+	}
+
+	var result *EnrollResultMessage
+	rule, err := s.blocklist.Match("", req.SN, session.RemoteAddr)
+	if err == nil && rule != nil {
+		if rule.Type == BlockByCIDR {
+			s.reconnects.Penalize(remoteHost(session.RemoteAddr))
+		}
+		err = fmt.Errorf("device blocked")
+	}
+	if err == nil {
+		result, err = s.enrollments.Enroll(&req, session.RemoteAddr)
+	}
+	if err != nil {
+		session.log.Warn("Enrollment refused", logging.KeySN, req.SN, "error", err)
+		result = &EnrollResultMessage{
+			Status:       EnrollmentRejected,
+			EnrollmentID: req.EnrollmentID,
+			Message:      err.Error(),
+		}
+	} else {
+		session.log.Info("Enrollment handled", "enrollment_id", result.EnrollmentID, logging.KeyAppID, result.AppID, logging.KeySN, result.SN, "status", result.Status)
+	}
+
+	sendErr := session.SendPayload(TypeEnrollResult, result)
+	session.CloseWithReason("enrollment " + result.Status)
+	return sendErr
+}
+
+// checkBlocklist returns why a login must be refused, and the rule that
+// refuses it, or an empty reason. A blocklist that cannot be read refuses
+// every login.
+func (s *Server) checkBlocklist(session *Session, auth *AuthMessage) (*BlockRule, string) {
+	rule, err := s.blocklist.Match(auth.AppID, auth.SN, session.RemoteAddr)
+	if err != nil {
+		session.log.Error("Failed to check blocklist", "error", err)
+		return nil, "blocklist unavailable"
+	}
+	if rule == nil {
+		return nil, ""
+	}
+
+	reason := "device blocked"
+	if rule.Reason != "" {
+		reason += ": " + rule.Reason
+	}
+	return rule, reason
+}
+
+// reserveConnection holds a connection slot of appID for sn while the
+// login completes, or refuses a login that would take appID over its
+// limit. A device replacing its own session does not count.
+func (s *Server) reserveConnection(appID, sn string) (func(), error) {
+	limit := s.tenants.Config(appID).MaxConnections
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	return s.sessionManager.Reserve(appID, sn, limit)
+}
+
+func (s *Server) flushQueuedCommands(session *Session) {
+	if s.commandQueue.PendingCount(session.AppID, session.SN) == 0 {
+		return
+	}
+
+	delivered, err := s.commandQueue.Flush(session.AppID, session.SN, func(cmd *CommandMessage, requestID string) error {
+		return s.commandLedger.SendTracked(session, cmd, requestID)
+	})
+	if err != nil {
+		session.log.Error("Failed to persist command queue", "error", err)
+	}
+	if delivered > 0 {
+		session.log.Info("Delivered queued commands", "count", delivered)
+	}
+}
+
+func (s *Server) recordAuth(session *Session) {
+	now := time.Now()
+
+	record, err := s.deviceStore.Get(session.AppID, session.SN)
+	if err != nil {
+		record = &DeviceRecord{
+			SN:        session.SN,
+			AppID:     session.AppID,
+			FirstSeen: now,
+		}
+	}
+
+	record.Meta = session.Meta
+	record.LastSeen = now
+	record.LastRemoteAddr = session.RemoteAddr
+	record.DisconnectReason = ""
+
+	if err := s.deviceStore.Put(record); err != nil {
+		session.log.Error("Failed to record device", "error", err)
+	}
+}
+
+func (s *Server) recordDisconnect(session *Session) {
+	if session.SN == "" {
+		return
+	}
+
+	// A newer session for the same device is already online; leave its record alone.
+	if current, exists := s.sessionManager.GetByDevice(session.AppID, session.SN); exists && current.ID != session.ID {
+		return
+	}
+
+	record, err := s.deviceStore.Get(session.AppID, session.SN)
+	if err != nil {
+		session.log.Error("Failed to load device", "error", err)
+		return
+	}
+
+	record.LastSeen = time.Now()
+	record.DisconnectReason = session.CloseReason()
+
+	if err := s.deviceStore.Put(record); err != nil {
+		session.log.Error("Failed to record disconnect", "error", err)
+	}
+}
+
 func (s *Server) handlePing(session *Session, msg *Message) error {
 	var ping PingMessage
-	if err := UnmarshalPayload(msg.Payload, &ping); err != nil {
+	if err := session.DecodePayload(msg.Payload, &ping); err != nil {
 		return err
 	}
 
 	session.UpdatePing()
 
 	pong := &PongMessage{Timestamp: time.Now().Unix()}
-	pongMsg, err := NewMessage(TypePong, pong)
-	if err != nil {
-		return err
-	}
-
-	return session.SendMessage(pongMsg)
+	return session.SendPayload(TypePong, pong)
 }
 
 func (s *Server) handlePong(session *Session, msg *Message) error {
@@ -213,12 +675,225 @@ func (s *Server) handlePong(session *Session, msg *Message) error {
 }
 
 func (s *Server) handleACK(session *Session, msg *Message) error {
+	if session.SN == "" {
+		return fmt.Errorf("ack from unauthenticated session")
+	}
+
 	var ack ACKMessage
-	if err := UnmarshalPayload(msg.Payload, &ack); err != nil {
+	if err := session.DecodePayload(msg.Payload, &ack); err != nil {
 		return err
 	}
+	if !s.acceptReply(session, msg.Type, ack.CmdID) {
+		return nil
+	}
+
+	session.log.Debug("ACK received", logging.KeyCmdID, ack.CmdID, "status", ack.Status)
+	s.commandLedger.RecordACK(&ack)
+	s.auditACK(session, &ack)
+	if s.cluster.returnReply(ack.CmdID, clusterReplyRequest{ACK: &ack}) {
+		return nil
+	}
+	s.deliverACK(session.AppID, session.SN, &ack)
+	return nil
+}
+
+// deliverACK tells the API, webhooks and anyone following the command that
+// it was answered.
+func (s *Server) deliverACK(appID, sn string, ack *ACKMessage) {
+	s.publishACK(appID, sn, ack)
+	s.progressHub.Publish(ack.CmdID, CommandEvent{Type: CommandEventACK, ACK: ack})
+	s.ackWaiter.Notify(ack.CmdID, ack)
+}
+
+// handleClusterReply applies an ACK or progress update that the node owning
+// the device sent back for a command forwarded from here.
+func (s *Server) handleClusterReply(record *CommandRecord, reply *clusterReplyRequest) {
+	if reply.ACK != nil {
+		if s.commandLedger.RecordACK(reply.ACK) {
+			s.deliverACK(record.AppID, record.SN, reply.ACK)
+		}
+		return
+	}
+	s.commandLedger.RecordProgress(reply.Progress)
+	s.progressHub.Publish(reply.Progress.CmdID, CommandEvent{Type: CommandEventProgress, Progress: reply.Progress})
+}
+
+// acceptReply reports whether cmdID was sent to session's device. Replies
+// for any other command are counted, logged and dropped, so a device cannot
+// complete or report on another device's commands.
+func (s *Server) acceptReply(session *Session, msgType MessageType, cmdID string) bool {
+	record, exists := s.commandLedger.Get(cmdID)
+	if exists && record.AppID == session.AppID && record.SN == session.SN {
+		return true
+	}
+
+	s.metrics.replyRejected(msgType)
+	session.log.Warn("Dropped reply for a command not sent to this device", "type", msgType.String(), logging.KeyCmdID, cmdID)
+	return false
+}
+
+func (s *Server) auditACK(session *Session, ack *ACKMessage) {
+	event := &AuditEvent{
+		Time:   time.Now(),
+		Kind:   AuditACK,
+		Action: "ack",
+		Actor:  session.SN,
+		AppID:  session.AppID,
+		SN:     session.SN,
+		CmdID:  ack.CmdID,
+		Result: ack.Status,
+		Detail: ack.Detail,
+	}
+	if record, exists := s.commandLedger.Get(ack.CmdID); exists {
+		event.Cmd = record.Cmd
+		event.RequestID = record.RequestID
+	}
+	s.appendAudit(event)
+}
+
+func (s *Server) publishACK(appID, sn string, ack *ACKMessage) {
+	event := Event{
+		Type:   EventCommandAcked,
+		AppID:  appID,
+		SN:     sn,
+		CmdID:  ack.CmdID,
+		Status: ack.Status,
+		Detail: ack.Detail,
+	}
+	if record, exists := s.commandLedger.Get(ack.CmdID); exists {
+		event.Cmd = record.Cmd
+		event.RequestID = record.RequestID
+		event.LatencyMS = record.LatencyMS
+	}
+	s.events.Publish(event)
+}
+
+func (s *Server) handleProgress(session *Session, msg *Message) error {
+	if session.SN == "" {
+		return fmt.Errorf("progress from unauthenticated session")
+	}
+
+	var progress ProgressMessage
+	if err := session.DecodePayload(msg.Payload, &progress); err != nil {
+		return fmt.Errorf("invalid progress payload: %w", err)
+	}
+
+	if progress.CmdID == "" {
+		return fmt.Errorf("progress cmd_id is required")
+	}
+	if progress.Percent < 0 || progress.Percent > 100 {
+		return fmt.Errorf("progress percent out of range: %d", progress.Percent)
+	}
+	if !s.acceptReply(session, msg.Type, progress.CmdID) {
+		return nil
+	}
+
+	s.commandLedger.RecordProgress(&progress)
+	if s.cluster.returnReply(progress.CmdID, clusterReplyRequest{Progress: &progress}) {
+		return nil
+	}
+	s.progressHub.Publish(progress.CmdID, CommandEvent{Type: CommandEventProgress, Progress: &progress})
+	return nil
+}
+
+
+func (s *Server) handleFileStatus(session *Session, msg *Message) error {
+	if session.SN == "" {
+		return fmt.Errorf("file status from unauthenticated session")
+	}
+
+	var status FileStatusMessage
+	if err := session.DecodePayload(msg.Payload, &status); err != nil {
+		return fmt.Errorf("invalid file status payload: %w", err)
+	}
+
+	if status.Status == FileStatusError {
+		session.log.Warn("Device rejected transfer", "transfer_id", status.TransferID, "detail", status.Detail)
+	}
+	if s.uploads.Has(status.TransferID) {
+		return s.uploads.HandleStatus(session, &status)
+	}
+	return s.transfers.HandleStatus(session, &status)
+}
+
+func (s *Server) handleUploadBegin(session *Session, msg *Message) error {
+	if session.SN == "" {
+		return fmt.Errorf("upload from unauthenticated session")
+	}
+
+	var begin FileBeginMessage
+	if err := session.DecodePayload(msg.Payload, &begin); err != nil {
+		return fmt.Errorf("invalid upload begin payload: %w", err)
+	}
+	return s.uploads.HandleBegin(session, &begin)
+}
+
+func (s *Server) handleUploadChunk(session *Session, msg *Message) error {
+	if session.SN == "" {
+		return fmt.Errorf("upload from unauthenticated session")
+	}
+
+	var chunk FileChunkMessage
+	if err := session.DecodePayload(msg.Payload, &chunk); err != nil {
+		return fmt.Errorf("invalid upload chunk payload: %w", err)
+	}
+	return s.uploads.HandleChunk(session, &chunk)
+}
+
+func (s *Server) handleUploadComplete(session *Session, msg *Message) error {
+	if session.SN == "" {
+		return fmt.Errorf("upload from unauthenticated session")
+	}
+
+	var complete FileCompleteMessage
+	if err := session.DecodePayload(msg.Payload, &complete); err != nil {
+		return fmt.Errorf("invalid upload complete payload: %w", err)
+	}
+	if err := s.uploads.HandleComplete(session, &complete); err != nil {
+		return err
+	}
+
+	if upload, err := s.uploads.Get(session.AppID, session.SN, complete.TransferID); err == nil {
+		session.log.Info("Upload finished", "upload_id", upload.ID, "state", upload.State)
+	}
+	return nil
+}
+
+func (s *Server) handleReport(session *Session, msg *Message) error {
+	if session.SN == "" {
+		return fmt.Errorf("report from unauthenticated session")
+	}
+
+	var report ReportMessage
+	if err := session.DecodePayload(msg.Payload, &report); err != nil {
+		return fmt.Errorf("invalid report payload: %w", err)
+	}
+
+	if report.Kind == "" {
+		return fmt.Errorf("report kind is required")
+	}
 
-	s.ackWaiter.Notify(ack.CmdID, &ack)
+	now := time.Now()
+	if report.Timestamp == 0 {
+		report.Timestamp = now.Unix()
+	}
+
+	stored := Report{
+		SN:         session.SN,
+		AppID:      session.AppID,
+		Kind:       report.Kind,
+		Data:       report.Data,
+		DeviceTS:   report.Timestamp,
+		ReceivedAt: now,
+	}
+	s.reportStore.Add(stored)
+	s.events.Publish(Event{
+		Type:   EventReport,
+		Time:   now,
+		AppID:  session.AppID,
+		SN:     session.SN,
+		Report: &stored,
+	})
 	return nil
 }
 
@@ -228,15 +903,21 @@ func (s *Server) sendAuthResult(session *Session, success bool, message string)
 		Message: message,
 	}
 
-	msg, err := NewMessage(TypeAuthOK, authOK)
-	if err != nil {
-		log.Printf("Failed to create auth result message: %v", err)
-		return
+	if err := session.SendPayload(TypeAuthOK, authOK); err != nil {
+		session.log.Warn("Failed to send auth result", "error", err)
 	}
+}
 
-	if err := session.SendMessage(msg); err != nil {
-		log.Printf("Failed to send auth result: %v", err)
+func (s *Server) sendAuthSuccess(session *Session, wire *WireParams) error {
+	authOK := &AuthOKMessage{
+		Success:     true,
+		Message:     "authenticated",
+		Version:     wire.Version,
+		Codec:       wire.Codec.Name(),
+		Compression: wire.Compression,
 	}
+
+	return session.SendAndUpgrade(TypeAuthOK, authOK, wire)
 }
 
 func (s *Server) sendError(session *Session, code int, message string) {
@@ -245,14 +926,8 @@ func (s *Server) sendError(session *Session, code int, message string) {
 		Message: message,
 	}
 
-	msg, err := NewMessage(TypeErr, errMsg)
-	if err != nil {
-		log.Printf("Failed to create error message: %v", err)
-		return
-	}
-
-	if err := session.SendMessage(msg); err != nil {
-		log.Printf("Failed to send error: %v", err)
+	if err := session.SendPayload(TypeErr, errMsg); err != nil {
+		session.log.Warn("Failed to send error", "error", err)
 	}
 }
 
@@ -271,7 +946,9 @@ func (s *Server) heartbeatLoop() {
 			for _, info := range sessions {
 				if session, exists := s.sessionManager.Get(info.ID); exists && session.SN != "" {
 					if err := session.SendPing(); err != nil {
-						log.Printf("Failed to send ping to %s: %v", session.SN, err)
+						session.log.Warn("Failed to send ping", "error", err)
+						s.metrics.heartbeatFailure()
+						session.CloseWithReason("heartbeat failed: " + err.Error())
 						s.sessionManager.Remove(session.ID)
 					}
 				}
@@ -292,17 +969,115 @@ func (s *Server) cleanupLoop() {
 			return
 		case <-ticker.C:
 			expired := s.sessionManager.CleanupExpired(s.sessionTimeout)
+			s.metrics.evicted(expired)
 			if expired > 0 {
-				log.Printf("Cleaned up %d expired sessions", expired)
+				s.logger.Info("Cleaned up expired sessions", "count", expired)
 			}
 		}
 	}
 }
 
+// commandTimeoutLoop times out commands whose ACK is overdue, including
+// those no API request is waiting on.
+func (s *Server) commandTimeoutLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case now := <-ticker.C:
+			if expired := s.commandLedger.ExpireOverdue(now); expired > 0 {
+				s.logger.Debug("Timed out overdue commands", "count", expired)
+			}
+		}
+	}
+}
+
+// Addr returns the address the server listens on, or nil before Start.
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
 func (s *Server) GetSessionManager() *SessionManager {
 	return s.sessionManager
 }
 
 func (s *Server) GetACKWaiter() *ACKWaiter {
 	return s.ackWaiter
+}
+
+func (s *Server) GetReportStore() *ReportStore {
+	return s.reportStore
+}
+
+func (s *Server) GetDeviceStore() DeviceStore {
+	return s.deviceStore
+}
+
+func (s *Server) GetCommandQueue() *CommandQueue {
+	return s.commandQueue
+}
+
+func (s *Server) GetCommandLedger() *CommandLedger {
+	return s.commandLedger
+}
+
+func (s *Server) GetProgressHub() *ProgressHub {
+	return s.progressHub
+}
+
+func (s *Server) GetEventBus() *EventBus {
+	return s.events
+}
+
+func (s *Server) GetTransferManager() *TransferManager {
+	return s.transfers
+}
+
+func (s *Server) GetAuthenticator() *security.Authenticator {
+	return s.authenticator
+}
+
+func (s *Server) GetCredentialStore() security.CredentialStore {
+	return s.credentials
+}
+
+func (s *Server) GetUploadManager() *UploadManager {
+	return s.uploads
+}
+
+func (s *Server) GetEnrollmentManager() *EnrollmentManager {
+	return s.enrollments
+}
+
+func (s *Server) GetBlocklist() *Blocklist {
+	return s.blocklist
+}
+
+func (s *Server) GetMetrics() *Metrics {
+	return s.metrics
+}
+
+func (s *Server) GetAuditLog() AuditLog {
+	return s.auditLog
+}
+
+func (s *Server) GetWebhooks() *Webhooks {
+	return s.webhooks
+}
+
+// GetCluster returns the server's cluster, or nil when it runs on its own.
+func (s *Server) GetCluster() *Cluster {
+	return s.cluster
+}
+
+func (s *Server) GetTenants() *Tenants {
+	return s.tenants
 }
\ No newline at end of file
@@ -3,8 +3,10 @@ package tcpserver
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,49 +22,110 @@ type Session struct {
 	LastPing   time.Time
 	Meta       map[string]string
 
-	writeMu    sync.Mutex
-	closeCh    chan struct{}
-	closeOnce  sync.Once
+	metrics     *Metrics
+	log         *slog.Logger
+	wire        atomic.Pointer[WireParams]
+	writeMu     sync.Mutex
+	closeCh     chan struct{}
+	closeOnce   sync.Once
+	closeReason string
 }
 
 func NewSession(conn net.Conn) *Session {
-	return &Session{
+	session := &Session{
 		ID:         uuid.New().String(),
 		Conn:       conn,
 		RemoteAddr: conn.RemoteAddr().String(),
 		LoginAt:    time.Now(),
 		LastPing:   time.Now(),
 		closeCh:    make(chan struct{}),
+		log:        slog.Default(),
 	}
+	session.wire.Store(HandshakeParams())
+	return session
 }
 
+// Wire returns the settings currently used on the connection: the
+// handshake defaults until the auth handshake negotiates others.
+func (s *Session) Wire() *WireParams {
+	return s.wire.Load()
+}
+
+func (s *Session) ProtocolVersion() uint8 {
+	return s.Wire().Version
+}
+
+func (s *Session) Codec() Codec {
+	return s.Wire().Codec
+}
+
+// SendMessage writes msg using the session's negotiated protocol version.
+// The payload must already be encoded with the session's codec.
 func (s *Session) SendMessage(msg *Message) error {
 	s.writeMu.Lock()
 	defer s.writeMu.Unlock()
 
+	return s.writeLocked(msg)
+}
+
+// SendPayload encodes payload with the session's codec and sends it. The
+// codec is read under the write lock, so a payload is never encoded with
+// one codec and framed after the session switched to another.
+func (s *Session) SendPayload(msgType MessageType, payload interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	msg, err := NewMessageWithCodec(s.Codec(), msgType, payload)
+	if err != nil {
+		return err
+	}
+	return s.writeLocked(msg)
+}
+
+// DecodePayload decodes a payload received on this session.
+func (s *Session) DecodePayload(data []byte, v interface{}) error {
+	return s.Codec().Unmarshal(data, v)
+}
+
+// SendAndUpgrade sends payload with the current settings and then switches
+// the session to wire, with no other write in between. It is used to send
+// the auth result, which the device must still be able to decode.
+func (s *Session) SendAndUpgrade(msgType MessageType, payload interface{}, wire *WireParams) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	msg, err := NewMessageWithCodec(s.Codec(), msgType, payload)
+	if err != nil {
+		return err
+	}
+	if err := s.writeLocked(msg); err != nil {
+		return err
+	}
+	s.wire.Store(wire)
+	return nil
+}
+
+func (s *Session) writeLocked(msg *Message) error {
 	select {
 	case <-s.closeCh:
 		return ErrSessionClosed
 	default:
-		return WriteMessage(s.Conn, msg)
 	}
-}
 
-func (s *Session) SendCommand(cmd *CommandMessage) error {
-	msg, err := NewMessage(TypeCMD, cmd)
-	if err != nil {
+	if err := WriteFrame(s.Conn, msg, s.Wire()); err != nil {
 		return err
 	}
-	return s.SendMessage(msg)
+	s.metrics.messageSent(msg.Type)
+	return nil
+}
+
+func (s *Session) SendCommand(cmd *CommandMessage) error {
+	return s.SendPayload(TypeCMD, cmd)
 }
 
 func (s *Session) SendPing() error {
 	ping := &PingMessage{Timestamp: time.Now().Unix()}
-	msg, err := NewMessage(TypePing, ping)
-	if err != nil {
-		return err
-	}
-	return s.SendMessage(msg)
+	return s.SendPayload(TypePing, ping)
 }
 
 func (s *Session) UpdatePing() {
@@ -74,13 +137,27 @@ func (s *Session) IsExpired(timeout time.Duration) bool {
 }
 
 func (s *Session) Close() error {
+	return s.CloseWithReason("closed")
+}
+
+// CloseWithReason closes the session and records why. Only the first
+// reason is kept when a session is closed more than once.
+func (s *Session) CloseWithReason(reason string) error {
 	s.closeOnce.Do(func() {
+		s.closeReason = reason
 		close(s.closeCh)
 		s.Conn.Close()
 	})
 	return nil
 }
 
+func (s *Session) CloseReason() string {
+	if !s.IsClosed() {
+		return ""
+	}
+	return s.closeReason
+}
+
 func (s *Session) IsClosed() bool {
 	select {
 	case <-s.closeCh:
@@ -92,15 +169,61 @@ func (s *Session) IsClosed() bool {
 
 type SessionManager struct {
 	sessions map[string]*Session
-	snToID   map[string]string
+	byDevice map[string]string         // deviceKey -> session id
+	reserved map[string]map[string]int // appid -> sn -> logins holding a slot
+	events   *EventBus
 	mu       sync.RWMutex
 }
 
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
 		sessions: make(map[string]*Session),
-		snToID:   make(map[string]string),
+		byDevice: make(map[string]string),
+		reserved: make(map[string]map[string]int),
+	}
+}
+
+// Reserve holds one of appID's limit connection slots for sn until release
+// is called, so two logins cannot both take the last slot. A device that is
+// online or already logging in does not need another one.
+func (sm *SessionManager) Reserve(appID, sn string, limit int) (release func(), err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	_, online := sm.byDevice[deviceKey(appID, sn)]
+	if !online && sm.reserved[appID][sn] == 0 {
+		count := 0
+		for _, sessionID := range sm.byDevice {
+			if session, ok := sm.sessions[sessionID]; ok && session.AppID == appID {
+				count++
+			}
+		}
+		for other := range sm.reserved[appID] {
+			if _, online := sm.byDevice[deviceKey(appID, other)]; !online {
+				count++
+			}
+		}
+		if count >= limit {
+			return nil, fmt.Errorf("%w (%d)", ErrConnectionLimit, limit)
+		}
+	}
+
+	if sm.reserved[appID] == nil {
+		sm.reserved[appID] = make(map[string]int)
 	}
+	sm.reserved[appID][sn]++
+
+	return func() {
+		sm.mu.Lock()
+		defer sm.mu.Unlock()
+
+		if sm.reserved[appID][sn]--; sm.reserved[appID][sn] <= 0 {
+			delete(sm.reserved[appID], sn)
+			if len(sm.reserved[appID]) == 0 {
+				delete(sm.reserved, appID)
+			}
+		}
+	}, nil
 }
 
 func (sm *SessionManager) Add(session *Session) {
@@ -108,16 +231,19 @@ func (sm *SessionManager) Add(session *Session) {
 	defer sm.mu.Unlock()
 
 	if session.SN != "" {
-		if oldID, exists := sm.snToID[session.SN]; exists {
+		key := deviceKey(session.AppID, session.SN)
+		if oldID, exists := sm.byDevice[key]; exists {
 			if oldSession, ok := sm.sessions[oldID]; ok {
-				oldSession.Close()
+				oldSession.CloseWithReason("replaced by new session")
 				delete(sm.sessions, oldID)
+				sm.events.Publish(sessionEvent(EventDeviceDisconnected, oldSession))
 			}
 		}
-		sm.snToID[session.SN] = session.ID
+		sm.byDevice[key] = session.ID
 	}
 
 	sm.sessions[session.ID] = session
+	sm.events.Publish(sessionEvent(EventDeviceAuthenticated, session))
 }
 
 func (sm *SessionManager) Remove(sessionID string) {
@@ -128,10 +254,36 @@ func (sm *SessionManager) Remove(sessionID string) {
 		session.Close()
 		delete(sm.sessions, sessionID)
 
-		if session.SN != "" {
-			delete(sm.snToID, session.SN)
+		// A device that logged in again is already mapped to its new
+		// session.
+		key := deviceKey(session.AppID, session.SN)
+		if session.SN != "" && sm.byDevice[key] == sessionID {
+			delete(sm.byDevice, key)
 		}
+		sm.events.Publish(sessionEvent(EventDeviceDisconnected, session))
+	}
+}
+
+// Disconnect closes the session of a device with reason. It reports whether
+// the device was online.
+func (sm *SessionManager) Disconnect(appID, sn, reason string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	key := deviceKey(appID, sn)
+	sessionID, exists := sm.byDevice[key]
+	if !exists {
+		return false
+	}
+	session, exists := sm.sessions[sessionID]
+	delete(sm.byDevice, key)
+	if !exists {
+		return false
 	}
+	session.CloseWithReason(reason)
+	delete(sm.sessions, sessionID)
+	sm.events.Publish(sessionEvent(EventDeviceDisconnected, session))
+	return true
 }
 
 func (sm *SessionManager) Get(sessionID string) (*Session, bool) {
@@ -141,11 +293,11 @@ func (sm *SessionManager) Get(sessionID string) (*Session, bool) {
 	return session, exists
 }
 
-func (sm *SessionManager) GetBySN(sn string) (*Session, bool) {
+func (sm *SessionManager) GetByDevice(appID, sn string) (*Session, bool) {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	if sessionID, exists := sm.snToID[sn]; exists {
+	if sessionID, exists := sm.byDevice[deviceKey(appID, sn)]; exists {
 		if session, ok := sm.sessions[sessionID]; ok && !session.IsClosed() {
 			return session, true
 		}
@@ -153,17 +305,61 @@ func (sm *SessionManager) GetBySN(sn string) (*Session, bool) {
 	return nil, false
 }
 
-func (sm *SessionManager) GetOnlineDevices() []string {
+// FindBySN returns the online sessions of every app's device with sn.
+func (sm *SessionManager) FindBySN(sn string) []*Session {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	var devices []string
-	for sn := range sm.snToID {
-		devices = append(devices, sn)
+	var found []*Session
+	for _, sessionID := range sm.byDevice {
+		if session, ok := sm.sessions[sessionID]; ok && session.SN == sn && !session.IsClosed() {
+			found = append(found, session)
+		}
+	}
+	return found
+}
+
+func (sm *SessionManager) GetOnlineDevices() []DeviceRef {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	devices := make([]DeviceRef, 0, len(sm.byDevice))
+	for _, sessionID := range sm.byDevice {
+		if session, ok := sm.sessions[sessionID]; ok {
+			devices = append(devices, DeviceRef{AppID: session.AppID, SN: session.SN})
+		}
 	}
 	return devices
 }
 
+// CountByApp returns how many devices of appID are online.
+func (sm *SessionManager) CountByApp(appID string) int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	count := 0
+	for _, sessionID := range sm.byDevice {
+		if session, ok := sm.sessions[sessionID]; ok && session.AppID == appID {
+			count++
+		}
+	}
+	return count
+}
+
+// OnlineByApp returns how many devices of each app are online.
+func (sm *SessionManager) OnlineByApp() map[string]int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, sessionID := range sm.byDevice {
+		if session, ok := sm.sessions[sessionID]; ok {
+			counts[session.AppID]++
+		}
+	}
+	return counts
+}
+
 func (sm *SessionManager) GetSessionInfo() map[string]SessionInfo {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
@@ -171,13 +367,16 @@ func (sm *SessionManager) GetSessionInfo() map[string]SessionInfo {
 	info := make(map[string]SessionInfo)
 	for _, session := range sm.sessions {
 		info[session.ID] = SessionInfo{
-			ID:         session.ID,
-			SN:         session.SN,
-			AppID:      session.AppID,
-			RemoteAddr: session.RemoteAddr,
-			LoginAt:    session.LoginAt,
-			LastPing:   session.LastPing,
-			Meta:       session.Meta,
+			ID:              session.ID,
+			SN:              session.SN,
+			AppID:           session.AppID,
+			RemoteAddr:      session.RemoteAddr,
+			LoginAt:         session.LoginAt,
+			LastPing:        session.LastPing,
+			Meta:            session.Meta,
+			ProtocolVersion: session.ProtocolVersion(),
+			Codec:           session.Codec().Name(),
+			Compression:     session.Wire().Compression,
 		}
 	}
 	return info
@@ -196,11 +395,12 @@ func (sm *SessionManager) CleanupExpired(timeout time.Duration) int {
 
 	for _, id := range expired {
 		if session, exists := sm.sessions[id]; exists {
-			session.Close()
+			session.CloseWithReason("session expired")
 			delete(sm.sessions, id)
 			if session.SN != "" {
-				delete(sm.snToID, session.SN)
+				delete(sm.byDevice, deviceKey(session.AppID, session.SN))
 			}
+			sm.events.Publish(sessionEvent(EventDeviceExpired, session))
 		}
 	}
 
@@ -212,22 +412,25 @@ func (sm *SessionManager) Shutdown(ctx context.Context) error {
 	defer sm.mu.Unlock()
 
 	for _, session := range sm.sessions {
-		session.Close()
+		session.CloseWithReason("server shutdown")
 	}
 
 	sm.sessions = make(map[string]*Session)
-	sm.snToID = make(map[string]string)
+	sm.byDevice = make(map[string]string)
 	return nil
 }
 
 type SessionInfo struct {
-	ID         string            `json:"id"`
-	SN         string            `json:"sn"`
-	AppID      string            `json:"appid"`
-	RemoteAddr string            `json:"remote_addr"`
-	LoginAt    time.Time         `json:"login_at"`
-	LastPing   time.Time         `json:"last_ping"`
-	Meta       map[string]string `json:"meta"`
+	ID              string            `json:"id"`
+	SN              string            `json:"sn"`
+	AppID           string            `json:"appid"`
+	RemoteAddr      string            `json:"remote_addr"`
+	LoginAt         time.Time         `json:"login_at"`
+	LastPing        time.Time         `json:"last_ping"`
+	Meta            map[string]string `json:"meta"`
+	ProtocolVersion uint8             `json:"protocol_version"`
+	Codec           string            `json:"codec"`
+	Compression     string            `json:"compression,omitempty"`
 }
 
 var ErrSessionClosed = fmt.Errorf("session closed")
\ No newline at end of file
@@ -0,0 +1,98 @@
+package tcpserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestReserveConnectionLimit starts many logins of one app at once and
+// checks that no more than the limit get a slot.
+func TestReserveConnectionLimit(t *testing.T) {
+	sm := NewSessionManager()
+	const limit = 3
+
+	var mu sync.Mutex
+	var releases []func()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(sn string) {
+			defer wg.Done()
+			if release, err := sm.Reserve(testAppID, sn, limit); err == nil {
+				mu.Lock()
+				releases = append(releases, release)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("s%d", i))
+	}
+	wg.Wait()
+
+	if len(releases) != limit {
+		t.Fatalf("%d logins got a slot, want %d", len(releases), limit)
+	}
+
+	// Further devices wait until a slot is released.
+	if _, err := sm.Reserve(testAppID, "s-new", limit); err == nil {
+		t.Error("login over the limit got a slot")
+	}
+	for _, release := range releases {
+		release()
+	}
+	if _, err := sm.Reserve(testAppID, "s-new", limit); err != nil {
+		t.Errorf("slot not freed after release: %v", err)
+	}
+}
+
+// TestSessionRemoveKeepsNewerSession removes a stale session of a device
+// that is registered under a newer one and checks the device stays online.
+func TestSessionRemoveKeepsNewerSession(t *testing.T) {
+	sm := NewSessionManager()
+	newSession := func() *Session {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		session := NewSession(conn)
+		session.AppID, session.SN = testAppID, "s1"
+		return session
+	}
+
+	stale := newSession()
+	current := newSession()
+	sm.Add(current)
+	sm.mu.Lock()
+	sm.sessions[stale.ID] = stale
+	sm.mu.Unlock()
+
+	sm.Remove(stale.ID)
+	if session, online := sm.GetByDevice(testAppID, "s1"); !online || session.ID != current.ID {
+		t.Fatalf("device after removing a stale session: %v, %v", session, online)
+	}
+
+	sm.Remove(current.ID)
+	if _, online := sm.GetByDevice(testAppID, "s1"); online {
+		t.Error("device online after removing its session")
+	}
+}
+
+// TestSecondLoginRefused logs in twice on one connection and checks the
+// session keeps the device it first logged in as.
+func TestSecondLoginRefused(t *testing.T) {
+	server := startTestServer(t, nil)
+	sessions := server.GetSessionManager()
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+	first, _ := sessions.GetByDevice(testAppID, "s1")
+
+	if _, _, err := device.login(testAppID, "s2", testKey, nil); err == nil || !strings.Contains(err.Error(), "unexpected auth response type") {
+		t.Fatalf("second login: %v", err)
+	}
+	if _, online := sessions.GetByDevice(testAppID, "s2"); online {
+		t.Error("session logged in as a second device")
+	}
+	if session, online := sessions.GetByDevice(testAppID, "s1"); !online || session.ID != first.ID || session.SN != "s1" {
+		t.Errorf("s1 after the second login: %v, %v", session, online)
+	}
+}
@@ -0,0 +1,113 @@
+package tcpserver
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DeviceRef names a device. An AppID is a tenant, and serial numbers are
+// only unique within their app.
+type DeviceRef struct {
+	AppID string `json:"appid"`
+	SN    string `json:"sn"`
+}
+
+// deviceKey is the map key for a device.
+func deviceKey(appID, sn string) string {
+	return appID + "/" + sn
+}
+
+var (
+	ErrConnectionLimit = errors.New("connection limit reached for app")
+	ErrCommandRate     = errors.New("command rate limit exceeded for app")
+)
+
+// TenantConfig holds the quotas of one app. Zero values mean no limit.
+type TenantConfig struct {
+	// MaxConnections caps the app's concurrent device sessions.
+	MaxConnections int `yaml:"max_connections"`
+	// CommandRate caps commands sent to the app's devices per second,
+	// allowing bursts of up to CommandBurst.
+	CommandRate  float64 `yaml:"command_rate"`
+	CommandBurst int     `yaml:"command_burst"`
+}
+
+// Tenants applies per-app quotas. Apps without their own config get the
+// defaults.
+type Tenants struct {
+	defaults TenantConfig
+	apps     map[string]TenantConfig
+
+	buckets map[string]*tokenBucket
+	mu      sync.Mutex
+}
+
+func NewTenants(defaults TenantConfig, apps map[string]TenantConfig) *Tenants {
+	if apps == nil {
+		apps = make(map[string]TenantConfig)
+	}
+	return &Tenants{
+		defaults: defaults,
+		apps:     apps,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// Config returns the quotas of appID.
+func (t *Tenants) Config(appID string) TenantConfig {
+	if config, exists := t.apps[appID]; exists {
+		return config
+	}
+	return t.defaults
+}
+
+// AllowCommand takes one command from appID's rate allowance, returning
+// ErrCommandRate when it is used up.
+func (t *Tenants) AllowCommand(appID string) error {
+	config := t.Config(appID)
+	if config.CommandRate <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucket, exists := t.buckets[appID]
+	if !exists {
+		burst := float64(config.CommandBurst)
+		if burst < 1 {
+			burst = config.CommandRate
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		bucket = &tokenBucket{rate: config.CommandRate, burst: burst, tokens: burst, last: time.Now()}
+		t.buckets[appID] = bucket
+	}
+	if !bucket.take(time.Now()) {
+		return ErrCommandRate
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
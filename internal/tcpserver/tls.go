@@ -0,0 +1,116 @@
+package tcpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type TLSConfig struct {
+	Enable            bool
+	CertFile          string
+	KeyFile           string
+	CAFile            string
+	RequireClientCert bool
+}
+
+func (c *TLSConfig) serverConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pool, err := LoadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if c.RequireClientCert {
+		if c.CAFile == "" {
+			return nil, fmt.Errorf("require_client_cert needs a CA file to verify clients")
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// clientConfig dials peers presenting the certificate, if any, and
+// trusting CAFile, or the system roots without one.
+func (c *TLSConfig) clientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CAFile != "" {
+		pool, err := LoadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// verifyPeerSN checks that a verified client certificate, when present, was
+// issued to the SN the device claims in its auth message. The SN must match
+// the certificate CN or one of its DNS SANs.
+func (s *Server) verifyPeerSN(session *Session, sn string) error {
+	conn := session.Conn
+	if metered, ok := conn.(*meteredConn); ok {
+		conn = metered.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	peers := tlsConn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		if s.tlsConfig != nil && s.tlsConfig.RequireClientCert {
+			return fmt.Errorf("client certificate required")
+		}
+		return nil
+	}
+
+	cert := peers[0]
+	if cert.Subject.CommonName == sn {
+		return nil
+	}
+	for _, name := range cert.DNSNames {
+		if name == sn {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate does not match sn %s", sn)
+}
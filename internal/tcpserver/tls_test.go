@@ -0,0 +1,217 @@
+package tcpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"device-agent/internal/security"
+)
+
+// testPKI is a CA with a server certificate for 127.0.0.1, written to a
+// temporary directory.
+type testPKI struct {
+	dir     string
+	ca      *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+	caFile  string
+	certPEM string
+	keyPEM  string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pki := &testPKI{dir: t.TempDir(), ca: ca, caKey: caKey}
+	pki.caFile = pki.writePEM(t, "ca.pem", "CERTIFICATE", der)
+	pki.certPEM, pki.keyPEM = pki.issue(t, "server", func(cert *x509.Certificate) {
+		cert.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+	return pki
+}
+
+// issue signs a certificate for cn and returns the certificate and key
+// files.
+func (p *testPKI) issue(t *testing.T, cn string, customize func(cert *x509.Certificate)) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if customize != nil {
+		customize(template)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.writePEM(t, cn+".pem", "CERTIFICATE", der), p.writePEM(t, cn+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func (p *testPKI) writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(p.dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clientConfig trusts the CA and, when certFile is set, presents that
+// certificate.
+func (p *testPKI) clientConfig(t *testing.T, certFile, keyFile string) *tls.Config {
+	t.Helper()
+
+	pool, err := LoadCertPool(p.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+func startTLSServer(t *testing.T, pki *testPKI, requireClientCert bool, nonces security.NonceStore) *Server {
+	return startTestServer(t, func(config *Config) {
+		config.NonceStore = nonces
+		config.TLS = &TLSConfig{
+			Enable:            true,
+			CertFile:          pki.certPEM,
+			KeyFile:           pki.keyPEM,
+			CAFile:            pki.caFile,
+			RequireClientCert: requireClientCert,
+		}
+	})
+}
+
+func TestTLSLogin(t *testing.T) {
+	pki := newTestPKI(t)
+	server := startTLSServer(t, pki, false, nil)
+
+	device := dialTestDevice(t, serverAddr(server), pki.clientConfig(t, "", ""))
+	device.mustLogin(testAppID, "s1", testKey)
+
+	if _, online := server.GetSessionManager().GetByDevice(testAppID, "s1"); !online {
+		t.Fatal("device is not online after a TLS login")
+	}
+}
+
+func TestMutualTLSMatchingCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	server := startTLSServer(t, pki, true, nil)
+
+	certFile, keyFile := pki.issue(t, "s1", nil)
+	device := dialTestDevice(t, serverAddr(server), pki.clientConfig(t, certFile, keyFile))
+	device.mustLogin(testAppID, "s1", testKey)
+}
+
+func TestMutualTLSCertificateSAN(t *testing.T) {
+	pki := newTestPKI(t)
+	server := startTLSServer(t, pki, true, nil)
+
+	certFile, keyFile := pki.issue(t, "kiosk", func(cert *x509.Certificate) {
+		cert.DNSNames = []string{"s1"}
+	})
+	device := dialTestDevice(t, serverAddr(server), pki.clientConfig(t, certFile, keyFile))
+	device.mustLogin(testAppID, "s1", testKey)
+}
+
+func TestMutualTLSMismatchKeepsNonce(t *testing.T) {
+	pki := newTestPKI(t)
+	nonces := security.NewMemoryNonceStore()
+	server := startTLSServer(t, pki, true, nonces)
+
+	certFile, keyFile := pki.issue(t, "s1", nil)
+	device := dialTestDevice(t, serverAddr(server), pki.clientConfig(t, certFile, keyFile))
+
+	auth, authOK, err := device.login(testAppID, "s2", testKey, nil)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if authOK.Success {
+		t.Fatal("login with another device's certificate succeeded")
+	}
+	if nonces.HasNonce(auth.Nonce) {
+		t.Error("refused login used up the device's nonce")
+	}
+}
+
+func TestMutualTLSRequiresCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	server := startTLSServer(t, pki, true, nil)
+
+	device := dialTestDevice(t, serverAddr(server), pki.clientConfig(t, "", ""))
+	if _, authOK, err := device.login(testAppID, "s1", testKey, nil); err == nil && authOK.Success {
+		t.Fatal("login without a client certificate succeeded")
+	}
+	if _, online := server.GetSessionManager().GetByDevice(testAppID, "s1"); online {
+		t.Fatal("device without a client certificate is online")
+	}
+}
+
+func TestMutualTLSUntrustedCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	server := startTLSServer(t, pki, true, nil)
+
+	other := newTestPKI(t)
+	certFile, keyFile := other.issue(t, "s1", nil)
+	device := dialTestDevice(t, serverAddr(server), pki.clientConfig(t, certFile, keyFile))
+	if _, authOK, err := device.login(testAppID, "s1", testKey, nil); err == nil && authOK.Success {
+		t.Fatal("login with a certificate from another CA succeeded")
+	}
+}
@@ -0,0 +1,412 @@
+package tcpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultMaxUploadSize = 256 * 1024 * 1024 // 256MB
+
+	// uploadRequestTimeout fails requests the device never started, e.g.
+	// because its agent predates uploads.
+	uploadRequestTimeout = time.Minute
+	uploadRetention      = 24 * time.Hour
+)
+
+type UploadState string
+
+const (
+	UploadStateRequested UploadState = "requested"
+	UploadStateReceiving UploadState = "receiving"
+	UploadStateDone      UploadState = "done"
+	UploadStateFailed    UploadState = "failed"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadNotReady = errors.New("upload not complete")
+)
+
+type Upload struct {
+	ID         string      `json:"upload_id"`
+	AppID      string      `json:"appid"`
+	SN         string      `json:"sn"`
+	Path       string      `json:"path"`
+	Name       string      `json:"name,omitempty"`
+	Size       int64       `json:"size"`
+	Received   int64       `json:"received"`
+	SHA256     string      `json:"sha256,omitempty"`
+	State      UploadState `json:"state"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+
+	file      string
+	sessionID string
+}
+
+func (u *Upload) finished() bool {
+	return u.State == UploadStateDone || u.State == UploadStateFailed
+}
+
+// UploadManager asks devices for files and stores what they send back under
+// dir/<sn>/. An upload that loses its connection fails; it is not resumed.
+type UploadManager struct {
+	dir     string
+	maxSize int64
+	uploads map[string]*Upload
+	mu      sync.Mutex
+}
+
+func NewUploadManager(dir string, maxSize int64) *UploadManager {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "device-agent-uploads")
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxUploadSize
+	}
+	return &UploadManager{
+		dir:     dir,
+		maxSize: maxSize,
+		uploads: make(map[string]*Upload),
+	}
+}
+
+// Request sends an upload request for filePath to the device on session.
+func (m *UploadManager) Request(session *Session, filePath string) (*Upload, error) {
+	now := time.Now()
+	upload := &Upload{
+		ID:        uuid.New().String(),
+		AppID:     session.AppID,
+		SN:        session.SN,
+		Path:      filePath,
+		State:     UploadStateRequested,
+		CreatedAt: now,
+		UpdatedAt: now,
+		sessionID: session.ID,
+	}
+
+	m.mu.Lock()
+	m.pruneLocked(now)
+	m.uploads[upload.ID] = upload
+	m.mu.Unlock()
+
+	req := &UploadRequestMessage{UploadID: upload.ID, Path: filePath}
+	if err := session.SendPayload(TypeUploadRequest, req); err != nil {
+		m.mu.Lock()
+		delete(m.uploads, upload.ID)
+		m.mu.Unlock()
+		return nil, err
+	}
+
+	return m.Get(session.AppID, session.SN, upload.ID)
+}
+
+func (m *UploadManager) Get(appID, sn, id string) (*Upload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, exists := m.uploads[id]
+	if !exists || upload.AppID != appID || upload.SN != sn {
+		return nil, ErrUploadNotFound
+	}
+	m.expireLocked(upload, time.Now())
+	copied := *upload
+	return &copied, nil
+}
+
+// ContentPath returns where a completed upload is stored on disk.
+func (m *UploadManager) ContentPath(appID, sn, id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, exists := m.uploads[id]
+	if !exists || upload.AppID != appID || upload.SN != sn {
+		return "", ErrUploadNotFound
+	}
+	if upload.State != UploadStateDone {
+		return "", ErrUploadNotReady
+	}
+	return upload.file, nil
+}
+
+// ListByDevice returns the uploads for a device, oldest first.
+func (m *UploadManager) ListByDevice(appID, sn string) []*Upload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var uploads []*Upload
+	for _, upload := range m.uploads {
+		if upload.AppID == appID && upload.SN == sn {
+			m.expireLocked(upload, now)
+			copied := *upload
+			uploads = append(uploads, &copied)
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].CreatedAt.Before(uploads[j].CreatedAt)
+	})
+	return uploads
+}
+
+// Has reports whether id is a known upload, so status messages can be told
+// apart from those for gateway-to-device transfers.
+func (m *UploadManager) Has(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.uploads[id]
+	return exists
+}
+
+// lookupLocked returns the unfinished upload id sent over session. It
+// returns nil without an error for an upload that already finished, so late
+// frames after a failure are dropped quietly.
+func (m *UploadManager) lookupLocked(session *Session, id string) (*Upload, error) {
+	upload, exists := m.uploads[id]
+	if !exists || upload.AppID != session.AppID || upload.SN != session.SN {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+	}
+	if upload.finished() {
+		return nil, nil
+	}
+	if upload.sessionID != session.ID {
+		return nil, fmt.Errorf("upload %s belongs to another session", id)
+	}
+	return upload, nil
+}
+
+func (m *UploadManager) HandleBegin(session *Session, begin *FileBeginMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, err := m.lookupLocked(session, begin.TransferID)
+	if err != nil || upload == nil {
+		return err
+	}
+	if upload.State != UploadStateRequested {
+		return fmt.Errorf("upload %s already started", upload.ID)
+	}
+	if begin.Size < 0 || begin.Size > m.maxSize {
+		m.finishLocked(upload, fmt.Sprintf("file size %d exceeds limit %d", begin.Size, m.maxSize))
+		return nil
+	}
+
+	name := path.Base(begin.Name)
+	if name == "." || name == "/" || name == ".." {
+		name = "upload"
+	}
+
+	dir := filepath.Join(m.dir, filepath.Base(session.AppID), filepath.Base(session.SN))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		m.finishLocked(upload, fmt.Sprintf("create upload directory: %v", err))
+		return nil
+	}
+	file := filepath.Join(dir, upload.ID)
+	if err := os.WriteFile(file+".part", nil, 0o644); err != nil {
+		m.finishLocked(upload, fmt.Sprintf("create upload file: %v", err))
+		return nil
+	}
+
+	upload.Name = name
+	upload.Size = begin.Size
+	upload.State = UploadStateReceiving
+	upload.UpdatedAt = time.Now()
+	upload.file = file
+	return nil
+}
+
+// HandleChunk appends a chunk to the upload's partial file. The write runs
+// without the manager lock; frames of one upload all come from its
+// session's read loop, so they never race each other.
+func (m *UploadManager) HandleChunk(session *Session, chunk *FileChunkMessage) error {
+	m.mu.Lock()
+	upload, err := m.lookupLocked(session, chunk.TransferID)
+	if err != nil || upload == nil {
+		m.mu.Unlock()
+		return err
+	}
+	if upload.State != UploadStateReceiving {
+		m.mu.Unlock()
+		return fmt.Errorf("upload %s has not started", upload.ID)
+	}
+	if chunk.Offset != upload.Received {
+		m.finishLocked(upload, fmt.Sprintf("chunk offset %d does not match received size %d", chunk.Offset, upload.Received))
+		m.mu.Unlock()
+		return nil
+	}
+	if upload.Received+int64(len(chunk.Data)) > upload.Size {
+		m.finishLocked(upload, fmt.Sprintf("chunk at %d overruns file size %d", chunk.Offset, upload.Size))
+		m.mu.Unlock()
+		return nil
+	}
+	file := upload.file
+	m.mu.Unlock()
+
+	err = appendFile(file+".part", chunk.Data)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if upload.finished() {
+		return nil
+	}
+	if err != nil {
+		m.finishLocked(upload, fmt.Sprintf("write upload file: %v", err))
+		return nil
+	}
+	upload.Received += int64(len(chunk.Data))
+	upload.UpdatedAt = time.Now()
+	return nil
+}
+
+// HandleComplete verifies the received file against the size announced at
+// begin and the hash sent with the complete message. The file is hashed
+// without the manager lock.
+func (m *UploadManager) HandleComplete(session *Session, complete *FileCompleteMessage) error {
+	m.mu.Lock()
+	upload, err := m.lookupLocked(session, complete.TransferID)
+	if err != nil || upload == nil {
+		m.mu.Unlock()
+		return err
+	}
+	if upload.State != UploadStateReceiving {
+		m.mu.Unlock()
+		return fmt.Errorf("upload %s has not started", upload.ID)
+	}
+	if upload.Received != upload.Size {
+		m.finishLocked(upload, fmt.Sprintf("size mismatch: got %d, expected %d", upload.Received, upload.Size))
+		m.mu.Unlock()
+		return nil
+	}
+	file := upload.file
+	m.mu.Unlock()
+
+	sum, err := fileSHA256(file + ".part")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if upload.finished() {
+		return nil
+	}
+	if err != nil {
+		m.finishLocked(upload, err.Error())
+		return nil
+	}
+	if complete.SHA256 != "" && sum != complete.SHA256 {
+		m.finishLocked(upload, fmt.Sprintf("sha256 mismatch: got %s, expected %s", sum, complete.SHA256))
+		return nil
+	}
+
+	if err := os.Rename(file+".part", file); err != nil {
+		m.finishLocked(upload, fmt.Sprintf("store upload: %v", err))
+		return nil
+	}
+
+	upload.SHA256 = sum
+	m.finishLocked(upload, "")
+	return nil
+}
+
+// HandleStatus records a device refusing or abandoning an upload.
+func (m *UploadManager) HandleStatus(session *Session, status *FileStatusMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, err := m.lookupLocked(session, status.TransferID)
+	if err != nil || upload == nil {
+		return err
+	}
+	if status.Status != FileStatusError {
+		return fmt.Errorf("unexpected upload status %q", status.Status)
+	}
+	m.finishLocked(upload, status.Detail)
+	return nil
+}
+
+// SessionClosed fails every unfinished upload sent over session.
+func (m *UploadManager) SessionClosed(session *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, upload := range m.uploads {
+		if upload.sessionID == session.ID && !upload.finished() {
+			m.finishLocked(upload, "connection lost")
+		}
+	}
+}
+
+// finishLocked marks upload done, or failed when reason is set. Failed
+// uploads drop their partial file.
+func (m *UploadManager) finishLocked(upload *Upload, reason string) {
+	now := time.Now()
+	upload.State = UploadStateDone
+	if reason != "" {
+		upload.State = UploadStateFailed
+		upload.Error = reason
+		if upload.file != "" {
+			os.Remove(upload.file + ".part")
+		}
+	}
+	upload.UpdatedAt = now
+	upload.FinishedAt = &now
+}
+
+func (m *UploadManager) expireLocked(upload *Upload, now time.Time) {
+	if upload.State == UploadStateRequested && now.Sub(upload.CreatedAt) > uploadRequestTimeout {
+		m.finishLocked(upload, "device did not respond to upload request")
+	}
+}
+
+func (m *UploadManager) pruneLocked(now time.Time) {
+	for id, upload := range m.uploads {
+		m.expireLocked(upload, now)
+		if upload.finished() && now.Sub(upload.UpdatedAt) > uploadRetention {
+			if upload.file != "" {
+				os.Remove(upload.file)
+			}
+			delete(m.uploads, id)
+		}
+	}
+}
+
+func appendFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("read %s: %w", name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
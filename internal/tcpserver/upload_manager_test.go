@@ -0,0 +1,165 @@
+package tcpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+)
+
+// requestTestUpload asks the device logged in as sn for filePath and waits
+// for the request to arrive.
+func requestTestUpload(t *testing.T, server *Server, device *testDevice, sn, filePath string) *Upload {
+	t.Helper()
+
+	session, online := server.GetSessionManager().GetByDevice(testAppID, sn)
+	if !online {
+		t.Fatalf("%s is offline", sn)
+	}
+	upload, err := server.GetUploadManager().Request(session, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req UploadRequestMessage
+	device.expect(TypeUploadRequest, &req)
+	if req.UploadID != upload.ID || req.Path != filePath {
+		t.Fatalf("request %+v", req)
+	}
+	return upload
+}
+
+// TestUploadFromDevice streams a file from the device in chunks and checks
+// the gateway stores it under the name the device sent.
+func TestUploadFromDevice(t *testing.T) {
+	server := startTestServer(t, func(config *Config) {
+		config.UploadDir = t.TempDir()
+	})
+	uploads := server.GetUploadManager()
+
+	device := dialTestDevice(t, serverAddr(server), nil)
+	device.mustLogin(testAppID, "s1", testKey)
+	upload := requestTestUpload(t, server, device, "s1", "/var/log/agent.log")
+	if upload.State != UploadStateRequested {
+		t.Fatalf("requested %+v", upload)
+	}
+
+	content := "line 1\nline 2\n"
+	sum := sha256.Sum256([]byte(content))
+	device.send(TypeFileBegin, &FileBeginMessage{TransferID: upload.ID, Name: "/var/log/agent.log", Size: int64(len(content))})
+	device.send(TypeFileChunk, &FileChunkMessage{TransferID: upload.ID, Offset: 0, Data: []byte(content[:7])})
+	device.send(TypeFileChunk, &FileChunkMessage{TransferID: upload.ID, Offset: 7, Data: []byte(content[7:])})
+	device.send(TypeFileComplete, &FileCompleteMessage{TransferID: upload.ID, SHA256: hex.EncodeToString(sum[:])})
+
+	waitFor(t, "upload to finish", func() bool {
+		got, _ := uploads.Get(testAppID, "s1", upload.ID)
+		return got.State == UploadStateDone
+	})
+	got, _ := uploads.Get(testAppID, "s1", upload.ID)
+	if got.Name != "agent.log" || got.Received != int64(len(content)) || got.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("upload %+v", got)
+	}
+	stored, err := uploads.ContentPath(testAppID, "s1", upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(stored); string(data) != content {
+		t.Errorf("stored %q", data)
+	}
+
+	if _, err := uploads.Get("A2", "s1", upload.ID); err != ErrUploadNotFound {
+		t.Errorf("upload seen from another app: %v", err)
+	}
+}
+
+func TestUploadFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		// send plays the device's side once the upload was requested.
+		send func(device *testDevice, id string)
+		err  string
+	}{
+		{
+			name: "refused by the device",
+			send: func(device *testDevice, id string) {
+				device.send(TypeFileStatus, &FileStatusMessage{TransferID: id, Status: FileStatusError, Detail: "path /etc/shadow is not allowed"})
+			},
+			err: "path /etc/shadow is not allowed",
+		},
+		{
+			name: "too large",
+			send: func(device *testDevice, id string) {
+				device.send(TypeFileBegin, &FileBeginMessage{TransferID: id, Name: "big.bin", Size: 1 << 20})
+			},
+			err: "exceeds limit",
+		},
+		{
+			name: "chunk out of order",
+			send: func(device *testDevice, id string) {
+				device.send(TypeFileBegin, &FileBeginMessage{TransferID: id, Name: "a.txt", Size: 8})
+				device.send(TypeFileChunk, &FileChunkMessage{TransferID: id, Offset: 4, Data: []byte("4567")})
+			},
+			err: "does not match received size",
+		},
+		{
+			name: "chunk past the size",
+			send: func(device *testDevice, id string) {
+				device.send(TypeFileBegin, &FileBeginMessage{TransferID: id, Name: "a.txt", Size: 2})
+				device.send(TypeFileChunk, &FileChunkMessage{TransferID: id, Offset: 0, Data: []byte("0123")})
+			},
+			err: "overruns file size",
+		},
+		{
+			name: "short file",
+			send: func(device *testDevice, id string) {
+				device.send(TypeFileBegin, &FileBeginMessage{TransferID: id, Name: "a.txt", Size: 8})
+				device.send(TypeFileChunk, &FileChunkMessage{TransferID: id, Offset: 0, Data: []byte("0123")})
+				device.send(TypeFileComplete, &FileCompleteMessage{TransferID: id})
+			},
+			err: "size mismatch",
+		},
+		{
+			name: "wrong checksum",
+			send: func(device *testDevice, id string) {
+				device.send(TypeFileBegin, &FileBeginMessage{TransferID: id, Name: "a.txt", Size: 4})
+				device.send(TypeFileChunk, &FileChunkMessage{TransferID: id, Offset: 0, Data: []byte("0123")})
+				device.send(TypeFileComplete, &FileCompleteMessage{TransferID: id, SHA256: strings.Repeat("0", 64)})
+			},
+			err: "sha256 mismatch",
+		},
+		{
+			name: "connection lost",
+			send: func(device *testDevice, id string) {
+				device.send(TypeFileBegin, &FileBeginMessage{TransferID: id, Name: "a.txt", Size: 4})
+				device.conn.Close()
+			},
+			err: "connection lost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startTestServer(t, func(config *Config) {
+				config.UploadDir = t.TempDir()
+				config.MaxUploadSize = 1024
+			})
+			uploads := server.GetUploadManager()
+
+			device := dialTestDevice(t, serverAddr(server), nil)
+			device.mustLogin(testAppID, "s1", testKey)
+			upload := requestTestUpload(t, server, device, "s1", "a.txt")
+			tt.send(device, upload.ID)
+
+			waitFor(t, "upload to fail", func() bool {
+				got, _ := uploads.Get(testAppID, "s1", upload.ID)
+				return got.State == UploadStateFailed
+			})
+			got, _ := uploads.Get(testAppID, "s1", upload.ID)
+			if !strings.Contains(got.Error, tt.err) {
+				t.Errorf("error %q, want %q", got.Error, tt.err)
+			}
+			if _, err := uploads.ContentPath(testAppID, "s1", upload.ID); err != ErrUploadNotReady {
+				t.Errorf("content of a failed upload: %v", err)
+			}
+		})
+	}
+}
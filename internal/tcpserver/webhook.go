@@ -0,0 +1,848 @@
+package tcpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"device-agent/internal/jsonfile"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultWebhookMaxAttempts    = 5
+	DefaultWebhookInitialBackoff = time.Second
+	DefaultWebhookMaxBackoff     = 5 * time.Minute
+	DefaultWebhookTimeout        = 10 * time.Second
+	DefaultDeadLetterSize        = 1000
+	DefaultWebhookWorkers        = 2
+	DefaultWebhookQueueSize      = 1000
+)
+
+// EventWebhookTest is only ever sent by Webhooks.Test.
+const EventWebhookTest = "webhook.test"
+
+// Headers sent with every webhook call. The signature is the hex HMAC-SHA256
+// of the timestamp, a dot and the body, keyed with the webhook's secret.
+const (
+	WebhookHeaderID        = "X-Webhook-ID"
+	WebhookHeaderDelivery  = "X-Webhook-Delivery"
+	WebhookHeaderEvent     = "X-Webhook-Event"
+	WebhookHeaderTimestamp = "X-Webhook-Timestamp"
+	WebhookHeaderSignature = "X-Webhook-Signature"
+)
+
+// WebhookEventTypes are the events webhooks may subscribe to. A webhook
+// without events gets all of them.
+var WebhookEventTypes = []string{
+	EventDeviceAuthenticated,
+	EventDeviceDisconnected,
+	EventDeviceExpired,
+	EventDeviceAuthFailed,
+	EventCommandAcked,
+	EventCommandTimeout,
+}
+
+// Webhook is a URL the gateway posts matching events to.
+type Webhook struct {
+	ID     string   `json:"webhook_id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	AppIDs []string `json:"appids,omitempty"`
+	// Secret signs every call. It is only shown when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Matches reports whether event should be sent to the webhook.
+func (w *Webhook) Matches(event *Event) bool {
+	if len(w.Events) > 0 && !containsString(w.Events, event.Type) {
+		return false
+	}
+	if len(w.AppIDs) > 0 && !containsString(w.AppIDs, event.AppID) {
+		return false
+	}
+	return true
+}
+
+func (w *Webhook) normalize() error {
+	if w.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", w.URL)
+	}
+	for _, eventType := range w.Events {
+		if !containsString(WebhookEventTypes, eventType) {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+
+	if w.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return fmt.Errorf("generate secret: %w", err)
+		}
+		w.Secret = hex.EncodeToString(secret)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature of body sent at timestamp (unix
+// seconds), as found in the X-Webhook-Signature header.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// WebhookStore keeps webhooks and the deliveries that ran out of attempts.
+type WebhookStore interface {
+	Put(hook *Webhook) error
+	Get(id string) (*Webhook, error)
+	Delete(id string) error
+	List() ([]*Webhook, error)
+
+	// AddDeadLetter keeps delivery, dropping the oldest dead letters beyond
+	// limit.
+	AddDeadLetter(delivery *WebhookDelivery, limit int) error
+	// TakeDeadLetter removes a dead letter and returns it.
+	TakeDeadLetter(id string) (*WebhookDelivery, error)
+	// DeadLetters returns the dead letters, oldest first.
+	DeadLetters() ([]*WebhookDelivery, error)
+}
+
+var (
+	ErrWebhookNotFound    = fmt.Errorf("webhook not found")
+	ErrDeadLetterNotFound = fmt.Errorf("dead letter not found")
+	ErrWebhookQueueFull   = fmt.Errorf("webhook queue full")
+	ErrWebhooksClosed     = fmt.Errorf("webhooks closed")
+)
+
+type MemoryWebhookStore struct {
+	hooks       map[string]*Webhook
+	deadLetters []*WebhookDelivery
+	mu          sync.RWMutex
+}
+
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{
+		hooks: make(map[string]*Webhook),
+	}
+}
+
+func (m *MemoryWebhookStore) Put(hook *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *hook
+	m.hooks[hook.ID] = &copied
+	return nil
+}
+
+func (m *MemoryWebhookStore) Get(id string) (*Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hook, exists := m.hooks[id]
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+	copied := *hook
+	return &copied, nil
+}
+
+func (m *MemoryWebhookStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.hooks[id]; !exists {
+		return ErrWebhookNotFound
+	}
+	delete(m.hooks, id)
+	return nil
+}
+
+// List returns every webhook, oldest first.
+func (m *MemoryWebhookStore) List() ([]*Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	hooks := make([]*Webhook, 0, len(m.hooks))
+	for _, hook := range m.hooks {
+		copied := *hook
+		hooks = append(hooks, &copied)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+	})
+	return hooks, nil
+}
+
+func (m *MemoryWebhookStore) AddDeadLetter(delivery *WebhookDelivery, limit int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copied := *delivery
+	m.deadLetters = append(m.deadLetters, &copied)
+	if limit > 0 && len(m.deadLetters) > limit {
+		m.deadLetters = m.deadLetters[len(m.deadLetters)-limit:]
+	}
+	return nil
+}
+
+func (m *MemoryWebhookStore) TakeDeadLetter(id string) (*WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, delivery := range m.deadLetters {
+		if delivery.ID == id {
+			m.deadLetters = append(m.deadLetters[:i:i], m.deadLetters[i+1:]...)
+			return delivery, nil
+		}
+	}
+	return nil, ErrDeadLetterNotFound
+}
+
+func (m *MemoryWebhookStore) DeadLetters() ([]*WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make([]*WebhookDelivery, 0, len(m.deadLetters))
+	for _, delivery := range m.deadLetters {
+		copied := *delivery
+		result = append(result, &copied)
+	}
+	return result, nil
+}
+
+// FileWebhookStore is a MemoryWebhookStore persisted to JSON files after
+// every change: webhooks to path and dead letters to deadLetterPath. Both
+// hold secrets or event details and are only readable by the owner.
+type FileWebhookStore struct {
+	*MemoryWebhookStore
+	path           string
+	deadLetterPath string
+	writeMu        sync.Mutex
+}
+
+func NewFileWebhookStore(path, deadLetterPath string) (*FileWebhookStore, error) {
+	store := &FileWebhookStore{
+		MemoryWebhookStore: NewMemoryWebhookStore(),
+		path:               path,
+		deadLetterPath:     deadLetterPath,
+	}
+
+	var hooks []*Webhook
+	if err := readWebhookFile(path, &hooks); err != nil {
+		return nil, fmt.Errorf("read webhook store: %w", err)
+	}
+	for _, hook := range hooks {
+		store.hooks[hook.ID] = hook
+	}
+
+	if err := readWebhookFile(deadLetterPath, &store.deadLetters); err != nil {
+		return nil, fmt.Errorf("read webhook dead letters: %w", err)
+	}
+	return store, nil
+}
+
+// readWebhookFile decodes the JSON file at path into v, leaving v alone if
+// the file does not exist.
+func readWebhookFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (f *FileWebhookStore) Put(hook *Webhook) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryWebhookStore.Put(hook); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileWebhookStore) Delete(id string) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryWebhookStore.Delete(id); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileWebhookStore) save() error {
+	hooks, err := f.MemoryWebhookStore.List()
+	if err != nil {
+		return err
+	}
+	return jsonfile.Write(f.path, hooks, 0o600)
+}
+
+func (f *FileWebhookStore) AddDeadLetter(delivery *WebhookDelivery, limit int) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if err := f.MemoryWebhookStore.AddDeadLetter(delivery, limit); err != nil {
+		return err
+	}
+	return f.saveDeadLetters()
+}
+
+func (f *FileWebhookStore) TakeDeadLetter(id string) (*WebhookDelivery, error) {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	delivery, err := f.MemoryWebhookStore.TakeDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+	return delivery, f.saveDeadLetters()
+}
+
+func (f *FileWebhookStore) saveDeadLetters() error {
+	deadLetters, err := f.MemoryWebhookStore.DeadLetters()
+	if err != nil {
+		return err
+	}
+	return jsonfile.Write(f.deadLetterPath, deadLetters, 0o600)
+}
+
+// WebhookConfig controls how webhooks are called. Zero fields use the
+// defaults.
+type WebhookConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+	Timeout        time.Duration `yaml:"timeout"`
+	DeadLetterSize int           `yaml:"dead_letter_size"`
+	// Workers is how many calls to one webhook may be in flight, and
+	// QueueSize how many of its deliveries may wait for a worker. Events
+	// that find the queue full are dead-lettered.
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue_size"`
+	// AllowedHosts lists hostnames, IPs and CIDRs webhooks may call even
+	// though they are loopback, link-local or private addresses, which are
+	// refused otherwise.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// WebhookDelivery is one event on its way to one webhook.
+type WebhookDelivery struct {
+	ID         string     `json:"delivery_id"`
+	WebhookID  string     `json:"webhook_id"`
+	URL        string     `json:"url"`
+	Event      Event      `json:"event"`
+	Attempts   int        `json:"attempts"`
+	StatusCode int        `json:"status_code,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	FailedAt   *time.Time `json:"failed_at,omitempty"`
+}
+
+// Webhooks posts events to the webhooks in its store. Each webhook has its
+// own queue and workers, so a slow receiver only delays its own events. A
+// call that fails is retried with exponential backoff; once it has used up
+// its attempts it is kept as a dead letter, where it can be retried by hand.
+// Deliveries queued or waiting to retry when the gateway stops are lost.
+type Webhooks struct {
+	store     WebhookStore
+	config    WebhookConfig
+	allowed   hostAllowlist
+	client    *http.Client
+	done      chan struct{}
+	logger    *slog.Logger
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	queues   map[string]*webhookQueue // webhook id -> queue
+	closed   bool
+	queuesMu sync.Mutex
+}
+
+// webhookQueue holds the deliveries waiting for one webhook's workers.
+type webhookQueue struct {
+	jobs chan webhookJob
+	stop chan struct{}
+}
+
+type webhookJob struct {
+	hook     *Webhook
+	delivery *WebhookDelivery
+}
+
+func NewWebhooks(store WebhookStore, config WebhookConfig) *Webhooks {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultWebhookMaxAttempts
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = DefaultWebhookInitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultWebhookMaxBackoff
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	if config.DeadLetterSize <= 0 {
+		config.DeadLetterSize = DefaultDeadLetterSize
+	}
+	if config.Workers <= 0 {
+		config.Workers = DefaultWebhookWorkers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultWebhookQueueSize
+	}
+
+	w := &Webhooks{
+		store:   store,
+		config:  config,
+		allowed: newHostAllowlist(config.AllowedHosts),
+		done:    make(chan struct{}),
+		logger:  slog.Default(),
+		queues:  make(map[string]*webhookQueue),
+	}
+	w.client = &http.Client{
+		Timeout: config.Timeout,
+		// Proxies are not used, since they would dial on the gateway's
+		// behalf without the address check.
+		Transport: &http.Transport{
+			DialContext:         w.dialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: config.Workers,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		// A redirect could lead anywhere; it counts as a failed call.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return w
+}
+
+// Add validates and stores a new webhook, generating a secret if it has
+// none.
+func (w *Webhooks) Add(hook *Webhook) (*Webhook, error) {
+	if err := hook.normalize(); err != nil {
+		return nil, err
+	}
+	if err := w.checkURL(hook.URL); err != nil {
+		return nil, err
+	}
+	hook.ID = uuid.New().String()
+	hook.CreatedAt = time.Now()
+	if err := w.store.Put(hook); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+func (w *Webhooks) Get(id string) (*Webhook, error) {
+	return w.store.Get(id)
+}
+
+// Remove deletes a webhook. Its queued deliveries are dropped.
+func (w *Webhooks) Remove(id string) error {
+	if err := w.store.Delete(id); err != nil {
+		return err
+	}
+
+	w.queuesMu.Lock()
+	defer w.queuesMu.Unlock()
+
+	if queue, exists := w.queues[id]; exists {
+		close(queue.stop)
+		delete(w.queues, id)
+	}
+	return nil
+}
+
+func (w *Webhooks) List() ([]*Webhook, error) {
+	return w.store.List()
+}
+
+// Dispatch queues event for every webhook it matches. Events of types
+// webhooks cannot subscribe to are ignored.
+func (w *Webhooks) Dispatch(event Event) {
+	if !containsString(WebhookEventTypes, event.Type) {
+		return
+	}
+	hooks, err := w.store.List()
+	if err != nil {
+		w.logger.Error("Failed to list webhooks", "error", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !hook.Matches(&event) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:        uuid.New().String(),
+			WebhookID: hook.ID,
+			URL:       hook.URL,
+			Event:     event,
+		}
+		err := w.enqueue(hook, delivery)
+		if err == ErrWebhookNotFound {
+			// Removed since it was listed.
+			continue
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+			w.deadLetter(delivery)
+		}
+	}
+}
+
+// Test sends a webhook.test event to a webhook once, without retrying, and
+// returns the outcome.
+func (w *Webhooks) Test(id string) (*WebhookDelivery, error) {
+	hook, err := w.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery := &WebhookDelivery{
+		ID:        uuid.New().String(),
+		WebhookID: hook.ID,
+		URL:       hook.URL,
+		Event:     Event{Type: EventWebhookTest, Time: time.Now()},
+	}
+	w.attempt(hook, delivery)
+	return delivery, nil
+}
+
+// DeadLetters returns the deliveries that ran out of attempts, newest first.
+func (w *Webhooks) DeadLetters() []WebhookDelivery {
+	deadLetters, err := w.store.DeadLetters()
+	if err != nil {
+		w.logger.Error("Failed to list webhook dead letters", "error", err)
+	}
+
+	result := make([]WebhookDelivery, 0, len(deadLetters))
+	for i := len(deadLetters) - 1; i >= 0; i-- {
+		result = append(result, *deadLetters[i])
+	}
+	return result
+}
+
+// RetryDeadLetter takes a delivery off the dead-letter list and queues it
+// again with a fresh set of attempts.
+func (w *Webhooks) RetryDeadLetter(deliveryID string) (*WebhookDelivery, error) {
+	var webhookID string
+	for _, dead := range w.DeadLetters() {
+		if dead.ID == deliveryID {
+			webhookID = dead.WebhookID
+			break
+		}
+	}
+	if webhookID == "" {
+		return nil, ErrDeadLetterNotFound
+	}
+	hook, err := w.store.Get(webhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, err := w.store.TakeDeadLetter(deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Attempts = 0
+	delivery.StatusCode = 0
+	delivery.Error = ""
+	delivery.FailedAt = nil
+	copied := *delivery
+	if err := w.enqueue(hook, delivery); err != nil {
+		delivery.Error = err.Error()
+		w.deadLetter(delivery)
+		return nil, err
+	}
+	return &copied, nil
+}
+
+// Close abandons queued deliveries and pending retries and waits for calls
+// in flight.
+func (w *Webhooks) Close() {
+	w.closeOnce.Do(func() {
+		w.queuesMu.Lock()
+		w.closed = true
+		w.queuesMu.Unlock()
+		close(w.done)
+	})
+	w.wg.Wait()
+}
+
+// enqueue hands delivery to hook's workers, starting them on its first
+// delivery. It fails if the queue is full, Close was called or the hook
+// was removed; the hook is looked up under the lock Remove takes, so a
+// removed hook's queue is never started again.
+func (w *Webhooks) enqueue(hook *Webhook, delivery *WebhookDelivery) error {
+	w.queuesMu.Lock()
+	defer w.queuesMu.Unlock()
+
+	if w.closed {
+		return ErrWebhooksClosed
+	}
+	if _, err := w.store.Get(hook.ID); err != nil {
+		return err
+	}
+	queue, exists := w.queues[hook.ID]
+	if !exists {
+		queue = &webhookQueue{
+			jobs: make(chan webhookJob, w.config.QueueSize),
+			stop: make(chan struct{}),
+		}
+		w.queues[hook.ID] = queue
+		w.wg.Add(w.config.Workers)
+		for i := 0; i < w.config.Workers; i++ {
+			go w.work(queue)
+		}
+	}
+
+	select {
+	case queue.jobs <- webhookJob{hook: hook, delivery: delivery}:
+		return nil
+	default:
+		return ErrWebhookQueueFull
+	}
+}
+
+func (w *Webhooks) work(queue *webhookQueue) {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case job := <-queue.jobs:
+			w.deliver(job.hook, job.delivery, queue.stop)
+		case <-queue.stop:
+			return
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// deliver calls hook until it accepts delivery or the attempts run out.
+func (w *Webhooks) deliver(hook *Webhook, delivery *WebhookDelivery, stop <-chan struct{}) {
+	backoff := w.config.InitialBackoff
+	for {
+		if w.attempt(hook, delivery) {
+			return
+		}
+
+		if delivery.Attempts >= w.config.MaxAttempts {
+			w.deadLetter(delivery)
+			return
+		}
+
+		w.logger.Warn("Webhook call failed, retrying", "webhook_id", hook.ID, "delivery_id", delivery.ID,
+			"attempt", delivery.Attempts, "retry_in", backoff, "error", delivery.Error)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		case <-w.done:
+			timer.Stop()
+			return
+		}
+		backoff *= 2
+		if backoff > w.config.MaxBackoff {
+			backoff = w.config.MaxBackoff
+		}
+	}
+}
+
+// attempt makes one call for delivery and reports whether the receiver
+// accepted it with a 2xx status.
+func (w *Webhooks) attempt(hook *Webhook, delivery *WebhookDelivery) bool {
+	delivery.Attempts++
+	delivery.StatusCode = 0
+	delivery.Error = ""
+
+	body, err := json.Marshal(&delivery.Event)
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderID, hook.ID)
+	req.Header.Set(WebhookHeaderDelivery, delivery.ID)
+	req.Header.Set(WebhookHeaderEvent, delivery.Event.Type)
+	req.Header.Set(WebhookHeaderTimestamp, timestamp)
+	req.Header.Set(WebhookHeaderSignature, SignWebhook(hook.Secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		delivery.Error = resp.Status
+		return false
+	}
+	return true
+}
+
+func (w *Webhooks) deadLetter(delivery *WebhookDelivery) {
+	now := time.Now()
+	delivery.FailedAt = &now
+	w.logger.Error("Webhook call failed, giving up", "webhook_id", delivery.WebhookID, "delivery_id", delivery.ID,
+		"attempts", delivery.Attempts, "error", delivery.Error)
+
+	if err := w.store.AddDeadLetter(delivery, w.config.DeadLetterSize); err != nil {
+		w.logger.Error("Failed to store webhook dead letter", "delivery_id", delivery.ID, "error", err)
+	}
+}
+
+// checkURL refuses webhook URLs naming a loopback, link-local or private
+// address that is not allowed. Hostnames are checked again for every call,
+// once resolved.
+func (w *Webhooks) checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %q", rawURL)
+	}
+	host := u.Hostname()
+	if w.allowed.allowsHost(host) {
+		return nil
+	}
+	if ip := net.ParseIP(host); (ip != nil && nonPublicIP(ip)) || strings.EqualFold(host, "localhost") {
+		return fmt.Errorf("url %q is not a public address", rawURL)
+	}
+	return nil
+}
+
+// dialContext connects to a webhook, refusing non-public addresses unless
+// the host is allowed. The address is checked after resolving, so a
+// hostname cannot point the call elsewhere.
+func (w *Webhooks) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: w.config.Timeout, KeepAlive: 30 * time.Second}
+	if !w.allowed.allowsHost(host) {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			ipHost, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(ipHost)
+			if ip == nil || (nonPublicIP(ip) && !w.allowed.allowsIP(ip)) {
+				return fmt.Errorf("webhook address %s is not public", ipHost)
+			}
+			return nil
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// nonPublicIP reports whether ip is loopback, link-local, private,
+// unspecified or otherwise not reachable on the internet.
+func nonPublicIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// hostAllowlist holds the hostnames and networks of WebhookConfig's
+// AllowedHosts.
+type hostAllowlist struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+func newHostAllowlist(entries []string) hostAllowlist {
+	allowed := hostAllowlist{hosts: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			allowed.networks = append(allowed.networks, network)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			allowed.networks = append(allowed.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if entry != "" {
+			allowed.hosts[strings.ToLower(entry)] = true
+		}
+	}
+	return allowed
+}
+
+// allowsHost reports whether host, a hostname or IP, is allowed.
+func (a hostAllowlist) allowsHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return a.allowsIP(ip)
+	}
+	return a.hosts[strings.ToLower(host)]
+}
+
+func (a hostAllowlist) allowsIP(ip net.IP) bool {
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
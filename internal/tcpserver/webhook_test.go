@@ -0,0 +1,293 @@
+package tcpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestWebhooks calls receivers on 127.0.0.1 and retries at once.
+func newTestWebhooks(t *testing.T, store WebhookStore, configure func(config *WebhookConfig)) *Webhooks {
+	t.Helper()
+
+	config := WebhookConfig{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Timeout:        5 * time.Second,
+		AllowedHosts:   []string{"127.0.0.1"},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	webhooks := NewWebhooks(store, config)
+	t.Cleanup(webhooks.Close)
+	return webhooks
+}
+
+func addTestWebhook(t *testing.T, webhooks *Webhooks, url string) *Webhook {
+	t.Helper()
+
+	hook, err := webhooks.Add(&Webhook{URL: url, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("add webhook: %v", err)
+	}
+	return hook
+}
+
+func TestWebhookSignature(t *testing.T) {
+	received := make(chan Event, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(WebhookHeaderTimestamp)
+		if got, want := r.Header.Get(WebhookHeaderSignature), SignWebhook("s3cret", timestamp, body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+		}
+		if r.Header.Get(WebhookHeaderEvent) != EventDeviceAuthenticated {
+			t.Errorf("event header %q", r.Header.Get(WebhookHeaderEvent))
+		}
+
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+
+	webhooks := newTestWebhooks(t, NewMemoryWebhookStore(), nil)
+	addTestWebhook(t, webhooks, receiver.URL)
+	webhooks.Dispatch(Event{Type: EventDeviceAuthenticated, AppID: testAppID, SN: "s1"})
+
+	select {
+	case event := <-received:
+		if event.SN != "s1" {
+			t.Errorf("received %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	webhooks := newTestWebhooks(t, NewMemoryWebhookStore(), nil)
+	addTestWebhook(t, webhooks, receiver.URL)
+	webhooks.Dispatch(Event{Type: EventCommandAcked, CmdID: "c1"})
+
+	waitFor(t, "third call", func() bool { return calls.Load() == 3 })
+	webhooks.Close()
+	if dead := webhooks.DeadLetters(); len(dead) != 0 {
+		t.Errorf("dead letters after a successful retry: %+v", dead)
+	}
+}
+
+// TestWebhookDeadLetter runs a delivery out of attempts and checks the dead
+// letter survives a restart and can be retried.
+func TestWebhookDeadLetter(t *testing.T) {
+	var healthy atomic.Bool
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	dir := t.TempDir()
+	path, deadLetterPath := filepath.Join(dir, "webhooks.json"), filepath.Join(dir, "dead-letters.json")
+	store, err := NewFileWebhookStore(path, deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks := newTestWebhooks(t, store, nil)
+	addTestWebhook(t, webhooks, receiver.URL)
+	webhooks.Dispatch(Event{Type: EventCommandTimeout, CmdID: "c1"})
+
+	waitFor(t, "dead letter", func() bool { return len(webhooks.DeadLetters()) == 1 })
+	webhooks.Close()
+	if calls.Load() != 3 {
+		t.Errorf("%d calls, want 3", calls.Load())
+	}
+	for _, file := range []string{path, deadLetterPath} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o600 {
+			t.Errorf("%s has mode %v, want 0600", filepath.Base(file), info.Mode().Perm())
+		}
+	}
+
+	reopened, err := NewFileWebhookStore(path, deadLetterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks = newTestWebhooks(t, reopened, nil)
+	dead := webhooks.DeadLetters()
+	if len(dead) != 1 || dead[0].Event.CmdID != "c1" || dead[0].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("dead letters after restart: %+v", dead)
+	}
+
+	healthy.Store(true)
+	if _, err := webhooks.RetryDeadLetter(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "retried call", func() bool { return calls.Load() == 4 })
+	webhooks.Close()
+	if dead := webhooks.DeadLetters(); len(dead) != 0 {
+		t.Errorf("dead letters after a successful retry: %+v", dead)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	webhooks := newTestWebhooks(t, NewMemoryWebhookStore(), func(config *WebhookConfig) {
+		config.Workers = 1
+		config.QueueSize = 1
+	})
+	addTestWebhook(t, webhooks, receiver.URL)
+
+	webhooks.Dispatch(Event{Type: EventCommandAcked, CmdID: "c1"})
+	<-started
+	for _, cmdID := range []string{"c2", "c3", "c4"} {
+		webhooks.Dispatch(Event{Type: EventCommandAcked, CmdID: cmdID})
+	}
+
+	dead := webhooks.DeadLetters()
+	if len(dead) != 2 || dead[0].Event.CmdID != "c4" || dead[0].Error != ErrWebhookQueueFull.Error() {
+		t.Fatalf("dead letters: %+v", dead)
+	}
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+
+	webhooks := newTestWebhooks(t, NewMemoryWebhookStore(), func(config *WebhookConfig) {
+		config.AllowedHosts = nil
+	})
+	for _, url := range []string{receiver.URL, "http://localhost/hook", "http://10.1.2.3/hook", "http://169.254.169.254/latest"} {
+		if _, err := webhooks.Add(&Webhook{URL: url}); err == nil {
+			t.Errorf("webhook to %s accepted", url)
+		}
+	}
+
+	// A hostname that resolves to a private address is refused when dialed.
+	_, port, _ := net.SplitHostPort(receiver.Listener.Addr().String())
+	hook := &Webhook{ID: "w1", URL: "http://localhost:" + port, Secret: "s3cret"}
+	if err := webhooks.store.Put(hook); err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := webhooks.Test(hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Error == "" || calls.Load() != 0 {
+		t.Errorf("call to a private address went through: %+v", delivery)
+	}
+}
+
+func TestWebhookIgnoresRedirects(t *testing.T) {
+	var redirected atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected.Add(1)
+	}))
+	defer target.Close()
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer receiver.Close()
+
+	webhooks := newTestWebhooks(t, NewMemoryWebhookStore(), nil)
+	hook := addTestWebhook(t, webhooks, receiver.URL)
+	delivery, err := webhooks.Test(hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.StatusCode != http.StatusTemporaryRedirect || delivery.Error == "" {
+		t.Errorf("redirect accepted: %+v", delivery)
+	}
+	if redirected.Load() != 0 {
+		t.Error("redirect was followed")
+	}
+}
+
+// TestWebhookRemovedWhileDispatching checks a dispatch that listed a hook
+// before it was removed neither restarts its queue nor dead-letters.
+func TestWebhookRemovedWhileDispatching(t *testing.T) {
+	webhooks := newTestWebhooks(t, NewMemoryWebhookStore(), nil)
+	hook := addTestWebhook(t, webhooks, "http://127.0.0.1:1/hook")
+	if err := webhooks.Remove(hook.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := &WebhookDelivery{ID: "d1", WebhookID: hook.ID, URL: hook.URL, Event: Event{Type: EventCommandAcked}}
+	if err := webhooks.enqueue(hook, delivery); err != ErrWebhookNotFound {
+		t.Errorf("enqueue for a removed hook: %v", err)
+	}
+	if len(webhooks.queues) != 0 {
+		t.Error("removed hook's queue started again")
+	}
+	if dead := webhooks.DeadLetters(); len(dead) != 0 {
+		t.Errorf("dead letters: %+v", dead)
+	}
+}
+
+// TestServerDispatchesWebhooks publishes more events at once than an
+// EventBus subscriber buffers and checks the webhook gets every one.
+func TestServerDispatchesWebhooks(t *testing.T) {
+	const count = 2 * eventSubscriberBufferSize
+
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(WebhookHeaderEvent) != EventCommandAcked {
+			t.Errorf("event header %q", r.Header.Get(WebhookHeaderEvent))
+		}
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+
+	server := startTestServer(t, func(config *Config) {
+		config.Webhooks.AllowedHosts = []string{"127.0.0.1"}
+		config.Webhooks.QueueSize = count
+	})
+	addTestWebhook(t, server.GetWebhooks(), receiver.URL)
+
+	events := server.GetEventBus()
+	events.Publish(Event{Type: EventReport, SN: "s1"})
+	for i := 0; i < count; i++ {
+		events.Publish(Event{Type: EventCommandAcked, CmdID: fmt.Sprintf("c%d", i)})
+	}
+	waitFor(t, "every event delivered", func() bool { return calls.Load() == count })
+	if dead := server.GetWebhooks().DeadLetters(); len(dead) != 0 {
+		t.Errorf("dead letters: %+v", dead)
+	}
+}